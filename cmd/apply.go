@@ -0,0 +1,424 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/joemiller/gmachine/internal/config"
+	"github.com/joemiller/gmachine/internal/gcp"
+	"github.com/joemiller/gmachine/internal/indentor"
+	"github.com/joemiller/gmachine/internal/spec"
+	"github.com/joemiller/gmachine/internal/spinner"
+	"github.com/spf13/cobra"
+	"google.golang.org/api/compute/v1"
+)
+
+// applyCmd represents the apply command
+var applyCmd = &cobra.Command{
+	Use:   "apply -f SPEC",
+	Short: "Create or update a cloud machine from a spec file",
+	Long: `Create or update a cloud machine from a spec file.
+
+The spec file declares a machine with the same settings as the flags of
+'gmachine create', plus its labels, metadata and data disks. If the machine does
+not exist it is created. Otherwise the changes needed to make it match the spec
+are printed and applied:
+
+  - the machine type is changed, the machine must be stopped
+  - labels and metadata in the spec are added or updated, others are kept
+  - the boot disk and data disks are grown
+  - missing data disks are created and detached data disks are attached
+
+Changing the boot disk type, the encryption, the network, the provisioning model
+or the service account requires deleting and recreating the machine. Its boot
+disk is recreated from the image, so anything on it is lost; data disks are
+detached first and attached again. Recreating is refused unless --allow-recreate
+is set. Shrinking disks and changing data disks' type or encryption is not
+supported.`,
+	Example: indentor.Indent("  ", `
+# Create the machine in machine1.yaml, or update it to match the spec
+gmachine apply -f machine1.yaml
+
+# Show the changes without applying them
+gmachine apply -f machine1.yaml --dry-run
+
+# Apply changes that require recreating the machine
+gmachine apply -f machine1.yaml --allow-recreate
+
+# An example spec, unset fields have the defaults of 'gmachine create'
+name: machine1
+project: my-proj
+zone: us-west1-a
+machine_type: e2-standard-4
+boot_disk:
+  size: 50GB
+  type: pd-balanced
+csek: true
+network:
+  no_address: true
+  tags: [allow-iap-ssh]
+labels:
+  team: infra
+metadata:
+  enable-oslogin: "true"
+startup_script: ./startup.sh
+disks:
+  - name: machine1-data
+    size: 200GB
+    csek: true
+`),
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE:         apply,
+}
+
+func init() {
+	applyCmd.Flags().StringP("file", "f", "", "The spec file of the machine")
+	applyCmd.Flags().Bool("allow-recreate", false, "Apply changes that require deleting and recreating the machine. Its boot disk is recreated from the image")
+
+	rootCmd.AddCommand(applyCmd)
+}
+
+// applyConfig is the part of the config file that apply uses.
+type applyConfig interface {
+	createConfig
+	diskConfig
+	DiskOwner(project, zone, disk string) string
+	SetDiskAttached(name, disk, deviceName string, attached bool) error
+	SetBootCSEK(ctx context.Context, name, bootDisk string, csek gcp.CSEKBundle) error
+	SetHostKeys(name string, keys []string) error
+}
+
+func apply(cmd *cobra.Command, _ []string) error {
+	file, err := cmd.Flags().GetString("file")
+	if err != nil {
+		return err
+	}
+	allowRecreate, err := cmd.Flags().GetBool("allow-recreate")
+	if err != nil {
+		return err
+	}
+	if file == "" {
+		return errors.New("--file/-f not specified")
+	}
+
+	s, err := spec.Load(file)
+	if err != nil {
+		return err
+	}
+	cfg, err := config.LoadFile(cfgFile)
+	if err != nil {
+		return err
+	}
+	if !cfg.Exists(s.Name) {
+		return applyCreate(cmd, cfg, s)
+	}
+
+	machine, err := cfg.Get(s.Name)
+	if err != nil {
+		return err
+	}
+	if machine.Project != s.Project || machine.Zone != s.Zone {
+		return fmt.Errorf("machine '%s' is in project %s, zone %s. apply cannot move machines to another project or zone",
+			s.Name, machine.Project, machine.Zone)
+	}
+	ref := machine.Ref()
+	instance, err := backend.DescribeInstance(cmd.Context(), ref)
+	if err != nil {
+		return err
+	}
+	bootDisk, _ := gcp.BootDisk(instance)
+	if bootDisk == "" {
+		return fmt.Errorf("machine '%s' has no boot disk", s.Name)
+	}
+
+	cur := spec.Current{Instance: instance, KMSKey: machine.KMSKey, Disks: map[string]*compute.Disk{}}
+	if cur.BootDisk, err = backend.DescribeDisk(cmd.Context(), ref.Disk(bootDisk)); err != nil {
+		return err
+	}
+	if machine.Network != nil {
+		cur.Network = *machine.Network
+	}
+	for _, d := range s.Disks {
+		owner := cfg.DiskOwner(ref.Project, ref.Zone, d.Name)
+		if owner != "" && owner != s.Name {
+			return fmt.Errorf("disk %s is a data disk of machine '%s'", d.Name, owner)
+		}
+		disk, err := backend.DescribeDisk(cmd.Context(), ref.Disk(d.Name))
+		switch {
+		case errors.Is(err, gcp.ErrNotFound) && owner == "":
+			cur.Disks[d.Name] = nil
+			continue
+		case err != nil:
+			return err
+		case owner == "":
+			return fmt.Errorf("disk %s exists but is not a data disk of '%s', attach it with 'gmachine disk attach %s %s' first",
+				d.Name, s.Name, s.Name, d.Name)
+		}
+		cur.Disks[d.Name] = &disk
+	}
+
+	changes := s.Diff(cur)
+	if len(changes) == 0 {
+		cmd.Printf("Machine %s is up to date\n", s.Name)
+		return nil
+	}
+	cmd.Printf("Changes to machine %s:\n", s.Name)
+	recreate := false
+	unsupported := []string{}
+	for _, c := range changes {
+		cmd.Printf("  %s\n", c)
+		switch c.Action {
+		case spec.Recreate:
+			recreate = true
+		case spec.Unsupported:
+			unsupported = append(unsupported, c.Field)
+		}
+	}
+	if len(unsupported) > 0 {
+		return fmt.Errorf("cannot apply changes to %s", strings.Join(unsupported, ", "))
+	}
+
+	if recreate {
+		if !allowRecreate {
+			return fmt.Errorf("the changes require recreating machine '%s', which recreates its boot disk from the image. Re-run with --allow-recreate to recreate it", s.Name)
+		}
+		if err := recreateMachine(cmd, cfg, s, ref, instance); err != nil {
+			return err
+		}
+	} else if err := applyChanges(cmd, cfg, s, ref, instance, changes); err != nil {
+		return err
+	}
+	if err := applyDiskChanges(cmd, cfg, s, ref, changes); err != nil {
+		return err
+	}
+	cmd.Println("Success")
+	return nil
+}
+
+// applyCreate creates the machine and the data disks in the spec.
+func applyCreate(cmd *cobra.Command, cfg applyConfig, s spec.Spec) error {
+	for _, d := range s.Disks {
+		if owner := cfg.DiskOwner(s.Project, s.Zone, d.Name); owner != "" {
+			return fmt.Errorf("disk %s is a data disk of machine '%s'", d.Name, owner)
+		}
+	}
+	req := s.CreateRequest()
+	if req.Account == "" {
+		account, err := backend.CurrentAccount(cmd.Context())
+		if err != nil {
+			return err
+		}
+		req.Account = account
+	}
+	if err := createMachine(cmd, cfg, req, s.CSEK, nil); err != nil {
+		return err
+	}
+	for _, d := range s.Disks {
+		if err := applyNewDisk(cmd, cfg, req.Ref(), d); err != nil {
+			return err
+		}
+	}
+	cmd.Println("Success")
+	return nil
+}
+
+// applyChanges applies the changes that do not require recreating the machine,
+// except those of data disks, see applyDiskChanges.
+func applyChanges(cmd *cobra.Command, cfg applyConfig, s spec.Spec, ref gcp.InstanceRef, instance compute.Instance, changes []spec.Change) error {
+	labels, metadata := map[string]string{}, map[string]string{}
+	for _, c := range changes {
+		switch {
+		case c.Field == "machine_type" && instance.Status != "TERMINATED":
+			return fmt.Errorf("machine '%s' must be stopped to change its machine type, stop it with 'gmachine stop %s'", ref.Name, ref.Name)
+		case strings.HasPrefix(c.Field, "labels."):
+			labels[c.Key] = c.To
+		case strings.HasPrefix(c.Field, "metadata."):
+			metadata[c.Key] = c.To
+		}
+	}
+
+	for _, c := range changes {
+		switch c.Field {
+		case "machine_type":
+			op, err := backend.ResizeInstance(cmd.Context(), ref, s.MachineType)
+			if err != nil {
+				return err
+			}
+			if err := waitOperation(cmd, op, fmt.Sprintf("Resizing %s to %s", ref.Name, s.MachineType)); err != nil {
+				return err
+			}
+		case "boot_disk.size":
+			bootDisk, _ := gcp.BootDisk(instance)
+			if err := resizeDisk(cmd, ref.Disk(bootDisk), s.BootDisk.Size); err != nil {
+				return err
+			}
+		}
+	}
+	if len(labels) > 0 {
+		err := withSpinner(cmd, fmt.Sprintf("Updating labels of %s", ref.Name), func() error {
+			return backend.UpdateLabels(cmd.Context(), ref, labels)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(metadata) > 0 {
+		return withSpinner(cmd, fmt.Sprintf("Updating metadata of %s", ref.Name), func() error {
+			return backend.UpdateMetadata(cmd.Context(), ref, metadata)
+		})
+	}
+	return nil
+}
+
+// applyDiskChanges creates, attaches and grows the data disks in the spec.
+func applyDiskChanges(cmd *cobra.Command, cfg applyConfig, s spec.Spec, ref gcp.InstanceRef, changes []spec.Change) error {
+	for _, d := range s.Disks {
+		for _, c := range changes {
+			if c.Key != d.Name {
+				continue
+			}
+			var err error
+			switch strings.TrimPrefix(c.Field, "disks."+d.Name) {
+			case "":
+				err = applyNewDisk(cmd, cfg, ref, d)
+			case ".attached":
+				var csek gcp.CSEKBundle
+				if csek, err = machineCSEK(cmd, cfg, ref.Name); err == nil {
+					err = attachDataDisk(cmd, cfg, ref, d.Name, d.DeviceName, diskKey(csek, ref.Disk(d.Name)))
+				}
+			case ".size":
+				err = resizeDisk(cmd, ref.Disk(d.Name), d.Size)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// applyNewDisk creates the data disk 'd' of the machine and attaches it.
+func applyNewDisk(cmd *cobra.Command, cfg applyConfig, ref gcp.InstanceRef, d spec.Disk) error {
+	disk := newDisk{Name: d.Name, DeviceName: d.DeviceName, Size: d.Size, Type: d.Type, Encrypt: d.CSEK}
+	csek, err := createDisk(cmd, cfg, ref, disk)
+	if err != nil {
+		return err
+	}
+	return attachDataDisk(cmd, cfg, ref, d.Name, d.DeviceName, csek)
+}
+
+// attachDataDisk attaches the data disk 'diskName' to the machine and records
+// that it is attached in the config file.
+func attachDataDisk(cmd *cobra.Command, cfg applyConfig, ref gcp.InstanceRef, diskName, deviceName string, csek gcp.CSEKBundle) error {
+	if err := attachDisk(cmd, ref, diskName, deviceName, csek); err != nil {
+		return err
+	}
+	return cfg.SetDiskAttached(ref.Name, diskName, deviceName, true)
+}
+
+// recreateMachine deletes the machine and creates it again from the spec. Its
+// attached data disks are detached first and attached again.
+func recreateMachine(cmd *cobra.Command, cfg applyConfig, s spec.Spec, ref gcp.InstanceRef, instance compute.Instance) error {
+	// get the data disks' keys, and unlock the config file to save the new boot
+	// disk key, before anything is changed
+	csek, err := machineCSEK(cmd, cfg, ref.Name)
+	if err != nil {
+		return err
+	}
+	if s.CSEK && cfg.Locked() && cfg.KeyStoreType() == "" {
+		if _, err := unlockKeys(cmd, cfg); err != nil {
+			return err
+		}
+	}
+
+	bootDisk, _ := gcp.BootDisk(instance)
+	var attached []*compute.AttachedDisk
+	for _, d := range instance.Disks {
+		if !d.Boot {
+			attached = append(attached, d)
+		}
+	}
+	for _, d := range attached {
+		op, err := backend.DetachDisk(cmd.Context(), ref, d.DeviceName)
+		if err != nil {
+			return err
+		}
+		if err := waitOperation(cmd, op, fmt.Sprintf("Detaching disk %s from %s", path.Base(d.Source), ref.Name)); err != nil {
+			return err
+		}
+	}
+	// the new instance has new host keys
+	if err := cfg.SetHostKeys(ref.Name, nil); err != nil {
+		return err
+	}
+	op, err := backend.DeleteInstance(cmd.Context(), ref)
+	if err != nil {
+		return err
+	}
+	if err := waitOperation(cmd, op, fmt.Sprintf("Deleting %s", ref.Name)); err != nil {
+		return err
+	}
+
+	req := s.CreateRequest()
+	req.Account = ref.Account
+	if s.CSEK {
+		req.CSEK, err = gcp.CreateWrappedCSEK(gcp.DiskURI(ref.Project, ref.Zone, ref.Name), nil)
+		if err != nil {
+			return fmt.Errorf("failed generating CSEK Key: %w", err)
+		}
+	}
+	// save the new key before the boot disk is encrypted with it so that it is
+	// never lost
+	if err := cfg.SetBootCSEK(cmd.Context(), ref.Name, bootDisk, req.CSEK); err != nil {
+		return err
+	}
+	op, err = backend.CreateInstance(cmd.Context(), req)
+	if err != nil {
+		return err
+	}
+	if err := waitOperation(cmd, op, fmt.Sprintf("Creating %s", ref.Name)); err != nil {
+		return err
+	}
+	pinHostKeys(cmd, ref)
+	refreshSSHFiles(cmd)
+	if err := cfg.SetKMSKey(ref.Name, s.KMSKey); err != nil {
+		return err
+	}
+	if err := cfg.SetNetwork(ref.Name, s.Network); err != nil {
+		return err
+	}
+
+	for _, d := range attached {
+		diskRef := ref.Disk(path.Base(d.Source))
+		if err := attachDisk(cmd, ref, diskRef.Name, d.DeviceName, diskKey(csek, diskRef)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resizeDisk grows the disk 'ref' to 'size' and waits for it to be resized.
+func resizeDisk(cmd *cobra.Command, ref gcp.DiskRef, size string) error {
+	op, err := backend.ResizeDisk(cmd.Context(), ref, size)
+	if err != nil {
+		return err
+	}
+	return waitOperation(cmd, op, fmt.Sprintf("Resizing disk %s to %s", ref.Name, size))
+}
+
+// withSpinner shows a spinner with 'msg' while 'fn' runs, for backend calls that
+// wait for their operation themselves.
+func withSpinner(cmd *cobra.Command, msg string, fn func() error) error {
+	s := spinner.New(cmd.ErrOrStderr(), msg)
+	s.Start()
+	if err := fn(); err != nil {
+		s.Stop("failed")
+		return err
+	}
+	s.Stop("done")
+	return nil
+}
@@ -0,0 +1,179 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/joemiller/gmachine/internal/config"
+	"github.com/joemiller/gmachine/internal/gcp"
+	"github.com/joemiller/gmachine/internal/keys"
+	"github.com/joemiller/gmachine/internal/spinner"
+	"github.com/joemiller/gmachine/internal/sshclient"
+	"github.com/spf13/cobra"
+	"google.golang.org/api/compute/v1"
+)
+
+// defaultStartTimeout is how long connect commands wait for a machine to start
+// and ssh to be reachable with --start, see addStartFlags.
+const defaultStartTimeout = 5 * time.Minute
+
+// settlingStatuses are the statuses of an instance that is changing state, it is
+// waited for until it leaves them before it is started.
+var settlingStatuses = map[string]bool{
+	"PROVISIONING": true,
+	"STAGING":      true,
+	"STOPPING":     true,
+	"SUSPENDING":   true,
+	"REPAIRING":    true,
+}
+
+// addStartFlags adds the --start and --start-timeout flags of commands that
+// connect to a machine.
+func addStartFlags(cmd *cobra.Command) {
+	cmd.Flags().Bool("start", false, "Start the machine if it is stopped, or resume it if it is suspended, and wait for ssh to be reachable before connecting. Overrides the machine's saved auto_start setting if set")
+	cmd.Flags().Duration("start-timeout", defaultStartTimeout, "Maximum time to wait for the machine to start and ssh to be reachable")
+}
+
+// autoStart returns whether to start the machine before connecting to it: the
+// --start flag if it is set, or else the machine's saved auto_start setting.
+func autoStart(cmd *cobra.Command, saved *config.SSH) (bool, error) {
+	if cmd.Flags().Changed("start") {
+		return cmd.Flags().GetBool("start")
+	}
+	return saved != nil && saved.AutoStart, nil
+}
+
+// startForConnect makes sure that the machine is RUNNING before connecting to
+// it. A stopped machine is started and a suspended one resumed with its CSEK
+// keys, after waiting for a machine that is stopping or suspending. If it was not
+// running, it then waits until ssh answers at the address returned by 'addr', if
+// any, eg: none through an IAP tunnel. Everything is done within --start-timeout.
+//
+// 'prompt' is false when stdin is not the user's, eg: in an ssh ProxyCommand.
+// Locked CSEK keys can then only be unlocked with the key cached by 'keys
+// unlock'.
+func startForConnect(cmd *cobra.Command, cfg keyConfig, ref gcp.InstanceRef, prompt bool, addr func(compute.Instance) string) error {
+	timeout, err := cmd.Flags().GetDuration("start-timeout")
+	if err != nil {
+		return err
+	}
+	parent := cmd.Context()
+	cause := fmt.Errorf("machine '%s' was not reachable within %s: %w", ref.Name, timeout, context.DeadlineExceeded)
+	ctx, cancel := context.WithTimeoutCause(parent, timeout, cause)
+	defer cancel()
+	// startInstance and resumeInstance wait with the command's context
+	cmd.SetContext(ctx)
+	defer cmd.SetContext(parent)
+
+	instance, err := settledInstance(cmd, ref)
+	if err != nil {
+		return err
+	}
+	switch instance.Status {
+	case "RUNNING":
+		return nil
+	case "TERMINATED", "SUSPENDED":
+		csek, err := connectCSEK(cmd, cfg, ref.Name, prompt)
+		if err != nil {
+			return err
+		}
+		if instance.Status == "TERMINATED" {
+			err = startInstance(cmd, ref, csek)
+		} else {
+			err = resumeInstance(cmd, ref, csek)
+		}
+		if err != nil || dryRun {
+			return err
+		}
+	default:
+		return fmt.Errorf("machine '%s' is %s and cannot be started", ref.Name, instance.Status)
+	}
+
+	if instance, err = backend.DescribeInstance(ctx, ref); err != nil {
+		return err
+	}
+	host := addr(instance)
+	if host == "" {
+		return nil
+	}
+	return withSpinner(cmd, fmt.Sprintf("Waiting for ssh on %s", ref.Name), func() error {
+		return sshclient.WaitReachable(ctx, net.JoinHostPort(host, "22"), gcp.PollInterval)
+	})
+}
+
+// settledInstance returns the instance once it is not changing state, see
+// settlingStatuses.
+func settledInstance(cmd *cobra.Command, ref gcp.InstanceRef) (compute.Instance, error) {
+	instance, err := backend.DescribeInstance(cmd.Context(), ref)
+	if err != nil || !settlingStatuses[instance.Status] {
+		return instance, err
+	}
+
+	s := spinner.New(cmd.ErrOrStderr(), fmt.Sprintf("Waiting for %s, which is %s", ref.Name, instance.Status))
+	s.Start()
+	for settlingStatuses[instance.Status] {
+		select {
+		case <-cmd.Context().Done():
+			s.Stop("failed")
+			return instance, context.Cause(cmd.Context())
+		case <-time.After(gcp.PollInterval):
+		}
+		if instance, err = backend.DescribeInstance(cmd.Context(), ref); err != nil {
+			s.Stop("failed")
+			return instance, err
+		}
+	}
+	s.Stop(instance.Status)
+	return instance, nil
+}
+
+// connectCSEK returns the CSEK keys to start the machine 'name' with, see
+// machineStartCSEK. Without 'prompt' locked keys are only unlocked with the key
+// cached by 'keys unlock'.
+func connectCSEK(cmd *cobra.Command, cfg keyConfig, name string, prompt bool) (gcp.CSEKBundle, error) {
+	if !prompt {
+		if _, err := cfg.CSEK(cmd.Context(), name); errors.Is(err, config.ErrLocked) {
+			key, err := keys.AgentKey(keys.AgentSocket(cfg.Filename()))
+			if err == nil {
+				err = cfg.Unlock(key)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("the CSEK keys are locked, run 'gmachine keys unlock' to start %s when connecting: %w", name, err)
+			}
+		}
+	}
+	return machineStartCSEK(cmd, cfg, name)
+}
+
+// sshAddress returns the address ssh connects to the instance at directly in
+// 'mode', see gcp.SSHOptions, or "" if it connects through an IAP tunnel or a
+// jump host.
+func sshAddress(instance compute.Instance, mode string, jump bool) string {
+	switch {
+	case jump || mode == gcp.SSHModeIAP:
+		return ""
+	case mode == gcp.SSHModeInternalIP:
+		return internalIP(instance.NetworkInterfaces)
+	}
+	// without an external IP ssh tunnels through IAP
+	return externalIP(instance.NetworkInterfaces)
+}
+
+// startForSSH starts the machine, and its jump host first if any, before
+// connecting to it with ssh, see startForConnect.
+func startForSSH(cmd *cobra.Command, cfg keyConfig, m nativeMachine, prompt bool) error {
+	if m.jump != nil {
+		err := startForConnect(cmd, cfg, m.jump.ref, prompt, func(instance compute.Instance) string {
+			return sshAddress(instance, "", false)
+		})
+		if err != nil {
+			return fmt.Errorf("jump host '%s': %w", m.jump.ref.Name, err)
+		}
+	}
+	return startForConnect(cmd, cfg, m.ref, prompt, func(instance compute.Instance) string {
+		return sshAddress(instance, m.mode, m.jump != nil)
+	})
+}
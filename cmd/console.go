@@ -59,6 +59,7 @@ func console(cmd *cobra.Command, args []string) error {
 	}
 
 	return gcp.OpenConsole(
+		cmd.Context(),
 		cmd.OutOrStdout(),
 		cmd.OutOrStderr(),
 		name,
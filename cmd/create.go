@@ -1,8 +1,11 @@
 package cmd
 
 import (
+	"context"
+	"crypto/rsa"
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/joemiller/gmachine/internal/config"
 	"github.com/joemiller/gmachine/internal/gcp"
@@ -14,7 +17,12 @@ import (
 var createCmd = &cobra.Command{
 	Use:   "create NAME",
 	Short: "Create a cloud machine",
-	Long:  "Create a cloud machine",
+	Long: `Create a cloud machine.
+
+Machines are created with the enable-guest-attributes=TRUE metadata so that the
+guest agent publishes their ssh host keys, which gmachine then pins for 'gmachine
+ssh', see 'gmachine ssh --help'. --pin-host-keys=false leaves the metadata unset,
+host keys are then trusted the first time they are seen.`,
 	Example: indentor.Indent("  ", `
 # Create a new machine 'machine1' in the 'my-proj' project, zone 'us-west1-a' using the default Compute Engine Service Account
 gmachine create machine1 -p my-proj -z us-west1-a
@@ -31,6 +39,19 @@ gmachine create machine1 -p my-proj -z us-west1-a --service-account my-service-a
 # Encrypt the machine's root disk using a locally stored CSEK key. A new key is generated automatically.
 gmachine create machine1 -p my-proj -z us-west1-a --csek
 
+# Wrap the generated CSEK key with Google's RSA certificate so that the raw key is never sent to Google Cloud.
+curl -o google-cloud-csek-ingress.pem https://cloud-certs.storage.googleapis.com/google-cloud-csek-ingress.pem
+gmachine create machine1 -p my-proj -z us-west1-a --csek-rsa-cert google-cloud-csek-ingress.pem
+
+# Encrypt the machine's root disk with a Cloud KMS key (CMEK). The Compute Engine service agent must be allowed to use the key.
+gmachine create machine1 -p my-proj -z us-west1-a --kms-key projects/my-proj/locations/us-west1/keyRings/my-ring/cryptoKeys/my-key
+
+# Create a new machine without an external IP in a subnet of a custom network. 'gmachine ssh' tunnels through IAP.
+gmachine create machine1 -p my-proj -z us-west1-a --network dev --subnet workstations --no-address --tags allow-iap-ssh
+
+# Create a Spot machine that is deleted when it is preempted, or after running for 4 hours.
+gmachine create machine1 -p my-proj -z us-west1-a --provisioning-model spot --instance-termination-action delete --max-run-duration 4h
+
 # List all options
 gmachine create -h
 `),
@@ -48,8 +69,20 @@ func init() {
 	createCmd.Flags().String("image-project", "ubuntu-os-cloud", "The Google Cloud project against which all image and image family references will be resolved")
 	createCmd.Flags().String("image-family", "ubuntu-2204-lts", "The image family for the operating system that the boot disk will be initialized with")
 	createCmd.Flags().Bool("csek", false, "Encrypt the boot disk with a customer-supplied-encryption-key. A key will be generated and stored in the local config file")
+	createCmd.Flags().String("csek-rsa-cert", "", "PEM file with Google's RSA certificate to wrap the generated CSEK key with, its key-type is rsa-encrypted. Implies --csek")
+	createCmd.Flags().String("kms-key", "", "Encrypt the boot disk with a customer-managed Cloud KMS key (CMEK): projects/PROJECT/locations/LOCATION/keyRings/KEY_RING/cryptoKeys/KEY")
+	createCmd.Flags().String("network", "", "The VPC network of the instance. Defaults to the 'default' network")
+	createCmd.Flags().String("subnet", "", "The subnet of the instance in the zone's region, required for custom mode networks")
+	createCmd.Flags().Bool("no-address", false, "Create the instance without an external IP")
+	createCmd.Flags().String("private-network-ip", "", "A static internal IP, or the name of a reserved internal address, for the instance. Defaults to an ephemeral internal IP")
+	createCmd.Flags().StringSlice("tags", nil, "Network tags of the instance, eg: to match firewall rules")
+	createCmd.Flags().String("stack-type", "", "The IP stack type of the instance: IPV4_ONLY (default) or IPV4_IPV6")
+	createCmd.Flags().String("provisioning-model", "", "The provisioning model of the instance: standard (default) or spot. Spot instances are cheaper but can be preempted at any time")
+	createCmd.Flags().String("instance-termination-action", "", "What happens to the instance when it is preempted or reaches --max-run-duration: stop (default) or delete")
+	createCmd.Flags().Duration("max-run-duration", 0, "Terminate the instance after it has run for this long, eg: 4h. Not supported by the api backend")
 	createCmd.Flags().String("machine-type", "f1-micro", "Specifies the machine type used for the instances. To get a list of available machine types, run 'gcloud compute machine-types list'")
 	createCmd.Flags().Bool("disable-ssh-project-keys", false, "Disable automatically adding project SSH key users to the instance")
+	createCmd.Flags().Bool("pin-host-keys", true, "Enable guest attributes on the instance (enable-guest-attributes=TRUE metadata) so that its ssh host keys are published and pinned")
 	createCmd.Flags().Bool("set-default", false, "Set this instance as the default. The first created instance will always be set as default")
 	createCmd.Flags().StringP("startup-script", "", "", "A script to run when the instance is started")
 	createCmd.Flags().StringP("startup-script-url", "", "", "URL to a publicly-accessible script to run when the instance is started")
@@ -61,9 +94,8 @@ func init() {
 
 	// TODO: there are so many more options that we might support over time, some examples:
 	//   * --image (if specified, --image-family can't be used)
-	//   * --network / --subnet
-	//   * --preemptible
 	//
+	addAsyncFlag(createCmd)
 	rootCmd.AddCommand(createCmd)
 }
 
@@ -102,6 +134,11 @@ func create(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+	rsaCert, err := csekRSACert(cmd)
+	if err != nil {
+		return err
+	}
+	encrypt = encrypt || rsaCert != nil
 	machineType, err := cmd.Flags().GetString("machine-type")
 	if err != nil {
 		return err
@@ -110,6 +147,10 @@ func create(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+	guestAttributes, err := cmd.Flags().GetBool("pin-host-keys")
+	if err != nil {
+		return err
+	}
 	setAsDefault, err := cmd.Flags().GetBool("set-default")
 	if err != nil {
 		return err
@@ -134,8 +175,34 @@ func create(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+	kmsKey, err := cmd.Flags().GetString("kms-key")
+	if err != nil {
+		return err
+	}
+	network, err := createNetwork(cmd)
+	if err != nil {
+		return err
+	}
+	scheduling, err := createScheduling(cmd)
+	if err != nil {
+		return err
+	}
 
 	// validators
+	if kmsKey != "" {
+		if encrypt {
+			return errors.New("cannot specify both --kms-key and --csek")
+		}
+		if err := gcp.ValidateKMSKey(kmsKey); err != nil {
+			return err
+		}
+	}
+	if err := network.Validate(); err != nil {
+		return err
+	}
+	if err := scheduling.Validate(); err != nil {
+		return err
+	}
 	if noServiceAccount && serviceAccount != "" {
 		return errors.New("cannot specify both --no-service-account and --service-account")
 	}
@@ -148,7 +215,7 @@ func create(cmd *cobra.Command, args []string) error {
 
 	// lookup the currently configured GCP account if --account was not specified
 	if account == "" {
-		account, err = gcp.GetCurrentAccount()
+		account, err = backend.CurrentAccount(cmd.Context())
 		if err != nil {
 			return err
 		}
@@ -176,9 +243,9 @@ func create(cmd *cobra.Command, args []string) error {
 	}
 	// --create-service-account creates a new service account using the name of the instance.
 	if createServiceAccount {
-		err = gcp.CreateServiceAccount(cmd.OutOrStdout(), cmd.OutOrStderr(), name, account, project)
+		err = backend.CreateServiceAccount(cmd.Context(), account, project, name)
 		if err != nil {
-			return fmt.Errorf("failed creating Service Account: %s", err)
+			return fmt.Errorf("failed creating Service Account: %w", err)
 		}
 		serviceAccountEmail = fmt.Sprintf("%s@%s.iam.gserviceaccount.com", name, project)
 	}
@@ -193,15 +260,6 @@ func create(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("machine '%s' already exists in the config file", name)
 	}
 
-	// generate new csek key if requested
-	var csekBundle gcp.CSEKBundle
-	if encrypt {
-		csekBundle, err = gcp.CreateCSEK(gcp.DiskURI(project, zone, name))
-		if err != nil {
-			return fmt.Errorf("failed generating CSEK Key: %w", err)
-		}
-	}
-
 	req := gcp.CreateRequest{
 		Name:             name,
 		Account:          account,
@@ -212,7 +270,9 @@ func create(cmd *cobra.Command, args []string) error {
 		BootDiskType:     diskType,
 		ImageProject:     imageProject,
 		ImageFamily:      imageFamily,
-		CSEK:             csekBundle,
+		KMSKey:           kmsKey,
+		Network:          network,
+		Scheduling:       scheduling,
 		ServiceAccount:   serviceAccountEmail,
 		NoServiceAccount: noServiceAccount,
 		StartupScript:    startupScript,
@@ -221,16 +281,12 @@ func create(cmd *cobra.Command, args []string) error {
 	if disableProjectSSHKeys {
 		req.AddMetadata("block-project-ssh-keys", "true")
 	}
-
-	cmd.Println("Creating...")
-	err = gcp.CreateInstance(cmd.OutOrStdout(), cmd.OutOrStderr(), req)
-	if err != nil {
-		return err
+	if guestAttributes {
+		// the guest agent publishes the host keys in guest attributes, see
+		// pinHostKeys
+		req.AddMetadata("enable-guest-attributes", "TRUE")
 	}
-
-	// add machine to config file
-	err = cfg.Add(name, account, project, zone, csekBundle)
-	if err != nil {
+	if err = createMachine(cmd, cfg, req, encrypt, rsaCert); err != nil {
 		return err
 	}
 
@@ -242,3 +298,128 @@ func create(cmd *cobra.Command, args []string) error {
 	cmd.Println("Success")
 	return nil
 }
+
+// createConfig is the part of the config file that createMachine uses.
+type createConfig interface {
+	keyConfig
+	KeyStoreType() string
+	StoreKeys(ctx context.Context, csek gcp.CSEKBundle) (gcp.CSEKBundle, error)
+	Add(name, account, project, zone string, csek gcp.CSEKBundle) error
+	DeleteWithKeys(ctx context.Context, name string) error
+	SetKMSKey(name, key string) error
+	SetNetwork(name string, network gcp.Network) error
+}
+
+// createMachine adds the instance 'req' to the config file, creates it and waits
+// for it to be created. If 'encrypt' is set the boot disk is encrypted with a
+// new CSEK key, wrapped with 'rsaCert' if it is not nil.
+func createMachine(cmd *cobra.Command, cfg createConfig, req gcp.CreateRequest, encrypt bool, rsaCert *rsa.PublicKey) error {
+	// generate new csek key if requested
+	var storedBundle gcp.CSEKBundle
+	if encrypt {
+		// unlock now rather than after the machine is created so that the key can be saved
+		if cfg.Locked() && cfg.KeyStoreType() == "" {
+			if _, err := unlockKeys(cmd, cfg); err != nil {
+				return err
+			}
+		}
+		csekBundle, err := gcp.CreateWrappedCSEK(gcp.DiskURI(req.Project, req.Zone, req.Name), rsaCert)
+		if err != nil {
+			return fmt.Errorf("failed generating CSEK Key: %w", err)
+		}
+		// store the key in the key store, if any, before the disk is encrypted with it
+		storedBundle, err = cfg.StoreKeys(cmd.Context(), csekBundle)
+		if err != nil {
+			return err
+		}
+		req.CSEK = csekBundle
+	}
+
+	// add the machine and its key to the config file before the disk is encrypted
+	// with it, so that neither is lost if waiting for the instance fails
+	if err := addMachine(cfg, req, storedBundle); err != nil {
+		return err
+	}
+	op, err := backend.CreateInstance(cmd.Context(), req)
+	if err != nil {
+		// the instance was not created
+		if rmErr := cfg.DeleteWithKeys(cmd.Context(), req.Name); rmErr != nil {
+			cmd.PrintErrf("Warning: %s\n", rmErr)
+		}
+		return err
+	}
+	if err = waitOperation(cmd, op, fmt.Sprintf("Creating %s", req.Name)); err != nil {
+		// the operation failed, eg: the zone ran out of resources. The machine is
+		// kept unless the instance is known not to exist, it may still be creating
+		// if waiting timed out or was interrupted
+		if cmd.Context().Err() == nil {
+			if _, descErr := backend.DescribeInstance(cmd.Context(), req.Ref()); errors.Is(descErr, gcp.ErrNotFound) {
+				if rmErr := cfg.DeleteWithKeys(cmd.Context(), req.Name); rmErr != nil {
+					cmd.PrintErrf("Warning: %s\n", rmErr)
+				}
+			}
+		}
+		return err
+	}
+	pinHostKeys(cmd, req.Ref())
+	refreshSSHFiles(cmd)
+	return nil
+}
+
+// addMachine adds the instance 'req' to the config file with its CSEK keys
+// 'csek', KMS key and network settings.
+func addMachine(cfg createConfig, req gcp.CreateRequest, csek gcp.CSEKBundle) error {
+	if err := cfg.Add(req.Name, req.Account, req.Project, req.Zone, csek); err != nil {
+		return err
+	}
+	if req.KMSKey != "" {
+		if err := cfg.SetKMSKey(req.Name, req.KMSKey); err != nil {
+			return err
+		}
+	}
+	if !req.Network.IsZero() {
+		return cfg.SetNetwork(req.Name, req.Network)
+	}
+	return nil
+}
+
+// createNetwork returns the network settings from the create command's flags.
+func createNetwork(cmd *cobra.Command) (gcp.Network, error) {
+	var n gcp.Network
+	var err error
+	if n.Network, err = cmd.Flags().GetString("network"); err != nil {
+		return n, err
+	}
+	if n.Subnet, err = cmd.Flags().GetString("subnet"); err != nil {
+		return n, err
+	}
+	if n.NoAddress, err = cmd.Flags().GetBool("no-address"); err != nil {
+		return n, err
+	}
+	if n.InternalIP, err = cmd.Flags().GetString("private-network-ip"); err != nil {
+		return n, err
+	}
+	if n.Tags, err = cmd.Flags().GetStringSlice("tags"); err != nil {
+		return n, err
+	}
+	stackType, err := cmd.Flags().GetString("stack-type")
+	n.StackType = strings.ToUpper(stackType)
+	return n, err
+}
+
+// createScheduling returns the scheduling settings from the create command's
+// flags.
+func createScheduling(cmd *cobra.Command) (gcp.Scheduling, error) {
+	var s gcp.Scheduling
+	model, err := cmd.Flags().GetString("provisioning-model")
+	if err != nil {
+		return s, err
+	}
+	action, err := cmd.Flags().GetString("instance-termination-action")
+	if err != nil {
+		return s, err
+	}
+	s.ProvisioningModel, s.TerminationAction = strings.ToUpper(model), strings.ToUpper(action)
+	s.MaxRunDuration, err = cmd.Flags().GetDuration("max-run-duration")
+	return s, err
+}
@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/joemiller/gmachine/internal/config"
+	"github.com/joemiller/gmachine/internal/gcp"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateMachine_waitFails(t *testing.T) {
+	dir := t.TempDir()
+	cfg, err := config.LoadFile(filepath.Join(dir, "gmachine.yaml"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	// the instance is still being created when the wait times out
+	saved := backend
+	t.Cleanup(func() { backend = saved })
+	backend = gcp.NewFake("", time.Hour, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	cmd := &cobra.Command{}
+	cmd.SetContext(ctx)
+	cmd.SetErr(io.Discard)
+
+	req := gcp.CreateRequest{Name: "foo", Account: "me@example.com", Project: "my-proj", Zone: "us-west1-a", MachineType: "e2-small"}
+	assert.ErrorIs(t, createMachine(cmd, cfg, req, true, nil), context.DeadlineExceeded)
+
+	// the instance exists, so the machine and its key are kept
+	_, err = backend.DescribeInstance(context.Background(), req.Ref())
+	assert.NoError(t, err)
+	cfg, err = config.LoadFile(filepath.Join(dir, "gmachine.yaml"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	machine, err := cfg.Get("foo")
+	assert.NoError(t, err)
+	if assert.Len(t, machine.CSEK, 1) {
+		assert.NotEmpty(t, machine.CSEK[0].Key)
+	}
+
+	// the machine is removed again if the instance is not created at all
+	other, err := config.LoadFile(filepath.Join(dir, "other.yaml"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	cmd.SetContext(context.Background())
+	assert.ErrorContains(t, createMachine(cmd, other, req, false, nil), "already exists")
+	assert.False(t, other.Exists("foo"))
+}
+
+// exhaustedBackend fails creating instances and disks once their operation
+// completes, like the API does when a zone runs out of resources.
+type exhaustedBackend struct {
+	*gcp.Fake
+}
+
+func (exhaustedBackend) CreateInstance(_ context.Context, req gcp.CreateRequest) (*gcp.Operation, error) {
+	return exhaustedOperation(req.Name, req.Project, req.Zone), nil
+}
+
+func (exhaustedBackend) CreateDisk(_ context.Context, req gcp.DiskRequest) (*gcp.Operation, error) {
+	return exhaustedOperation(req.Ref.Name, req.Ref.Project, req.Ref.Zone), nil
+}
+
+func exhaustedOperation(target, project, zone string) *gcp.Operation {
+	return &gcp.Operation{Name: "operation-1", Type: "insert", Target: target, Project: project, Zone: zone,
+		Status: "DONE", ErrorCode: "ZONE_RESOURCE_POOL_EXHAUSTED", Error: "the zone does not have enough resources"}
+}
+
+func TestCreateMachine_operationFails(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "gmachine.yaml")
+	if !assert.NoError(t, os.WriteFile(file, []byte("version: 4\nkey_store:\n  type: file\nmachines: []\n"), 0o600)) {
+		return
+	}
+	cfg, err := config.LoadFile(file)
+	if !assert.NoError(t, err) {
+		return
+	}
+	saved := backend
+	t.Cleanup(func() { backend = saved })
+	backend = exhaustedBackend{gcp.NewFake("", 0, nil)}
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.Background())
+	cmd.SetErr(io.Discard)
+
+	// the instance does not exist, so the machine and its stored key are removed
+	req := gcp.CreateRequest{Name: "foo", Account: "me@example.com", Project: "my-proj", Zone: "us-west1-a", MachineType: "e2-small"}
+	assert.ErrorIs(t, createMachine(cmd, cfg, req, true, nil), gcp.ErrZoneResourceExhausted)
+	assert.False(t, cfg.Exists("foo"))
+	keys, err := os.ReadFile(filepath.Join(dir, "gmachine-keys.json"))
+	if assert.NoError(t, err) {
+		assert.NotContains(t, string(keys), "foo")
+	}
+
+	// the same for a data disk
+	backend = gcp.NewFake("", 0, nil)
+	if !assert.NoError(t, createMachine(cmd, cfg, req, false, nil)) {
+		return
+	}
+	backend = exhaustedBackend{backend.(*gcp.Fake)}
+	_, err = createDisk(cmd, cfg, req.Ref(), newDisk{Name: "foo-data", DeviceName: "data", Size: "10GB", Encrypt: true})
+	assert.ErrorIs(t, err, gcp.ErrZoneResourceExhausted)
+	machine, err := cfg.Get("foo")
+	if assert.NoError(t, err) {
+		assert.Empty(t, machine.Disks)
+		assert.Empty(t, machine.CSEK)
+	}
+}
@@ -1,7 +1,9 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/joemiller/gmachine/internal/config"
 	"github.com/joemiller/gmachine/internal/gcp"
@@ -28,6 +30,7 @@ gcloud delete machine1 -f
 
 func init() {
 	deleteCmd.Flags().BoolP("force", "f", false, "Delete the machine from the config file even if an error occurs deleting from GCP")
+	addAsyncFlag(deleteCmd)
 
 	rootCmd.AddCommand(deleteCmd)
 }
@@ -49,19 +52,30 @@ func delete(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+	// the keys of the data disks are deleted with the machine, don't lose them
+	if len(machine.Disks) > 0 {
+		disks := []string{}
+		for _, d := range machine.Disks {
+			disks = append(disks, d.Name)
+		}
+		return fmt.Errorf("machine '%s' has data disks: %s. Delete them with 'gmachine disk delete', or detach them and attach them to another machine first",
+			machine.Name, strings.Join(disks, ", "))
+	}
 
-	cmd.Printf("Deleting %s...\n", machine.Name)
-
-	err = gcp.DeleteInstance(
-		cmd.OutOrStdout(),
-		cmd.OutOrStderr(),
-		machine.Name,
-		machine.Account,
-		machine.Project,
-		machine.Zone,
-	)
+	async, _ := cmd.Flags().GetBool("async")
+	op, err := backend.DeleteInstance(cmd.Context(), machine.Ref())
+	if err == nil {
+		err = waitOperation(cmd, op, fmt.Sprintf("Deleting %s", machine.Name))
+	}
 	if err != nil && !force {
-		return fmt.Errorf("delete failed: %v. (re-run with '-f' to delete %s from the config file)", err, machine.Name)
+		return fmt.Errorf("delete failed: %w. (re-run with '-f' to delete %s from the config file)", err, machine.Name)
+	}
+	// the key store may hold the only copy of the keys of an instance that still
+	// exists, eg: with --async or -f
+	deleted := err == nil && !async
+	if !deleted {
+		_, descErr := backend.DescribeInstance(cmd.Context(), machine.Ref())
+		deleted = errors.Is(descErr, gcp.ErrNotFound)
 	}
 
 	// remove machine from config file
@@ -69,7 +83,25 @@ func delete(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+	if !deleted {
+		if hasStoredKeys(machine.CSEK) {
+			cmd.PrintErrf("Warning: the instance %s may still exist, its CSEK keys were kept in the key store\n", machine.Name)
+		}
+	} else if err = cfg.DeleteStoredKeys(cmd.Context(), machine); err != nil {
+		cmd.PrintErrf("Warning: %s\n", err)
+	}
+	refreshSSHFiles(cmd)
 
 	cmd.Println("Success")
 	return nil
 }
+
+// hasStoredKeys returns true if any of the keys is kept in the key store.
+func hasStoredKeys(csek gcp.CSEKBundle) bool {
+	for _, k := range csek {
+		if k.KeyRef != "" {
+			return true
+		}
+	}
+	return false
+}
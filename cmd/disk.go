@@ -0,0 +1,512 @@
+package cmd
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/joemiller/gmachine/internal/config"
+	"github.com/joemiller/gmachine/internal/gcp"
+	"github.com/joemiller/gmachine/internal/indentor"
+	"github.com/spf13/cobra"
+)
+
+// diskCmd represents the disk command
+var diskCmd = &cobra.Command{
+	Use:   "disk",
+	Short: "Create, attach, detach and delete the data disks of machines",
+	Long: `Create, attach, detach and delete the data disks of machines.
+
+Data disks are persistent disks in addition to a machine's boot disk, eg: to keep home directories
+on a separate disk so that the machine can be rebuilt. They are not deleted with the machine.
+gmachine tracks each machine's data disks in the config file. A CSEK encrypted data disk's key is
+stored with the machine's keys and passed when the machine is started, while the disk is attached.`,
+}
+
+// diskCreateCmd represents the disk create command
+var diskCreateCmd = &cobra.Command{
+	Use:   "create MACHINE DISK",
+	Short: "Create a data disk and attach it to a machine",
+	Long:  "Create a data disk in the machine's project and zone and attach it to the machine",
+	Example: indentor.Indent("  ", `
+# Create a 100GB disk 'machine1-home' and attach it to machine1
+gmachine disk create machine1 machine1-home
+
+# Create a 500GB SSD disk encrypted with a new CSEK key
+gmachine disk create machine1 machine1-home --size 500GB --type pd-ssd --csek
+`),
+	Args:         cobra.ExactArgs(2),
+	SilenceUsage: true,
+	RunE:         diskCreate,
+}
+
+// diskAttachCmd represents the disk attach command
+var diskAttachCmd = &cobra.Command{
+	Use:   "attach MACHINE DISK",
+	Short: "Attach a data disk to a machine",
+	Long: `Attach a data disk to a machine.
+
+The disk may be a detached data disk of the machine, a detached data disk of another machine in the
+same project and zone, which is moved to this machine with its CSEK key, or an existing disk that
+is not encrypted with a CSEK key.`,
+	Example: indentor.Indent("  ", `
+# Attach the disk 'machine1-home' to machine1 again
+gmachine disk attach machine1 machine1-home
+
+# Move the disk 'machine1-home' to machine2
+gmachine disk detach machine1 machine1-home
+gmachine disk attach machine2 machine1-home
+`),
+	Args:         cobra.ExactArgs(2),
+	SilenceUsage: true,
+	RunE:         diskAttach,
+}
+
+// diskDetachCmd represents the disk detach command
+var diskDetachCmd = &cobra.Command{
+	Use:   "detach MACHINE DISK",
+	Short: "Detach a data disk from a machine",
+	Long: `Detach a data disk from a machine. The disk and its CSEK key are kept, attach it again with
+'gmachine disk attach'. Unmount the disk in the machine first.`,
+	Example: indentor.Indent("  ", `
+# Detach the disk 'machine1-home' from machine1
+gmachine disk detach machine1 machine1-home
+`),
+	Args:         cobra.ExactArgs(2),
+	SilenceUsage: true,
+	RunE:         diskDetach,
+}
+
+// diskListCmd represents the disk list command
+var diskListCmd = &cobra.Command{
+	Use:   "list [MACHINE]",
+	Short: "List the data disks of all machines, or of one machine",
+	Long:  "List the data disks of all machines, or of one machine",
+	Example: indentor.Indent("  ", `
+# List the data disks of all machines
+gmachine disk list
+
+# List the data disks of machine1
+gmachine disk list machine1
+`),
+	Args:         cobra.MaximumNArgs(1),
+	SilenceUsage: true,
+	RunE:         diskList,
+}
+
+// diskDeleteCmd represents the disk delete command
+var diskDeleteCmd = &cobra.Command{
+	Use:   "delete MACHINE DISK",
+	Short: "Delete a data disk of a machine",
+	Long: `Delete a data disk of a machine, detaching it first if it is attached. The disk's CSEK key is
+removed from the config file.`,
+	Example: indentor.Indent("  ", `
+# Delete the disk 'machine1-home' of machine1
+gmachine disk delete machine1 machine1-home
+`),
+	Args:         cobra.ExactArgs(2),
+	SilenceUsage: true,
+	RunE:         diskDelete,
+}
+
+// diskResizeCmd represents the disk resize command
+var diskResizeCmd = &cobra.Command{
+	Use:   "resize MACHINE DISK --size SIZE",
+	Short: "Grow a data disk of a machine",
+	Long: `Grow a data disk of a machine, disks cannot be shrunk. The disk can be resized while it is
+attached, then grow the file system on it in the machine, eg: with resize2fs.`,
+	Example: indentor.Indent("  ", `
+# Grow the disk 'machine1-home' of machine1 to 500GB
+gmachine disk resize machine1 machine1-home --size 500GB
+`),
+	Args:         cobra.ExactArgs(2),
+	SilenceUsage: true,
+	RunE:         diskResize,
+}
+
+func init() {
+	diskCreateCmd.Flags().String("size", "100GB", "Size of the disk, eg: 100GB or 1TB")
+	diskCreateCmd.Flags().String("type", "pd-balanced", "Type of the disk. To get a list of available disk types, run 'gcloud compute disk-types list'")
+	diskCreateCmd.Flags().Bool("csek", false, "Encrypt the disk with a customer-supplied-encryption-key. A key will be generated and stored with the machine's keys")
+	diskCreateCmd.Flags().String("csek-rsa-cert", "", "PEM file with Google's RSA certificate to wrap the generated CSEK key with, its key-type is rsa-encrypted. Implies --csek")
+	diskCreateCmd.Flags().String("device-name", "", "Device name of the disk in the machine, /dev/disk/by-id/google-DEVICE_NAME. Defaults to the disk's name")
+	diskCreateCmd.Flags().Bool("no-attach", false, "Create the disk without attaching it to the machine")
+	diskAttachCmd.Flags().String("device-name", "", "Device name of the disk in the machine, /dev/disk/by-id/google-DEVICE_NAME. Defaults to the disk's name")
+	diskResizeCmd.Flags().String("size", "", "New size of the disk, eg: 500GB or 1TB")
+	diskResizeCmd.MarkFlagRequired("size")
+	addAsyncFlag(diskResizeCmd)
+
+	diskCmd.AddCommand(diskCreateCmd)
+	diskCmd.AddCommand(diskAttachCmd)
+	diskCmd.AddCommand(diskDetachCmd)
+	diskCmd.AddCommand(diskListCmd)
+	diskCmd.AddCommand(diskDeleteCmd)
+	diskCmd.AddCommand(diskResizeCmd)
+	rootCmd.AddCommand(diskCmd)
+}
+
+func diskCreate(cmd *cobra.Command, args []string) error {
+	name, diskName := args[0], args[1] // guaranteed not nil due to cobra.ExactArgs(2)
+
+	size, err := cmd.Flags().GetString("size")
+	if err != nil {
+		return err
+	}
+	diskType, err := cmd.Flags().GetString("type")
+	if err != nil {
+		return err
+	}
+	encrypt, err := cmd.Flags().GetBool("csek")
+	if err != nil {
+		return err
+	}
+	rsaCert, err := csekRSACert(cmd)
+	if err != nil {
+		return err
+	}
+	encrypt = encrypt || rsaCert != nil
+	deviceName, err := cmd.Flags().GetString("device-name")
+	if err != nil {
+		return err
+	}
+	noAttach, err := cmd.Flags().GetBool("no-attach")
+	if err != nil {
+		return err
+	}
+	if deviceName == "" {
+		deviceName = diskName
+	}
+
+	cfg, err := config.LoadFile(cfgFile)
+	if err != nil {
+		return err
+	}
+	machine, err := cfg.Get(name)
+	if err != nil {
+		return err
+	}
+	ref := machine.Ref().Disk(diskName)
+	if owner := cfg.DiskOwner(ref.Project, ref.Zone, diskName); owner != "" {
+		return fmt.Errorf("disk %s is already a data disk of machine '%s'", diskName, owner)
+	}
+
+	disk := newDisk{Name: diskName, DeviceName: deviceName, Size: size, Type: diskType, Encrypt: encrypt, RSACert: rsaCert}
+	csek, err := createDisk(cmd, cfg, machine.Ref(), disk)
+	if err != nil {
+		return err
+	}
+
+	if !noAttach {
+		if err := attachDisk(cmd, machine.Ref(), diskName, deviceName, csek); err != nil {
+			return err
+		}
+		if err := cfg.SetDiskAttached(name, diskName, deviceName, true); err != nil {
+			return err
+		}
+	}
+	cmd.Println("Success")
+	return nil
+}
+
+func diskAttach(cmd *cobra.Command, args []string) error {
+	name, diskName := args[0], args[1] // guaranteed not nil due to cobra.ExactArgs(2)
+
+	deviceName, err := cmd.Flags().GetString("device-name")
+	if err != nil {
+		return err
+	}
+
+	cfg, err := config.LoadFile(cfgFile)
+	if err != nil {
+		return err
+	}
+	machine, err := cfg.Get(name)
+	if err != nil {
+		return err
+	}
+	ref := machine.Ref().Disk(diskName)
+
+	switch owner := cfg.DiskOwner(ref.Project, ref.Zone, diskName); owner {
+	case name:
+		d, _ := machine.Disk(diskName)
+		if d.Attached {
+			return fmt.Errorf("disk %s is already attached to %s", diskName, name)
+		}
+		if deviceName == "" {
+			deviceName = d.DeviceName
+		}
+	case "":
+		// an existing disk that gmachine did not create, it has no key
+		disk, err := backend.DescribeDisk(cmd.Context(), ref)
+		if err != nil {
+			return err
+		}
+		if gcp.KeyEncryption(disk.DiskEncryptionKey) == gcp.EncryptionCSEK {
+			return fmt.Errorf("disk %s is encrypted with a CSEK key that is not in the config file", diskName)
+		}
+		if err := cfg.AddDisk(cmd.Context(), name, config.Disk{Name: diskName, DeviceName: deviceName}, nil); err != nil {
+			return err
+		}
+	default:
+		other, err := cfg.Get(owner)
+		if err != nil {
+			return err
+		}
+		if d, _ := other.Disk(diskName); d.Attached {
+			return fmt.Errorf("disk %s is attached to machine '%s', detach it first with 'gmachine disk detach %s %s'", diskName, owner, owner, diskName)
+		}
+		if err := cfg.MoveDisk(owner, name, diskName); err != nil {
+			return err
+		}
+		cmd.Printf("Moved disk %s from %s to %s\n", diskName, owner, name)
+	}
+	if deviceName == "" {
+		deviceName = diskName
+	}
+
+	csek, err := machineCSEK(cmd, cfg, name)
+	if err != nil {
+		return err
+	}
+	if err := attachDisk(cmd, machine.Ref(), diskName, deviceName, diskKey(csek, ref)); err != nil {
+		return err
+	}
+	if err := cfg.SetDiskAttached(name, diskName, deviceName, true); err != nil {
+		return err
+	}
+	cmd.Println("Success")
+	return nil
+}
+
+// newDisk is a data disk to create with createDisk.
+type newDisk struct {
+	Name       string
+	DeviceName string
+	Size       string
+	Type       string
+	// Encrypt encrypts the disk with a new CSEK key, wrapped with RSACert if it
+	// is not nil
+	Encrypt bool
+	RSACert *rsa.PublicKey
+}
+
+// diskConfig is the part of the config file that createDisk uses.
+type diskConfig interface {
+	keyConfig
+	KeyStoreType() string
+	AddDisk(ctx context.Context, name string, disk config.Disk, csek gcp.CSEKBundle) error
+	RemoveDisk(ctx context.Context, name, disk string) error
+}
+
+// createDisk creates the data disk 'disk' of the machine 'ref', adds it to the
+// config file detached and waits for it to be created. It returns the disk's key
+// if it is CSEK encrypted.
+func createDisk(cmd *cobra.Command, cfg diskConfig, ref gcp.InstanceRef, disk newDisk) (gcp.CSEKBundle, error) {
+	diskRef := ref.Disk(disk.Name)
+	var csek gcp.CSEKBundle
+	if disk.Encrypt {
+		// unlock now rather than after the disk is created so that the key can be saved
+		if cfg.Locked() && cfg.KeyStoreType() == "" {
+			if _, err := unlockKeys(cmd, cfg); err != nil {
+				return nil, err
+			}
+		}
+		var err error
+		csek, err = gcp.CreateWrappedCSEK(diskRef.URI(), disk.RSACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed generating CSEK Key: %w", err)
+		}
+	}
+
+	// save the disk and its key before the disk is encrypted with it so that the
+	// key is never lost
+	if err := cfg.AddDisk(cmd.Context(), ref.Name, config.Disk{Name: disk.Name, DeviceName: disk.DeviceName}, csek); err != nil {
+		return nil, err
+	}
+	op, err := backend.CreateDisk(cmd.Context(), gcp.DiskRequest{Ref: diskRef, Size: disk.Size, Type: disk.Type, CSEK: csek})
+	if err != nil {
+		// the disk was not created
+		if rmErr := cfg.RemoveDisk(cmd.Context(), ref.Name, disk.Name); rmErr != nil {
+			cmd.PrintErrf("Warning: %s\n", rmErr)
+		}
+		return nil, err
+	}
+	if err := waitOperation(cmd, op, fmt.Sprintf("Creating disk %s", disk.Name)); err != nil {
+		// as for instances, the disk is only removed if it is known not to exist
+		if cmd.Context().Err() == nil {
+			if _, descErr := backend.DescribeDisk(cmd.Context(), diskRef); errors.Is(descErr, gcp.ErrNotFound) {
+				if rmErr := cfg.RemoveDisk(cmd.Context(), ref.Name, disk.Name); rmErr != nil {
+					cmd.PrintErrf("Warning: %s\n", rmErr)
+				}
+			}
+		}
+		return nil, err
+	}
+	return csek, nil
+}
+
+// attachDisk attaches the data disk 'diskName' with its key 'csek' to the
+// machine and waits for it to be attached.
+func attachDisk(cmd *cobra.Command, ref gcp.InstanceRef, diskName, deviceName string, csek gcp.CSEKBundle) error {
+	op, err := backend.AttachDisk(cmd.Context(), ref, gcp.AttachDiskRequest{Disk: diskName, DeviceName: deviceName, CSEK: csek})
+	if err != nil {
+		return err
+	}
+	return waitOperation(cmd, op, fmt.Sprintf("Attaching disk %s to %s", diskName, ref.Name))
+}
+
+// diskKey returns the key of the disk 'ref' from the machine's keys 'csek'.
+func diskKey(csek gcp.CSEKBundle, ref gcp.DiskRef) gcp.CSEKBundle {
+	var key gcp.CSEKBundle
+	for _, k := range csek {
+		if k.URI == ref.URI() {
+			key = append(key, k)
+		}
+	}
+	return key
+}
+
+func diskDetach(cmd *cobra.Command, args []string) error {
+	name, diskName := args[0], args[1] // guaranteed not nil due to cobra.ExactArgs(2)
+
+	cfg, err := config.LoadFile(cfgFile)
+	if err != nil {
+		return err
+	}
+	machine, err := cfg.Get(name)
+	if err != nil {
+		return err
+	}
+	d, ok := machine.Disk(diskName)
+	if !ok {
+		return fmt.Errorf("disk %s is not a data disk of %s", diskName, name)
+	}
+	if !d.Attached {
+		return fmt.Errorf("disk %s is not attached to %s", diskName, name)
+	}
+
+	op, err := backend.DetachDisk(cmd.Context(), machine.Ref(), d.DeviceName)
+	if err == nil {
+		err = waitOperation(cmd, op, fmt.Sprintf("Detaching disk %s from %s", diskName, name))
+	}
+	if err != nil {
+		return err
+	}
+	if err := cfg.SetDiskAttached(name, diskName, d.DeviceName, false); err != nil {
+		return err
+	}
+	cmd.Println("Success")
+	return nil
+}
+
+func diskList(cmd *cobra.Command, args []string) error {
+	cfg, err := config.LoadFile(cfgFile)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		if _, err := cfg.Get(args[0]); err != nil {
+			return err
+		}
+	}
+
+	table := tabwriter.NewWriter(cmd.OutOrStdout(), 5, 0, 2, ' ', 0)
+	print := func(values ...string) {
+		fmt.Fprintln(table, strings.Join(values, "\t"))
+	}
+	print("MACHINE", "DISK", "DEVICE_NAME", "ATTACHED", "SIZE_GB", "TYPE", "ENCRYPTION", "STATUS")
+	for _, m := range cfg.Machines {
+		if len(args) > 0 && m.Name != args[0] {
+			continue
+		}
+		for _, d := range m.Disks {
+			disk, err := backend.DescribeDisk(cmd.Context(), m.Ref().Disk(d.Name))
+			if err != nil {
+				if cmd.Context().Err() != nil {
+					return err
+				}
+				cmd.PrintErrln(err)
+				print(m.Name, d.Name, d.DeviceName, fmt.Sprintf("%t", d.Attached), "", "", "", "")
+				continue
+			}
+			print(m.Name, d.Name, d.DeviceName, fmt.Sprintf("%t", d.Attached), fmt.Sprintf("%d", disk.SizeGb),
+				path.Base(disk.Type), gcp.KeyEncryption(disk.DiskEncryptionKey), disk.Status)
+		}
+	}
+	return table.Flush()
+}
+
+func diskDelete(cmd *cobra.Command, args []string) error {
+	name, diskName := args[0], args[1] // guaranteed not nil due to cobra.ExactArgs(2)
+
+	cfg, err := config.LoadFile(cfgFile)
+	if err != nil {
+		return err
+	}
+	machine, err := cfg.Get(name)
+	if err != nil {
+		return err
+	}
+	d, ok := machine.Disk(diskName)
+	if !ok {
+		return fmt.Errorf("disk %s is not a data disk of %s", diskName, name)
+	}
+
+	if d.Attached {
+		op, err := backend.DetachDisk(cmd.Context(), machine.Ref(), d.DeviceName)
+		if err == nil {
+			err = waitOperation(cmd, op, fmt.Sprintf("Detaching disk %s from %s", diskName, name))
+		}
+		// the machine may have been deleted already
+		if err != nil && !errors.Is(err, gcp.ErrNotFound) {
+			return err
+		}
+		if err := cfg.SetDiskAttached(name, diskName, d.DeviceName, false); err != nil {
+			return err
+		}
+	}
+
+	op, err := backend.DeleteDisk(cmd.Context(), machine.Ref().Disk(diskName))
+	if err == nil {
+		err = waitOperation(cmd, op, fmt.Sprintf("Deleting disk %s", diskName))
+	}
+	if err != nil && !errors.Is(err, gcp.ErrNotFound) {
+		return err
+	}
+	if err := cfg.RemoveDisk(cmd.Context(), name, diskName); err != nil {
+		return err
+	}
+	cmd.Println("Success")
+	return nil
+}
+
+func diskResize(cmd *cobra.Command, args []string) error {
+	name, diskName := args[0], args[1] // guaranteed not nil due to cobra.ExactArgs(2)
+
+	size, err := cmd.Flags().GetString("size")
+	if err != nil {
+		return err
+	}
+
+	cfg, err := config.LoadFile(cfgFile)
+	if err != nil {
+		return err
+	}
+	machine, err := cfg.Get(name)
+	if err != nil {
+		return err
+	}
+	if _, ok := machine.Disk(diskName); !ok {
+		return fmt.Errorf("disk %s is not a data disk of %s", diskName, name)
+	}
+
+	op, err := backend.ResizeDisk(cmd.Context(), machine.Ref().Disk(diskName), size)
+	if err != nil {
+		return err
+	}
+	return waitOperation(cmd, op, fmt.Sprintf("Resizing disk %s to %s", diskName, size))
+}
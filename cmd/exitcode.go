@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+
+	"github.com/joemiller/gmachine/internal/config"
+	"github.com/joemiller/gmachine/internal/gcp"
+	"github.com/joemiller/gmachine/internal/keystore"
+)
+
+// Process exit codes. These are part of gmachine's interface for scripts, do not
+// change existing values. Keep the table in README.md up to date.
+const (
+	exitOK                    = 0
+	exitError                 = 1 // any error not listed below
+	exitNotFound              = 3
+	exitPermissionDenied      = 4
+	exitAuthExpired           = 5
+	exitQuotaExceeded         = 6
+	exitZoneResourceExhausted = 7
+	exitCSEKMissing           = 8
+	exitInvalidState          = 9
+	exitTimeout               = 124 // same as timeout(1)
+	exitInterrupted           = 130 // 128 + SIGINT
+)
+
+var exitCodes = []struct {
+	err  error
+	code int
+}{
+	{errInterrupted, exitInterrupted},
+	{context.DeadlineExceeded, exitTimeout},
+	{gcp.ErrAuthExpired, exitAuthExpired},
+	{gcp.ErrNotFound, exitNotFound},
+	{gcp.ErrPermissionDenied, exitPermissionDenied},
+	{gcp.ErrQuotaExceeded, exitQuotaExceeded},
+	{gcp.ErrZoneResourceExhausted, exitZoneResourceExhausted},
+	{gcp.ErrCSEKMissing, exitCSEKMissing},
+	{config.ErrLocked, exitCSEKMissing},
+	{keystore.ErrNotFound, exitCSEKMissing},
+	{gcp.ErrInvalidState, exitInvalidState},
+}
+
+// exitCode returns the process exit code for the error returned by a command.
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	for _, e := range exitCodes {
+		if errors.Is(err, e.err) {
+			return e.code
+		}
+	}
+	return exitError
+}
@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/joemiller/gmachine/internal/config"
+	"github.com/joemiller/gmachine/internal/gcp"
+	"github.com/joemiller/gmachine/internal/sshclient"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// hostKeysTimeout is how long to wait for the guest agent of a started
+	// machine to publish its host keys.
+	hostKeysTimeout = 2 * time.Minute
+	// hostKeysPollInterval is how often the guest attributes are checked for the
+	// host keys while waiting.
+	hostKeysPollInterval = 5 * time.Second
+)
+
+// pinHostKeys waits for the guest agent of the started machine to publish its
+// ssh host keys in guest attributes and pins them in the config file. Machines
+// that do not enable guest attributes are skipped. Errors are printed as warnings,
+// ssh then trusts the host key the first time it connects.
+func pinHostKeys(cmd *cobra.Command, ref gcp.InstanceRef) {
+	if async, _ := cmd.Flags().GetBool("async"); async || dryRun {
+		return
+	}
+	instance, err := backend.DescribeInstance(cmd.Context(), ref)
+	if err != nil {
+		cmd.PrintErrf("Warning: failed fetching host keys of %s: %s\n", ref.Name, err)
+		return
+	}
+	if !gcp.GuestAttributesEnabled(instance) {
+		slog.DebugContext(cmd.Context(), "not pinning host keys, guest attributes are not enabled", "instance", ref.Name)
+		return
+	}
+
+	var keys []string
+	err = withSpinner(cmd, fmt.Sprintf("Fetching host keys of %s", ref.Name), func() error {
+		keys, err = waitHostKeys(cmd.Context(), ref)
+		return err
+	})
+	if err == nil {
+		err = setHostKeys(ref.Name, keys)
+	}
+	if err != nil {
+		cmd.PrintErrf("Warning: failed fetching host keys of %s: %s\n", ref.Name, err)
+	}
+}
+
+// setHostKeys pins the host keys of the machine 'name' in the config file.
+func setHostKeys(name string, keys []string) error {
+	cfg, err := config.LoadFile(cfgFile)
+	if err != nil {
+		return err
+	}
+	return cfg.SetHostKeys(name, keys)
+}
+
+// waitHostKeys polls the instance's guest attributes until its host keys are
+// published or hostKeysTimeout passes.
+func waitHostKeys(ctx context.Context, ref gcp.InstanceRef) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, hostKeysTimeout)
+	defer cancel()
+	for {
+		keys, err := backend.HostKeys(ctx, ref)
+		if err != nil || len(keys) > 0 {
+			return keys, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("the guest agent did not publish them within %s", hostKeysTimeout)
+		case <-time.After(hostKeysPollInterval):
+		}
+	}
+}
+
+// writeKnownHosts rewrites the managed known_hosts file with the pinned host keys
+// of the machines in the config file. Keys that ssh added for machines without
+// pinned keys are kept, and those of machines no longer in the config file are
+// removed. The file is not created until a machine has pinned keys.
+func writeKnownHosts() error {
+	cfg, err := config.LoadFile(cfgFile)
+	if err != nil {
+		return err
+	}
+	pinned := map[string][]string{}
+	aliases := map[string]bool{}
+	for _, m := range cfg.Machines {
+		aliases[hostKeyAlias(m.Name)] = true
+		if len(m.HostKeys) > 0 {
+			pinned[hostKeyAlias(m.Name)] = m.HostKeys
+		}
+	}
+	if _, err := os.Stat(knownHostsFile()); errors.Is(err, fs.ErrNotExist) && len(pinned) == 0 {
+		return nil
+	}
+	return sshclient.WriteKnownHosts(knownHostsFile(), pinned, func(host string) bool {
+		return !strings.HasPrefix(host, hostKeyAlias("")) || aliases[host]
+	})
+}
@@ -0,0 +1,333 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/joemiller/gmachine/internal/config"
+	"github.com/joemiller/gmachine/internal/escrow"
+	"github.com/joemiller/gmachine/internal/gcp"
+	"github.com/joemiller/gmachine/internal/indentor"
+	"github.com/joemiller/gmachine/internal/keys"
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+)
+
+// keysExportCmd represents the keys export command
+var keysExportCmd = &cobra.Command{
+	Use:   "export NAME --to FILE",
+	Short: "Export a machine's CSEK keys to an encrypted escrow file",
+	Long: `Export a machine's CSEK keys to an encrypted escrow file.
+
+Without the config file's keys a CSEK encrypted machine cannot be started again. Keep an escrow
+file somewhere safe, eg: with a team lead, to recover the machine with 'keys import' if the
+config file is lost. The escrow file is encrypted with one of:
+
+  a passphrase      prompted for, the default
+  --recipient       the RSA public keys of the people who can import it, from PEM files
+  --shares N        a random key split into N Shamir shares, any --threshold of them import
+                    it. Each share is written to FILE.share-I, give them to different people`,
+	Example: indentor.Indent("  ", `
+# Export the keys of machine1 encrypted with a passphrase
+gmachine keys export machine1 --to machine1.escrow
+
+# Export the keys of machine1 for a team lead, who created the key pair with:
+#   openssl genpkey -algorithm RSA -pkeyopt rsa_keygen_bits:4096 -out lead.pem
+#   openssl pkey -in lead.pem -pubout -out lead.pub.pem
+gmachine keys export machine1 --to machine1.escrow --recipient lead.pub.pem
+
+# Split the key into 5 shares, any 3 of them import the keys
+gmachine keys export machine1 --to machine1.escrow --shares 5 --threshold 3
+`),
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE:         keysExport,
+}
+
+// keysImportCmd represents the keys import command
+var keysImportCmd = &cobra.Command{
+	Use:   "import FILE",
+	Short: "Import a machine and its CSEK keys from an escrow file",
+	Long: `Import a machine and its CSEK keys from an escrow file written by 'keys export'.
+
+The machine is added to the config file and its keys are stored like the keys of a new machine.
+With --print the keys are printed in the format of gcloud's --csek-key-file instead.`,
+	Example: indentor.Indent("  ", `
+# Import a passphrase encrypted escrow file, prompts for the passphrase
+gmachine keys import machine1.escrow
+
+# Import an escrow file encrypted for your RSA key
+gmachine keys import machine1.escrow --identity lead.pem
+
+# Import an escrow file with 3 of its shares
+gmachine keys import machine1.escrow --share machine1.escrow.share-1 --share machine1.escrow.share-4 --share machine1.escrow.share-5
+
+# Print the CSEK keys to use them with gcloud
+gmachine keys import machine1.escrow --print > csek.json
+`),
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE:         keysImport,
+}
+
+func init() {
+	keysExportCmd.Flags().String("to", "", "Escrow file to write")
+	keysExportCmd.Flags().StringArray("recipient", nil, "PEM file with the RSA public key of a recipient, can be repeated")
+	keysExportCmd.Flags().Int("shares", 0, "Split the key into this many shares")
+	keysExportCmd.Flags().Int("threshold", 0, "Number of shares required to import the keys")
+	keysExportCmd.MarkFlagRequired("to")
+	keysImportCmd.Flags().String("identity", "", "PEM file with the RSA private key of a recipient")
+	keysImportCmd.Flags().StringArray("share", nil, "Share file, can be repeated")
+	keysImportCmd.Flags().Bool("print", false, "Print the CSEK keys instead of importing the machine")
+
+	keysCmd.AddCommand(keysExportCmd)
+	keysCmd.AddCommand(keysImportCmd)
+}
+
+func keysExport(cmd *cobra.Command, args []string) error {
+	name := args[0] // guaranteed not nil due to cobra.ExactArgs(1)
+
+	to, err := cmd.Flags().GetString("to")
+	if err != nil {
+		return err
+	}
+	recipients, err := cmd.Flags().GetStringArray("recipient")
+	if err != nil {
+		return err
+	}
+	shares, err := cmd.Flags().GetInt("shares")
+	if err != nil {
+		return err
+	}
+	threshold, err := cmd.Flags().GetInt("threshold")
+	if err != nil {
+		return err
+	}
+	if len(recipients) > 0 && shares > 0 {
+		return errors.New("cannot specify both --recipient and --shares")
+	}
+	if (shares > 0) != (threshold > 0) {
+		return errors.New("--shares and --threshold must be used together")
+	}
+
+	opts := escrow.Options{Shares: shares, Threshold: threshold}
+	for _, path := range recipients {
+		pub, err := readPEM(path, gcp.ReadRSACert)
+		if err != nil {
+			return err
+		}
+		opts.Recipients = append(opts.Recipients, pub)
+	}
+
+	// don't overwrite an escrow file, it may be the only copy of other keys
+	files := []string{to}
+	for i := 1; i <= shares; i++ {
+		files = append(files, fmt.Sprintf("%s.share-%d", to, i))
+	}
+	for _, f := range files {
+		if _, err := os.Stat(f); err == nil {
+			return fmt.Errorf("%s already exists", f)
+		}
+	}
+
+	cfg, err := config.LoadFile(cfgFile)
+	if err != nil {
+		return err
+	}
+	machine, err := cfg.Get(name)
+	if err != nil {
+		return err
+	}
+	csek, err := machineCSEK(cmd, cfg, name)
+	if err != nil {
+		return err
+	}
+
+	if len(opts.Recipients) == 0 && shares == 0 {
+		prompter := keys.NewPrompter(os.Stdin, cmd.ErrOrStderr())
+		opts.Passphrase, err = prompter.NewPassphrase("New passphrase for the escrow file: ")
+		if err != nil {
+			return err
+		}
+	}
+
+	var disks []escrow.Disk
+	for _, d := range machine.Disks {
+		disks = append(disks, escrow.Disk{Name: d.Name, DeviceName: d.DeviceName, Attached: d.Attached})
+	}
+	file, shareFiles, err := escrow.Export(escrow.Machine{
+		Name:    machine.Name,
+		Account: machine.Account,
+		Project: machine.Project,
+		Zone:    machine.Zone,
+		KMSKey:  machine.KMSKey,
+		CSEK:    csek,
+		Disks:   disks,
+	}, opts)
+	if err != nil {
+		return err
+	}
+
+	data, err := file.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := writeNewFile(to, data); err != nil {
+		return err
+	}
+	for i, s := range shareFiles {
+		data, err := s.Marshal()
+		if err != nil {
+			return err
+		}
+		if err := writeNewFile(files[i+1], data); err != nil {
+			return err
+		}
+	}
+
+	cmd.Printf("Exported the CSEK keys of %s to %s\n", name, to)
+	if shares > 0 {
+		cmd.Printf("Give each of the %d share files to a different person, any %d of them import the keys:\n", shares, threshold)
+		for _, f := range files[1:] {
+			cmd.Printf("  %s\n", f)
+		}
+	}
+	return nil
+}
+
+func keysImport(cmd *cobra.Command, args []string) error {
+	path := args[0] // guaranteed not nil due to cobra.ExactArgs(1)
+
+	identity, err := cmd.Flags().GetString("identity")
+	if err != nil {
+		return err
+	}
+	sharePaths, err := cmd.Flags().GetStringArray("share")
+	if err != nil {
+		return err
+	}
+	printKeys, err := cmd.Flags().GetBool("print")
+	if err != nil {
+		return err
+	}
+
+	file, err := escrow.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var machine escrow.Machine
+	switch {
+	case file.Recipients != nil:
+		if identity == "" {
+			return fmt.Errorf("%s is encrypted for recipients, pass the private key of one of them with --identity", path)
+		}
+		priv, err := readPEM(identity, escrow.ReadPrivateKey)
+		if err != nil {
+			return err
+		}
+		machine, err = file.OpenIdentity(priv)
+		if err != nil {
+			return err
+		}
+	case file.Shares != nil:
+		if len(sharePaths) == 0 {
+			return fmt.Errorf("%s is split into shares, pass %d of them with --share", path, file.Shares.Threshold)
+		}
+		shares, err := escrow.ReadShares(sharePaths)
+		if err != nil {
+			return err
+		}
+		machine, err = file.OpenShares(shares)
+		if err != nil {
+			return err
+		}
+	default:
+		prompter := keys.NewPrompter(os.Stdin, cmd.ErrOrStderr())
+		passphrase, err := prompter.Passphrase(fmt.Sprintf("Enter the passphrase for the escrow file %s: ", path))
+		if err != nil {
+			return err
+		}
+		machine, err = file.OpenPassphrase(passphrase)
+		if err != nil {
+			return err
+		}
+	}
+
+	if printKeys {
+		data, err := machine.CSEK.MarshalIndent()
+		if err != nil {
+			return err
+		}
+		cmd.Println(string(data))
+		return nil
+	}
+
+	cfg, err := config.LoadFile(cfgFile)
+	if err != nil {
+		return err
+	}
+	if cfg.Exists(machine.Name) {
+		return fmt.Errorf("machine '%s' already exists in the config file, use --print to print its keys instead", machine.Name)
+	}
+	for _, d := range machine.Disks {
+		if owner := cfg.DiskOwner(machine.Project, machine.Zone, d.Name); owner != "" {
+			return fmt.Errorf("disk %s is already a data disk of machine '%s'", d.Name, owner)
+		}
+	}
+	if cfg.Locked() && cfg.KeyStoreType() == "" {
+		if _, err := unlockKeys(cmd, cfg); err != nil {
+			return err
+		}
+	}
+	stored, err := cfg.StoreKeys(cmd.Context(), machine.CSEK)
+	if err != nil {
+		return err
+	}
+	if err := cfg.Add(machine.Name, machine.Account, machine.Project, machine.Zone, stored); err != nil {
+		return err
+	}
+	if machine.KMSKey != "" {
+		if err := cfg.SetKMSKey(machine.Name, machine.KMSKey); err != nil {
+			return err
+		}
+	}
+	for _, d := range machine.Disks {
+		// the disks' keys were added with the machine's
+		if err := cfg.AddDisk(cmd.Context(), machine.Name, config.Disk{Name: d.Name, DeviceName: d.DeviceName, Attached: d.Attached}, nil); err != nil {
+			return err
+		}
+	}
+	cmd.Printf("Imported machine %s and its CSEK keys from %s\n", machine.Name, path)
+	return nil
+}
+
+// readPEM reads the key in the PEM file 'path' with 'read', expanding ~ in the
+// path.
+func readPEM[K any](path string, read func(string) (K, error)) (K, error) {
+	path, err := homedir.Expand(path)
+	if err != nil {
+		var zero K
+		return zero, err
+	}
+	return read(path)
+}
+
+// writeNewFile writes 'data' to a new file only readable by the user. In dry-run
+// mode the file is not written.
+func writeNewFile(path string, data []byte) error {
+	if dryRun {
+		fmt.Fprintf(config.DryRun, "[dry-run] write %s\n", path)
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,515 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/joemiller/gmachine/internal/config"
+	"github.com/joemiller/gmachine/internal/gcp"
+	"github.com/joemiller/gmachine/internal/indentor"
+	"github.com/joemiller/gmachine/internal/keys"
+	"github.com/joemiller/gmachine/internal/keystore"
+	"github.com/joemiller/gmachine/internal/rotate"
+	"github.com/spf13/cobra"
+)
+
+// keysCmd represents the keys command
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Encrypt, unlock, move, rotate and escrow the CSEK keys",
+	Long: `Encrypt, unlock, move, rotate and escrow the CSEK keys.
+
+'keys lock' encrypts the CSEK keys in the config file with a passphrase. Commands that need the
+keys, such as 'start', 'resume' and 'create --csek', then prompt for the passphrase. Run
+'keys unlock' to cache the unlocked keys for a while instead of being prompted for every command.
+
+'keys migrate' moves the CSEK keys out of the config file into a key store, such as the OS
+keyring, or back. 'keys rotate' replaces the key of a machine's boot disk with a new key.
+
+'keys export' writes a machine's keys to an encrypted escrow file, and 'keys import' recovers
+the machine from it, eg: after the config file was lost.`,
+}
+
+// keysLockCmd represents the keys lock command
+var keysLockCmd = &cobra.Command{
+	Use:   "lock",
+	Short: "Encrypt the CSEK keys with a passphrase, or forget the keys cached by 'keys unlock'",
+	Long:  "Encrypt the CSEK keys with a passphrase, or forget the keys cached by 'keys unlock'",
+	Example: indentor.Indent("  ", `
+# Encrypt the CSEK keys in the config file, prompts for a new passphrase
+gmachine keys lock
+
+# Forget the keys cached by 'keys unlock', they are encrypted already
+gmachine keys lock
+`),
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE:         keysLock,
+}
+
+// keysUnlockCmd represents the keys unlock command
+var keysUnlockCmd = &cobra.Command{
+	Use:   "unlock",
+	Short: "Cache the unlocked CSEK keys so that commands do not prompt for the passphrase",
+	Long: `Cache the unlocked CSEK keys so that commands do not prompt for the passphrase.
+
+The key derived from the passphrase is cached in memory by a background 'gmachine keys agent'
+process, like ssh-agent, until --ttl expires or 'gmachine keys lock' is run.`,
+	Example: indentor.Indent("  ", `
+# Unlock the CSEK keys for 15 minutes
+gmachine keys unlock
+
+# Unlock the CSEK keys for the rest of the day
+gmachine keys unlock --ttl 8h
+`),
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE:         keysUnlock,
+}
+
+// keysChangePassphraseCmd represents the keys change-passphrase command
+var keysChangePassphraseCmd = &cobra.Command{
+	Use:   "change-passphrase",
+	Short: "Change the passphrase of the encrypted CSEK keys",
+	Long:  "Change the passphrase of the encrypted CSEK keys",
+	Example: indentor.Indent("  ", `
+gmachine keys change-passphrase
+`),
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE:         keysChangePassphrase,
+}
+
+// keysMigrateCmd represents the keys migrate command
+var keysMigrateCmd = &cobra.Command{
+	Use:   "migrate --to STORE",
+	Short: "Move the CSEK keys between the config file and a key store",
+	Long: `Move the CSEK keys between the config file and a key store.
+
+The keys are copied to the new store before the config file is changed, and deleted from the
+old store afterwards. Key stores:
+
+  config   the config file, encrypted if 'keys lock' was used
+  keyring  the Secret Service, eg: GNOME Keyring or KWallet, using secret-tool(1)
+  pass     pass(1), in the folder --path (default "gmachine")
+  file     a JSON file only readable by you, --path (default gmachine-keys.json next to the config file)
+  command  an external command, run as 'COMMAND get|set|delete REF'. 'set' reads the key from
+           stdin and 'get' exits with code 2 if the key is not found
+  fake     a JSON file for tests, --path (default fake-keystore.json next to the config file)`,
+	Example: indentor.Indent("  ", `
+# Store the CSEK keys in the OS keyring
+gmachine keys migrate --to keyring
+
+# Store the CSEK keys with pass(1) under gmachine/csek/
+gmachine keys migrate --to pass --path gmachine/csek
+
+# Store the CSEK keys with a custom command
+gmachine keys migrate --to command --command "/usr/local/bin/my-vault --profile gmachine"
+
+# Move the CSEK keys back into the config file
+gmachine keys migrate --to config
+`),
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE:         keysMigrate,
+}
+
+// keysRotateCmd represents the keys rotate command
+var keysRotateCmd = &cobra.Command{
+	Use:   "rotate NAME",
+	Short: "Replace the CSEK key of a machine's boot disk with a new key",
+	Long: `Replace the CSEK key of a machine's boot disk with a new key.
+
+The key of a disk cannot be changed, so the machine is stopped, its boot disk is snapshotted and
+copied to a new disk encrypted with a new key, and the new disk replaces the old boot disk. The
+snapshot and the old disk are then deleted and the machine is started again if it was running.
+
+Each step is recorded in the config file. If the rotation is interrupted, run the command again
+to resume it. The config file always has the key of the boot disk that is attached.
+
+Keys that are rsa-encrypted are rotated to new keys wrapped with the certificate passed with
+--csek-rsa-cert, it also rotates raw keys to rsa-encrypted keys.`,
+	Example: indentor.Indent("  ", `
+# Rotate the CSEK key of machine1
+gmachine keys rotate machine1
+
+# Rotate the key but keep the old disk, eg: until the machine has been checked
+gmachine keys rotate machine1 --keep-old-disk
+
+# Rotate to a key wrapped with Google's RSA certificate
+curl -o google-cloud-csek-ingress.pem https://cloud-certs.storage.googleapis.com/google-cloud-csek-ingress.pem
+gmachine keys rotate machine1 --csek-rsa-cert google-cloud-csek-ingress.pem
+`),
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE:         keysRotate,
+}
+
+// keysAgentCmd represents the keys agent command, it is started by 'keys unlock'
+var keysAgentCmd = &cobra.Command{
+	Use:          "agent",
+	Short:        "Cache the key read from stdin, started by 'keys unlock'",
+	Hidden:       true,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE:         keysAgent,
+}
+
+func init() {
+	keysUnlockCmd.Flags().Duration("ttl", 15*time.Minute, "How long to cache the unlocked keys")
+	keysMigrateCmd.Flags().String("to", "", "Key store to move the keys to: config, "+strings.Join(keystore.Types, ", "))
+	keysMigrateCmd.Flags().String("path", "", "Path of the 'file' or 'fake' key store, or folder of the 'pass' key store")
+	keysMigrateCmd.Flags().String("command", "", "Command of the 'command' key store, split on spaces")
+	keysMigrateCmd.MarkFlagRequired("to")
+	keysRotateCmd.Flags().Bool("keep-old-disk", false, "Keep the old boot disk, as a detached data disk with its key, instead of deleting it")
+	keysRotateCmd.Flags().String("csek-rsa-cert", "", "PEM file with Google's RSA certificate to wrap the new keys with, their key-type is rsa-encrypted")
+	keysAgentCmd.Flags().String("socket", "", "Unix socket to listen on")
+	keysAgentCmd.Flags().Duration("ttl", 15*time.Minute, "How long to cache the key")
+
+	keysCmd.AddCommand(keysLockCmd)
+	keysCmd.AddCommand(keysUnlockCmd)
+	keysCmd.AddCommand(keysChangePassphraseCmd)
+	keysCmd.AddCommand(keysMigrateCmd)
+	keysCmd.AddCommand(keysRotateCmd)
+	keysCmd.AddCommand(keysAgentCmd)
+	rootCmd.AddCommand(keysCmd)
+}
+
+// keyConfig is the part of the config used to unlock CSEK keys.
+type keyConfig interface {
+	Filename() string
+	Locked() bool
+	PassphraseKey(passphrase []byte) ([]byte, error)
+	Unlock(key []byte) error
+	CSEK(ctx context.Context, name string) (gcp.CSEKBundle, error)
+	StartCSEK(ctx context.Context, name string) (gcp.CSEKBundle, error)
+	Rotation(name string) (*config.Rotation, error)
+}
+
+func keysLock(cmd *cobra.Command, _ []string) error {
+	cfg, err := config.LoadFile(cfgFile)
+	if err != nil {
+		return err
+	}
+
+	if cfg.Encrypted() {
+		err = keys.AgentForget(keys.AgentSocket(cfg.Filename()))
+		if errors.Is(err, keys.ErrNoAgent) {
+			cmd.Println("The CSEK keys are already locked")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		cmd.Println("Locked the CSEK keys")
+		return nil
+	}
+
+	prompter := keys.NewPrompter(os.Stdin, cmd.ErrOrStderr())
+	passphrase, err := prompter.NewPassphrase(fmt.Sprintf("New passphrase for the CSEK keys in %s: ", cfg.Filename()))
+	if err != nil {
+		return err
+	}
+	if err = cfg.EncryptKeys(passphrase); err != nil {
+		return err
+	}
+	cmd.Printf("Encrypted the CSEK keys in %s\n", cfg.Filename())
+	return nil
+}
+
+func keysUnlock(cmd *cobra.Command, _ []string) error {
+	ttl, err := cmd.Flags().GetDuration("ttl")
+	if err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		return errors.New("--ttl must be greater than 0")
+	}
+
+	cfg, err := config.LoadFile(cfgFile)
+	if err != nil {
+		return err
+	}
+	if !cfg.Encrypted() {
+		return fmt.Errorf("the CSEK keys in %s are not encrypted, run 'gmachine keys lock' to encrypt them", cfg.Filename())
+	}
+
+	key, err := unlockKeys(cmd, cfg)
+	if err != nil {
+		return err
+	}
+
+	socket := keys.AgentSocket(cfg.Filename())
+	err = keys.AgentSetKey(socket, key, ttl)
+	if errors.Is(err, keys.ErrNoAgent) {
+		err = startAgent(socket, key, ttl)
+	}
+	if err != nil {
+		return err
+	}
+	cmd.Printf("Unlocked the CSEK keys for %s\n", ttl)
+	return nil
+}
+
+func keysChangePassphrase(cmd *cobra.Command, _ []string) error {
+	cfg, err := config.LoadFile(cfgFile)
+	if err != nil {
+		return err
+	}
+	if !cfg.Encrypted() {
+		return fmt.Errorf("the CSEK keys in %s are not encrypted, run 'gmachine keys lock' to encrypt them", cfg.Filename())
+	}
+
+	if _, err := unlockKeys(cmd, cfg); err != nil {
+		return err
+	}
+	prompter := keys.NewPrompter(os.Stdin, cmd.ErrOrStderr())
+	passphrase, err := prompter.NewPassphrase("New passphrase: ")
+	if err != nil {
+		return err
+	}
+	if _, err = cfg.ChangePassphrase(passphrase); err != nil {
+		return err
+	}
+
+	// the cached key is for the old passphrase
+	if err := keys.AgentForget(keys.AgentSocket(cfg.Filename())); err != nil && !errors.Is(err, keys.ErrNoAgent) {
+		return err
+	}
+	cmd.Println("Changed the passphrase")
+	return nil
+}
+
+func keysMigrate(cmd *cobra.Command, _ []string) error {
+	to, err := cmd.Flags().GetString("to")
+	if err != nil {
+		return err
+	}
+	path, err := cmd.Flags().GetString("path")
+	if err != nil {
+		return err
+	}
+	command, err := cmd.Flags().GetString("command")
+	if err != nil {
+		return err
+	}
+
+	var settings *keystore.Settings
+	if to != "config" {
+		settings = &keystore.Settings{Type: to, Path: path, Command: strings.Fields(command)}
+		// check the settings before reading any keys
+		if _, err := keystore.New(*settings, ""); err != nil {
+			return err
+		}
+	} else if path != "" || command != "" {
+		return errors.New("--path and --command can not be used with '--to config'")
+	}
+
+	cfg, err := config.LoadFile(cfgFile)
+	if err != nil {
+		return err
+	}
+	n, err := cfg.MoveKeys(cmd.Context(), settings)
+	if errors.Is(err, config.ErrLocked) {
+		if _, err = unlockKeys(cmd, cfg); err != nil {
+			return err
+		}
+		n, err = cfg.MoveKeys(cmd.Context(), settings)
+	}
+	if err != nil {
+		return err
+	}
+	cmd.Printf("Moved %d CSEK keys to %s\n", n, to)
+	return nil
+}
+
+func keysRotate(cmd *cobra.Command, args []string) error {
+	name := args[0] // guaranteed not nil due to cobra.ExactArgs(1)
+
+	keepOldDisk, err := cmd.Flags().GetBool("keep-old-disk")
+	if err != nil {
+		return err
+	}
+	rsaCert, err := csekRSACert(cmd)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := config.LoadFile(cfgFile)
+	if err != nil {
+		return err
+	}
+	machine, err := cfg.Get(name)
+	if err != nil {
+		return err
+	}
+
+	rot, err := cfg.Rotation(name)
+	if err != nil {
+		return err
+	}
+	if rot != nil {
+		cmd.PrintErrf("Resuming the unfinished key rotation of %s at step '%s'\n", name, rot.Step)
+		if keepOldDisk != rot.KeepOldDisk && cmd.Flags().Changed("keep-old-disk") {
+			cmd.PrintErrf("Warning: --keep-old-disk is ignored when a rotation is resumed\n")
+		}
+		if rsaCert != nil {
+			cmd.PrintErrf("Warning: --csek-rsa-cert is ignored when a rotation is resumed\n")
+		}
+	}
+
+	rotator := &rotate.Rotator{
+		Backend: backend,
+		Journal: cfg,
+		Wait: func(_ context.Context, op *gcp.Operation, msg string) error {
+			return waitOperation(cmd, op, msg)
+		},
+		Now: time.Now,
+	}
+	opts := rotate.Options{KeepOldDisk: keepOldDisk, RSACert: rsaCert}
+	err = rotator.Rotate(cmd.Context(), machine.Ref(), opts)
+	if errors.Is(err, config.ErrLocked) {
+		if _, err = unlockKeys(cmd, cfg); err != nil {
+			return err
+		}
+		err = rotator.Rotate(cmd.Context(), machine.Ref(), opts)
+	}
+	if err != nil {
+		return err
+	}
+	cmd.Printf("Rotated the CSEK key of %s\n", name)
+	return nil
+}
+
+// csekRSACert returns the RSA certificate from the --csek-rsa-cert flag, or nil
+// if it is not set.
+func csekRSACert(cmd *cobra.Command) (*rsa.PublicKey, error) {
+	path, err := cmd.Flags().GetString("csek-rsa-cert")
+	if err != nil || path == "" {
+		return nil, err
+	}
+	return readPEM(path, gcp.ReadRSACert)
+}
+
+func keysAgent(cmd *cobra.Command, _ []string) error {
+	socket, err := cmd.Flags().GetString("socket")
+	if err != nil {
+		return err
+	}
+	ttl, err := cmd.Flags().GetDuration("ttl")
+	if err != nil {
+		return err
+	}
+	if socket == "" {
+		return errors.New("--socket is required")
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("error reading the key from stdin: %w", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(line))
+	if err != nil {
+		return fmt.Errorf("error reading the key from stdin: %w", err)
+	}
+	return keys.ServeAgent(cmd.Context(), socket, key, ttl)
+}
+
+// unlockKeys unlocks the config's CSEK keys with the key cached by 'keys unlock',
+// or by prompting for the passphrase, and returns the key.
+func unlockKeys(cmd *cobra.Command, cfg keyConfig) ([]byte, error) {
+	socket := keys.AgentSocket(cfg.Filename())
+	if key, err := keys.AgentKey(socket); err == nil {
+		if err = cfg.Unlock(key); err == nil {
+			return key, nil
+		}
+		// the passphrase was changed since the key was cached
+		keys.AgentForget(socket)
+	}
+
+	prompter := keys.NewPrompter(os.Stdin, cmd.ErrOrStderr())
+	passphrase, err := prompter.Passphrase(fmt.Sprintf("Enter the passphrase for the CSEK keys in %s: ", cfg.Filename()))
+	if err != nil {
+		return nil, err
+	}
+	key, err := cfg.PassphraseKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return key, cfg.Unlock(key)
+}
+
+// machineCSEK returns the decrypted CSEK keys of the machine 'name', unlocking
+// the keys if needed.
+func machineCSEK(cmd *cobra.Command, cfg keyConfig, name string) (gcp.CSEKBundle, error) {
+	// the boot disk may have either key until the rotation is finished
+	if rot, err := cfg.Rotation(name); err != nil || rot != nil {
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("the CSEK key of %s is being rotated, run 'gmachine keys rotate %s' to finish it first", name, name)
+	}
+	csek, err := cfg.CSEK(cmd.Context(), name)
+	if !errors.Is(err, config.ErrLocked) {
+		return csek, err
+	}
+	if _, err := unlockKeys(cmd, cfg); err != nil {
+		return nil, err
+	}
+	return cfg.CSEK(cmd.Context(), name)
+}
+
+// machineStartCSEK returns the CSEK keys to start the machine 'name' with, which
+// leaves out the keys of its detached data disks, see machineCSEK.
+func machineStartCSEK(cmd *cobra.Command, cfg keyConfig, name string) (gcp.CSEKBundle, error) {
+	if _, err := machineCSEK(cmd, cfg, name); err != nil {
+		return nil, err
+	}
+	return cfg.StartCSEK(cmd.Context(), name)
+}
+
+// startAgent starts a 'gmachine keys agent' process in the background that
+// caches 'key' on 'socket' for 'ttl'. The key is passed on a pipe rather than the
+// command line so that it is not visible to other users.
+func startAgent(socket string, key []byte, ttl time.Duration) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	agent := exec.Command(exe, "keys", "agent", "--config", cfgFile, "--backend", "gcloud", "--socket", socket, "--ttl", ttl.String())
+	agent.Stdin = r
+	// run in a new session so that the agent outlives the terminal
+	agent.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = agent.Start()
+	r.Close()
+	if err != nil {
+		return fmt.Errorf("error starting the keys agent: %w", err)
+	}
+	if _, err = fmt.Fprintln(w, base64.StdEncoding.EncodeToString(key)); err != nil {
+		return fmt.Errorf("error starting the keys agent: %w", err)
+	}
+	w.Close()
+	agent.Process.Release()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if _, err = keys.AgentKey(socket); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("the keys agent did not start: %w", err)
+}
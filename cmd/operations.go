@@ -0,0 +1,198 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/joemiller/gmachine/internal/config"
+	"github.com/joemiller/gmachine/internal/gcp"
+	"github.com/joemiller/gmachine/internal/indentor"
+	"github.com/joemiller/gmachine/internal/spinner"
+	"github.com/spf13/cobra"
+)
+
+// operationsCmd represents the operations command
+var operationsCmd = &cobra.Command{
+	Use:   "operations",
+	Short: "Wait for or list long-running operations",
+	Long:  "Wait for or list long-running operations",
+}
+
+// operationsWaitCmd represents the operations wait command
+var operationsWaitCmd = &cobra.Command{
+	Use:   "wait OPERATION",
+	Short: "Wait for an operation started with --async to complete",
+	Long:  "Wait for an operation started with --async to complete",
+	Example: indentor.Indent("  ", `
+# Stop the default machine without waiting, then wait for the stop to complete
+op=$(gmachine stop --async)
+gmachine operations wait $op
+
+# Wait for an operation on the machine named 'machine2'
+gmachine operations wait operation-1234 -m machine2
+
+# Wait for an operation on a machine that is no longer in the config file, eg: after 'delete --async'
+gmachine operations wait operation-1234 -p my-proj -z us-west1-a
+`),
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE:         operationsWait,
+}
+
+// operationsListCmd represents the operations list command
+var operationsListCmd = &cobra.Command{
+	Use:   "list [NAME]",
+	Short: "List recent operations on a machine",
+	Long:  "List recent operations on a machine",
+	Example: indentor.Indent("  ", `
+# List recent operations on the default machine
+gmachine operations list
+
+# List recent operations on the machine named 'machine2'
+gmachine operations list machine2
+`),
+	SilenceUsage: true,
+	RunE:         operationsList,
+}
+
+func init() {
+	operationsWaitCmd.Flags().StringP("machine", "m", "", "The machine the operation belongs to. Defaults to the default machine")
+	operationsWaitCmd.Flags().StringP("account", "a", "", "The Google Cloud account to use instead of the machine's account")
+	operationsWaitCmd.Flags().StringP("project", "p", "", "The Google Cloud project of the operation. Requires --zone, --machine is ignored")
+	operationsWaitCmd.Flags().StringP("zone", "z", "", "The Google Cloud zone of the operation. Requires --project, --machine is ignored")
+
+	operationsCmd.AddCommand(operationsWaitCmd)
+	operationsCmd.AddCommand(operationsListCmd)
+	rootCmd.AddCommand(operationsCmd)
+}
+
+func operationsWait(cmd *cobra.Command, args []string) error {
+	name, err := cmd.Flags().GetString("machine")
+	if err != nil {
+		return err
+	}
+	account, err := cmd.Flags().GetString("account")
+	if err != nil {
+		return err
+	}
+	project, err := cmd.Flags().GetString("project")
+	if err != nil {
+		return err
+	}
+	zone, err := cmd.Flags().GetString("zone")
+	if err != nil {
+		return err
+	}
+
+	if (project == "") != (zone == "") {
+		return errors.New("--project and --zone must be specified together")
+	}
+
+	ref := gcp.InstanceRef{Account: account, Project: project, Zone: zone}
+	if project == "" {
+		cfg, err := config.LoadFile(cfgFile)
+		if err != nil {
+			return err
+		}
+
+		if name == "" {
+			name = cfg.GetDefault()
+		}
+		if name == "" {
+			return errors.New("must specify machine with --machine or set a default machine with 'set-default'")
+		}
+
+		machine, err := cfg.Get(name)
+		if err != nil {
+			return err
+		}
+		ref = machine.Ref()
+		if account != "" {
+			ref.Account = account
+		}
+	}
+
+	op, err := backend.GetOperation(cmd.Context(), ref, args[0])
+	if err != nil {
+		return err
+	}
+	return waitOperation(cmd, op, fmt.Sprintf("Waiting for %s on %s", op.Type, op.Target))
+}
+
+func operationsList(cmd *cobra.Command, args []string) error {
+	cfg, err := config.LoadFile(cfgFile)
+	if err != nil {
+		return err
+	}
+
+	name := cfg.GetDefault()
+	if len(args) > 0 {
+		name = args[0]
+	}
+	if name == "" {
+		return errors.New("must specify machine or set a default machine with 'set-default'")
+	}
+
+	machine, err := cfg.Get(name)
+	if err != nil {
+		return err
+	}
+
+	ops, err := backend.ListOperations(cmd.Context(), machine.Ref())
+	if err != nil {
+		return err
+	}
+
+	table := tabwriter.NewWriter(cmd.OutOrStdout(), 5, 0, 2, ' ', 0)
+	print := func(values ...string) {
+		fmt.Fprintln(table, strings.Join(values, "\t"))
+	}
+	print("NAME", "TYPE", "STATUS", "START_TIME", "DURATION", "ERROR")
+	for _, op := range ops {
+		duration := ""
+		if op.Done() && !op.StartTime.IsZero() && !op.EndTime.IsZero() {
+			duration = op.EndTime.Sub(op.StartTime).Round(time.Second).String()
+		}
+		start := ""
+		if !op.StartTime.IsZero() {
+			start = op.StartTime.Local().Format(time.RFC3339)
+		}
+		print(op.Name, op.Type, op.Status, start, duration, op.Error)
+	}
+	return table.Flush()
+}
+
+// addAsyncFlag adds the --async flag to a command that starts an operation.
+func addAsyncFlag(cmd *cobra.Command) {
+	cmd.Flags().Bool("async", false, "Print the operation ID and return immediately instead of waiting for the operation to complete")
+}
+
+// waitOperation waits for the operation to complete while rendering a progress
+// indicator on stderr. If the command's --async flag is set the operation ID is
+// printed to stdout and waitOperation returns immediately.
+func waitOperation(cmd *cobra.Command, op *gcp.Operation, msg string) error {
+	if async, _ := cmd.Flags().GetBool("async"); async {
+		fmt.Fprintln(cmd.OutOrStdout(), op.Name)
+		waitCmd := fmt.Sprintf("gmachine operations wait %s -p %s -z %s", op.Name, op.Project, op.Zone)
+		if op.Account != "" {
+			waitCmd += " -a " + op.Account
+		}
+		cmd.PrintErrf("Started operation %s. Run '%s' to wait for it to complete\n", op.Name, waitCmd)
+		return nil
+	}
+
+	s := spinner.New(cmd.ErrOrStderr(), msg)
+	s.Start()
+	op, err := gcp.WaitOperation(cmd.Context(), backend, op, func(op *gcp.Operation) {
+		s.SetStatus(op.Status)
+	})
+	if err != nil {
+		s.Stop("failed")
+		return err
+	}
+	s.Stop("done")
+	return nil
+}
@@ -2,30 +2,47 @@ package cmd
 
 import (
 	"errors"
+	"fmt"
 
 	"github.com/joemiller/gmachine/internal/config"
 	"github.com/joemiller/gmachine/internal/gcp"
 	"github.com/joemiller/gmachine/internal/indentor"
 	"github.com/spf13/cobra"
+	"google.golang.org/api/compute/v1"
 )
 
 // printIPCmd represents the printIP command
 var printIPCmd = &cobra.Command{
 	Use:   "print-ip [NAME]",
 	Short: "Print a machine's public IP if it is RUNNING",
-	Long:  "Print a machine's public IP if it is RUNNING",
+	Long: `Print a machine's public IP if it is RUNNING.
+
+Machines created with --no-address have no public IP, use --internal to print
+their internal IP instead.
+
+--start, or the machine's saved auto_start setting, starts the machine first if
+it is stopped, or resumes it if it is suspended, and waits until ssh answers at
+the IP.`,
 	Example: indentor.Indent("  ", `
 # print public IP of the default machine
-gcloud print-ip
+gmachine print-ip
 
 # print public IP of a machine named 'machine2'
-gcloud print-ip machine2
+gmachine print-ip machine2
+
+# print internal IP of the default machine
+gmachine print-ip --internal
+
+# start the default machine if needed and print its public IP once ssh answers
+gmachine print-ip --start
 `),
 	SilenceUsage: true,
 	RunE:         printIP,
 }
 
 func init() {
+	printIPCmd.Flags().Bool("internal", false, "Print the internal IP instead of the public IP")
+	addStartFlags(printIPCmd)
 	rootCmd.AddCommand(printIPCmd)
 }
 
@@ -48,12 +65,37 @@ func printIP(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	return gcp.PrintIP(
-		cmd.OutOrStdout(),
-		cmd.OutOrStderr(),
-		name,
-		machine.Account,
-		machine.Project,
-		machine.Zone,
-	)
+	internal, err := cmd.Flags().GetBool("internal")
+	if err != nil {
+		return err
+	}
+	start, err := autoStart(cmd, machine.SSH)
+	if err != nil {
+		return err
+	}
+	if start {
+		err := startForConnect(cmd, cfg, machine.Ref(), true, func(instance compute.Instance) string {
+			if internal {
+				return internalIP(instance.NetworkInterfaces)
+			}
+			return externalIP(instance.NetworkInterfaces)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	instance, err := backend.DescribeInstance(cmd.Context(), machine.Ref())
+	if err != nil {
+		return err
+	}
+	if internal {
+		fmt.Fprintln(cmd.OutOrStdout(), internalIP(instance.NetworkInterfaces))
+		return nil
+	}
+	if !gcp.HasExternalAddress(instance) {
+		return fmt.Errorf("machine '%s' has no public IP, use --internal to print its internal IP", name)
+	}
+	fmt.Fprintln(cmd.OutOrStdout(), externalIP(instance.NetworkInterfaces))
+	return nil
 }
@@ -2,9 +2,9 @@ package cmd
 
 import (
 	"errors"
+	"fmt"
 
 	"github.com/joemiller/gmachine/internal/config"
-	"github.com/joemiller/gmachine/internal/gcp"
 	"github.com/joemiller/gmachine/internal/indentor"
 	"github.com/spf13/cobra"
 )
@@ -28,6 +28,7 @@ gmachine resize machine1 --type n2-custom-8-8192
 
 func init() {
 	resizeCmd.Flags().StringP("type", "t", "", "Resize the machine to the specified machine-type")
+	addAsyncFlag(resizeCmd)
 
 	rootCmd.AddCommand(resizeCmd)
 }
@@ -54,20 +55,9 @@ func resize(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	cmd.Printf("Resizing %s to %s...\n", machine.Name, size)
-	err = gcp.ResizeInstance(
-		cmd.OutOrStdout(),
-		cmd.OutOrStderr(),
-		machine.Name,
-		machine.Account,
-		machine.Project,
-		machine.Zone,
-		size,
-	)
+	op, err := backend.ResizeInstance(cmd.Context(), machine.Ref(), size)
 	if err != nil {
 		return err
 	}
-
-	cmd.Println("Success")
-	return nil
+	return waitOperation(cmd, op, fmt.Sprintf("Resizing %s to %s", machine.Name, size))
 }
@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"errors"
+	"fmt"
 
 	"github.com/joemiller/gmachine/internal/config"
 	"github.com/joemiller/gmachine/internal/gcp"
@@ -26,6 +27,7 @@ gcloud machine resume machine2
 }
 
 func init() {
+	addAsyncFlag(resumeCmd)
 	rootCmd.AddCommand(resumeCmd)
 }
 
@@ -48,13 +50,19 @@ func resume(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	return gcp.ResumeInstance(
-		cmd.OutOrStdout(),
-		cmd.OutOrStderr(),
-		name,
-		machine.Account,
-		machine.Project,
-		machine.Zone,
-		machine.CSEK,
-	)
+	csek, err := machineStartCSEK(cmd, cfg, machine.Name)
+	if err != nil {
+		return err
+	}
+
+	return resumeInstance(cmd, machine.Ref(), csek)
+}
+
+// resumeInstance resumes the suspended instance and waits for it to be RUNNING.
+func resumeInstance(cmd *cobra.Command, ref gcp.InstanceRef, csek gcp.CSEKBundle) error {
+	op, err := backend.ResumeInstance(cmd.Context(), ref, csek)
+	if err != nil {
+		return err
+	}
+	return waitOperation(cmd, op, fmt.Sprintf("Resuming %s", ref.Name))
 }
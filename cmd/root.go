@@ -1,10 +1,19 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/joemiller/gmachine/internal/config"
+	"github.com/joemiller/gmachine/internal/gcp"
+	"github.com/joemiller/gmachine/internal/logging"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -13,7 +22,22 @@ var (
 	version = "development"
 	verbose = false
 
-	cfgFile string
+	cfgFile     string
+	backendName = "gcloud"
+	timeout     time.Duration
+	dryRun      bool
+	logFormat   = "text"
+	logFile     string
+
+	// logOut is the --log-file, closed once the command returns.
+	logOut io.WriteCloser
+
+	// cancelTimeout releases the --timeout context once the command returns.
+	cancelTimeout context.CancelFunc = func() {}
+
+	// backend is the gcp.Backend selected with --backend. It is initialized before
+	// any command runs.
+	backend gcp.Backend
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -21,6 +45,14 @@ var rootCmd = &cobra.Command{
 	Use:   "gmachine",
 	Short: "Manage cloud machines on Google Cloud Platform",
 	Long:  "Manage cloud machines on Google Cloud Platform",
+
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := setupLogging(cmd); err != nil {
+			return err
+		}
+		setupTimeout(cmd)
+		return setupBackend(cmd, args)
+	},
 }
 
 var versionCmd = &cobra.Command{
@@ -31,11 +63,85 @@ var versionCmd = &cobra.Command{
 	},
 }
 
+// Execute runs the root command and exits with a code from exitcode.go if it fails.
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
+	ctx, cancel := interruptContext()
+	defer cancel(nil)
+
+	err := rootCmd.ExecuteContext(ctx)
+	cancelTimeout()
+	if err != nil {
+		// cobra has already printed the error, this is for --log-file
+		slog.Debug("command failed", "error", err, "exit_code", exitCode(err))
+	}
+	if logOut != nil {
+		logOut.Close()
+	}
+	if err != nil {
 		// fmt.Println(err)
-		os.Exit(1)
+		os.Exit(exitCode(err))
+	}
+}
+
+// errInterrupted is the cause of the command's context being canceled by SIGINT.
+var errInterrupted = fmt.Errorf("interrupted: %w", context.Canceled)
+
+// interruptContext returns a context that is canceled with errInterrupted on the
+// first SIGINT. Child processes such as gcloud are sent SIGINT when the context is
+// canceled. A second SIGINT terminates gmachine immediately.
+func interruptContext() (context.Context, context.CancelCauseFunc) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt)
+	go func() {
+		select {
+		case <-sigCh:
+			cancel(errInterrupted)
+		case <-ctx.Done():
+		}
+		signal.Stop(sigCh)
+	}()
+	return ctx, cancel
+}
+
+// setupLogging installs the default slog logger. Logs are written to stderr, or
+// the --log-file, at debug level with --verbose or --log-file and only warnings
+// and errors otherwise.
+func setupLogging(cmd *cobra.Command) error {
+	var w io.Writer = cmd.ErrOrStderr()
+	level := slog.LevelWarn
+	if verbose {
+		level = slog.LevelDebug
+	}
+	if logFile != "" {
+		f, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return fmt.Errorf("error opening log file: %w", err)
+		}
+		logOut = f
+		w = f
+		level = slog.LevelDebug
+	}
+
+	logger, err := logging.New(w, logFormat, level)
+	if err != nil {
+		return err
 	}
+	slog.SetDefault(logger)
+	slog.Debug("starting", "version", version, "command", cmd.CommandPath(), "args", os.Args[1:], "backend", backendName)
+	return nil
+}
+
+// setupTimeout applies the --timeout flag to the command's context.
+func setupTimeout(cmd *cobra.Command) {
+	if timeout <= 0 {
+		return
+	}
+	cause := fmt.Errorf("timed out after %s: %w", timeout, context.DeadlineExceeded)
+	ctx, cancel := context.WithTimeoutCause(cmd.Context(), timeout, cause)
+	cmd.SetContext(ctx)
+	cancelTimeout = cancel
 }
 
 func init() {
@@ -50,8 +156,106 @@ func init() {
 		cfgFile = v
 	}
 
+	if v := viper.GetString("GMACHINE_BACKEND"); v != "" {
+		backendName = v
+	}
+
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", cfgFile, "Config file")
-	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "Enable verbose logging")
+	rootCmd.PersistentFlags().StringVar(&backendName, "backend", backendName, "How to talk to Google Cloud: 'gcloud' (run the gcloud cli), 'api' (call the Compute API directly) or 'fake' (simulated, for testing)")
+	rootCmd.PersistentFlags().DurationVar(&timeout, "timeout", 0, "Maximum time to wait for the command to complete, eg: 30s, 5m. Commands that wait for an operation stop waiting, the operation itself is not canceled. 0 means no timeout")
+	rootCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "Print the gcloud commands or API requests that would change anything, and any changes to the config file, instead of running them. Read-only calls are still made")
+	rootCmd.PersistentFlags().Int("retries", gcp.DefaultRetryPolicy.Retries, "Number of times to retry transient Google Cloud errors such as rate limits. Overrides 'retry.retries' in the config file")
+	rootCmd.PersistentFlags().Duration("retry-initial-delay", gcp.DefaultRetryPolicy.InitialDelay, "Delay before the first retry, doubled for each retry. Overrides 'retry.initial_delay' in the config file")
+	rootCmd.PersistentFlags().Duration("retry-max-delay", gcp.DefaultRetryPolicy.MaxDelay, "Maximum delay between retries. Overrides 'retry.max_delay' in the config file")
+	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "Enable verbose logging: every gcloud command and API request, config changes and retries")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", logFormat, "Log format: 'text' or 'json'")
+	rootCmd.PersistentFlags().StringVar(&logFile, "log-file", "", "Append verbose logs to this file instead of stderr, eg: to attach to a bug report. Implies --verbose")
 
 	rootCmd.AddCommand(versionCmd)
 }
+
+// setupBackend initializes the gcp.Backend selected with the --backend flag. The
+// backend retries transient errors using the retry policy from the config file
+// and --retry* flags. With --dry-run, the backend and the config package print
+// changes to stdout instead of making them.
+//
+// The fake backend stores its state in the file set by GMACHINE_FAKE_STATE, or
+// next to the config file by default. GMACHINE_FAKE_DELAY sets how long the fake's
+// transitional states (eg: STOPPING) last and GMACHINE_FAKE_LATENCY how long each
+// call takes. GMACHINE_FAKE_EXHAUSTED_ZONES is a comma separated list of zones
+// without capacity to create or start instances in.
+func setupBackend(cmd *cobra.Command, args []string) error {
+	var dryRunOut io.Writer
+	if dryRun {
+		dryRunOut = cmd.OutOrStdout()
+		config.DryRun = dryRunOut
+	}
+
+	switch backendName {
+	case "gcloud":
+		gcloud := gcp.NewGcloud(os.Stdout, os.Stderr)
+		gcloud.DryRun = dryRunOut
+		backend = gcloud
+	case "api":
+		var api *gcp.API
+		var err error
+		if dryRun {
+			api, err = gcp.NewDryRunAPI(cmd.Context(), dryRunOut)
+		} else {
+			api, err = gcp.NewAPI(cmd.Context())
+		}
+		if err != nil {
+			return err
+		}
+		backend = api
+	case "fake":
+		stateFile := filepath.Join(filepath.Dir(cfgFile), "fake-backend.json")
+		if v := viper.GetString("GMACHINE_FAKE_STATE"); v != "" {
+			stateFile = v
+		}
+		delay := viper.GetDuration("GMACHINE_FAKE_DELAY")
+		fake := gcp.NewFake(stateFile, delay, cmd.OutOrStdout())
+		fake.Latency = viper.GetDuration("GMACHINE_FAKE_LATENCY")
+		if v := viper.GetString("GMACHINE_FAKE_EXHAUSTED_ZONES"); v != "" {
+			fake.ExhaustedZones = strings.Split(v, ",")
+		}
+		fake.DryRun = dryRunOut
+		backend = fake
+	default:
+		return fmt.Errorf("unknown backend '%s', must be one of: gcloud, api, fake", backendName)
+	}
+
+	policy, err := retryPolicy(cmd)
+	if err != nil {
+		return err
+	}
+	backend = gcp.NewRetrying(backend, policy)
+	return nil
+}
+
+// retryPolicy returns the retry policy from the config file with any --retry*
+// flags applied.
+func retryPolicy(cmd *cobra.Command) (gcp.RetryPolicy, error) {
+	// the hook runs before every command, including ones that do not use the
+	// config file such as 'version', so it is only read
+	policy := config.LoadRetryPolicy(cfgFile)
+
+	var err error
+	flags := cmd.Flags()
+	if flags.Changed("retries") {
+		if policy.Retries, err = flags.GetInt("retries"); err != nil {
+			return policy, err
+		}
+	}
+	if flags.Changed("retry-initial-delay") {
+		if policy.InitialDelay, err = flags.GetDuration("retry-initial-delay"); err != nil {
+			return policy, err
+		}
+	}
+	if flags.Changed("retry-max-delay") {
+		if policy.MaxDelay, err = flags.GetDuration("retry-max-delay"); err != nil {
+			return policy, err
+		}
+	}
+	return policy, nil
+}
@@ -0,0 +1,217 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/joemiller/gmachine/internal/config"
+	"github.com/joemiller/gmachine/internal/fileutil"
+	"github.com/joemiller/gmachine/internal/indentor"
+	"github.com/joemiller/gmachine/internal/sshclient"
+	"github.com/spf13/cobra"
+)
+
+// sshConfigHeader starts the managed ssh_config Include file.
+const sshConfigHeader = "# Generated by 'gmachine ssh-config --write', do not edit. It is regenerated when\n# machines are created, deleted or started.\n"
+
+// sshConfigCmd represents the ssh-config command
+var sshConfigCmd = &cobra.Command{
+	Use:   "ssh-config",
+	Short: "Print ssh_config Host blocks for the machines in the config file",
+	Long: `Print ssh_config Host blocks for the machines in the config file, so that
+'ssh NAME' and tools that use ssh, eg: rsync, git or VS Code Remote, connect to
+them.
+
+Hosts connect as set by 'gmachine ssh --save-mode', with the machine's key managed
+by gmachine, see 'gmachine ssh --native'. Their ProxyCommand calls back into
+gmachine to add the key and find the machine's current address, so the Host
+blocks do not change when a machine's address does. Machines that enable OS Login
+in their metadata must save --os-login. They connect as the OS Login user that
+was recorded when 'gmachine ssh' or the ProxyCommand last added the key, so
+connect to them with 'gmachine ssh' once first.
+
+With --write the Host blocks are written to the 'config' file in the 'ssh'
+directory next to the config file instead, and rewritten whenever a machine is
+created, deleted or started. Include it from ~/.ssh/config.`,
+	Example: indentor.Indent("  ", `
+# print the Host blocks
+gmachine ssh-config
+
+# write the managed Include file, then include it from ~/.ssh/config
+gmachine ssh-config --write
+	`),
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE:         sshConfig,
+}
+
+// sshProxyCmd is the ProxyCommand of the Host blocks written by ssh-config.
+var sshProxyCmd = &cobra.Command{
+	Use:          "ssh-proxy NAME",
+	Short:        "Connect stdin and stdout to a machine's ssh port, for ssh's ProxyCommand",
+	Hidden:       true,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE:         sshProxy,
+}
+
+func init() {
+	sshConfigCmd.Flags().Bool("write", false, "Write the Host blocks to the managed Include file instead of printing them")
+	rootCmd.AddCommand(sshConfigCmd)
+	addStartFlags(sshProxyCmd)
+	rootCmd.AddCommand(sshProxyCmd)
+}
+
+func sshConfig(cmd *cobra.Command, _ []string) error {
+	write, err := cmd.Flags().GetBool("write")
+	if err != nil {
+		return err
+	}
+	hosts, err := sshConfigHosts()
+	if err != nil {
+		return err
+	}
+	if !write {
+		cmd.Print(hosts)
+		return nil
+	}
+
+	file := sshConfigFile()
+	if dryRun {
+		cmd.Printf("[dry-run] write %s:\n%s", file, hosts)
+		return nil
+	}
+	if err := writeSSHConfig(hosts); err != nil {
+		return err
+	}
+	cmd.Printf("Wrote %s, include it from ~/.ssh/config with:\n\n  Include %q\n", file, file)
+	return nil
+}
+
+// sshConfigFile returns the path of the managed ssh_config Include file.
+func sshConfigFile() string {
+	return filepath.Join(sshDir(), "config")
+}
+
+// sshConfigHosts returns the ssh_config Host blocks of all machines in the config
+// file. Their ProxyCommand runs 'gmachine ssh-proxy' with the same config file
+// and backend, which adds the machine's key when connecting, so the blocks are
+// rendered without calling Google Cloud. Machines that use OS Login connect as
+// the user recorded when their key was last added, see setOSLoginUser.
+func sshConfigHosts() (string, error) {
+	cfg, err := config.LoadFile(cfgFile)
+	if err != nil {
+		return "", err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	localUser, err := localUsername()
+	if err != nil {
+		return "", err
+	}
+	blocks := []string{}
+	for _, m := range cfg.Machines {
+		target, _, err := managedTarget(m.Name, m.HostKeys)
+		if err != nil {
+			return "", err
+		}
+		target.User = localUser
+		if m.SSH != nil && m.SSH.OSLogin {
+			// unknown until the key is added, ssh-proxy then rewrites the file
+			target.User = m.OSLoginUser
+		}
+		target.Host = m.Name
+		target.ProxyCommand = sshclient.ShellJoin([]string{exe, "--config", cfgFile, "--backend", backendName, "ssh-proxy", m.Name})
+		blocks = append(blocks, target.ConfigHost(m.Name))
+	}
+	return sshConfigHeader + "\n" + strings.Join(blocks, "\n"), nil
+}
+
+// writeSSHConfig writes the managed ssh_config Include file.
+func writeSSHConfig(hosts string) error {
+	if err := os.MkdirAll(sshDir(), 0o700); err != nil {
+		return err
+	}
+	return fileutil.WriteFileAtomic(sshConfigFile(), []byte(hosts), 0o600)
+}
+
+// refreshSSHFiles rewrites the managed known_hosts file, and the managed
+// ssh_config Include file if it was written with 'ssh-config --write', after
+// machines were created, deleted or started. Errors are printed as warnings since
+// the machines were changed regardless.
+func refreshSSHFiles(cmd *cobra.Command) {
+	if dryRun {
+		return
+	}
+	if err := writeKnownHosts(); err != nil {
+		cmd.PrintErrf("Warning: failed updating %s: %s\n", knownHostsFile(), err)
+	}
+	if err := rewriteSSHConfig(); err != nil {
+		cmd.PrintErrf("Warning: failed updating %s: %s\n", sshConfigFile(), err)
+	}
+}
+
+// rewriteSSHConfig rewrites the managed ssh_config Include file if it was written
+// with 'ssh-config --write'.
+func rewriteSSHConfig() error {
+	if _, err := os.Stat(sshConfigFile()); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	hosts, err := sshConfigHosts()
+	if err != nil {
+		return err
+	}
+	return writeSSHConfig(hosts)
+}
+
+func sshProxy(cmd *cobra.Command, args []string) error {
+	cfg, err := config.LoadFile(cfgFile)
+	if err != nil {
+		return err
+	}
+	machine, err := cfg.Get(args[0])
+	if err != nil {
+		return err
+	}
+
+	var settings config.SSH
+	if machine.SSH != nil {
+		settings = *machine.SSH
+	}
+	native := nativeMachine{ref: machine.Ref(), mode: settings.Mode, osLogin: settings.OSLogin, hostKeys: machine.HostKeys}
+	if settings.JumpHost != "" {
+		jump, err := cfg.Get(settings.JumpHost)
+		if err != nil {
+			return fmt.Errorf("jump host '%s': %w", settings.JumpHost, err)
+		}
+		native.jump = &nativeMachine{ref: jump.Ref(), osLogin: jump.SSH != nil && jump.SSH.OSLogin, hostKeys: jump.HostKeys}
+	}
+	start, err := autoStart(cmd, machine.SSH)
+	if err != nil {
+		return err
+	}
+	if start {
+		// stdin is ssh's connection, locked keys cannot be prompted for
+		if err := startForSSH(cmd, cfg, native, false); err != nil {
+			return err
+		}
+	}
+	target, err := nativeTarget(cmd.Context(), native)
+	if err != nil {
+		return err
+	}
+	if target.ProxyCommand == "" {
+		return sshclient.Proxy(cmd.Context(), net.JoinHostPort(target.Host, "22"), cmd.InOrStdin(), cmd.OutOrStdout())
+	}
+	// run the IAP tunnel or jump host's ssh in place of gmachine, ssh's tokens
+	// are replaced like ssh does
+	proxy := strings.NewReplacer("%h", target.Host, "%p", "22").Replace(target.ProxyCommand)
+	return sshclient.Exec(cmd.Context(), []string{"sh", "-c", proxy})
+}
@@ -1,25 +1,73 @@
 package cmd
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"os/user"
+	"path/filepath"
+	"strings"
 
 	"github.com/joemiller/gmachine/internal/config"
 	"github.com/joemiller/gmachine/internal/gcp"
 	"github.com/joemiller/gmachine/internal/indentor"
+	"github.com/joemiller/gmachine/internal/sshclient"
 	"github.com/spf13/cobra"
+	"google.golang.org/api/compute/v1"
 )
 
 // sshCmd represents the ssh command
 var sshCmd = &cobra.Command{
 	Use:   "ssh [NAME]",
-	Short: "Spawn 'gcloud compute ssh' to connect to a machine",
-	Long:  "Spawn 'gcloud compute ssh' to connect to a machine",
+	Short: "Connect to a machine with 'gcloud compute ssh' or the system ssh client",
+	Long: `Connect to a machine with 'gcloud compute ssh', or with the system ssh client
+and a key managed by gmachine with --native.
+
+Machines created with --no-address have no public IP, gcloud connects to them
+through an IAP tunnel. The network needs a firewall rule allowing ingress from
+35.235.240.0/20 on port 22.
+
+--tunnel-through-iap always tunnels through IAP, --internal-ip connects to the
+machine's internal IP, eg: over a VPN, and --jump-host connects to its internal
+IP through another machine in the config file. With --save-mode these flags are
+saved as the machine's default connection mode, which is used when none of them
+are set.
+
+--native connects with the system ssh client instead of gcloud. gmachine
+generates a key pair for the machine and adds it to the machine's ssh-keys
+metadata, or to the OS Login profile of the machine's account if the machine
+enables OS Login or --os-login is set. Keys and the known_hosts file that host
+keys are pinned in are kept in the 'ssh' directory next to the config file.
+Jump hosts are reached at their external IP, or through IAP if they have none.
+
+Host keys are pinned when a machine that enables guest attributes is created or
+started, other host keys are then refused. Host keys of other machines are
+trusted the first time they are seen. --native checks host keys against that
+known_hosts file, gcloud against its own, ~/.ssh/google_compute_known_hosts,
+which the pinned host keys of the machine and its jump host are written to
+before connecting.
+
+--start, or the machine's saved auto_start setting, starts the machine first if
+it is stopped, or resumes it if it is suspended, and waits until it is RUNNING
+and ssh answers, within --start-timeout.`,
 	Example: indentor.Indent("  ", `
 # open a shell via ssh on the default machine
 gmachine ssh
 
 # open a shell via ssh on the machine named 'machine2'
 gmachine ssh machine2
+
+# connect to 'machine2' through the machine 'bastion', and do so by default from now on
+gmachine ssh machine2 --jump-host bastion --save-mode
+
+# connect to 'machine2' with its default connection mode again
+gmachine ssh machine2 --save-mode
+
+# connect with the system ssh client and a key managed by gmachine, and do so by default from now on
+gmachine ssh machine2 --native --save-mode
+
+# start 'machine2' if it is stopped or suspended before connecting, and do so by default from now on
+gmachine ssh machine2 --start --save-mode
 	`),
 	SilenceUsage: true,
 	RunE:         ssh,
@@ -28,8 +76,15 @@ gmachine ssh machine2
 func init() {
 	rootCmd.AddCommand(sshCmd)
 
-	sshCmd.Flags().String("ssh-args", "", "Additional ssh args to pass to ssh (example '-A -C'). Overrides default_ssh_args from config file if set.'")
+	sshCmd.Flags().String("ssh-args", "", "Additional ssh args to pass to ssh (example '-A -C'). Overrides ssh_args from config file if set.'")
 	sshCmd.Flags().BoolP("agent-forward", "A", false, "Enable SSH Agent forwarding")
+	sshCmd.Flags().Bool("tunnel-through-iap", false, "Connect through an IAP tunnel, even if the machine has a public IP")
+	sshCmd.Flags().Bool("internal-ip", false, "Connect to the machine's internal IP, eg: over a VPN")
+	sshCmd.Flags().String("jump-host", "", "Connect to the machine's internal IP through another machine in the config file")
+	sshCmd.Flags().Bool("native", false, "Connect with the system ssh client and a key managed by gmachine instead of 'gcloud compute ssh'")
+	sshCmd.Flags().Bool("os-login", false, "With --native, add the key to the OS Login profile of the machine's account instead of the machine's metadata")
+	sshCmd.Flags().Bool("save-mode", false, "Save the connection mode flags (--tunnel-through-iap, --internal-ip, --jump-host, --native, --os-login, or none for the default) as the machine's default, and --start as its auto_start setting")
+	addStartFlags(sshCmd)
 }
 
 func ssh(cmd *cobra.Command, args []string) error {
@@ -51,19 +106,270 @@ func ssh(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	sshArgs := machine.DefaultSSHArgs
+	sshArgs := append([]string{}, machine.SSHArgs...)
 	if args, err := cmd.Flags().GetString("ssh-args"); err == nil && args != "" {
-		sshArgs = args
+		sshArgs = strings.Fields(args)
 	}
 
 	if forward, _ := cmd.Flags().GetBool("agent-forward"); forward {
-		sshArgs = sshArgs + " -A"
+		sshArgs = append(sshArgs, "-A")
+	}
+
+	saved := machine.SSH
+	save, _ := cmd.Flags().GetBool("save-mode")
+	if save {
+		// --save-mode without connection mode flags saves the default
+		saved = nil
+	}
+	settings, err := sshSettings(cmd, saved)
+	if err != nil {
+		return err
+	}
+	// auto_start is kept unless --start is set, whatever the connection mode
+	if settings.AutoStart, err = autoStart(cmd, machine.SSH); err != nil {
+		return err
+	}
+	if save {
+		if err := cfg.SetSSH(name, settings); err != nil {
+			return err
+		}
+	}
+	opts := gcp.SSHOptions{Mode: settings.Mode, Args: sshArgs, HostKeys: machine.HostKeys}
+	native := nativeMachine{ref: machine.Ref(), mode: settings.Mode, osLogin: settings.OSLogin, hostKeys: machine.HostKeys}
+	if settings.JumpHost != "" {
+		jump, err := cfg.Get(settings.JumpHost)
+		if err != nil {
+			return fmt.Errorf("jump host '%s': %w", settings.JumpHost, err)
+		}
+		ref := jump.Ref()
+		opts.JumpHost = &ref
+		opts.JumpHostKeys = jump.HostKeys
+		native.jump = &nativeMachine{ref: ref, osLogin: jump.SSH != nil && jump.SSH.OSLogin, hostKeys: jump.HostKeys}
+	}
+	if settings.AutoStart {
+		if err := startForSSH(cmd, cfg, native, true); err != nil {
+			return err
+		}
+	}
+	if !settings.Native {
+		return backend.SSHInstance(cmd.Context(), machine.Ref(), opts)
+	}
+
+	target, err := nativeTarget(cmd.Context(), native)
+	if err != nil {
+		return err
+	}
+	command := target.Args(sshArgs...)
+	if dryRun {
+		// the key may not have been added, print the command instead
+		fmt.Fprintf(cmd.OutOrStdout(), "[dry-run] %s\n", sshclient.ShellJoin(command))
+		return nil
+	}
+	return sshclient.Exec(cmd.Context(), command)
+}
+
+// sshDir returns the directory of the keys and known_hosts file of native ssh,
+// next to the config file.
+func sshDir() string {
+	return filepath.Join(filepath.Dir(cfgFile), "ssh")
+}
+
+// managedTarget returns the parts of the target of the machine 'name' that
+// gmachine manages: its key, generated the first time, and the known_hosts file
+// its host keys are pinned in, if 'hostKeys' has any, see writeKnownHosts.
+func managedTarget(name string, hostKeys []string) (sshclient.Target, sshclient.Key, error) {
+	key, err := sshclient.LoadOrCreateKey(sshDir(), "id_ed25519_"+name, "gmachine-"+name)
+	target := sshclient.Target{
+		IdentityFile:   key.File,
+		KnownHostsFile: knownHostsFile(),
+		HostKeyAlias:   hostKeyAlias(name),
+		Pinned:         len(hostKeys) > 0,
+	}
+	return target, key, err
+}
+
+// knownHostsFile returns the path of the managed known_hosts file.
+func knownHostsFile() string {
+	return filepath.Join(sshDir(), "known_hosts")
+}
+
+// hostKeyAlias returns the alias the host keys of the machine 'name' are kept
+// under in the managed known_hosts file, so that they do not depend on the
+// machine's address.
+func hostKeyAlias(name string) string {
+	return "gmachine-" + name
+}
+
+// nativeMachine is what connecting to a machine with native ssh needs from the
+// config file.
+type nativeMachine struct {
+	ref gcp.InstanceRef
+	// mode is gcp.SSHModeIAP, gcp.SSHModeInternalIP or "", see gcp.SSHOptions
+	mode     string
+	osLogin  bool
+	hostKeys []string
+	// jump is the jump host, if any
+	jump *nativeMachine
+}
+
+// nativeTarget returns how to connect to the machine with the system ssh client
+// after adding the machine's managed key to it, see addNativeKey. The instance,
+// and the jump host if there is one, must be RUNNING. Jump hosts are connected to
+// at their external IP, or through IAP if they have none.
+func nativeTarget(ctx context.Context, m nativeMachine) (sshclient.Target, error) {
+	opts := gcp.SSHOptions{Mode: m.mode}
+	if m.jump != nil {
+		opts.JumpHost = &m.jump.ref
+	}
+	if err := opts.Validate(); err != nil {
+		return sshclient.Target{}, err
+	}
+	ref := m.ref
+	target, key, err := managedTarget(ref.Name, m.hostKeys)
+	if err != nil {
+		return target, err
 	}
+	instance, err := backend.DescribeInstance(ctx, ref)
+	if err != nil {
+		return target, err
+	}
+	if instance.Status != "RUNNING" {
+		return target, fmt.Errorf("machine '%s' is %s, it must be RUNNING to connect", ref.Name, instance.Status)
+	}
+	if target.User, err = addNativeKey(ctx, ref, instance, key, m.osLogin); err != nil {
+		return target, err
+	}
+
+	target.Host = internalIP(instance.NetworkInterfaces)
+	switch {
+	case m.jump != nil:
+		jump, err := nativeTarget(ctx, nativeMachine{ref: m.jump.ref, osLogin: m.jump.osLogin, hostKeys: m.jump.hostKeys})
+		if err != nil {
+			return target, fmt.Errorf("jump host '%s': %w", m.jump.ref.Name, err)
+		}
+		target.ProxyCommand = sshclient.ShellJoin(jump.Args("-W", "%h:%p"))
+	case m.mode == gcp.SSHModeInternalIP:
+	case m.mode == gcp.SSHModeIAP || externalIP(instance.NetworkInterfaces) == "":
+		// like gcloud, without an external IP ssh tunnels through IAP
+		target.ProxyCommand = sshclient.ShellJoin(gcp.IAPTunnelCommand(ref))
+	default:
+		target.Host = externalIP(instance.NetworkInterfaces)
+	}
+	return target, nil
+}
+
+// addNativeKey adds the machine's managed key to the OS Login profile of the
+// machine's account if 'osLogin' is set or the instance enables OS Login, or else
+// to the instance's ssh-keys metadata for the local user. It returns the user to
+// connect as.
+func addNativeKey(ctx context.Context, ref gcp.InstanceRef, instance compute.Instance, key sshclient.Key, osLogin bool) (string, error) {
+	osLogin = osLogin || gcp.OSLoginEnabled(instance)
+	user, err := nativeUser(ctx, ref, key, osLogin)
+	if err != nil || osLogin {
+		return user, err
+	}
+	return user, gcp.AddSSHKey(ctx, backend, ref, user, key.PublicKey)
+}
+
+// nativeUser returns the user to connect to the machine as with its managed key:
+// the POSIX username of the OS Login profile of the machine's account, which the
+// key is added to, if 'osLogin' is set, or else the local user.
+func nativeUser(ctx context.Context, ref gcp.InstanceRef, key sshclient.Key, osLogin bool) (string, error) {
+	if !osLogin {
+		return localUsername()
+	}
+	user, err := backend.ImportOSLoginKey(ctx, ref.Account, key.PublicKey)
+	if err != nil || dryRun {
+		return user, err
+	}
+	return user, setOSLoginUser(ref.Name, user)
+}
+
+// setOSLoginUser records the OS Login user of the machine 'name' in the config
+// file if it changed, and rewrites the managed ssh_config Include file, which
+// connects as that user.
+func setOSLoginUser(name, user string) error {
+	cfg, err := config.LoadFile(cfgFile)
+	if err != nil {
+		return err
+	}
+	m, err := cfg.Get(name)
+	if err != nil || m.OSLoginUser == user {
+		return err
+	}
+	if err := cfg.SetOSLoginUser(name, user); err != nil {
+		return err
+	}
+	return rewriteSSHConfig()
+}
 
-	return gcp.SSHInstance(name,
-		machine.Account,
-		machine.Project,
-		machine.Zone,
-		sshArgs,
-	)
+// localUsername returns the local user's name as a valid Linux username, like
+// gcloud: lowercase, without a Windows domain, and with other characters than
+// letters, numbers, '_' and '-' removed.
+func localUsername() (string, error) {
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	name := strings.ToLower(u.Username)
+	if i := strings.LastIndex(name, "\\"); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return -1
+	}, name)
+	if name == "" {
+		return "", fmt.Errorf("local username '%s' is not a valid username", u.Username)
+	}
+	return name, nil
+}
+
+// sshSettings returns how to connect to a machine: from the connection mode
+// flags if any are set, or else the machine's saved settings.
+func sshSettings(cmd *cobra.Command, saved *config.SSH) (config.SSH, error) {
+	var settings config.SSH
+	changed := false
+	for _, flag := range []string{"tunnel-through-iap", "internal-ip", "jump-host", "native", "os-login"} {
+		changed = changed || cmd.Flags().Changed(flag)
+	}
+	if !changed {
+		if saved != nil {
+			settings = *saved
+		}
+		return settings, nil
+	}
+
+	iap, err := cmd.Flags().GetBool("tunnel-through-iap")
+	if err != nil {
+		return settings, err
+	}
+	internalIP, err := cmd.Flags().GetBool("internal-ip")
+	if err != nil {
+		return settings, err
+	}
+	if settings.JumpHost, err = cmd.Flags().GetString("jump-host"); err != nil {
+		return settings, err
+	}
+	if settings.Native, err = cmd.Flags().GetBool("native"); err != nil {
+		return settings, err
+	}
+	if settings.OSLogin, err = cmd.Flags().GetBool("os-login"); err != nil {
+		return settings, err
+	}
+	switch {
+	case settings.OSLogin && !settings.Native:
+		return settings, errors.New("--os-login requires --native")
+	case iap && internalIP:
+		return settings, errors.New("cannot specify both --tunnel-through-iap and --internal-ip")
+	case iap && settings.JumpHost != "":
+		return settings, errors.New("cannot specify both --tunnel-through-iap and --jump-host")
+	case iap:
+		settings.Mode = gcp.SSHModeIAP
+	case internalIP:
+		settings.Mode = gcp.SSHModeInternalIP
+	}
+	return settings, nil
 }
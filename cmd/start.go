@@ -2,10 +2,13 @@ package cmd
 
 import (
 	"errors"
+	"fmt"
+	"strings"
 
 	"github.com/joemiller/gmachine/internal/config"
 	"github.com/joemiller/gmachine/internal/gcp"
 	"github.com/joemiller/gmachine/internal/indentor"
+	"github.com/joemiller/gmachine/internal/spinner"
 	"github.com/spf13/cobra"
 )
 
@@ -13,19 +16,29 @@ import (
 var startCmd = &cobra.Command{
 	Use:   "start [NAME]",
 	Short: "Start a stopped cloud machine",
-	Long:  "Start a stopped cloud machine",
+	Long: `Start a stopped cloud machine.
+
+With --retry-preempted, if the machine's zone does not have the capacity to
+start it, eg: after a Spot machine was preempted, the machine and its disks are
+moved to each of the other zones in the region in turn until it starts. Machines
+with CSEK keys cannot be moved.`,
 	Example: indentor.Indent("  ", `
 # Start the default machine
 gmachine start
 
 # Start a machine named 'machine2'
 gmachine start machine2
+
+# Start a preempted Spot machine, in another zone of the region if its zone has no capacity
+gmachine start machine2 --retry-preempted
 `),
 	SilenceUsage: true,
 	RunE:         start,
 }
 
 func init() {
+	startCmd.Flags().Bool("retry-preempted", false, "If the zone has no capacity to start the machine, move it to the other zones in the region until it starts")
+	addAsyncFlag(startCmd)
 	rootCmd.AddCommand(startCmd)
 }
 
@@ -48,13 +61,83 @@ func start(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	return gcp.StartInstance(
-		cmd.OutOrStdout(),
-		cmd.OutOrStderr(),
-		name,
-		machine.Account,
-		machine.Project,
-		machine.Zone,
-		machine.CSEK,
-	)
+	csek, err := machineStartCSEK(cmd, cfg, machine.Name)
+	if err != nil {
+		return err
+	}
+
+	retry, err := cmd.Flags().GetBool("retry-preempted")
+	if err != nil {
+		return err
+	}
+	if async, _ := cmd.Flags().GetBool("async"); async && retry {
+		return errors.New("--retry-preempted cannot be used with --async")
+	}
+
+	err = startInstance(cmd, machine.Ref(), csek)
+	if !retry || !errors.Is(err, gcp.ErrZoneResourceExhausted) {
+		return err
+	}
+	return startInOtherZones(cmd, cfg, machine.Ref(), csek)
+}
+
+// zoneConfig records the zone of a machine that was moved, see config.SetZone.
+type zoneConfig interface {
+	SetZone(name, zone string) error
+}
+
+// startInstance starts the instance and waits for it to be RUNNING.
+func startInstance(cmd *cobra.Command, ref gcp.InstanceRef, csek gcp.CSEKBundle) error {
+	op, err := backend.StartInstance(cmd.Context(), ref, csek)
+	if err != nil {
+		return err
+	}
+	if err := waitOperation(cmd, op, fmt.Sprintf("Starting %s in %s", ref.Name, ref.Zone)); err != nil {
+		return err
+	}
+	pinHostKeys(cmd, ref)
+	refreshSSHFiles(cmd)
+	return nil
+}
+
+// startInOtherZones moves the stopped instance to each of the other zones in its
+// region and tries to start it there, until it starts or no zone has capacity.
+func startInOtherZones(cmd *cobra.Command, cfg zoneConfig, ref gcp.InstanceRef, csek gcp.CSEKBundle) error {
+	if len(csek) > 0 {
+		return fmt.Errorf("zone %s has no capacity to start machine '%s', and machines with CSEK keys cannot be moved to another zone", ref.Zone, ref.Name)
+	}
+	zones, err := backend.ListZones(cmd.Context(), ref.Account, ref.Project, gcp.Region(ref.Zone))
+	if err != nil {
+		return err
+	}
+	tried := []string{ref.Zone}
+	for _, zone := range zones {
+		if zone == tried[0] {
+			continue
+		}
+		cmd.PrintErrf("Zone %s has no capacity, moving %s to %s\n", ref.Zone, ref.Name, zone)
+		if err := moveInstance(cmd, cfg, ref, zone); err != nil {
+			return err
+		}
+		ref.Zone = zone
+		tried = append(tried, zone)
+
+		err := startInstance(cmd, ref, nil)
+		if !errors.Is(err, gcp.ErrZoneResourceExhausted) {
+			return err
+		}
+	}
+	return fmt.Errorf("no capacity to start machine '%s' in zones %s: %w", ref.Name, strings.Join(tried, ", "), gcp.ErrZoneResourceExhausted)
+}
+
+// moveInstance moves the stopped instance to 'zone' and records its new zone.
+func moveInstance(cmd *cobra.Command, cfg zoneConfig, ref gcp.InstanceRef, zone string) error {
+	s := spinner.New(cmd.ErrOrStderr(), fmt.Sprintf("Moving %s to %s", ref.Name, zone))
+	s.Start()
+	if err := backend.MoveInstance(cmd.Context(), ref, zone); err != nil {
+		s.Stop("failed")
+		return err
+	}
+	s.Stop("done")
+	return cfg.SetZone(ref.Name, zone)
 }
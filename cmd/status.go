@@ -1,11 +1,15 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"path"
 	"strings"
 	"sync"
 	"text/tabwriter"
+	"time"
 
 	"github.com/joemiller/gmachine/internal/config"
 	"github.com/joemiller/gmachine/internal/gcp"
@@ -32,10 +36,17 @@ gmachine status machine2
 }
 
 func init() {
+	statusCmd.Flags().Duration("machine-timeout", 30*time.Second, "Maximum time to wait for the status of each machine. Machines that do not respond in time are shown with the status TIMEOUT")
+
 	rootCmd.AddCommand(statusCmd)
 }
 
 func status(cmd *cobra.Command, args []string) error {
+	machineTimeout, err := cmd.Flags().GetDuration("machine-timeout")
+	if err != nil {
+		return err
+	}
+
 	cfg, err := config.LoadFile(cfgFile)
 	if err != nil {
 		return err
@@ -51,7 +62,7 @@ func status(cmd *cobra.Command, args []string) error {
 	print := func(values ...string) {
 		fmt.Fprintln(table, strings.Join(values, "\t"))
 	}
-	print("NAME", "ACCOUNT", "PROJECT", "ZONE", "MACHINE_TYPE", "PREEMPTIBLE", "ENCRYPTION", "SERVICE_ACCOUNT", "INTERNAL_IP", "EXTERNAL_IP", "STATUS", "DEFAULT")
+	print("NAME", "ACCOUNT", "PROJECT", "ZONE", "MACHINE_TYPE", "PREEMPTIBLE", "ENCRYPTION", "DISKS", "SERVICE_ACCOUNT", "INTERNAL_IP", "EXTERNAL_IP", "STATUS", "DEFAULT")
 
 	eg := errgroup.Group{}
 	eg.SetLimit(8)
@@ -80,15 +91,45 @@ func status(cmd *cobra.Command, args []string) error {
 			if err != nil {
 				return err
 			}
-			meta, err := gcp.DescribeInstance(name, machine.Account, machine.Project, machine.Zone)
-			if err != nil {
-				cmd.PrintErr(err)
+
+			ctx, cancel := context.WithTimeout(cmd.Context(), machineTimeout)
+			defer cancel()
+
+			meta, err := backend.DescribeInstance(ctx, machine.Ref())
+			if errors.Is(err, context.DeadlineExceeded) && cmd.Context().Err() == nil {
+				// report the slow machine and keep going rather than holding up the whole table
+				outputCh <- []string{
+					name,
+					machine.Account,
+					machine.Project,
+					machine.Zone,
+					"", "", "", "", "", "", "",
+					"TIMEOUT",
+					defaultStr(cfg.GetDefault(), name),
+				}
 				return nil
 			}
-
-			encryptStatus := ""
-			if len(machine.CSEK) > 0 {
-				encryptStatus = "CSEK"
+			if errors.Is(err, gcp.ErrNotFound) {
+				// a Spot machine with the delete termination action is gone once it is preempted
+				if preempted, _ := gcp.Preempted(ctx, backend, machine.Ref()); preempted {
+					outputCh <- []string{
+						name,
+						machine.Account,
+						machine.Project,
+						machine.Zone,
+						"", "true", "", "", "", "", "",
+						"DELETED (preempted)",
+						defaultStr(cfg.GetDefault(), name),
+					}
+					return nil
+				}
+			}
+			if err != nil {
+				if cmd.Context().Err() != nil {
+					return err
+				}
+				cmd.PrintErrln(err)
+				return nil
 			}
 
 			gsa := ""
@@ -97,20 +138,19 @@ func status(cmd *cobra.Command, args []string) error {
 				gsa = meta.ServiceAccounts[0].Email
 			}
 
-			// TODO: also handle CMEK encryption some day
-
 			outputCh <- []string{
 				name,
 				machine.Account,
 				machine.Project,
 				path.Base(meta.Zone),
 				path.Base(meta.MachineType),
-				fmt.Sprintf("%t", meta.Scheduling.Preemptible),
-				encryptStatus,
+				fmt.Sprintf("%t", gcp.IsSpot(meta)),
+				gcp.DiskEncryption(meta),
+				dataDisks(meta),
 				gsa,
 				internalIP(meta.NetworkInterfaces),
-				externalIP(meta.NetworkInterfaces),
-				meta.Status,
+				statusExternalIP(meta),
+				instanceStatus(ctx, machine.Ref(), meta),
 				defaultStr(cfg.GetDefault(), name),
 			}
 			return nil
@@ -118,15 +158,18 @@ func status(cmd *cobra.Command, args []string) error {
 	}
 
 	// wait for the `gcloud` describers to finish
-	if err := eg.Wait(); err != nil {
-		return fmt.Errorf("gcloud error: %v", err)
-	}
+	err = eg.Wait()
 	close(outputCh)
 
 	// wait for the table printer go routine to finish:
 	printerWg.Wait()
 
-	return nil
+	// --timeout or SIGINT stopped the describers, only --machine-timeout is a
+	// TIMEOUT row
+	if cmd.Context().Err() != nil {
+		return context.Cause(cmd.Context())
+	}
+	return err
 }
 
 // return internalIP  if set, else empty string.
@@ -150,6 +193,44 @@ func externalIP(interfaces []*compute.NetworkInterface) string {
 	return interfaces[0].AccessConfigs[0].NatIP
 }
 
+// instanceStatus returns the instance's status, noting if a stopped Spot or
+// preemptible instance was preempted rather than stopped by a user.
+func instanceStatus(ctx context.Context, ref gcp.InstanceRef, instance compute.Instance) string {
+	if instance.Status != "TERMINATED" || !gcp.IsSpot(instance) {
+		return instance.Status
+	}
+	preempted, err := gcp.Preempted(ctx, backend, ref)
+	if err != nil {
+		slog.DebugContext(ctx, "failed checking if instance was preempted", "instance", ref.Name, "error", err)
+		return instance.Status
+	}
+	if preempted {
+		return instance.Status + " (preempted)"
+	}
+	return instance.Status
+}
+
+// statusExternalIP returns the instance's external IP, or "none" if it was
+// created without one.
+func statusExternalIP(instance compute.Instance) string {
+	if !gcp.HasExternalAddress(instance) {
+		return "none"
+	}
+	return externalIP(instance.NetworkInterfaces)
+}
+
+// dataDisks returns the names of the instance's attached disks other than its
+// boot disk.
+func dataDisks(instance compute.Instance) string {
+	disks := []string{}
+	for _, d := range instance.Disks {
+		if !d.Boot {
+			disks = append(disks, path.Base(d.Source))
+		}
+	}
+	return strings.Join(disks, ",")
+}
+
 func defaultStr(def, name string) string {
 	if def == name {
 		return "*"
@@ -2,9 +2,9 @@ package cmd
 
 import (
 	"errors"
+	"fmt"
 
 	"github.com/joemiller/gmachine/internal/config"
-	"github.com/joemiller/gmachine/internal/gcp"
 	"github.com/joemiller/gmachine/internal/indentor"
 	"github.com/spf13/cobra"
 )
@@ -26,6 +26,7 @@ gmachine stop machine2
 }
 
 func init() {
+	addAsyncFlag(stopCmd)
 	rootCmd.AddCommand(stopCmd)
 }
 
@@ -48,12 +49,9 @@ func stop(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	return gcp.StopInstance(
-		cmd.OutOrStdout(),
-		cmd.OutOrStderr(),
-		name,
-		machine.Account,
-		machine.Project,
-		machine.Zone,
-	)
+	op, err := backend.StopInstance(cmd.Context(), machine.Ref())
+	if err != nil {
+		return err
+	}
+	return waitOperation(cmd, op, fmt.Sprintf("Stopping %s", machine.Name))
 }
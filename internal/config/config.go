@@ -1,24 +1,45 @@
 package config
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
 	"path"
 	"sync"
+	"time"
 
+	"github.com/joemiller/gmachine/internal/fileutil"
 	"github.com/joemiller/gmachine/internal/gcp"
+	"github.com/joemiller/gmachine/internal/keystore"
 	"github.com/mitchellh/go-homedir"
 	"golang.org/x/sys/unix"
 	"gopkg.in/yaml.v2"
 )
 
 type config struct {
-	Version  int       `yaml:"version"`
-	Default  string    `yaml:"default"`
-	Machines []machine `yaml:"machines"`
-	filename string
-	mu       sync.RWMutex
+	Version    int                `yaml:"version"`
+	Default    string             `yaml:"default"`
+	Retry      *retry             `yaml:"retry,omitempty"`
+	Encryption *encryption        `yaml:"encryption,omitempty"`
+	KeyStore   *keystore.Settings `yaml:"key_store,omitempty"`
+	Machines   []machine          `yaml:"machines"`
+	filename   string
+	mu         sync.RWMutex
+
+	// set once the CSEK keys are unlocked, see Unlock
+	passphraseKey []byte
+	dataKey       []byte
+}
+
+// retry overrides the defaults of gcp.DefaultRetryPolicy. Unset fields use the
+// default.
+type retry struct {
+	Retries      *int          `yaml:"retries,omitempty"`
+	InitialDelay time.Duration `yaml:"initial_delay,omitempty"`
+	MaxDelay     time.Duration `yaml:"max_delay,omitempty"`
 }
 
 type machine struct {
@@ -27,16 +48,56 @@ type machine struct {
 	Project string         `yaml:"project"`
 	Zone    string         `yaml:"zone"`
 	CSEK    gcp.CSEKBundle `yaml:"csek"`
-	// TODO provide a way to set default ssh args for a machine. Currently requires manual edit of config file
-	DefaultSSHArgs string `yaml:"default_ssh_args"`
-	ServiceAccount string `yaml:"service_account"`
+	// SSHArgs are extra args that 'gmachine ssh' passes to ssh unless --ssh-args is set
+	SSHArgs        []string `yaml:"ssh_args,omitempty"`
+	ServiceAccount string   `yaml:"service_account"`
+	// KMSKey is the Cloud KMS key the boot disk is encrypted with (CMEK), if any
+	KMSKey string `yaml:"kms_key,omitempty"`
+	// Rotation is set while the machine's CSEK key is being rotated, see Rotation
+	Rotation *Rotation `yaml:"rotation,omitempty"`
+	// Disks are the machine's data disks, see Disk
+	Disks []Disk `yaml:"disks,omitempty"`
+	// Network holds the machine's network settings if they are not the defaults
+	Network *gcp.Network `yaml:"network,omitempty"`
+	// SSH holds how 'gmachine ssh' connects to the machine if it is not the
+	// default, see SSH
+	SSH *SSH `yaml:"ssh,omitempty"`
+	// HostKeys are the machine's ssh host keys from its guest attributes, as
+	// "TYPE BASE64" lines, see SetHostKeys
+	HostKeys []string `yaml:"host_keys,omitempty"`
+	// OSLoginUser is the POSIX username of the OS Login profile that the native
+	// ssh key was last added to, see SetOSLoginUser
+	OSLoginUser string `yaml:"os_login_user,omitempty"`
+}
+
+// bundles returns pointers to all of the machine's CSEK bundles, including those
+// of an unfinished rotation, so that their keys can be encrypted or moved
+// together.
+func (m *machine) bundles() []*gcp.CSEKBundle {
+	b := []*gcp.CSEKBundle{&m.CSEK}
+	if m.Rotation != nil {
+		b = append(b, &m.Rotation.CSEK, &m.Rotation.OldCSEK)
+	}
+	return b
+}
+
+// Ref returns the gcp.InstanceRef used to manage the machine.
+func (m machine) Ref() gcp.InstanceRef {
+	return gcp.InstanceRef{Name: m.Name, Account: m.Account, Project: m.Project, Zone: m.Zone}
 }
 
+// DryRun, if set, makes changes to config files print a description of the change
+// to it instead of writing the file.
+var DryRun io.Writer
+
 func newConfig() *config {
-	return &config{Version: 1}
+	return &config{Version: CurrentVersion}
 }
 
-// TODO document
+// LoadFile loads the config file 'file', or returns an empty config if it does
+// not exist. Files written by older versions of gmachine are migrated to
+// CurrentVersion and saved, the original file is kept as a backup. Files written
+// by newer versions are refused.
 func LoadFile(file string) (*config, error) {
 	cfg := newConfig()
 
@@ -56,24 +117,63 @@ func LoadFile(file string) (*config, error) {
 		return cfg, fmt.Errorf("config file %s is not writable", path)
 	}
 
+	// The file is replaced atomically when it is saved so it can be read without
+	// holding the lock.
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("error reading %s: %w", path, err)
 	}
 
-	err = yaml.Unmarshal(data, cfg)
+	version, err := cfg.decode(data)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+		return nil, err
+	}
+	slog.Debug("loaded config", "file", path, "version", version, "machines", len(cfg.Machines))
+
+	if version < CurrentVersion {
+		err = cfg.update(fmt.Sprintf("migrate from version %d to %d", version, CurrentVersion), func(*config) error { return nil })
+		if err != nil {
+			return nil, err
+		}
 	}
 	return cfg, nil
 }
 
+// decode parses the config file 'data' into c, migrating it to CurrentVersion,
+// and returns the version of the file.
+func (c *config) decode(data []byte) (int, error) {
+	version, err := fileVersion(data)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing %s: %w", c.filename, err)
+	}
+	if version > CurrentVersion {
+		return 0, fmt.Errorf("config file %s was written by a newer version of gmachine (config version %d, this version supports up to %d), upgrade gmachine to use it",
+			c.filename, version, CurrentVersion)
+	}
+
+	if version < CurrentVersion {
+		data, err = migrate(data, version)
+		if err != nil {
+			return 0, fmt.Errorf("error migrating %s from version %d: %w", c.filename, version, err)
+		}
+	}
+
+	if err := yaml.Unmarshal(data, c); err != nil {
+		return 0, fmt.Errorf("error parsing %s: %w", c.filename, err)
+	}
+	c.Version = CurrentVersion
+	return version, nil
+}
+
 // TODO document
 // TODO do we need Exist()? Could we just use Get instead?
 func (c *config) Exists(name string) bool {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
+	return c.exists(name)
+}
 
+func (c *config) exists(name string) bool {
 	for _, m := range c.Machines {
 		if m.Name == name {
 			return true
@@ -100,66 +200,150 @@ func (c *config) Get(name string) (machine, error) {
 
 // TODO document
 func (c *config) Add(name, account, project, zone string, csek gcp.CSEKBundle) error {
-	// fail if already exists
-	if c.Exists(name) {
-		return fmt.Errorf("machine '%s' already exists", name)
-	}
-
 	if csek == nil {
 		csek = gcp.CSEKBundle{}
 	}
 
-	// add to config.Machines array
-	m := machine{
-		Name:    name,
-		Account: account,
-		Project: project,
-		Zone:    zone,
-		CSEK:    csek,
-		// TODO service account, default ssh args
-	}
-	c.mu.Lock()
-	c.Machines = append(c.Machines, m)
-	// If this is the only machine in the database, mark it as the new default
-	if len(c.Machines) == 1 {
-		c.Default = name
-	}
-	c.mu.Unlock()
+	change := fmt.Sprintf("add machine '%s' (account: %s, project: %s, zone: %s, csek: %v)",
+		name, account, project, zone, csek.Redacted())
+	return c.update(change, func(c *config) error {
+		// fail if already exists
+		if c.exists(name) {
+			return fmt.Errorf("machine '%s' already exists", name)
+		}
+		// new keys are encrypted when they are saved, see update
+		if hasPlaintextKey(csek) && c.Encryption != nil && c.dataKey == nil {
+			return ErrLocked
+		}
 
-	return c.save()
+		// add to config.Machines array
+		c.Machines = append(c.Machines, machine{
+			Name:    name,
+			Account: account,
+			Project: project,
+			Zone:    zone,
+			CSEK:    csek,
+			// TODO service account, default ssh args
+		})
+		// If this is the only machine in the database, mark it as the new default
+		if len(c.Machines) == 1 {
+			c.Default = name
+		}
+		return nil
+	})
 }
 
 // TODO document
 func (c *config) Delete(name string) error {
-	if !c.Exists(name) {
-		return fmt.Errorf("machine '%s' does not exist", name)
+	return c.update(fmt.Sprintf("delete machine '%s'", name), func(c *config) error {
+		if !c.exists(name) {
+			return fmt.Errorf("machine '%s' does not exist", name)
+		}
+		for i, m := range c.Machines {
+			if m.Name == name {
+				c.Machines = append(c.Machines[:i], c.Machines[i+1:]...)
+				break
+			}
+		}
+		// if the deleted machine was the default, unset the default machine
+		if c.Default == name {
+			c.Default = ""
+		}
+		return nil
+	})
+}
+
+// SetKMSKey records the Cloud KMS key that the boot disk of machine 'name' is
+// encrypted with.
+func (c *config) SetKMSKey(name, key string) error {
+	return c.updateMachine(fmt.Sprintf("set KMS key of machine '%s' to '%s'", name, key), name, func(_ *config, m *machine) error {
+		m.KMSKey = key
+		return nil
+	})
+}
+
+// SetBootCSEK replaces the CSEK key of the machine's boot disk 'bootDisk' with
+// 'csek', eg: when the machine is recreated. 'csek' may be empty if the new boot
+// disk is not CSEK encrypted. The new key is stored in the key store first if the
+// config file uses one, and the old key is deleted from it. Set the key before
+// the new boot disk is created so that it is never lost.
+func (c *config) SetBootCSEK(ctx context.Context, name, bootDisk string, csek gcp.CSEKBundle) error {
+	stored, err := c.StoreKeys(ctx, csek)
+	if err != nil {
+		return err
 	}
 
-	c.mu.Lock()
-	for i, m := range c.Machines {
-		if m.Name == name {
-			c.Machines = append(c.Machines[:i], c.Machines[i+1:]...)
-			break
+	var old gcp.CSEKBundle
+	change := fmt.Sprintf("set boot disk key of machine '%s' (old boot disk: %s, csek: %v)", name, bootDisk, stored.Redacted())
+	err = c.updateMachine(change, name, func(c *config, m *machine) error {
+		// new keys are encrypted when they are saved, see update
+		if hasPlaintextKey(stored) && c.Encryption != nil && c.dataKey == nil {
+			return ErrLocked
 		}
+		var rest gcp.CSEKBundle
+		old, rest = partitionKeys(m.CSEK, gcp.DiskURI(m.Project, m.Zone, bootDisk))
+		// the boot disk's key is the first key
+		m.CSEK = append(stored, rest...)
+		return nil
+	})
+	if err != nil {
+		return err
 	}
-	// if the deleted machine was the default, unset the default machine
-	if c.Default == name {
-		c.Default = ""
+
+	c.mu.RLock()
+	settings := c.KeyStore
+	c.mu.RUnlock()
+	if settings == nil {
+		return nil
 	}
-	c.mu.Unlock()
+	return c.deleteStoredKeys(ctx, *settings, old)
+}
+
+// SetNetwork records the network settings the machine 'name' was created with.
+func (c *config) SetNetwork(name string, network gcp.Network) error {
+	return c.updateMachine(fmt.Sprintf("set network of machine '%s' to %+v", name, network), name, func(_ *config, m *machine) error {
+		m.Network = nil
+		if !network.IsZero() {
+			m.Network = &network
+		}
+		return nil
+	})
+}
 
-	return c.save()
+// SetZone records that the machine 'name' was moved to 'zone' with its disks.
+// Machines with CSEK keys cannot be moved, their keys are bound to the disks'
+// zone.
+func (c *config) SetZone(name, zone string) error {
+	return c.updateMachine(fmt.Sprintf("set zone of machine '%s' to %s", name, zone), name, func(_ *config, m *machine) error {
+		if len(m.CSEK) > 0 {
+			return fmt.Errorf("machine '%s' has CSEK keys and cannot be moved to another zone", name)
+		}
+		m.Zone = zone
+		return nil
+	})
+}
+
+// updateMachine applies the change 'fn' to the machine 'name', see update.
+func (c *config) updateMachine(change, name string, fn func(*config, *machine) error) error {
+	return c.update(change, func(c *config) error {
+		for i := range c.Machines {
+			if c.Machines[i].Name == name {
+				return fn(c, &c.Machines[i])
+			}
+		}
+		return errors.New("machine not found")
+	})
 }
 
 // TODO document
 func (c *config) SetDefault(name string) error {
-	if name != "" && !c.Exists(name) {
-		return fmt.Errorf("machine '%s' does not exist", name)
-	}
-	c.mu.Lock()
-	c.Default = name
-	c.mu.Unlock()
-	return c.save()
+	return c.update(fmt.Sprintf("set default machine to '%s'", name), func(c *config) error {
+		if name != "" && !c.exists(name) {
+			return fmt.Errorf("machine '%s' does not exist", name)
+		}
+		c.Default = name
+		return nil
+	})
 }
 
 // TODO document
@@ -169,6 +353,62 @@ func (c *config) GetDefault() string {
 	return c.Default
 }
 
+// RetryPolicy returns the retry policy from the config file's 'retry' section,
+// using gcp.DefaultRetryPolicy for any settings that are not set.
+func (c *config) RetryPolicy() gcp.RetryPolicy {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.Retry.policy()
+}
+
+// LoadRetryPolicy returns the retry policy of the config file 'file' like
+// RetryPolicy, without migrating or saving the file. It is read before any
+// command runs, so a missing or unreadable file, or one written by a newer
+// version of gmachine, gives gcp.DefaultRetryPolicy rather than an error.
+func LoadRetryPolicy(file string) gcp.RetryPolicy {
+	var cfg struct {
+		Retry *retry `yaml:"retry"`
+	}
+	path, err := homedir.Expand(file)
+	if err == nil {
+		var data []byte
+		if data, err = os.ReadFile(path); err == nil {
+			err = yaml.Unmarshal(data, &cfg)
+		}
+	}
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Debug("using the default retry policy", "file", file, "error", err)
+		}
+		return gcp.DefaultRetryPolicy
+	}
+	return cfg.Retry.policy()
+}
+
+// policy returns gcp.DefaultRetryPolicy with the overrides of r, if any.
+func (r *retry) policy() gcp.RetryPolicy {
+	p := gcp.DefaultRetryPolicy
+	if r == nil {
+		return p
+	}
+	if r.Retries != nil {
+		p.Retries = *r.Retries
+	}
+	if r.InitialDelay > 0 {
+		p.InitialDelay = r.InitialDelay
+	}
+	if r.MaxDelay > 0 {
+		p.MaxDelay = r.MaxDelay
+	}
+	return p
+}
+
+// Filename returns the path of the config file.
+func (c *config) Filename() string {
+	return c.filename
+}
+
 // TODO document
 func (c *config) Count() int {
 	c.mu.RLock()
@@ -177,23 +417,93 @@ func (c *config) Count() int {
 	return len(c.Machines)
 }
 
-// save persist the control cluster cache to a file in JSON format
-// If the directory containing the file does not exist it will be created.
-func (c *config) save() error {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+// update applies the change 'fn' to the config and saves it. Other gmachine
+// processes may have changed the file since it was loaded, so the file is locked,
+// read again and 'fn' is applied to its current contents rather than to c. The
+// result is written atomically, then c is updated to match it. Files at an older
+// version are backed up before they are replaced. If the CSEK keys are encrypted
+// and unlocked, any plaintext keys are encrypted.
+//
+// 'change' describes the change being saved, it is printed instead and only c is
+// changed when DryRun is set.
+func (c *config) update(change string, fn func(*config) error) error {
+	if DryRun != nil {
+		c.mu.Lock()
+		err := fn(c)
+		if err == nil && c.Encryption != nil && c.dataKey != nil {
+			err = c.encryptKeys()
+		}
+		c.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(DryRun, "[dry-run] config %s: %s\n", c.filename, change)
+		return nil
+	}
 
-	yamlBytes, err := yaml.Marshal(c)
+	err := os.MkdirAll(path.Dir(c.filename), 0o700)
+	if err != nil {
+		return err
+	}
+	unlock, err := fileutil.Lock(c.filename)
 	if err != nil {
 		return err
 	}
+	defer unlock()
+
+	c.mu.RLock()
+	passphraseKey := c.passphraseKey
+	c.mu.RUnlock()
+
+	current := newConfig()
+	current.filename = c.filename
+	data, err := os.ReadFile(c.filename)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return fmt.Errorf("error reading %s: %w", c.filename, err)
+	default:
+		version, err := current.decode(data)
+		if err != nil {
+			return err
+		}
+		if version < CurrentVersion {
+			bak, err := backup(c.filename, data, version)
+			if err != nil {
+				return fmt.Errorf("error backing up %s before migrating it: %w", c.filename, err)
+			}
+			slog.Info("migrating config file", "file", c.filename, "from", version, "to", CurrentVersion, "backup", bak)
+		}
+		if current.Encryption != nil && passphraseKey != nil {
+			if err := current.unlock(passphraseKey); err != nil {
+				return fmt.Errorf("the CSEK key passphrase was changed by another gmachine process, try again: %w", err)
+			}
+		}
+	}
+
+	if err := fn(current); err != nil {
+		return err
+	}
+	if current.Encryption != nil && current.dataKey != nil {
+		if err := current.encryptKeys(); err != nil {
+			return err
+		}
+	}
 
-	err = os.MkdirAll(path.Dir(c.filename), 0o700)
+	slog.Debug("saving config", "file", c.filename, "change", change)
+	yamlBytes, err := yaml.Marshal(current)
 	if err != nil {
 		return err
 	}
+	if err := fileutil.WriteFileAtomic(c.filename, yamlBytes, 0o600); err != nil {
+		return fmt.Errorf("error saving %s: %w", c.filename, err)
+	}
 
-	return os.WriteFile(c.filename, yamlBytes, 0o600)
+	c.mu.Lock()
+	c.Version, c.Default, c.Retry, c.Encryption, c.KeyStore, c.Machines = current.Version, current.Default, current.Retry, current.Encryption, current.KeyStore, current.Machines
+	c.passphraseKey, c.dataKey = current.passphraseKey, current.dataKey
+	c.mu.Unlock()
+	return nil
 }
 
 // fileExists checks if a file exists and is not a directory before we
@@ -1,11 +1,17 @@
 package config_test
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/joemiller/gmachine/internal/config"
+	"github.com/joemiller/gmachine/internal/gcp"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -53,6 +59,52 @@ machines:
 	assert.Equal(t, "raw", csek.KeyType)
 }
 
+func TestRetryPolicy(t *testing.T) {
+	// defaults
+	cfg, err := config.LoadFile("/no/such/file")
+	assert.NoError(t, err)
+	assert.Equal(t, gcp.DefaultRetryPolicy, cfg.RetryPolicy())
+
+	// overrides, unset fields keep the default
+	contents := `
+---
+version: 1
+retry:
+  retries: 0
+  max_delay: 1m
+`
+	cfg, err = config.LoadFile(tempFile(t, contents))
+	assert.NoError(t, err)
+	assert.Equal(t, gcp.RetryPolicy{
+		Retries:      0,
+		InitialDelay: gcp.DefaultRetryPolicy.InitialDelay,
+		MaxDelay:     time.Minute,
+	}, cfg.RetryPolicy())
+}
+
+func TestLoadRetryPolicy(t *testing.T) {
+	assert.Equal(t, gcp.DefaultRetryPolicy, config.LoadRetryPolicy("/no/such/file"))
+
+	// older files are read without being migrated
+	contents := `
+---
+version: 1
+retry:
+  retries: 2
+`
+	file := tempFile(t, contents)
+	assert.Equal(t, 2, config.LoadRetryPolicy(file).Retries)
+	data, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, contents, string(data))
+
+	// files of newer versions are not refused
+	assert.Equal(t, 3, config.LoadRetryPolicy(tempFile(t, "version: 1000\nretry:\n  retries: 3\n")).Retries)
+
+	// unreadable files use the default
+	assert.Equal(t, gcp.DefaultRetryPolicy, config.LoadRetryPolicy(tempFile(t, "retry: [")))
+}
+
 func TestLoadFile_file_does_not_exist(t *testing.T) {
 	cfg, err := config.LoadFile("/no/such/file")
 	assert.NoError(t, err)
@@ -100,6 +152,90 @@ func TestAdd(t *testing.T) {
 	assert.Equal(t, cfg, cfg2)
 }
 
+func TestAdd_dryRun(t *testing.T) {
+	var out bytes.Buffer
+	config.DryRun = &out
+	t.Cleanup(func() { config.DryRun = nil })
+
+	tmpfile := tempFile(t, "")
+	cfg, err := config.LoadFile(tmpfile)
+	assert.NoError(t, err)
+
+	csek := gcp.CSEKBundle{{URI: "disk-uri", Key: "c2VjcmV0", KeyType: "raw"}}
+	err = cfg.Add("foo-machine", "my-account", "my-proj", "us-west1-a", csek)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "[dry-run] config "+tmpfile+": add machine 'foo-machine'")
+	assert.NotContains(t, out.String(), "c2VjcmV0")
+
+	// the file is not changed
+	b, err := os.ReadFile(tmpfile)
+	assert.NoError(t, err)
+	assert.Empty(t, b)
+}
+
+func TestAdd_concurrent(t *testing.T) {
+	// each goroutine loads its own config, like separate gmachine processes
+	tmpfile := tempFile(t, "")
+	const n = 20
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cfg, err := config.LoadFile(tmpfile)
+			if !assert.NoError(t, err) {
+				return
+			}
+			csek := gcp.CSEKBundle{{URI: fmt.Sprintf("disk-%d", i), Key: "c2VjcmV0", KeyType: "raw"}}
+			assert.NoError(t, cfg.Add(fmt.Sprintf("machine-%d", i), "my-account", "my-proj", "zone1", csek))
+		}(i)
+	}
+	wg.Wait()
+
+	// no machine is lost
+	cfg, err := config.LoadFile(tmpfile)
+	assert.NoError(t, err)
+	assert.Equal(t, n, cfg.Count())
+	for i := 0; i < n; i++ {
+		m, err := cfg.Get(fmt.Sprintf("machine-%d", i))
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("disk-%d", i), m.CSEK[0].URI)
+	}
+
+	// no temp files are left behind
+	files, _ := filepath.Glob(filepath.Join(filepath.Dir(tmpfile), ".*"))
+	assert.Empty(t, files)
+}
+
+func TestAdd_merge(t *testing.T) {
+	tmpfile := tempFile(t, "")
+	cfg1, err := config.LoadFile(tmpfile)
+	assert.NoError(t, err)
+	cfg2, err := config.LoadFile(tmpfile)
+	assert.NoError(t, err)
+
+	// cfg2 does not know about foo but it is not dropped when cfg2 is saved
+	assert.NoError(t, cfg1.Add("foo", "my-account", "my-proj", "zone1", nil))
+	assert.NoError(t, cfg2.Add("bar", "my-account", "my-proj", "zone1", nil))
+	assert.Equal(t, 2, cfg2.Count())
+	assert.Equal(t, "foo", cfg2.GetDefault())
+
+	// adding a machine that another process added should error
+	err = cfg1.Add("bar", "my-account", "my-proj", "zone1", nil)
+	assert.ErrorContains(t, err, "already exists")
+
+	// deleting a machine that another process deleted should error
+	assert.NoError(t, cfg1.Delete("foo"))
+	err = cfg2.Delete("foo")
+	assert.ErrorContains(t, err, "does not exist")
+
+	cfg3, err := config.LoadFile(tmpfile)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, cfg3.Count())
+	assert.True(t, cfg3.Exists("bar"))
+}
+
 func TestGet(t *testing.T) {
 	// create new empty config
 	tmpfile := tempFile(t, "")
@@ -183,3 +319,140 @@ func TestGetSetDefault(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "bar", cfg2.GetDefault())
 }
+
+func TestSetKMSKey(t *testing.T) {
+	tmpfile := tempFile(t, "")
+	cfg, err := config.LoadFile(tmpfile)
+	assert.NoError(t, err)
+	assert.NoError(t, cfg.Add("foo", "my-account", "my-proj", "zone1", nil))
+
+	key := "projects/my-proj/locations/us-west1/keyRings/my-ring/cryptoKeys/my-key"
+	assert.NoError(t, cfg.SetKMSKey("foo", key))
+	assert.Error(t, cfg.SetKMSKey("no-such-machine", key))
+
+	cfg2, err := config.LoadFile(tmpfile)
+	assert.NoError(t, err)
+	m, err := cfg2.Get("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, key, m.KMSKey)
+}
+
+func TestSetNetwork(t *testing.T) {
+	tmpfile := tempFile(t, "")
+	cfg, err := config.LoadFile(tmpfile)
+	assert.NoError(t, err)
+	assert.NoError(t, cfg.Add("foo", "my-account", "my-proj", "zone1", nil))
+
+	network := gcp.Network{Subnet: "workstations", NoAddress: true, Tags: []string{"ssh"}}
+	assert.NoError(t, cfg.SetNetwork("foo", network))
+	cfg2, err := config.LoadFile(tmpfile)
+	assert.NoError(t, err)
+	m, _ := cfg2.Get("foo")
+	assert.Equal(t, &network, m.Network)
+
+	// the default settings are not saved
+	assert.NoError(t, cfg.SetNetwork("foo", gcp.Network{}))
+	m, _ = cfg.Get("foo")
+	assert.Nil(t, m.Network)
+}
+
+func TestSetZone(t *testing.T) {
+	tmpfile := tempFile(t, "")
+	cfg, err := config.LoadFile(tmpfile)
+	assert.NoError(t, err)
+	assert.NoError(t, cfg.Add("foo", "my-account", "my-proj", "us-west1-a", nil))
+	assert.NoError(t, cfg.Add("bar", "my-account", "my-proj", "us-west1-a", gcp.CSEKBundle{{URI: testDiskURI, Key: testKey, KeyType: "raw"}}))
+
+	assert.NoError(t, cfg.SetZone("foo", "us-west1-b"))
+	cfg2, err := config.LoadFile(tmpfile)
+	assert.NoError(t, err)
+	m, _ := cfg2.Get("foo")
+	assert.Equal(t, "us-west1-b", m.Zone)
+
+	assert.ErrorContains(t, cfg.SetZone("bar", "us-west1-b"), "has CSEK keys")
+}
+
+func TestSetBootCSEK(t *testing.T) {
+	ctx := context.Background()
+	tmpfile := tempFile(t, "")
+	cfg, err := config.LoadFile(tmpfile)
+	assert.NoError(t, err)
+	oldKey := gcp.CSEKBundle{{URI: testDiskURI, Key: testKey, KeyType: "raw"}}
+	dataKey := gcp.CSEKBundle{{URI: testDataDiskURI, Key: testKey, KeyType: "raw"}}
+	assert.NoError(t, cfg.Add("foo", "my-account", "my-proj", "zone1", oldKey))
+	assert.NoError(t, cfg.AddDisk(ctx, "foo", config.Disk{Name: "home", DeviceName: "home"}, dataKey))
+
+	// the data disk's key is kept
+	newKey := gcp.CSEKBundle{{URI: testDiskURI, Key: "bmV3LWtleQ==", KeyType: "raw"}}
+	assert.NoError(t, cfg.SetBootCSEK(ctx, "foo", "foo", newKey))
+	cfg2, err := config.LoadFile(tmpfile)
+	assert.NoError(t, err)
+	csek, err := cfg2.CSEK(ctx, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, append(newKey, dataKey...), csek)
+
+	// the new boot disk is not encrypted
+	assert.NoError(t, cfg.SetBootCSEK(ctx, "foo", "foo", nil))
+	csek, err = cfg.CSEK(ctx, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, dataKey, csek)
+}
+
+func TestSetSSH(t *testing.T) {
+	tmpfile := tempFile(t, "")
+	cfg, err := config.LoadFile(tmpfile)
+	assert.NoError(t, err)
+	assert.NoError(t, cfg.Add("foo", "my-account", "my-proj", "zone1", nil))
+	assert.NoError(t, cfg.Add("bastion", "my-account", "my-proj", "zone1", nil))
+
+	ssh := config.SSH{Mode: gcp.SSHModeInternalIP, JumpHost: "bastion", Native: true, AutoStart: true}
+	assert.NoError(t, cfg.SetSSH("foo", ssh))
+	cfg2, err := config.LoadFile(tmpfile)
+	assert.NoError(t, err)
+	m, _ := cfg2.Get("foo")
+	assert.Equal(t, &ssh, m.SSH)
+
+	assert.ErrorContains(t, cfg.SetSSH("foo", config.SSH{JumpHost: "foo"}), "its own jump host")
+	assert.ErrorContains(t, cfg.SetSSH("foo", config.SSH{JumpHost: "missing"}), "not found")
+	assert.ErrorContains(t, cfg.SetSSH("foo", config.SSH{Mode: gcp.SSHModeIAP, JumpHost: "bastion"}), "cannot connect through both")
+	assert.ErrorContains(t, cfg.SetSSH("foo", config.SSH{Mode: "direct"}), "invalid ssh mode")
+	assert.ErrorContains(t, cfg.SetSSH("foo", config.SSH{OSLogin: true}), "only used by native ssh")
+
+	// the default settings are not saved
+	assert.NoError(t, cfg.SetSSH("foo", config.SSH{}))
+	m, _ = cfg.Get("foo")
+	assert.Nil(t, m.SSH)
+}
+
+func TestSetHostKeys(t *testing.T) {
+	tmpfile := tempFile(t, "")
+	cfg, err := config.LoadFile(tmpfile)
+	assert.NoError(t, err)
+	assert.NoError(t, cfg.Add("foo", "my-account", "my-proj", "zone1", nil))
+
+	keys := []string{"ssh-ed25519 AAAA", "ssh-rsa BBBB"}
+	assert.NoError(t, cfg.SetHostKeys("foo", keys))
+	cfg2, err := config.LoadFile(tmpfile)
+	assert.NoError(t, err)
+	m, _ := cfg2.Get("foo")
+	assert.Equal(t, keys, m.HostKeys)
+
+	assert.NoError(t, cfg.SetHostKeys("foo", nil))
+	m, _ = cfg.Get("foo")
+	assert.Nil(t, m.HostKeys)
+	assert.ErrorContains(t, cfg.SetHostKeys("missing", keys), "not found")
+}
+
+func TestSetOSLoginUser(t *testing.T) {
+	tmpfile := tempFile(t, "")
+	cfg, err := config.LoadFile(tmpfile)
+	assert.NoError(t, err)
+	assert.NoError(t, cfg.Add("foo", "my-account", "my-proj", "zone1", nil))
+
+	assert.NoError(t, cfg.SetOSLoginUser("foo", "me_example_com"))
+	cfg2, err := config.LoadFile(tmpfile)
+	assert.NoError(t, err)
+	m, _ := cfg2.Get("foo")
+	assert.Equal(t, "me_example_com", m.OSLoginUser)
+	assert.ErrorContains(t, cfg.SetOSLoginUser("missing", "me_example_com"), "not found")
+}
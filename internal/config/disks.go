@@ -0,0 +1,198 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/joemiller/gmachine/internal/gcp"
+)
+
+// Disk is a data disk of a machine, in the machine's project and zone. If it is
+// CSEK encrypted its key is one of the machine's CSEK keys.
+type Disk struct {
+	Name       string `yaml:"name"`
+	DeviceName string `yaml:"device_name"`
+	// Attached is false while the disk is detached from the machine. The key of a
+	// detached disk is kept but not used to start the machine, see StartCSEK.
+	Attached bool `yaml:"attached"`
+}
+
+// Disk returns the machine's data disk 'name'.
+func (m machine) Disk(name string) (Disk, bool) {
+	for _, d := range m.Disks {
+		if d.Name == name {
+			return d, true
+		}
+	}
+	return Disk{}, false
+}
+
+// DiskOwner returns the name of the machine that the data disk 'disk' in
+// 'project' and 'zone' belongs to, or "" if it is not a data disk of any machine.
+func (c *config) DiskOwner(project, zone, disk string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.diskOwner(project, zone, disk)
+}
+
+func (c *config) diskOwner(project, zone, disk string) string {
+	for _, m := range c.Machines {
+		if _, ok := m.Disk(disk); ok && m.Project == project && m.Zone == zone {
+			return m.Name
+		}
+	}
+	return ""
+}
+
+// AddDisk adds the data disk 'disk' to the machine 'name'. 'csek' holds the
+// disk's key if it is CSEK encrypted, it is stored in the key store first if the
+// config file uses one. Add the disk before it is created so that its key is
+// never lost, and remove it with RemoveDisk if creating it fails.
+func (c *config) AddDisk(ctx context.Context, name string, disk Disk, csek gcp.CSEKBundle) error {
+	m, err := c.Get(name)
+	if err != nil {
+		return err
+	}
+	if owner := c.DiskOwner(m.Project, m.Zone, disk.Name); owner != "" {
+		return fmt.Errorf("disk %s is already a data disk of machine '%s'", disk.Name, owner)
+	}
+	stored, err := c.StoreKeys(ctx, csek)
+	if err != nil {
+		return err
+	}
+
+	change := fmt.Sprintf("add disk %s to machine '%s' (device name: %s, attached: %t, csek: %v)",
+		disk.Name, name, disk.DeviceName, disk.Attached, stored.Redacted())
+	return c.updateMachine(change, name, func(c *config, m *machine) error {
+		if owner := c.diskOwner(m.Project, m.Zone, disk.Name); owner != "" {
+			return fmt.Errorf("disk %s is already a data disk of machine '%s'", disk.Name, owner)
+		}
+		// new keys are encrypted when they are saved, see update
+		if hasPlaintextKey(stored) && c.Encryption != nil && c.dataKey == nil {
+			return ErrLocked
+		}
+		m.Disks = append(m.Disks, disk)
+		m.CSEK = append(m.CSEK, stored...)
+		return nil
+	})
+}
+
+// SetDiskAttached records whether the data disk 'disk' of the machine 'name' is
+// attached, and the device name it is attached with.
+func (c *config) SetDiskAttached(name, disk, deviceName string, attached bool) error {
+	change := fmt.Sprintf("set disk %s of machine '%s' attached: %t (device name: %s)", disk, name, attached, deviceName)
+	return c.updateMachine(change, name, func(c *config, m *machine) error {
+		for i := range m.Disks {
+			if m.Disks[i].Name == disk {
+				m.Disks[i].DeviceName, m.Disks[i].Attached = deviceName, attached
+				return nil
+			}
+		}
+		return fmt.Errorf("disk %s is not a data disk of machine '%s'", disk, name)
+	})
+}
+
+// MoveDisk moves the detached data disk 'disk' and its CSEK key from the machine
+// 'from' to the machine 'to', eg: before attaching it to 'to'. The machines must
+// be in the same project and zone.
+func (c *config) MoveDisk(from, to, disk string) error {
+	return c.update(fmt.Sprintf("move disk %s from machine '%s' to machine '%s'", disk, from, to), func(c *config) error {
+		var src, dst *machine
+		for i := range c.Machines {
+			switch c.Machines[i].Name {
+			case from:
+				src = &c.Machines[i]
+			case to:
+				dst = &c.Machines[i]
+			}
+		}
+		if src == nil || dst == nil {
+			return errors.New("machine not found")
+		}
+		if src.Project != dst.Project || src.Zone != dst.Zone {
+			return fmt.Errorf("machine '%s' is not in the same project and zone as machine '%s'", to, from)
+		}
+		d, ok := src.Disk(disk)
+		if !ok {
+			return fmt.Errorf("disk %s is not a data disk of machine '%s'", disk, from)
+		}
+		if d.Attached {
+			return fmt.Errorf("disk %s is attached to machine '%s'", disk, from)
+		}
+		src.Disks = removeDisk(src.Disks, disk)
+		d.Attached = false
+		dst.Disks = append(dst.Disks, d)
+
+		var key gcp.CSEKBundle
+		key, src.CSEK = partitionKeys(src.CSEK, gcp.DiskURI(src.Project, src.Zone, disk))
+		dst.CSEK = append(dst.CSEK, key...)
+		return nil
+	})
+}
+
+// RemoveDisk removes the data disk 'disk' and its CSEK key from the machine
+// 'name', and deletes the key from the key store, eg: after the disk was deleted.
+func (c *config) RemoveDisk(ctx context.Context, name, disk string) error {
+	var key gcp.CSEKBundle
+	err := c.updateMachine(fmt.Sprintf("remove disk %s from machine '%s'", disk, name), name, func(c *config, m *machine) error {
+		if _, ok := m.Disk(disk); !ok {
+			return fmt.Errorf("disk %s is not a data disk of machine '%s'", disk, name)
+		}
+		m.Disks = removeDisk(m.Disks, disk)
+		key, m.CSEK = partitionKeys(m.CSEK, gcp.DiskURI(m.Project, m.Zone, disk))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	c.mu.RLock()
+	settings := c.KeyStore
+	c.mu.RUnlock()
+	if settings == nil {
+		return nil
+	}
+	return c.deleteStoredKeys(ctx, *settings, key)
+}
+
+// StartCSEK returns the CSEK keys needed to start the machine 'name': its keys
+// without those of its detached data disks.
+func (c *config) StartCSEK(ctx context.Context, name string) (gcp.CSEKBundle, error) {
+	m, err := c.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	csek, err := c.CSEK(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range m.Disks {
+		if !d.Attached {
+			_, csek = partitionKeys(csek, gcp.DiskURI(m.Project, m.Zone, d.Name))
+		}
+	}
+	return csek, nil
+}
+
+func removeDisk(disks []Disk, name string) []Disk {
+	var keep []Disk
+	for _, d := range disks {
+		if d.Name != name {
+			keep = append(keep, d)
+		}
+	}
+	return keep
+}
+
+// partitionKeys splits 'csek' into the keys for 'uri' and the rest.
+func partitionKeys(csek gcp.CSEKBundle, uri string) (match, rest gcp.CSEKBundle) {
+	for _, k := range csek {
+		if k.URI == uri {
+			match = append(match, k)
+		} else {
+			rest = append(rest, k)
+		}
+	}
+	return match, rest
+}
@@ -0,0 +1,95 @@
+package config_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/joemiller/gmachine/internal/config"
+	"github.com/joemiller/gmachine/internal/gcp"
+	"github.com/joemiller/gmachine/internal/keystore"
+	"github.com/stretchr/testify/assert"
+)
+
+const testDataDiskURI = "https://www.googleapis.com/compute/v1/projects/my-proj/zones/zone1/disks/home"
+
+func TestDisks(t *testing.T) {
+	ctx := context.Background()
+	tmpfile := tempFile(t, "")
+	cfg, err := config.LoadFile(tmpfile)
+	assert.NoError(t, err)
+	bootKey := gcp.CSEKBundle{{URI: testDiskURI, Key: testKey, KeyType: "raw"}}
+	assert.NoError(t, cfg.Add("foo", "my-account", "my-proj", "zone1", bootKey))
+	assert.NoError(t, cfg.Add("bar", "my-account", "my-proj", "zone1", nil))
+	assert.NoError(t, cfg.Add("baz", "my-account", "my-proj", "zone2", nil))
+
+	dataKey := gcp.CSEKBundle{{URI: testDataDiskURI, Key: testKey, KeyType: "raw"}}
+	assert.NoError(t, cfg.AddDisk(ctx, "foo", config.Disk{Name: "home", DeviceName: "home"}, dataKey))
+	assert.ErrorContains(t, cfg.AddDisk(ctx, "bar", config.Disk{Name: "home"}, nil), "already a data disk of machine 'foo'")
+	assert.Equal(t, "foo", cfg.DiskOwner("my-proj", "zone1", "home"))
+	assert.Equal(t, "", cfg.DiskOwner("my-proj", "zone2", "home"))
+
+	// the key of a detached disk is kept, but not used to start the machine
+	csek, err := cfg.CSEK(ctx, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, append(bootKey, dataKey...), csek)
+	csek, err = cfg.StartCSEK(ctx, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, bootKey, csek)
+
+	assert.NoError(t, cfg.SetDiskAttached("foo", "home", "data", true))
+	assert.Error(t, cfg.SetDiskAttached("foo", "no-such-disk", "data", true))
+	cfg2, err := config.LoadFile(tmpfile)
+	assert.NoError(t, err)
+	m, _ := cfg2.Get("foo")
+	assert.Equal(t, []config.Disk{{Name: "home", DeviceName: "data", Attached: true}}, m.Disks)
+	csek, err = cfg2.StartCSEK(ctx, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, append(bootKey, dataKey...), csek)
+
+	// an attached disk can't be moved, or to a machine in another zone
+	assert.ErrorContains(t, cfg.MoveDisk("foo", "bar", "home"), "is attached to machine 'foo'")
+	assert.NoError(t, cfg.SetDiskAttached("foo", "home", "data", false))
+	assert.ErrorContains(t, cfg.MoveDisk("foo", "baz", "home"), "not in the same project and zone")
+
+	// the disk moves with its key
+	assert.NoError(t, cfg.MoveDisk("foo", "bar", "home"))
+	csek, err = cfg.CSEK(ctx, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, bootKey, csek)
+	csek, err = cfg.CSEK(ctx, "bar")
+	assert.NoError(t, err)
+	assert.Equal(t, dataKey, csek)
+	assert.Equal(t, "bar", cfg.DiskOwner("my-proj", "zone1", "home"))
+
+	assert.NoError(t, cfg.RemoveDisk(ctx, "bar", "home"))
+	assert.Error(t, cfg.RemoveDisk(ctx, "bar", "home"))
+	m, _ = cfg.Get("bar")
+	assert.Empty(t, m.Disks)
+	assert.Empty(t, m.CSEK)
+}
+
+func TestRemoveDisk_key_store(t *testing.T) {
+	ctx := context.Background()
+	tmpfile := tempFile(t, "version: 4\nkey_store:\n  type: fake\n")
+	cfg, err := config.LoadFile(tmpfile)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, cfg.Add("foo", "my-account", "my-proj", "zone1", nil))
+
+	dataKey := gcp.CSEKBundle{{URI: testDataDiskURI, Key: testKey, KeyType: "raw"}}
+	assert.NoError(t, cfg.AddDisk(ctx, "foo", config.Disk{Name: "home", DeviceName: "home"}, dataKey))
+	m, _ := cfg.Get("foo")
+	if !assert.Len(t, m.CSEK, 1) {
+		return
+	}
+	assert.Empty(t, m.CSEK[0].Key)
+	storeFile := filepath.Join(filepath.Dir(tmpfile), "fake-keystore.json")
+	_, err = keystore.NewFake(storeFile).Get(ctx, m.CSEK[0].KeyRef)
+	assert.NoError(t, err)
+
+	assert.NoError(t, cfg.RemoveDisk(ctx, "foo", "home"))
+	_, err = keystore.NewFake(storeFile).Get(ctx, m.CSEK[0].KeyRef)
+	assert.ErrorIs(t, err, keystore.ErrNotFound)
+}
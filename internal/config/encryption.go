@@ -0,0 +1,249 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/joemiller/gmachine/internal/gcp"
+	"github.com/joemiller/gmachine/internal/keys"
+	"github.com/joemiller/gmachine/internal/keystore"
+)
+
+// ErrLocked is returned when the CSEK keys are needed but the config file's keys
+// are encrypted and have not been unlocked.
+var ErrLocked = errors.New("CSEK keys are encrypted, unlock them with the passphrase first")
+
+// encryption is the config file's 'encryption' section. When it is set, CSEK keys
+// are stored encrypted with a random data key. The data key is stored encrypted
+// with a key derived from the passphrase so that changing the passphrase does not
+// require re-encrypting every CSEK key.
+type encryption struct {
+	keys.KDFParams `yaml:",inline"`
+	DataKey        string `yaml:"data_key"`
+}
+
+// dataKeyAAD binds the encrypted data key to its purpose.
+var dataKeyAAD = []byte("gmachine data key")
+
+// Encrypted returns true if the CSEK keys in the config file are encrypted with a
+// passphrase.
+func (c *config) Encrypted() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Encryption != nil
+}
+
+// Locked returns true if the CSEK keys are encrypted and have not been unlocked.
+func (c *config) Locked() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Encryption != nil && c.dataKey == nil
+}
+
+// PassphraseKey returns the key derived from 'passphrase' that unlocks the CSEK
+// keys, see Unlock. It can be cached instead of the passphrase.
+func (c *config) PassphraseKey(passphrase []byte) ([]byte, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.Encryption == nil {
+		return nil, errors.New("CSEK keys are not encrypted")
+	}
+	return c.Encryption.DeriveKey(passphrase)
+}
+
+// Unlock decrypts the data key with the PassphraseKey 'key' so that the CSEK
+// keys can be read with CSEK. Plaintext keys, eg: added by an older version of
+// gmachine, are encrypted and saved.
+func (c *config) Unlock(key []byte) error {
+	c.mu.Lock()
+	err := c.unlock(key)
+	plaintext := c.plaintextKeys()
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if plaintext > 0 {
+		return c.update(fmt.Sprintf("encrypt %d plaintext CSEK keys", plaintext), func(*config) error { return nil })
+	}
+	return nil
+}
+
+func (c *config) unlock(key []byte) error {
+	if c.Encryption == nil {
+		return errors.New("CSEK keys are not encrypted")
+	}
+	dataKey, err := keys.Open(key, c.Encryption.DataKey, dataKeyAAD)
+	if err != nil {
+		if errors.Is(err, keys.ErrDecrypt) {
+			return errors.New("incorrect passphrase")
+		}
+		return err
+	}
+	c.passphraseKey, c.dataKey = key, dataKey
+	return nil
+}
+
+// EncryptKeys encrypts all of the CSEK keys in the config file with
+// 'passphrase'. New keys are encrypted when they are added.
+func (c *config) EncryptKeys(passphrase []byte) error {
+	if c.Encrypted() {
+		return errors.New("CSEK keys are already encrypted, use ChangePassphrase to change the passphrase")
+	}
+
+	params, err := keys.NewKDFParams()
+	if err != nil {
+		return err
+	}
+	passphraseKey, err := params.DeriveKey(passphrase)
+	if err != nil {
+		return err
+	}
+	dataKey, err := keys.NewKey()
+	if err != nil {
+		return err
+	}
+	wrapped, err := keys.Seal(passphraseKey, dataKey, dataKeyAAD)
+	if err != nil {
+		return err
+	}
+
+	return c.update("encrypt CSEK keys", func(c *config) error {
+		if c.Encryption != nil {
+			return errors.New("CSEK keys were encrypted by another gmachine process")
+		}
+		c.Encryption = &encryption{KDFParams: params, DataKey: wrapped}
+		c.passphraseKey, c.dataKey = passphraseKey, dataKey
+		return nil
+	})
+}
+
+// ChangePassphrase changes the passphrase of the encrypted CSEK keys, they must be
+// unlocked. It returns the new PassphraseKey.
+func (c *config) ChangePassphrase(passphrase []byte) ([]byte, error) {
+	if c.Locked() {
+		return nil, ErrLocked
+	}
+	params, err := keys.NewKDFParams()
+	if err != nil {
+		return nil, err
+	}
+	passphraseKey, err := params.DeriveKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.update("change CSEK key passphrase", func(c *config) error {
+		if c.Encryption == nil {
+			return errors.New("CSEK keys are not encrypted")
+		}
+		wrapped, err := keys.Seal(passphraseKey, c.dataKey, dataKeyAAD)
+		if err != nil {
+			return err
+		}
+		c.Encryption = &encryption{KDFParams: params, DataKey: wrapped}
+		c.passphraseKey = passphraseKey
+		return nil
+	})
+	return passphraseKey, err
+}
+
+// CSEK returns the CSEK keys of the machine 'name', decrypted or read from the
+// key store. It returns ErrLocked if they are encrypted and have not been
+// unlocked.
+func (c *config) CSEK(ctx context.Context, name string) (gcp.CSEKBundle, error) {
+	m, err := c.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return c.openKeys(ctx, m.CSEK)
+}
+
+// openKeys returns 'csek' with its keys decrypted or read from the key store.
+func (c *config) openKeys(ctx context.Context, csek gcp.CSEKBundle) (gcp.CSEKBundle, error) {
+	c.mu.RLock()
+	dataKey, settings := c.dataKey, c.KeyStore
+	c.mu.RUnlock()
+
+	var store keystore.Store
+	var err error
+	bundle := make(gcp.CSEKBundle, len(csek))
+	for i, k := range csek {
+		switch {
+		case k.EncryptedKey != "":
+			if dataKey == nil {
+				return nil, ErrLocked
+			}
+			key, err := keys.Open(dataKey, k.EncryptedKey, []byte(k.URI))
+			if err != nil {
+				return nil, fmt.Errorf("error decrypting the CSEK key for %s: %w", k.URI, err)
+			}
+			k.Key, k.EncryptedKey = string(key), ""
+		case k.KeyRef != "":
+			if settings == nil {
+				return nil, fmt.Errorf("the CSEK key for %s is in a key store but the config file has no 'key_store'", k.URI)
+			}
+			if store == nil {
+				if store, err = c.keyStore(*settings); err != nil {
+					return nil, err
+				}
+			}
+			key, err := store.Get(ctx, k.KeyRef)
+			if err != nil {
+				return nil, fmt.Errorf("error reading the CSEK key for %s from the %s key store: %w", k.KeyRef, settings.Type, err)
+			}
+			k.Key, k.KeyRef = key, ""
+		}
+		bundle[i] = k
+	}
+	return bundle, nil
+}
+
+// plaintextKeys returns the number of CSEK keys that are not encrypted.
+func (c *config) plaintextKeys() int {
+	n := 0
+	for i := range c.Machines {
+		for _, csek := range c.Machines[i].bundles() {
+			for _, k := range *csek {
+				if k.EncryptedKey == "" && k.Key != "" {
+					n++
+				}
+			}
+		}
+	}
+	return n
+}
+
+// hasPlaintextKey returns true if any of the keys in 'csek' are plaintext.
+func hasPlaintextKey(csek gcp.CSEKBundle) bool {
+	for _, k := range csek {
+		if k.Key != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// encryptKeys encrypts any plaintext CSEK keys with the data key, which must be
+// unlocked. The URI of the disk is authenticated with each key so that keys cannot
+// be swapped between disks.
+func (c *config) encryptKeys() error {
+	for i := range c.Machines {
+		for _, bundle := range c.Machines[i].bundles() {
+			csek := make(gcp.CSEKBundle, len(*bundle))
+			for j, k := range *bundle {
+				if k.EncryptedKey == "" && k.Key != "" {
+					sealed, err := keys.Seal(c.dataKey, []byte(k.Key), []byte(k.URI))
+					if err != nil {
+						return err
+					}
+					k.Key, k.EncryptedKey = "", sealed
+				}
+				csek[j] = k
+			}
+			*bundle = csek
+		}
+	}
+	return nil
+}
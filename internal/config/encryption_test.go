@@ -0,0 +1,133 @@
+package config_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/joemiller/gmachine/internal/config"
+	"github.com/joemiller/gmachine/internal/gcp"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testKey        = "acXTX3rxrKAFTF0tYVLvydU1riRZTvUNC4g5I11NY+c="
+	testPassphrase = "correct horse battery staple"
+)
+
+func TestEncryptKeys(t *testing.T) {
+	tmpfile := tempFile(t, "")
+	cfg, err := config.LoadFile(tmpfile)
+	assert.NoError(t, err)
+	csek := gcp.CSEKBundle{{URI: "disk-uri", Key: testKey, KeyType: "raw"}}
+	assert.NoError(t, cfg.Add("foo", "my-account", "my-proj", "zone1", csek))
+	assert.False(t, cfg.Encrypted())
+
+	// existing keys are encrypted
+	assert.NoError(t, cfg.EncryptKeys([]byte(testPassphrase)))
+	assert.True(t, cfg.Encrypted())
+	data, _ := os.ReadFile(tmpfile)
+	assert.NotContains(t, string(data), testKey)
+	assert.Contains(t, string(data), "encrypted-key:")
+
+	// new keys are encrypted when they are added
+	csek2 := gcp.CSEKBundle{{URI: "disk-uri-2", Key: "c2VjcmV0", KeyType: "raw"}}
+	assert.NoError(t, cfg.Add("bar", "my-account", "my-proj", "zone1", csek2))
+	data, _ = os.ReadFile(tmpfile)
+	assert.NotContains(t, string(data), "c2VjcmV0")
+	assert.Equal(t, "c2VjcmV0", csek2[0].Key, "the caller's bundle is not changed")
+
+	// another process must unlock the keys
+	cfg2, err := config.LoadFile(tmpfile)
+	assert.NoError(t, err)
+	assert.True(t, cfg2.Locked())
+	_, err = cfg2.CSEK(context.Background(), "foo")
+	assert.ErrorIs(t, err, config.ErrLocked)
+	err = cfg2.Add("baz", "my-account", "my-proj", "zone1", gcp.CSEKBundle{{URI: "disk-uri-3", Key: "a2V5"}})
+	assert.ErrorIs(t, err, config.ErrLocked)
+
+	key, err := cfg2.PassphraseKey([]byte("wrong"))
+	assert.NoError(t, err)
+	assert.ErrorContains(t, cfg2.Unlock(key), "incorrect passphrase")
+
+	key, err = cfg2.PassphraseKey([]byte(testPassphrase))
+	assert.NoError(t, err)
+	assert.NoError(t, cfg2.Unlock(key))
+	got, err := cfg2.CSEK(context.Background(), "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, gcp.CSEKBundle{{URI: "disk-uri", Key: testKey, KeyType: "raw"}}, got)
+	got, err = cfg2.CSEK(context.Background(), "bar")
+	assert.NoError(t, err)
+	assert.Equal(t, "c2VjcmV0", got[0].Key)
+
+	// encrypting twice is an error
+	assert.Error(t, cfg2.EncryptKeys([]byte(testPassphrase)))
+}
+
+func TestChangePassphrase(t *testing.T) {
+	file, _ := copyFixture(t, "v3.yaml")
+	cfg, err := config.LoadFile(file)
+	assert.NoError(t, err)
+
+	_, err = cfg.ChangePassphrase([]byte("new passphrase"))
+	assert.ErrorIs(t, err, config.ErrLocked)
+
+	key, err := cfg.PassphraseKey([]byte(testPassphrase))
+	assert.NoError(t, err)
+	assert.NoError(t, cfg.Unlock(key))
+
+	// a process that unlocked the keys before the passphrase was changed can no
+	// longer save encrypted keys
+	stale, err := config.LoadFile(file)
+	assert.NoError(t, err)
+	assert.NoError(t, stale.Unlock(key))
+
+	_, err = cfg.ChangePassphrase([]byte("new passphrase"))
+	assert.NoError(t, err)
+
+	err = stale.Add("bar", "my-account", "my-proj", "zone1", gcp.CSEKBundle{{URI: "disk-uri-2", Key: "a2V5"}})
+	assert.ErrorContains(t, err, "passphrase was changed by another gmachine process")
+
+	cfg2, err := config.LoadFile(file)
+	assert.NoError(t, err)
+	oldKey, err := cfg2.PassphraseKey([]byte(testPassphrase))
+	assert.NoError(t, err)
+	assert.Error(t, cfg2.Unlock(oldKey))
+	newKey, err := cfg2.PassphraseKey([]byte("new passphrase"))
+	assert.NoError(t, err)
+	assert.NoError(t, cfg2.Unlock(newKey))
+	got, err := cfg2.CSEK(context.Background(), "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, testKey, got[0].Key)
+}
+
+func TestUnlock_encrypts_plaintext_keys(t *testing.T) {
+	// a plaintext key added to an encrypted config, eg: by hand
+	file, original := copyFixture(t, "v3.yaml")
+	contents := string(original) + `- name: bar
+  account: my-account
+  project: my-proj
+  zone: us-central1-a
+  csek:
+  - uri: disk-uri-2
+    key: c2VjcmV0
+    key-type: raw
+`
+	assert.NoError(t, os.WriteFile(file, []byte(contents), 0o600))
+
+	cfg, err := config.LoadFile(file)
+	assert.NoError(t, err)
+	got, err := cfg.CSEK(context.Background(), "bar")
+	assert.NoError(t, err, "plaintext keys can be read while locked")
+	assert.Equal(t, "c2VjcmV0", got[0].Key)
+
+	key, err := cfg.PassphraseKey([]byte(testPassphrase))
+	assert.NoError(t, err)
+	assert.NoError(t, cfg.Unlock(key))
+
+	data, _ := os.ReadFile(file)
+	assert.NotContains(t, string(data), "c2VjcmV0")
+	got, err = cfg.CSEK(context.Background(), "bar")
+	assert.NoError(t, err)
+	assert.Equal(t, "c2VjcmV0", got[0].Key)
+}
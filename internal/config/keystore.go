@@ -0,0 +1,195 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"reflect"
+
+	"github.com/joemiller/gmachine/internal/gcp"
+	"github.com/joemiller/gmachine/internal/keystore"
+)
+
+// KeyStoreType returns the type of key store the CSEK keys are stored in, or ""
+// if they are stored in the config file.
+func (c *config) KeyStoreType() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.KeyStore == nil {
+		return ""
+	}
+	return c.KeyStore.Type
+}
+
+// keyStore returns the Store for 'settings'.
+func (c *config) keyStore(settings keystore.Settings) (keystore.Store, error) {
+	return keystore.New(settings, filepath.Dir(c.filename))
+}
+
+// StoreKeys stores the keys in 'csek' in the config file's key store and returns
+// a bundle with references to them, to be passed to Add. If the config file does
+// not use a key store 'csek' is returned unchanged.
+func (c *config) StoreKeys(ctx context.Context, csek gcp.CSEKBundle) (gcp.CSEKBundle, error) {
+	c.mu.RLock()
+	settings := c.KeyStore
+	c.mu.RUnlock()
+	if settings == nil {
+		return csek, nil
+	}
+	store, err := c.keyStore(*settings)
+	if err != nil {
+		return nil, err
+	}
+	return storeKeys(ctx, store, settings.Type, csek)
+}
+
+func storeKeys(ctx context.Context, store keystore.Store, storeType string, csek gcp.CSEKBundle) (gcp.CSEKBundle, error) {
+	stored := make(gcp.CSEKBundle, len(csek))
+	for i, k := range csek {
+		if k.Key != "" {
+			ref := keystore.Ref(k.URI)
+			if DryRun != nil {
+				fmt.Fprintf(DryRun, "[dry-run] key store %s: set the key for %s\n", storeType, ref)
+			} else if err := store.Set(ctx, ref, k.Key); err != nil {
+				return nil, fmt.Errorf("error storing the CSEK key for %s in the %s key store: %w", ref, storeType, err)
+			}
+			k.Key, k.KeyRef = "", ref
+		}
+		stored[i] = k
+	}
+	return stored, nil
+}
+
+// DeleteStoredKeys deletes the keys of 'm' from the key store, eg: after the
+// machine was deleted.
+func (c *config) DeleteStoredKeys(ctx context.Context, m machine) error {
+	c.mu.RLock()
+	settings := c.KeyStore
+	c.mu.RUnlock()
+	if settings == nil {
+		return nil
+	}
+	var csek gcp.CSEKBundle
+	for _, b := range m.bundles() {
+		csek = append(csek, *b...)
+	}
+	return c.deleteStoredKeys(ctx, *settings, csek)
+}
+
+// DeleteWithKeys deletes the machine 'name' and its keys in the key store, eg:
+// when its instance was never created.
+func (c *config) DeleteWithKeys(ctx context.Context, name string) error {
+	m, err := c.Get(name)
+	if err != nil {
+		return err
+	}
+	if err := c.Delete(name); err != nil {
+		return err
+	}
+	return c.DeleteStoredKeys(ctx, m)
+}
+
+func (c *config) deleteStoredKeys(ctx context.Context, settings keystore.Settings, csek gcp.CSEKBundle) error {
+	store, err := c.keyStore(settings)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, k := range csek {
+		if k.KeyRef == "" {
+			continue
+		}
+		if DryRun != nil {
+			fmt.Fprintf(DryRun, "[dry-run] key store %s: delete the key for %s\n", settings.Type, k.KeyRef)
+			continue
+		}
+		if err := store.Delete(ctx, k.KeyRef); err != nil {
+			errs = append(errs, fmt.Errorf("error deleting the CSEK key for %s from the %s key store: %w", k.KeyRef, settings.Type, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// MoveKeys moves all of the CSEK keys to the key store 'to', or into the config
+// file if 'to' is nil. Keys moved into the config file are encrypted if the config
+// file's keys are encrypted. The keys are copied to the new store before the
+// config file is changed and deleted from the old store afterwards, so a failure
+// never leaves the config file without a working key. It returns the number of
+// keys moved.
+func (c *config) MoveKeys(ctx context.Context, to *keystore.Settings) (int, error) {
+	c.mu.RLock()
+	from := c.KeyStore
+	names := make([]string, len(c.Machines))
+	for i, m := range c.Machines {
+		names[i] = m.Name
+		if m.Rotation != nil {
+			c.mu.RUnlock()
+			return 0, fmt.Errorf("the CSEK key of machine '%s' is being rotated, run 'gmachine keys rotate %s' to finish it first", m.Name, m.Name)
+		}
+	}
+	c.mu.RUnlock()
+
+	if keystore.Same(from, to, filepath.Dir(c.filename)) {
+		return 0, errors.New("the CSEK keys are already stored there")
+	}
+	// keys moved into an encrypted config file must be encrypted
+	if to == nil && c.Locked() {
+		return 0, ErrLocked
+	}
+
+	// read every key, from wherever it is now
+	current := map[string]gcp.CSEKBundle{}
+	moved := map[string]gcp.CSEKBundle{}
+	n := 0
+	for _, name := range names {
+		csek, err := c.CSEK(ctx, name)
+		if err != nil {
+			return 0, err
+		}
+		m, _ := c.Get(name)
+		current[name] = m.CSEK
+		moved[name] = csek
+		n += len(csek)
+	}
+
+	toType := "config"
+	if to != nil {
+		toType = to.Type
+		store, err := c.keyStore(*to)
+		if err != nil {
+			return 0, err
+		}
+		for name, csek := range moved {
+			if moved[name], err = storeKeys(ctx, store, to.Type, csek); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	err := c.update(fmt.Sprintf("move %d CSEK keys to %s", n, toType), func(c *config) error {
+		for i, m := range c.Machines {
+			csek, ok := moved[m.Name]
+			if !ok || !reflect.DeepEqual(m.CSEK, current[m.Name]) {
+				return fmt.Errorf("the CSEK keys of machine '%s' were changed by another gmachine process, run the command again", m.Name)
+			}
+			c.Machines[i].CSEK = csek
+		}
+		c.KeyStore = to
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if from != nil {
+		for _, csek := range current {
+			if err := c.deleteStoredKeys(ctx, *from, csek); err != nil {
+				// the keys are in the new store, leaving a copy behind is not fatal
+				slog.Warn("could not delete a CSEK key from the old key store", "error", err)
+			}
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,102 @@
+package config_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/joemiller/gmachine/internal/config"
+	"github.com/joemiller/gmachine/internal/gcp"
+	"github.com/joemiller/gmachine/internal/keystore"
+	"github.com/stretchr/testify/assert"
+)
+
+const testDiskURI = "https://www.googleapis.com/compute/v1/projects/my-proj/zones/zone1/disks/foo"
+
+func TestStoreKeys(t *testing.T) {
+	ctx := context.Background()
+	tmpfile := tempFile(t, "version: 4\nkey_store:\n  type: fake\n")
+	cfg, err := config.LoadFile(tmpfile)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, keystore.TypeFake, cfg.KeyStoreType())
+
+	csek := gcp.CSEKBundle{{URI: testDiskURI, Key: testKey, KeyType: "raw"}}
+	stored, err := cfg.StoreKeys(ctx, csek)
+	assert.NoError(t, err)
+	assert.Equal(t, gcp.CSEKBundle{{URI: testDiskURI, KeyType: "raw", KeyRef: "projects/my-proj/zones/zone1/disks/foo"}}, stored)
+	assert.NoError(t, cfg.Add("foo", "my-account", "my-proj", "zone1", stored))
+
+	// only the reference is in the config file
+	data, _ := os.ReadFile(tmpfile)
+	assert.NotContains(t, string(data), testKey)
+	assert.Contains(t, string(data), "key-ref: projects/my-proj/zones/zone1/disks/foo")
+
+	// another process reads the key from the store
+	cfg2, err := config.LoadFile(tmpfile)
+	assert.NoError(t, err)
+	got, err := cfg2.CSEK(ctx, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, csek, got)
+
+	m, _ := cfg2.Get("foo")
+	assert.NoError(t, cfg2.Delete("foo"))
+	assert.NoError(t, cfg2.DeleteStoredKeys(ctx, m))
+	_, err = keystore.NewFake(filepath.Join(filepath.Dir(tmpfile), "fake-keystore.json")).Get(ctx, stored[0].KeyRef)
+	assert.ErrorIs(t, err, keystore.ErrNotFound)
+}
+
+func TestMoveKeys(t *testing.T) {
+	ctx := context.Background()
+	tmpfile := tempFile(t, "")
+	cfg, err := config.LoadFile(tmpfile)
+	assert.NoError(t, err)
+	csek := gcp.CSEKBundle{{URI: testDiskURI, Key: testKey, KeyType: "raw"}}
+	assert.NoError(t, cfg.Add("foo", "my-account", "my-proj", "zone1", csek))
+	assert.NoError(t, cfg.Add("bar", "my-account", "my-proj", "zone1", nil))
+
+	// config file to a key store
+	n, err := cfg.MoveKeys(ctx, &keystore.Settings{Type: keystore.TypeFake})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	data, _ := os.ReadFile(tmpfile)
+	assert.NotContains(t, string(data), testKey)
+	assert.Contains(t, string(data), "type: fake")
+	got, err := cfg.CSEK(ctx, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, csek, got)
+
+	_, err = cfg.MoveKeys(ctx, &keystore.Settings{Type: keystore.TypeFake, Path: "fake-keystore.json"})
+	assert.ErrorContains(t, err, "already stored there")
+
+	// to another key store, the old store's copy is deleted
+	n, err = cfg.MoveKeys(ctx, &keystore.Settings{Type: keystore.TypeFile})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	_, err = keystore.NewFake(filepath.Join(filepath.Dir(tmpfile), "fake-keystore.json")).Get(ctx, "projects/my-proj/zones/zone1/disks/foo")
+	assert.ErrorIs(t, err, keystore.ErrNotFound)
+
+	// back into an encrypted config file, the keys must be unlocked
+	assert.NoError(t, cfg.EncryptKeys([]byte(testPassphrase)))
+	cfg2, err := config.LoadFile(tmpfile)
+	assert.NoError(t, err)
+	_, err = cfg2.MoveKeys(ctx, nil)
+	assert.ErrorIs(t, err, config.ErrLocked)
+	key, err := cfg2.PassphraseKey([]byte(testPassphrase))
+	assert.NoError(t, err)
+	assert.NoError(t, cfg2.Unlock(key))
+	n, err = cfg2.MoveKeys(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, "", cfg2.KeyStoreType())
+
+	data, _ = os.ReadFile(tmpfile)
+	assert.NotContains(t, string(data), testKey)
+	assert.NotContains(t, string(data), "key_store")
+	assert.Contains(t, string(data), "encrypted-key:")
+	got, err = cfg2.CSEK(ctx, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, csek, got)
+}
@@ -0,0 +1,132 @@
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// CurrentVersion is the version of the config file format written by this
+// version of gmachine. Increment it when older versions of gmachine would misuse
+// files in the new format, so that they refuse them instead, and add a migration
+// to 'migrations' if older files need to change. Optional fields that older
+// versions can ignore do not need a new version, nor do keys they can still use,
+// eg: 'rsa-encrypted' CSEK keys. The versions are:
+//
+//  1. the original format, without a version
+//  2. 'ssh_args' lists and explicit CSEK 'key-type's, see migrateV1
+//  3. the 'encryption' section and 'encrypted-key' CSEK keys
+//  4. the 'key_store' section and 'key-ref' CSEK keys
+const CurrentVersion = 4
+
+// document is a config file decoded without a schema so that it can be migrated
+// regardless of its version.
+type document map[interface{}]interface{}
+
+// migrations upgrade a document from the version they are keyed by to the next
+// version. They are run in order until the document is at CurrentVersion.
+// Versions without a migration only need their version number changed.
+var migrations = map[int]func(document) error{
+	1: migrateV1,
+}
+
+// migrateV1 upgrades a version 1 document to version 2:
+//   - the machines' 'default_ssh_args' string is replaced by the 'ssh_args' list
+//   - CSEK keys without a 'key-type' are 'raw', the only type gmachine created
+func migrateV1(doc document) error {
+	for _, m := range doc.machines() {
+		if args, ok := m["default_ssh_args"]; ok {
+			s, ok := args.(string)
+			if !ok && args != nil {
+				return fmt.Errorf("machine '%v': default_ssh_args must be a string, not %T", m["name"], args)
+			}
+			if fields := strings.Fields(s); len(fields) > 0 {
+				m["ssh_args"] = fields
+			}
+			delete(m, "default_ssh_args")
+		}
+
+		keys, _ := m["csek"].([]interface{})
+		for _, k := range keys {
+			if key, ok := k.(document); ok && key["key-type"] == nil {
+				key["key-type"] = "raw"
+			}
+		}
+	}
+	return nil
+}
+
+// machines returns the document's machines that are maps, ignoring any other
+// entries so that they are reported by the typed unmarshal that follows.
+func (d document) machines() []document {
+	var machines []document
+	list, _ := d["machines"].([]interface{})
+	for _, m := range list {
+		if m, ok := m.(document); ok {
+			machines = append(machines, m)
+		}
+	}
+	return machines
+}
+
+// fileVersion returns the version of the config file 'data'. Files written before
+// the version was checked may not have one, they are version 1. Empty files are
+// new config files at CurrentVersion.
+func fileVersion(data []byte) (int, error) {
+	doc := document{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return 0, err
+	}
+	if len(doc) == 0 {
+		return CurrentVersion, nil
+	}
+	switch v := doc["version"].(type) {
+	case nil:
+		return 1, nil
+	case int:
+		if v < 1 {
+			return 0, fmt.Errorf("invalid config file version %d", v)
+		}
+		return v, nil
+	default:
+		return 0, fmt.Errorf("invalid config file version '%v'", v)
+	}
+}
+
+// migrate upgrades the config file 'data' at 'version' to CurrentVersion, one
+// version at a time, and returns the upgraded file. 'version' must not be newer
+// than CurrentVersion.
+func migrate(data []byte, version int) ([]byte, error) {
+	doc := document{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	for v := version; v < CurrentVersion; v++ {
+		if fn, ok := migrations[v]; ok {
+			if err := fn(doc); err != nil {
+				return nil, fmt.Errorf("migrating from version %d to %d: %w", v, v+1, err)
+			}
+		}
+		doc["version"] = v + 1
+		slog.Debug("migrated config", "from", v, "to", v+1)
+	}
+	return yaml.Marshal(doc)
+}
+
+// backup copies the config file 'data' at 'version' to a file next to 'path'
+// before it is migrated, eg: gmachine.yaml.v1.bak. An existing backup is not
+// overwritten, the new backup's name includes the time instead.
+func backup(path string, data []byte, version int) (string, error) {
+	name := fmt.Sprintf("%s.v%d.bak", path, version)
+	if fileExists(name) {
+		name = fmt.Sprintf("%s.v%d.%s.bak", path, version, time.Now().Format("20060102150405"))
+	}
+	if err := os.WriteFile(name, data, 0o600); err != nil {
+		return "", err
+	}
+	return name, nil
+}
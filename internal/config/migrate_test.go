@@ -0,0 +1,134 @@
+package config_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/joemiller/gmachine/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// copyFixture copies the testdata file 'name' to a temp dir and returns its path
+// and contents.
+func copyFixture(t *testing.T, name string) (string, []byte) {
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	assert.NoError(t, err)
+	return tempFile(t, string(data)), data
+}
+
+func TestLoadFile_migrations(t *testing.T) {
+	tests := []struct {
+		fixture string
+		backup  string // name of the backup file, empty if the file is not migrated
+		err     string
+		sshArgs []string
+		keyType string
+	}{
+		{fixture: "v1.yaml", backup: "temp.yaml.v1.bak", sshArgs: []string{"-A", "-C"}, keyType: "raw"},
+		{fixture: "v1-no-version.yaml", backup: "temp.yaml.v1.bak", sshArgs: []string{"-A", "-C"}, keyType: "raw"},
+		{fixture: "v2.yaml", backup: "temp.yaml.v2.bak", sshArgs: []string{"-A", "-C"}, keyType: "raw"},
+		{fixture: "v3.yaml", backup: "temp.yaml.v3.bak", sshArgs: []string{"-A", "-C"}, keyType: "raw"},
+		{fixture: "v4.yaml", sshArgs: []string{"-A", "-C"}, keyType: "raw"},
+		{fixture: "future.yaml", err: fmt.Sprintf("written by a newer version of gmachine (config version 99, this version supports up to %d)", config.CurrentVersion)},
+		{fixture: "invalid-version.yaml", err: "invalid config file version 'latest'"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.fixture, func(t *testing.T) {
+			file, original := copyFixture(t, tc.fixture)
+
+			cfg, err := config.LoadFile(file)
+			if tc.err != "" {
+				assert.ErrorContains(t, err, tc.err)
+				assert.Nil(t, cfg)
+
+				// the file is not changed
+				data, _ := os.ReadFile(file)
+				assert.Equal(t, original, data)
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			assert.Equal(t, config.CurrentVersion, cfg.Version)
+			assert.Equal(t, "foo", cfg.Default)
+			m, err := cfg.Get("foo")
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, "my-account", m.Account)
+			assert.Equal(t, tc.sshArgs, m.SSHArgs)
+			assert.Equal(t, tc.keyType, m.CSEK[0].KeyType)
+
+			backups, _ := filepath.Glob(file + ".*.bak")
+			if tc.backup == "" {
+				assert.Empty(t, backups)
+				return
+			}
+			if !assert.Len(t, backups, 1) {
+				return
+			}
+			assert.Equal(t, tc.backup, filepath.Base(backups[0]))
+			data, _ := os.ReadFile(backups[0])
+			assert.Equal(t, original, data)
+
+			// the migrated file is saved and loads without migrating again
+			data, _ = os.ReadFile(file)
+			assert.Contains(t, string(data), fmt.Sprintf("version: %d", config.CurrentVersion))
+			assert.NotContains(t, string(data), "default_ssh_args")
+			cfg2, err := config.LoadFile(file)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, cfg.Machines, cfg2.Machines)
+			backups, _ = filepath.Glob(file + ".*.bak")
+			assert.Len(t, backups, 1)
+		})
+	}
+}
+
+func TestLoadFile_migration_existing_backup(t *testing.T) {
+	file, original := copyFixture(t, "v1.yaml")
+	err := os.WriteFile(file+".v1.bak", []byte("older backup"), 0o600)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, err = config.LoadFile(file)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// the existing backup is kept
+	data, _ := os.ReadFile(file + ".v1.bak")
+	assert.Equal(t, "older backup", string(data))
+	backups, _ := filepath.Glob(file + ".v1.*.bak")
+	if !assert.Len(t, backups, 1) {
+		return
+	}
+	data, _ = os.ReadFile(backups[0])
+	assert.Equal(t, original, data)
+}
+
+func TestLoadFile_migration_dryRun(t *testing.T) {
+	var out bytes.Buffer
+	config.DryRun = &out
+	t.Cleanup(func() { config.DryRun = nil })
+
+	file, original := copyFixture(t, "v1.yaml")
+	cfg, err := config.LoadFile(file)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, config.CurrentVersion, cfg.Version)
+	assert.Contains(t, out.String(), fmt.Sprintf("migrate from version 1 to %d", config.CurrentVersion))
+
+	// neither the file nor a backup is written
+	data, _ := os.ReadFile(file)
+	assert.Equal(t, original, data)
+	backups, _ := filepath.Glob(file + ".*.bak")
+	assert.Empty(t, backups)
+}
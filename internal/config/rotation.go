@@ -0,0 +1,166 @@
+package config
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/joemiller/gmachine/internal/gcp"
+)
+
+// Rotation is the journal of a machine's CSEK key rotation. It is saved in the
+// config file before each step so that an interrupted rotation can be resumed,
+// and so that the key of the boot disk that is attached is always in the config
+// file: the machine's CSEK keys are only replaced with the new disk's key once
+// the new disk is attached, see CommitRotation.
+type Rotation struct {
+	// Step is the next step to run, eg: "snapshot"
+	Step       string `yaml:"step"`
+	OldDisk    string `yaml:"old_disk"`
+	NewDisk    string `yaml:"new_disk"`
+	Snapshot   string `yaml:"snapshot"`
+	DeviceName string `yaml:"device_name"`
+	// Restart is true if the machine was running and is started again when the
+	// rotation is finished.
+	Restart     bool `yaml:"restart,omitempty"`
+	KeepOldDisk bool `yaml:"keep_old_disk,omitempty"`
+	// CSEK holds the keys of the new disk and the snapshot. They are encrypted or
+	// stored in the key store like the machine's keys.
+	CSEK gcp.CSEKBundle `yaml:"csek"`
+	// OldCSEK holds the machine's previous keys once the rotation is committed,
+	// until they are deleted from the key store.
+	OldCSEK gcp.CSEKBundle `yaml:"old_csek,omitempty"`
+}
+
+// Rotation returns the unfinished key rotation of the machine 'name', or nil.
+func (c *config) Rotation(name string) (*Rotation, error) {
+	m, err := c.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if m.Rotation == nil {
+		return nil, nil
+	}
+	r := *m.Rotation
+	return &r, nil
+}
+
+// BeginRotation saves the journal 'r' of a new key rotation of the machine
+// 'name'. The keys in r.CSEK are stored in the key store first, if the config
+// file uses one.
+func (c *config) BeginRotation(ctx context.Context, name string, r Rotation) error {
+	if _, err := c.Get(name); err != nil {
+		return err
+	}
+	stored, err := c.StoreKeys(ctx, r.CSEK)
+	if err != nil {
+		return err
+	}
+	r.CSEK = stored
+
+	change := fmt.Sprintf("begin CSEK key rotation of machine '%s' (new disk: %s, snapshot: %s)", name, r.NewDisk, r.Snapshot)
+	return c.updateMachine(change, name, func(c *config, m *machine) error {
+		if m.Rotation != nil {
+			return fmt.Errorf("the CSEK key of machine '%s' is already being rotated", name)
+		}
+		if hasPlaintextKey(r.CSEK) && c.Encryption != nil && c.dataKey == nil {
+			return ErrLocked
+		}
+		m.Rotation = &r
+		return nil
+	})
+}
+
+// SetRotationStep records that the rotation of the machine 'name' has reached
+// 'step'.
+func (c *config) SetRotationStep(name, step string) error {
+	return c.updateMachine(fmt.Sprintf("set CSEK key rotation step of machine '%s' to %s", name, step), name, func(c *config, m *machine) error {
+		if m.Rotation == nil {
+			return fmt.Errorf("the CSEK key of machine '%s' is not being rotated", name)
+		}
+		m.Rotation.Step = step
+		return nil
+	})
+}
+
+// RotationCSEK returns the keys of the new disk and snapshot of the rotation of
+// the machine 'name', decrypted or read from the key store.
+func (c *config) RotationCSEK(ctx context.Context, name string) (gcp.CSEKBundle, error) {
+	r, err := c.Rotation(name)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, fmt.Errorf("the CSEK key of machine '%s' is not being rotated", name)
+	}
+	return c.openKeys(ctx, r.CSEK)
+}
+
+// CommitRotation replaces the CSEK key of the old boot disk of the machine 'name'
+// with the key of the rotation's new disk, once it is attached, and moves the
+// step on to 'step'. The old key is kept in the journal until FinishRotation, the
+// keys of data disks are not changed.
+func (c *config) CommitRotation(name, step string) error {
+	return c.updateMachine(fmt.Sprintf("commit CSEK key rotation of machine '%s'", name), name, func(c *config, m *machine) error {
+		r := m.Rotation
+		if r == nil {
+			return fmt.Errorf("the CSEK key of machine '%s' is not being rotated", name)
+		}
+		if r.OldCSEK != nil {
+			// already committed
+			r.Step = step
+			return nil
+		}
+		disk, rest := partitionKeys(r.CSEK, gcp.DiskURI(m.Project, m.Zone, r.NewDisk))
+		if len(disk) == 0 {
+			return fmt.Errorf("the rotation of machine '%s' has no CSEK key for disk %s", name, r.NewDisk)
+		}
+		old, keep := partitionKeys(m.CSEK, gcp.DiskURI(m.Project, m.Zone, r.OldDisk))
+		if len(old) == 0 {
+			return fmt.Errorf("machine '%s' has no CSEK key for disk %s", name, r.OldDisk)
+		}
+		r.OldCSEK, m.CSEK, r.CSEK = old, append(disk, keep...), rest
+		r.Step = step
+		return nil
+	})
+}
+
+// FinishRotation removes the journal of the committed rotation of the machine
+// 'name' and deletes the old keys from the key store. If the old disk was kept it
+// is added as a detached data disk instead, with its key.
+func (c *config) FinishRotation(ctx context.Context, name string) error {
+	r, err := c.Rotation(name)
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		return nil
+	}
+	if r.OldCSEK == nil {
+		return fmt.Errorf("the rotation of machine '%s' has not been committed", name)
+	}
+
+	err = c.updateMachine(fmt.Sprintf("finish CSEK key rotation of machine '%s'", name), name, func(c *config, m *machine) error {
+		if r.KeepOldDisk {
+			// the boot disk's device name is taken by the new disk
+			m.Disks = append(m.Disks, Disk{Name: r.OldDisk})
+			m.CSEK = append(m.CSEK, r.OldCSEK...)
+		}
+		m.Rotation = nil
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	c.mu.RLock()
+	settings := c.KeyStore
+	c.mu.RUnlock()
+	if settings == nil {
+		return nil
+	}
+	old := r.CSEK
+	if !r.KeepOldDisk {
+		old = append(r.OldCSEK, old...)
+	}
+	return c.deleteStoredKeys(ctx, *settings, old)
+}
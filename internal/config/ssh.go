@@ -0,0 +1,76 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/joemiller/gmachine/internal/gcp"
+)
+
+// SSH holds how 'gmachine ssh' connects to a machine when no connection flags
+// are given, see gcp.SSHOptions.
+type SSH struct {
+	// Mode is gcp.SSHModeIAP or gcp.SSHModeInternalIP, or "" for the machine's
+	// external IP
+	Mode string `yaml:"mode,omitempty"`
+	// JumpHost is the name of another machine to connect through
+	JumpHost string `yaml:"jump_host,omitempty"`
+	// Native connects with the system ssh client and a key managed by gmachine
+	// instead of 'gcloud compute ssh'
+	Native bool `yaml:"native,omitempty"`
+	// OSLogin adds the native key to the account's OS Login profile instead of
+	// the instance's metadata, even if the instance does not enable OS Login
+	OSLogin bool `yaml:"os_login,omitempty"`
+	// AutoStart starts the machine, or resumes it, if it is not running when
+	// connecting to it
+	AutoStart bool `yaml:"auto_start,omitempty"`
+}
+
+// SetSSH sets how 'gmachine ssh' connects to the machine 'name' by default. The
+// jump host, if any, must be another machine in the config file.
+func (c *config) SetSSH(name string, ssh SSH) error {
+	return c.updateMachine(fmt.Sprintf("set ssh settings of machine '%s' to %+v", name, ssh), name, func(c *config, m *machine) error {
+		if ssh.JumpHost != "" {
+			if ssh.JumpHost == name {
+				return fmt.Errorf("machine '%s' cannot be its own jump host", name)
+			}
+			if !c.exists(ssh.JumpHost) {
+				return fmt.Errorf("jump host '%s' not found in config file", ssh.JumpHost)
+			}
+		}
+		opts := gcp.SSHOptions{Mode: ssh.Mode}
+		if ssh.JumpHost != "" {
+			opts.JumpHost = &gcp.InstanceRef{Name: ssh.JumpHost}
+		}
+		if err := opts.Validate(); err != nil {
+			return err
+		}
+		if ssh.OSLogin && !ssh.Native {
+			return errors.New("OS Login keys are only used by native ssh")
+		}
+		m.SSH = nil
+		if ssh != (SSH{}) {
+			m.SSH = &ssh
+		}
+		return nil
+	})
+}
+
+// SetHostKeys pins the ssh host keys of the machine 'name', as "TYPE BASE64"
+// lines, replacing any pinned before.
+func (c *config) SetHostKeys(name string, keys []string) error {
+	return c.updateMachine(fmt.Sprintf("set host keys of machine '%s' to %v", name, keys), name, func(c *config, m *machine) error {
+		m.HostKeys = keys
+		return nil
+	})
+}
+
+// SetOSLoginUser records the POSIX username of the OS Login profile that the
+// native ssh key of the machine 'name' was added to, so that it is known without
+// adding the key again, eg: by 'gmachine ssh-config'.
+func (c *config) SetOSLoginUser(name, user string) error {
+	return c.updateMachine(fmt.Sprintf("set OS Login user of machine '%s' to '%s'", name, user), name, func(c *config, m *machine) error {
+		m.OSLoginUser = user
+		return nil
+	})
+}
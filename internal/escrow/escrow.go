@@ -0,0 +1,358 @@
+// Package escrow exports a machine's CSEK keys to an encrypted escrow file so
+// that they can be recovered if the config file is lost, eg: with the laptop it
+// was on.
+//
+// The machine is encrypted with a random file key, which is in turn encrypted
+// with a passphrase, or with the RSA public keys of one or more recipients, or
+// split into Shamir shares that are kept by different people and written to
+// separate share files. The decrypted machine's CSEK keys use the same JSON
+// format as gcloud's --csek-key-file.
+package escrow
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/joemiller/gmachine/internal/gcp"
+	"github.com/joemiller/gmachine/internal/keys"
+	"gopkg.in/yaml.v2"
+)
+
+// Version is the version of the escrow and share file formats.
+const Version = 1
+
+// Machine is the machine record in an escrow file, with its decrypted CSEK keys.
+type Machine struct {
+	Name    string         `json:"name"`
+	Account string         `json:"account"`
+	Project string         `json:"project"`
+	Zone    string         `json:"zone"`
+	KMSKey  string         `json:"kms_key,omitempty"`
+	CSEK    gcp.CSEKBundle `json:"csek"`
+	Disks   []Disk         `json:"disks,omitempty"`
+}
+
+// Disk is a data disk of the machine in an escrow file. Its key, if it is CSEK
+// encrypted, is in the machine's CSEK keys.
+type Disk struct {
+	Name       string `json:"name"`
+	DeviceName string `json:"device_name"`
+	Attached   bool   `json:"attached"`
+}
+
+// File is an escrow file. Exactly one of Passphrase, Recipients and Shares is
+// set, depending on how the file key is protected.
+type File struct {
+	Version int       `yaml:"gmachine_escrow"`
+	Machine string    `yaml:"machine"`
+	Created time.Time `yaml:"created"`
+	// Passphrase has the parameters to derive the file key from the passphrase.
+	Passphrase *keys.KDFParams `yaml:"passphrase,omitempty"`
+	// Recipients have the file key encrypted with their RSA public keys.
+	Recipients []Recipient `yaml:"recipients,omitempty"`
+	// Shares describes the Shamir shares of the file key, which are in share
+	// files.
+	Shares *SharesInfo `yaml:"shares,omitempty"`
+	// Data is the Machine as JSON, encrypted with the file key, see keys.Seal.
+	Data string `yaml:"data"`
+}
+
+// Recipient is the file key encrypted with a recipient's RSA public key.
+type Recipient struct {
+	Fingerprint string `yaml:"fingerprint"`
+	Key         string `yaml:"key"` // base64
+}
+
+// SharesInfo describes the Shamir shares of a file key.
+type SharesInfo struct {
+	ID        string `yaml:"id"` // identifies the shares of the same file key
+	Count     int    `yaml:"count"`
+	Threshold int    `yaml:"threshold"`
+}
+
+// Share is a share file, one of the Shamir shares of a file key.
+type Share struct {
+	Version   int    `yaml:"gmachine_escrow_share"`
+	Machine   string `yaml:"machine"`
+	ID        string `yaml:"id"`
+	Threshold int    `yaml:"threshold"`
+	Index     int    `yaml:"index"`
+	Share     string `yaml:"share"` // base64
+}
+
+// Options of Export. Set one of Passphrase, Recipients, or Shares and Threshold.
+type Options struct {
+	Passphrase []byte
+	Recipients []*rsa.PublicKey
+	// Shares is the number of shares to split the file key into, any Threshold of
+	// them recover it.
+	Shares    int
+	Threshold int
+	// Now returns the current time, defaults to time.Now.
+	Now func() time.Time
+}
+
+// oaepLabel binds RSA encrypted file keys to escrow files.
+var oaepLabel = []byte("gmachine-escrow")
+
+// Export encrypts 'm' and returns the escrow file, and its share files if the
+// file key is split into shares.
+func Export(m Machine, opts Options) (*File, []Share, error) {
+	if len(m.CSEK) == 0 {
+		return nil, nil, fmt.Errorf("machine %s has no CSEK keys to export", m.Name)
+	}
+	for _, k := range m.CSEK {
+		if k.Key == "" {
+			return nil, nil, fmt.Errorf("the CSEK key for %s is not decrypted", k.URI)
+		}
+	}
+	modes := 0
+	for _, set := range []bool{len(opts.Passphrase) > 0, len(opts.Recipients) > 0, opts.Shares > 0} {
+		if set {
+			modes++
+		}
+	}
+	if modes != 1 {
+		return nil, nil, errors.New("exactly one of a passphrase, recipients or shares is required")
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+
+	f := &File{Version: Version, Machine: m.Name, Created: opts.Now().UTC().Truncate(time.Second)}
+	var fileKey []byte
+	var shares []Share
+	var err error
+	switch {
+	case len(opts.Passphrase) > 0:
+		params, err := keys.NewKDFParams()
+		if err != nil {
+			return nil, nil, err
+		}
+		f.Passphrase = &params
+		if fileKey, err = params.DeriveKey(opts.Passphrase); err != nil {
+			return nil, nil, err
+		}
+
+	case len(opts.Recipients) > 0:
+		if fileKey, err = keys.NewKey(); err != nil {
+			return nil, nil, err
+		}
+		for _, pub := range opts.Recipients {
+			wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, fileKey, oaepLabel)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed encrypting the file key for %s: %w", Fingerprint(pub), err)
+			}
+			f.Recipients = append(f.Recipients, Recipient{Fingerprint: Fingerprint(pub), Key: base64.StdEncoding.EncodeToString(wrapped)})
+		}
+
+	default:
+		if fileKey, err = keys.NewKey(); err != nil {
+			return nil, nil, err
+		}
+		parts, err := split(fileKey, opts.Shares, opts.Threshold)
+		if err != nil {
+			return nil, nil, err
+		}
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			return nil, nil, err
+		}
+		f.Shares = &SharesInfo{ID: hex.EncodeToString(id), Count: opts.Shares, Threshold: opts.Threshold}
+		for i, p := range parts {
+			shares = append(shares, Share{
+				Version:   Version,
+				Machine:   m.Name,
+				ID:        f.Shares.ID,
+				Threshold: opts.Threshold,
+				Index:     i + 1,
+				Share:     base64.StdEncoding.EncodeToString(p),
+			})
+		}
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, nil, err
+	}
+	if f.Data, err = keys.Seal(fileKey, data, f.aad()); err != nil {
+		return nil, nil, err
+	}
+	return f, shares, nil
+}
+
+// aad binds the encrypted machine to the file's machine name.
+func (f *File) aad() []byte {
+	return []byte(fmt.Sprintf("gmachine-escrow-v%d:%s", f.Version, f.Machine))
+}
+
+// OpenPassphrase decrypts a passphrase protected escrow file.
+func (f *File) OpenPassphrase(passphrase []byte) (Machine, error) {
+	if f.Passphrase == nil {
+		return Machine{}, errors.New("the escrow file is not protected with a passphrase")
+	}
+	fileKey, err := f.Passphrase.DeriveKey(passphrase)
+	if err != nil {
+		return Machine{}, err
+	}
+	return f.open(fileKey)
+}
+
+// OpenIdentity decrypts an escrow file with the private key of one of its
+// recipients.
+func (f *File) OpenIdentity(priv *rsa.PrivateKey) (Machine, error) {
+	fp := Fingerprint(&priv.PublicKey)
+	for _, r := range f.Recipients {
+		if r.Fingerprint != fp {
+			continue
+		}
+		wrapped, err := base64.StdEncoding.DecodeString(r.Key)
+		if err != nil {
+			return Machine{}, fmt.Errorf("invalid file key for %s: %w", fp, err)
+		}
+		fileKey, err := rsa.DecryptOAEP(sha256.New(), nil, priv, wrapped, oaepLabel)
+		if err != nil {
+			return Machine{}, keys.ErrDecrypt
+		}
+		return f.open(fileKey)
+	}
+	if len(f.Recipients) == 0 {
+		return Machine{}, errors.New("the escrow file is not encrypted for recipients")
+	}
+	return Machine{}, fmt.Errorf("the escrow file is not encrypted for the key %s", fp)
+}
+
+// OpenShares decrypts an escrow file with at least the threshold of its shares.
+func (f *File) OpenShares(shares []Share) (Machine, error) {
+	if f.Shares == nil {
+		return Machine{}, errors.New("the escrow file's key is not split into shares")
+	}
+	parts := map[int][]byte{}
+	for _, s := range shares {
+		if s.ID != f.Shares.ID {
+			return Machine{}, fmt.Errorf("share %d of %s is not a share of this escrow file", s.Index, s.Machine)
+		}
+		b, err := base64.StdEncoding.DecodeString(s.Share)
+		if err != nil {
+			return Machine{}, fmt.Errorf("invalid share %d: %w", s.Index, err)
+		}
+		parts[s.Index] = b
+	}
+	if len(parts) < f.Shares.Threshold {
+		return Machine{}, fmt.Errorf("%d of the %d shares are required, got %d", f.Shares.Threshold, f.Shares.Count, len(parts))
+	}
+	fileKey, err := combine(parts)
+	if err != nil {
+		return Machine{}, err
+	}
+	return f.open(fileKey)
+}
+
+func (f *File) open(fileKey []byte) (Machine, error) {
+	var m Machine
+	data, err := keys.Open(fileKey, f.Data, f.aad())
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("invalid escrow data: %w", err)
+	}
+	return m, nil
+}
+
+// Fingerprint returns the SHA-256 fingerprint of an RSA public key, like
+// ssh-keygen -l.
+func Fingerprint(pub *rsa.PublicKey) string {
+	der, _ := x509.MarshalPKIXPublicKey(pub)
+	sum := sha256.Sum256(der)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// Marshal returns the escrow file as YAML.
+func (f *File) Marshal() ([]byte, error) {
+	return yaml.Marshal(f)
+}
+
+// Marshal returns the share file as YAML.
+func (s *Share) Marshal() ([]byte, error) {
+	return yaml.Marshal(s)
+}
+
+// ReadFile reads an escrow file.
+func ReadFile(path string) (*File, error) {
+	var f File
+	if err := readYAML(path, &f); err != nil {
+		return nil, err
+	}
+	if f.Version != Version {
+		return nil, fmt.Errorf("%s is not a gmachine escrow file, or was written by a newer version of gmachine", path)
+	}
+	return &f, nil
+}
+
+// ReadShares reads share files, sorted by index.
+func ReadShares(paths []string) ([]Share, error) {
+	var shares []Share
+	for _, path := range paths {
+		var s Share
+		if err := readYAML(path, &s); err != nil {
+			return nil, err
+		}
+		if s.Version != Version {
+			return nil, fmt.Errorf("%s is not a gmachine escrow share file, or was written by a newer version of gmachine", path)
+		}
+		shares = append(shares, s)
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].Index < shares[j].Index })
+	return shares, nil
+}
+
+func readYAML(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := yaml.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed parsing %s: %w", path, err)
+	}
+	return nil
+}
+
+// ReadPrivateKey reads an unencrypted RSA private key from the PEM file 'path',
+// in PKCS #1 or PKCS #8 format.
+func ReadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", path)
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing private key %s: %w", path, err)
+		}
+		priv, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s does not have an RSA private key", path)
+		}
+		return priv, nil
+	}
+	return nil, fmt.Errorf("%s has a PEM block of type '%s', expected an unencrypted RSA PRIVATE KEY or PRIVATE KEY", path, block.Type)
+}
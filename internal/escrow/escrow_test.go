@@ -0,0 +1,199 @@
+package escrow_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/joemiller/gmachine/internal/escrow"
+	"github.com/joemiller/gmachine/internal/gcp"
+	"github.com/joemiller/gmachine/internal/keys"
+	"github.com/stretchr/testify/assert"
+)
+
+func testMachine(t *testing.T) escrow.Machine {
+	csek, err := gcp.CreateCSEK(gcp.DiskURI("my-proj", "us-west1-a", "foo"))
+	assert.NoError(t, err)
+	data, err := gcp.CreateCSEK(gcp.DiskURI("my-proj", "us-west1-a", "foo-data"))
+	assert.NoError(t, err)
+	return escrow.Machine{Name: "foo", Account: "me@example.com", Project: "my-proj", Zone: "us-west1-a",
+		CSEK: append(csek, data...), Disks: []escrow.Disk{{Name: "foo-data", DeviceName: "data", Attached: true}}}
+}
+
+// roundTrip writes the escrow file and share files to a temp dir and reads them
+// back.
+func roundTrip(t *testing.T, f *escrow.File, shares []escrow.Share) (*escrow.File, []escrow.Share) {
+	dir := t.TempDir()
+	data, err := f.Marshal()
+	assert.NoError(t, err)
+	path := filepath.Join(dir, "foo.escrow")
+	assert.NoError(t, os.WriteFile(path, data, 0o600))
+	f, err = escrow.ReadFile(path)
+	assert.NoError(t, err)
+
+	paths := []string{}
+	// in reverse to check that they are sorted
+	for i := len(shares) - 1; i >= 0; i-- {
+		data, err := shares[i].Marshal()
+		assert.NoError(t, err)
+		p := filepath.Join(dir, "share-"+string(rune('a'+i)))
+		assert.NoError(t, os.WriteFile(p, data, 0o600))
+		paths = append(paths, p)
+	}
+	shares, err = escrow.ReadShares(paths)
+	assert.NoError(t, err)
+	return f, shares
+}
+
+func TestExport_passphrase(t *testing.T) {
+	m := testMachine(t)
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	f, shares, err := escrow.Export(m, escrow.Options{Passphrase: []byte("hunter2"), Now: func() time.Time { return now }})
+	assert.NoError(t, err)
+	assert.Empty(t, shares)
+	f, _ = roundTrip(t, f, nil)
+	assert.Equal(t, "foo", f.Machine)
+	assert.Equal(t, now, f.Created)
+
+	got, err := f.OpenPassphrase([]byte("hunter2"))
+	assert.NoError(t, err)
+	assert.Equal(t, m, got)
+
+	_, err = f.OpenPassphrase([]byte("hunter3"))
+	assert.ErrorIs(t, err, keys.ErrDecrypt)
+	_, err = f.OpenShares(nil)
+	assert.ErrorContains(t, err, "not split into shares")
+
+	// the encrypted data is bound to the machine's name
+	f.Machine = "bar"
+	_, err = f.OpenPassphrase([]byte("hunter2"))
+	assert.ErrorIs(t, err, keys.ErrDecrypt)
+}
+
+func TestExport_recipients(t *testing.T) {
+	m := testMachine(t)
+	alice, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	bob, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	mallory, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	f, _, err := escrow.Export(m, escrow.Options{Recipients: []*rsa.PublicKey{&alice.PublicKey, &bob.PublicKey}})
+	assert.NoError(t, err)
+	f, _ = roundTrip(t, f, nil)
+	if assert.Len(t, f.Recipients, 2) {
+		assert.Equal(t, escrow.Fingerprint(&bob.PublicKey), f.Recipients[1].Fingerprint)
+	}
+
+	for _, priv := range []*rsa.PrivateKey{alice, bob} {
+		got, err := f.OpenIdentity(priv)
+		assert.NoError(t, err)
+		assert.Equal(t, m, got)
+	}
+	_, err = f.OpenIdentity(mallory)
+	assert.ErrorContains(t, err, "is not encrypted for the key "+escrow.Fingerprint(&mallory.PublicKey))
+	_, err = f.OpenPassphrase([]byte("hunter2"))
+	assert.ErrorContains(t, err, "not protected with a passphrase")
+}
+
+func TestExport_shares(t *testing.T) {
+	m := testMachine(t)
+	f, shares, err := escrow.Export(m, escrow.Options{Shares: 5, Threshold: 3})
+	assert.NoError(t, err)
+	f, shares = roundTrip(t, f, shares)
+	if !assert.Len(t, shares, 5) {
+		return
+	}
+	assert.Equal(t, 3, f.Shares.Threshold)
+	assert.Equal(t, 1, shares[0].Index)
+
+	// any 3 or more of the shares open the file
+	for _, subset := range [][]int{{0, 1, 2}, {0, 2, 4}, {4, 3, 1}, {0, 1, 2, 3}, {0, 1, 2, 3, 4}} {
+		picked := []escrow.Share{}
+		for _, i := range subset {
+			picked = append(picked, shares[i])
+		}
+		got, err := f.OpenShares(picked)
+		if assert.NoError(t, err, subset) {
+			assert.Equal(t, m, got)
+		}
+	}
+
+	_, err = f.OpenShares(shares[:2])
+	assert.ErrorContains(t, err, "3 of the 5 shares are required, got 2")
+	// a share repeated does not count twice
+	_, err = f.OpenShares([]escrow.Share{shares[0], shares[0], shares[1]})
+	assert.ErrorContains(t, err, "got 2")
+
+	// a tampered share is detected
+	tampered := shares[2]
+	tampered.Share = shares[3].Share
+	_, err = f.OpenShares([]escrow.Share{shares[0], shares[1], tampered})
+	assert.ErrorIs(t, err, keys.ErrDecrypt)
+
+	// shares of another escrow file are rejected
+	_, other, err := escrow.Export(m, escrow.Options{Shares: 3, Threshold: 2})
+	assert.NoError(t, err)
+	_, err = f.OpenShares([]escrow.Share{shares[0], shares[1], other[2]})
+	assert.ErrorContains(t, err, "not a share of this escrow file")
+}
+
+func TestExport_invalid(t *testing.T) {
+	m := testMachine(t)
+
+	_, _, err := escrow.Export(m, escrow.Options{})
+	assert.ErrorContains(t, err, "exactly one of")
+	_, _, err = escrow.Export(m, escrow.Options{Passphrase: []byte("x"), Shares: 3, Threshold: 2})
+	assert.ErrorContains(t, err, "exactly one of")
+	_, _, err = escrow.Export(m, escrow.Options{Shares: 3, Threshold: 4})
+	assert.ErrorContains(t, err, "invalid number of shares")
+	_, _, err = escrow.Export(m, escrow.Options{Shares: 3, Threshold: 1})
+	assert.ErrorContains(t, err, "invalid number of shares")
+
+	m.CSEK[0].Key, m.CSEK[0].EncryptedKey = "", "c2VhbGVk"
+	_, _, err = escrow.Export(m, escrow.Options{Passphrase: []byte("x")})
+	assert.ErrorContains(t, err, "is not decrypted")
+	m.CSEK = nil
+	_, _, err = escrow.Export(m, escrow.Options{Passphrase: []byte("x")})
+	assert.ErrorContains(t, err, "has no CSEK keys")
+}
+
+func TestReadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "foo.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("version: 4\nmachines: []\n"), 0o600))
+	_, err := escrow.ReadFile(path)
+	assert.ErrorContains(t, err, "is not a gmachine escrow file")
+	_, err = escrow.ReadShares([]string{path})
+	assert.ErrorContains(t, err, "is not a gmachine escrow share file")
+}
+
+func TestReadPrivateKey(t *testing.T) {
+	dir := t.TempDir()
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	pkcs1 := filepath.Join(dir, "pkcs1.pem")
+	assert.NoError(t, os.WriteFile(pkcs1, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}), 0o600))
+	got, err := escrow.ReadPrivateKey(pkcs1)
+	assert.NoError(t, err)
+	assert.True(t, priv.Equal(got))
+
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	assert.NoError(t, err)
+	pkcs8 := filepath.Join(dir, "pkcs8.pem")
+	assert.NoError(t, os.WriteFile(pkcs8, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600))
+	got, err = escrow.ReadPrivateKey(pkcs8)
+	assert.NoError(t, err)
+	assert.True(t, priv.Equal(got))
+
+	encrypted := filepath.Join(dir, "encrypted.pem")
+	assert.NoError(t, os.WriteFile(encrypted, pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: der}), 0o600))
+	_, err = escrow.ReadPrivateKey(encrypted)
+	assert.ErrorContains(t, err, "expected an unencrypted RSA PRIVATE KEY or PRIVATE KEY")
+}
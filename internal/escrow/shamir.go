@@ -0,0 +1,109 @@
+package escrow
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// Shamir's secret sharing over GF(2^8): each byte of the secret is the constant
+// term of a random polynomial of degree threshold-1, and a share is the
+// polynomial evaluated at the share's index. Any threshold shares determine the
+// polynomials, fewer reveal nothing about the secret.
+
+// gfExp and gfLog are the tables of the generator 3 in GF(2^8) with the AES
+// polynomial x^8 + x^4 + x^3 + x + 1.
+var gfExp, gfLog [256]byte
+
+func init() {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		gfExp[i] = x
+		gfLog[x] = byte(i)
+		// x *= 3
+		hi := x & 0x80
+		x2 := x << 1
+		if hi != 0 {
+			x2 ^= 0x1b
+		}
+		x ^= x2
+	}
+	gfExp[255] = gfExp[0]
+}
+
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])+int(gfLog[b]))%255]
+}
+
+func div(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])-int(gfLog[b])+255)%255]
+}
+
+// split splits 'secret' into 'n' shares, any 'threshold' of which recover it.
+// Share i, at index i+1, is returned as shares[i].
+func split(secret []byte, n, threshold int) ([][]byte, error) {
+	if threshold < 2 || threshold > n || n > 255 {
+		return nil, fmt.Errorf("invalid number of shares %d with threshold %d, 2 <= threshold <= shares <= 255", n, threshold)
+	}
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret))
+	}
+	coeffs := make([]byte, threshold)
+	for b, s := range secret {
+		coeffs[0] = s
+		if _, err := rand.Read(coeffs[1:]); err != nil {
+			return nil, err
+		}
+		for i := range shares {
+			// Horner's method at x = i+1
+			x, y := byte(i+1), byte(0)
+			for c := threshold - 1; c >= 0; c-- {
+				y = mul(y, x) ^ coeffs[c]
+			}
+			shares[i][b] = y
+		}
+	}
+	return shares, nil
+}
+
+// combine recovers the secret from shares keyed by their index with Lagrange
+// interpolation at x = 0. With fewer than the threshold shares the result is
+// garbage rather than an error, the caller must authenticate it.
+func combine(shares map[int][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errors.New("at least 2 shares are required")
+	}
+	size := -1
+	for x, s := range shares {
+		if x < 1 || x > 255 {
+			return nil, fmt.Errorf("invalid share index %d", x)
+		}
+		if size != -1 && len(s) != size {
+			return nil, errors.New("the shares have different sizes")
+		}
+		size = len(s)
+	}
+
+	secret := make([]byte, size)
+	for xi, si := range shares {
+		// the Lagrange basis polynomial of xi at 0: prod(xj / (xj - xi)), in
+		// GF(2^8) subtraction is xor
+		basis := byte(1)
+		for xj := range shares {
+			if xj != xi {
+				basis = mul(basis, div(byte(xj), byte(xj)^byte(xi)))
+			}
+		}
+		for b := range secret {
+			secret[b] ^= mul(si[b], basis)
+		}
+	}
+	return secret, nil
+}
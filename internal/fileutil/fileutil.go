@@ -0,0 +1,96 @@
+// Package fileutil locks and atomically replaces files that are shared by
+// concurrent gmachine processes, such as the config file.
+package fileutil
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// LockTimeout is how long to wait for another gmachine process to release a
+// lock.
+var LockTimeout = 30 * time.Second
+
+// lockPollInterval is how often the lock is tried while another process holds it.
+const lockPollInterval = 50 * time.Millisecond
+
+// Lock takes an exclusive advisory lock (flock) that serializes changes to the
+// file 'path' between gmachine processes and returns a function that releases it.
+// The lock is held on a separate '.lock' file because the file itself is replaced
+// by WriteFileAtomic.
+func Lock(path string) (func(), error) {
+	name := path + ".lock"
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening lock file %s: %w", name, err)
+	}
+
+	deadline := time.Now().Add(LockTimeout)
+	for {
+		err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, unix.EWOULDBLOCK) && !errors.Is(err, unix.EINTR) {
+			f.Close()
+			return nil, fmt.Errorf("error locking %s: %w", name, err)
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("timed out after %s waiting for another gmachine to release the lock on %s", LockTimeout, path)
+		}
+		time.Sleep(lockPollInterval)
+	}
+
+	return func() {
+		unix.Flock(int(f.Fd()), unix.LOCK_UN) // closing the file releases the lock too
+		f.Close()
+	}, nil
+}
+
+// WriteFileAtomic writes 'data' to a temp file in the same directory as 'name'
+// and renames it over 'name', so that readers see either the old or the new file
+// and never a partially written one, even if gmachine or the system crashes.
+func WriteFileAtomic(name string, data []byte, perm os.FileMode) (err error) {
+	dir := filepath.Dir(name)
+	f, err := os.CreateTemp(dir, "."+filepath.Base(name)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	if err = f.Chmod(perm); err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(f.Name(), name); err != nil {
+		return err
+	}
+
+	// sync the directory so that the rename is durable
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil
+	}
+	defer d.Close()
+	d.Sync() // best effort, the file has already been replaced
+	return nil
+}
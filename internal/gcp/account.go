@@ -1,9 +1,15 @@
 package gcp
 
-func GetCurrentAccount() (string, error) {
-	out, err := output("gcloud", "auth", "list", "--filter=status:ACTIVE", "--format=value(account)")
+import (
+	"context"
+	"strings"
+)
+
+// CurrentAccount returns the active gcloud account.
+func (g *Gcloud) CurrentAccount(ctx context.Context) (string, error) {
+	out, err := output(ctx, "gcloud", "auth", "list", "--filter=status:ACTIVE", "--format=value(account)")
 	if err != nil {
 		return "", err
 	}
-	return string(out), nil
+	return strings.TrimSpace(string(out)), nil
 }
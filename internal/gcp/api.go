@@ -0,0 +1,565 @@
+package gcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/iam/v1"
+	"google.golang.org/api/option"
+	"google.golang.org/api/oslogin/v1"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// defaultScopes are the scopes gcloud assigns to an instance's service account
+// when --scopes is not specified.
+var defaultScopes = []string{
+	"https://www.googleapis.com/auth/devstorage.read_only",
+	"https://www.googleapis.com/auth/logging.write",
+	"https://www.googleapis.com/auth/monitoring.write",
+	"https://www.googleapis.com/auth/pubsub",
+	"https://www.googleapis.com/auth/service.management.readonly",
+	"https://www.googleapis.com/auth/servicecontrol",
+	"https://www.googleapis.com/auth/trace.append",
+}
+
+// API manages instances by calling the Compute Engine API directly instead of
+// shelling out to the gcloud cli.
+//
+// Credentials are loaded from Application Default Credentials. The per-machine
+// 'account' is not used by the API backend.
+type API struct {
+	svc     *compute.Service
+	iam     *iam.Service
+	oslogin *oslogin.Service
+}
+
+// NewAPI returns an API client. Additional options may be passed to override
+// the endpoint or credentials, eg: to run against a local test server.
+func NewAPI(ctx context.Context, opts ...option.ClientOption) (*API, error) {
+	return newAPI(ctx, nil, opts...)
+}
+
+// NewDryRunAPI returns an API client that prints requests that would change
+// anything to 'w', with encryption keys redacted, instead of sending them.
+// Read-only requests are sent.
+func NewDryRunAPI(ctx context.Context, w io.Writer, opts ...option.ClientOption) (*API, error) {
+	return newAPI(ctx, w, opts...)
+}
+
+func newAPI(ctx context.Context, dryRun io.Writer, opts ...option.ClientOption) (*API, error) {
+	opts = append([]option.ClientOption{option.WithScopes(compute.CloudPlatformScope)}, opts...)
+	client, _, err := htransport.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating API client: %w", err)
+	}
+	if dryRun != nil {
+		client.Transport = &dryRunTransport{base: client.Transport, w: dryRun}
+	}
+	client.Transport = &loggingTransport{base: client.Transport}
+	opts = append(opts, option.WithHTTPClient(client))
+
+	svc, err := compute.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating Compute API client: %w", err)
+	}
+	iamSvc, err := iam.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating IAM API client: %w", err)
+	}
+	osLoginSvc, err := oslogin.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating OS Login API client: %w", err)
+	}
+	return &API{svc: svc, iam: iamSvc, oslogin: osLoginSvc}, nil
+}
+
+// CurrentAccount always returns an empty string, the API backend authenticates
+// with Application Default Credentials.
+func (a *API) CurrentAccount(ctx context.Context) (string, error) {
+	return "", nil
+}
+
+// CreateServiceAccount creates a new service account 'name' in 'project'.
+func (a *API) CreateServiceAccount(ctx context.Context, account, project, name string) error {
+	req := &iam.CreateServiceAccountRequest{AccountId: name}
+	_, err := a.iam.Projects.ServiceAccounts.Create("projects/"+project, req).Context(ctx).Do()
+	return classifyAPIError(err)
+}
+
+// CreateInstance creates a new instance and its boot disk.
+func (a *API) CreateInstance(ctx context.Context, req CreateRequest) (*Operation, error) {
+	sizeGB, err := ParseDiskSizeGB(req.BootDiskSize)
+	if err != nil {
+		return nil, err
+	}
+	if req.Scheduling.MaxRunDuration != 0 {
+		// maxRunDuration is only in the beta API
+		return nil, errors.New("a max run duration is not supported by the Compute API backend")
+	}
+
+	disk := &compute.AttachedDisk{
+		Boot:       true,
+		AutoDelete: true,
+		Type:       "PERSISTENT",
+		InitializeParams: &compute.AttachedDiskInitializeParams{
+			DiskName:    req.Name,
+			DiskSizeGb:  sizeGB,
+			DiskType:    fmt.Sprintf("zones/%s/diskTypes/%s", req.Zone, req.BootDiskType),
+			SourceImage: fmt.Sprintf("projects/%s/global/images/family/%s", req.ImageProject, req.ImageFamily),
+		},
+		DiskEncryptionKey: req.CSEK.encryptionKey(DiskURI(req.Project, req.Zone, req.Name)),
+	}
+	if req.KMSKey != "" {
+		disk.DiskEncryptionKey = &compute.CustomerEncryptionKey{KmsKeyName: req.KMSKey}
+	}
+
+	instance := &compute.Instance{
+		Name:              req.Name,
+		MachineType:       fmt.Sprintf("zones/%s/machineTypes/%s", req.Zone, req.MachineType),
+		Disks:             []*compute.AttachedDisk{disk},
+		NetworkInterfaces: []*compute.NetworkInterface{req.Network.networkInterface(req.Zone)},
+		Scheduling:        req.Scheduling.scheduling(),
+	}
+	if len(req.Network.Tags) > 0 {
+		instance.Tags = &compute.Tags{Items: req.Network.Tags}
+	}
+	if len(req.Labels) > 0 {
+		instance.Labels = req.Labels
+	}
+
+	switch {
+	case req.NoServiceAccount:
+		// no service account and no scopes
+	case req.ServiceAccount != "":
+		instance.ServiceAccounts = []*compute.ServiceAccount{{Email: req.ServiceAccount, Scopes: defaultScopes}}
+	default:
+		instance.ServiceAccounts = []*compute.ServiceAccount{{Email: "default", Scopes: defaultScopes}}
+	}
+
+	metadata := &compute.Metadata{}
+	for k, v := range req.Metadata {
+		v := v
+		metadata.Items = append(metadata.Items, &compute.MetadataItems{Key: k, Value: &v})
+	}
+	if req.StartupScriptURL != "" {
+		metadata.Items = append(metadata.Items, &compute.MetadataItems{Key: "startup-script-url", Value: &req.StartupScriptURL})
+	}
+	if req.StartupScript != "" {
+		script, err := os.ReadFile(req.StartupScript)
+		if err != nil {
+			return nil, fmt.Errorf("error reading startup script: %w", err)
+		}
+		s := string(script)
+		metadata.Items = append(metadata.Items, &compute.MetadataItems{Key: "startup-script", Value: &s})
+	}
+	if len(metadata.Items) > 0 {
+		instance.Metadata = metadata
+	}
+
+	op, err := a.svc.Instances.Insert(req.Project, req.Zone, instance).Context(ctx).Do()
+	if err != nil {
+		return nil, classifyAPIError(err)
+	}
+	return operationFromCompute(req.Ref(), op), nil
+}
+
+// DeleteInstance deletes an instance.
+func (a *API) DeleteInstance(ctx context.Context, ref InstanceRef) (*Operation, error) {
+	op, err := a.svc.Instances.Delete(ref.Project, ref.Zone, ref.Name).Context(ctx).Do()
+	if err != nil {
+		return nil, classifyAPIError(err)
+	}
+	return operationFromCompute(ref, op), nil
+}
+
+// StopInstance stops an instance.
+func (a *API) StopInstance(ctx context.Context, ref InstanceRef) (*Operation, error) {
+	op, err := a.svc.Instances.Stop(ref.Project, ref.Zone, ref.Name).Context(ctx).Do()
+	if err != nil {
+		return nil, classifyAPIError(err)
+	}
+	return operationFromCompute(ref, op), nil
+}
+
+// StartInstance starts an instance. If the instance's disks are CSEK encrypted
+// the keys must be provided in 'csek'.
+func (a *API) StartInstance(ctx context.Context, ref InstanceRef, csek CSEKBundle) (*Operation, error) {
+	var op *compute.Operation
+	var err error
+
+	if len(csek) > 0 {
+		req := &compute.InstancesStartWithEncryptionKeyRequest{}
+		for _, k := range csek {
+			req.Disks = append(req.Disks, &compute.CustomerEncryptionKeyProtectedDisk{
+				Source:            k.URI,
+				DiskEncryptionKey: k.encryptionKey(),
+			})
+		}
+		op, err = a.svc.Instances.StartWithEncryptionKey(ref.Project, ref.Zone, ref.Name, req).Context(ctx).Do()
+	} else {
+		op, err = a.svc.Instances.Start(ref.Project, ref.Zone, ref.Name).Context(ctx).Do()
+	}
+	if err != nil {
+		return nil, classifyAPIError(err)
+	}
+	return operationFromCompute(ref, op), nil
+}
+
+// SuspendInstance suspends an instance.
+func (a *API) SuspendInstance(ctx context.Context, ref InstanceRef) (*Operation, error) {
+	op, err := a.svc.Instances.Suspend(ref.Project, ref.Zone, ref.Name).Context(ctx).Do()
+	if err != nil {
+		return nil, classifyAPIError(err)
+	}
+	return operationFromCompute(ref, op), nil
+}
+
+// ResumeInstance resumes a suspended instance. The v1 API does not accept
+// encryption keys on resume, CSEK encrypted instances cannot be suspended so
+// this is not a limitation in practice.
+func (a *API) ResumeInstance(ctx context.Context, ref InstanceRef, csek CSEKBundle) (*Operation, error) {
+	if len(csek) > 0 {
+		return nil, errors.New("resuming CSEK encrypted instances is not supported by the Compute API backend")
+	}
+	op, err := a.svc.Instances.Resume(ref.Project, ref.Zone, ref.Name).Context(ctx).Do()
+	if err != nil {
+		return nil, classifyAPIError(err)
+	}
+	return operationFromCompute(ref, op), nil
+}
+
+// ResizeInstance changes the machine-type of a stopped instance.
+func (a *API) ResizeInstance(ctx context.Context, ref InstanceRef, size string) (*Operation, error) {
+	req := &compute.InstancesSetMachineTypeRequest{
+		MachineType: fmt.Sprintf("zones/%s/machineTypes/%s", ref.Zone, size),
+	}
+	op, err := a.svc.Instances.SetMachineType(ref.Project, ref.Zone, ref.Name, req).Context(ctx).Do()
+	if err != nil {
+		return nil, classifyAPIError(err)
+	}
+	return operationFromCompute(ref, op), nil
+}
+
+// DescribeInstance returns the full instance resource.
+func (a *API) DescribeInstance(ctx context.Context, ref InstanceRef) (compute.Instance, error) {
+	instance, err := a.svc.Instances.Get(ref.Project, ref.Zone, ref.Name).Context(ctx).Do()
+	if err != nil {
+		return compute.Instance{}, classifyAPIError(err)
+	}
+	return *instance, nil
+}
+
+// DescribeDisk returns the full disk resource.
+func (a *API) DescribeDisk(ctx context.Context, ref DiskRef) (compute.Disk, error) {
+	disk, err := a.svc.Disks.Get(ref.Project, ref.Zone, ref.Name).Context(ctx).Do()
+	if err != nil {
+		return compute.Disk{}, classifyAPIError(err)
+	}
+	return *disk, nil
+}
+
+// CreateDisk creates a disk, empty or from a snapshot.
+func (a *API) CreateDisk(ctx context.Context, req DiskRequest) (*Operation, error) {
+	disk := &compute.Disk{
+		Name:              req.Ref.Name,
+		DiskEncryptionKey: req.CSEK.encryptionKey(req.Ref.URI()),
+	}
+	if req.Size != "" {
+		sizeGB, err := ParseDiskSizeGB(req.Size)
+		if err != nil {
+			return nil, err
+		}
+		disk.SizeGb = sizeGB
+	}
+	if req.Type != "" {
+		disk.Type = fmt.Sprintf("zones/%s/diskTypes/%s", req.Ref.Zone, req.Type)
+	}
+	if req.SourceSnapshot != "" {
+		disk.SourceSnapshot = "global/snapshots/" + req.SourceSnapshot
+		disk.SourceSnapshotEncryptionKey = req.CSEK.encryptionKey(SnapshotURI(req.Ref.Project, req.SourceSnapshot))
+	}
+
+	op, err := a.svc.Disks.Insert(req.Ref.Project, req.Ref.Zone, disk).Context(ctx).Do()
+	if err != nil {
+		return nil, classifyAPIError(err)
+	}
+	return operationFromCompute(InstanceRef(req.Ref), op), nil
+}
+
+// DeleteDisk deletes a disk.
+func (a *API) DeleteDisk(ctx context.Context, ref DiskRef) (*Operation, error) {
+	op, err := a.svc.Disks.Delete(ref.Project, ref.Zone, ref.Name).Context(ctx).Do()
+	if err != nil {
+		return nil, classifyAPIError(err)
+	}
+	return operationFromCompute(InstanceRef(ref), op), nil
+}
+
+// ResizeDisk grows a disk.
+func (a *API) ResizeDisk(ctx context.Context, ref DiskRef, size string) (*Operation, error) {
+	sizeGB, err := ParseDiskSizeGB(size)
+	if err != nil {
+		return nil, err
+	}
+	op, err := a.svc.Disks.Resize(ref.Project, ref.Zone, ref.Name, &compute.DisksResizeRequest{SizeGb: sizeGB}).Context(ctx).Do()
+	if err != nil {
+		return nil, classifyAPIError(err)
+	}
+	return operationFromCompute(InstanceRef(ref), op), nil
+}
+
+// AttachDisk attaches a disk to an instance. Like gcloud, the disk is not
+// deleted with the instance, see SetDiskAutoDelete.
+func (a *API) AttachDisk(ctx context.Context, ref InstanceRef, req AttachDiskRequest) (*Operation, error) {
+	disk := ref.Disk(req.Disk)
+	attached := &compute.AttachedDisk{
+		Source:            disk.URI(),
+		DeviceName:        req.DeviceName,
+		Boot:              req.Boot,
+		DiskEncryptionKey: req.CSEK.encryptionKey(disk.URI()),
+	}
+	op, err := a.svc.Instances.AttachDisk(ref.Project, ref.Zone, ref.Name, attached).Context(ctx).Do()
+	if err != nil {
+		return nil, classifyAPIError(err)
+	}
+	return operationFromCompute(ref, op), nil
+}
+
+// DetachDisk detaches a disk from an instance.
+func (a *API) DetachDisk(ctx context.Context, ref InstanceRef, deviceName string) (*Operation, error) {
+	op, err := a.svc.Instances.DetachDisk(ref.Project, ref.Zone, ref.Name, deviceName).Context(ctx).Do()
+	if err != nil {
+		return nil, classifyAPIError(err)
+	}
+	return operationFromCompute(ref, op), nil
+}
+
+// SetDiskAutoDelete sets whether a disk is deleted with the instance.
+func (a *API) SetDiskAutoDelete(ctx context.Context, ref InstanceRef, deviceName string, autoDelete bool) (*Operation, error) {
+	op, err := a.svc.Instances.SetDiskAutoDelete(ref.Project, ref.Zone, ref.Name, autoDelete, deviceName).Context(ctx).Do()
+	if err != nil {
+		return nil, classifyAPIError(err)
+	}
+	return operationFromCompute(ref, op), nil
+}
+
+// CreateSnapshot snapshots a disk.
+func (a *API) CreateSnapshot(ctx context.Context, ref DiskRef, name string, csek CSEKBundle) (*Operation, error) {
+	snapshot := &compute.Snapshot{
+		Name:                    name,
+		SnapshotEncryptionKey:   csek.encryptionKey(SnapshotURI(ref.Project, name)),
+		SourceDiskEncryptionKey: csek.encryptionKey(ref.URI()),
+	}
+	op, err := a.svc.Disks.CreateSnapshot(ref.Project, ref.Zone, ref.Name, snapshot).Context(ctx).Do()
+	if err != nil {
+		return nil, classifyAPIError(err)
+	}
+	return operationFromCompute(InstanceRef(ref), op), nil
+}
+
+// DeleteSnapshot deletes a snapshot and polls the global operation until it is
+// done.
+func (a *API) DeleteSnapshot(ctx context.Context, ref DiskRef, name string) error {
+	op, err := a.svc.Snapshots.Delete(ref.Project, name).Context(ctx).Do()
+	for err == nil && op.Status != "DONE" {
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-time.After(PollInterval):
+		}
+		op, err = a.svc.GlobalOperations.Get(ref.Project, op.Name).Context(ctx).Do()
+	}
+	if err != nil {
+		return classifyAPIError(err)
+	}
+	return operationFromCompute(InstanceRef(ref), op).Err()
+}
+
+// MoveInstance moves an instance to another zone and polls the global operation
+// until it is done.
+func (a *API) MoveInstance(ctx context.Context, ref InstanceRef, zone string) error {
+	req := &compute.InstanceMoveRequest{
+		TargetInstance:  fmt.Sprintf("zones/%s/instances/%s", ref.Zone, ref.Name),
+		DestinationZone: "zones/" + zone,
+	}
+	op, err := a.svc.Projects.MoveInstance(ref.Project, req).Context(ctx).Do()
+	for err == nil && op.Status != "DONE" {
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-time.After(PollInterval):
+		}
+		op, err = a.svc.GlobalOperations.Get(ref.Project, op.Name).Context(ctx).Do()
+	}
+	if err != nil {
+		return classifyAPIError(err)
+	}
+	return operationFromCompute(ref, op).Err()
+}
+
+// UpdateLabels merges the labels with the instance's labels and waits for the
+// update to complete.
+func (a *API) UpdateLabels(ctx context.Context, ref InstanceRef, labels map[string]string) error {
+	instance, err := a.DescribeInstance(ctx, ref)
+	if err != nil {
+		return err
+	}
+	req := &compute.InstancesSetLabelsRequest{Labels: map[string]string{}, LabelFingerprint: instance.LabelFingerprint}
+	for k, v := range instance.Labels {
+		req.Labels[k] = v
+	}
+	for k, v := range labels {
+		req.Labels[k] = v
+	}
+	op, err := a.svc.Instances.SetLabels(ref.Project, ref.Zone, ref.Name, req).Context(ctx).Do()
+	if err != nil {
+		return classifyAPIError(err)
+	}
+	_, err = WaitOperation(ctx, a, operationFromCompute(ref, op), nil)
+	return err
+}
+
+// UpdateMetadata merges the metadata with the instance's metadata and waits for
+// the update to complete.
+func (a *API) UpdateMetadata(ctx context.Context, ref InstanceRef, metadata map[string]string) error {
+	instance, err := a.DescribeInstance(ctx, ref)
+	if err != nil {
+		return err
+	}
+	req := &compute.Metadata{}
+	if instance.Metadata != nil {
+		req.Fingerprint = instance.Metadata.Fingerprint
+		for _, item := range instance.Metadata.Items {
+			if _, ok := metadata[item.Key]; !ok {
+				req.Items = append(req.Items, item)
+			}
+		}
+	}
+	for k, v := range metadata {
+		v := v
+		req.Items = append(req.Items, &compute.MetadataItems{Key: k, Value: &v})
+	}
+	op, err := a.svc.Instances.SetMetadata(ref.Project, ref.Zone, ref.Name, req).Context(ctx).Do()
+	if err != nil {
+		return classifyAPIError(err)
+	}
+	_, err = WaitOperation(ctx, a, operationFromCompute(ref, op), nil)
+	return err
+}
+
+// ListZones returns the zones of a region that are UP.
+func (a *API) ListZones(ctx context.Context, account, project, region string) ([]string, error) {
+	zones := []*compute.Zone{}
+	err := a.svc.Zones.List(project).Pages(ctx, func(list *compute.ZoneList) error {
+		zones = append(zones, list.Items...)
+		return nil
+	})
+	if err != nil {
+		return nil, classifyAPIError(err)
+	}
+	return upZones(zones, region), nil
+}
+
+// SSHInstance uses 'gcloud compute ssh', the API backend does not implement an
+// ssh client.
+func (a *API) SSHInstance(ctx context.Context, ref InstanceRef, opts SSHOptions) error {
+	return (&Gcloud{}).SSHInstance(ctx, ref, opts)
+}
+
+// GetOperation returns the current state of a zone operation.
+func (a *API) GetOperation(ctx context.Context, ref InstanceRef, name string) (*Operation, error) {
+	op, err := a.svc.ZoneOperations.Get(ref.Project, ref.Zone, name).Context(ctx).Do()
+	if err != nil {
+		return nil, classifyAPIError(err)
+	}
+	return operationFromCompute(ref, op), nil
+}
+
+// ListOperations returns the zone operations that targeted the instance, most
+// recent first.
+func (a *API) ListOperations(ctx context.Context, ref InstanceRef) ([]*Operation, error) {
+	target := fmt.Sprintf("https://www.googleapis.com/compute/v1/projects/%s/zones/%s/instances/%s", ref.Project, ref.Zone, ref.Name)
+
+	ops := []*Operation{}
+	err := a.svc.ZoneOperations.List(ref.Project, ref.Zone).
+		Filter(fmt.Sprintf("targetLink = \"%s\"", target)).
+		Pages(ctx, func(list *compute.OperationList) error {
+			for _, op := range list.Items {
+				ops = append(ops, operationFromCompute(ref, op))
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, classifyAPIError(err)
+	}
+
+	sort.Slice(ops, func(i, j int) bool {
+		return ops[i].StartTime.After(ops[j].StartTime)
+	})
+	return ops, nil
+}
+
+// ParseDiskSizeGB converts a gcloud style disk size such as "10GB" or "1TB" to
+// gigabytes. A value without units is treated as GB.
+func ParseDiskSizeGB(size string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	multipliers := []struct {
+		unit string
+		kb   int64
+	}{
+		{"TB", 1024 * 1024 * 1024},
+		{"GB", 1024 * 1024},
+		{"MB", 1024},
+		{"KB", 1},
+	}
+
+	kb := int64(1024 * 1024)
+	for _, m := range multipliers {
+		if strings.HasSuffix(s, m.unit) {
+			s = strings.TrimSuffix(s, m.unit)
+			kb = m.kb
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid disk size '%s'", size)
+	}
+	total := n * kb
+	if total%(1024*1024) != 0 {
+		return 0, fmt.Errorf("invalid disk size '%s': must be a whole number of GB", size)
+	}
+	return total / (1024 * 1024), nil
+}
+
+// loggingTransport is an http.RoundTripper that logs every API request with its
+// status and duration. Request bodies are not logged since they may contain
+// encryption keys.
+type loggingTransport struct {
+	base http.RoundTripper
+}
+
+func (t *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+
+	attrs := []any{"method", req.Method, "url", req.URL.Redacted(), "duration", time.Since(start)}
+	if err != nil {
+		attrs = append(attrs, "error", err)
+	} else {
+		attrs = append(attrs, "status", resp.StatusCode)
+	}
+	slog.DebugContext(req.Context(), "api", attrs...)
+	return resp, err
+}
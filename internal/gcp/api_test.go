@@ -0,0 +1,262 @@
+package gcp_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/joemiller/gmachine/internal/gcp"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+	"google.golang.org/api/oslogin/v1"
+)
+
+func TestMain(m *testing.M) {
+	gcp.PollInterval = 10 * time.Millisecond
+	os.Exit(m.Run())
+}
+
+// fakeComputeAPI is a minimal local stand-in for the Compute API. Every mutating
+// request returns a RUNNING operation which is reported as DONE when it is
+// fetched.
+type fakeComputeAPI struct {
+	mu       sync.Mutex
+	requests []string
+	bodies   map[string][]byte
+	opError  string
+	opCode   string
+}
+
+func (f *fakeComputeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/compute/v1/")
+	f.requests = append(f.requests, r.Method+" "+path)
+
+	body, _ := io.ReadAll(r.Body)
+	f.bodies[r.Method+" "+path] = body
+
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.Method == http.MethodGet && path == "projects/my-proj/zones/us-west1-a/instances/foo":
+		_ = json.NewEncoder(w).Encode(compute.Instance{
+			Name:   "foo",
+			Status: "RUNNING",
+			NetworkInterfaces: []*compute.NetworkInterface{{
+				NetworkIP:     "10.0.0.2",
+				AccessConfigs: []*compute.AccessConfig{{NatIP: "1.2.3.4"}},
+			}},
+		})
+	case r.Method == http.MethodGet && path == "projects/my-proj/zones/us-west1-a/instances/foo/getGuestAttributes":
+		_ = json.NewEncoder(w).Encode(compute.GuestAttributes{QueryValue: &compute.GuestAttributesValue{Items: []*compute.GuestAttributesEntry{
+			{Namespace: "hostkeys", Key: "ssh-rsa", Value: "BBBB\n"},
+			{Namespace: "hostkeys", Key: "ssh-ed25519", Value: "AAAA"},
+		}}})
+	case r.Method == http.MethodGet && strings.Contains(path, "/instances/"):
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"error": {"code": 404, "message": "The resource was not found"}}`))
+	case r.Method == http.MethodGet && strings.Contains(path, "/operations/"):
+		op := compute.Operation{Name: "op-1", Status: "DONE"}
+		if f.opError != "" {
+			op.Error = &compute.OperationError{Errors: []*compute.OperationErrorErrors{{Code: f.opCode, Message: f.opError}}}
+		}
+		_ = json.NewEncoder(w).Encode(op)
+	case r.Method == http.MethodPost && strings.HasSuffix(path, ":importSshPublicKey"):
+		// the OS Login API, at the same test endpoint
+		_ = json.NewEncoder(w).Encode(oslogin.ImportSshPublicKeyResponse{LoginProfile: &oslogin.LoginProfile{
+			PosixAccounts: []*oslogin.PosixAccount{{Username: "other"}, {Username: "me_example_com", Primary: true}},
+		}})
+	case r.Method == http.MethodPost || r.Method == http.MethodDelete:
+		_ = json.NewEncoder(w).Encode(compute.Operation{Name: "op-1", Status: "RUNNING"})
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+var fooRef = gcp.InstanceRef{Name: "foo", Project: "my-proj", Zone: "us-west1-a"}
+
+func newTestServer(t *testing.T, fake *fakeComputeAPI) *httptest.Server {
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newTestAPI(t *testing.T) (*gcp.API, *fakeComputeAPI) {
+	fake := &fakeComputeAPI{bodies: map[string][]byte{}}
+	srv := newTestServer(t, fake)
+
+	api, err := gcp.NewAPI(context.Background(),
+		option.WithEndpoint(srv.URL+"/compute/v1/"),
+		option.WithoutAuthentication(),
+	)
+	assert.NoError(t, err)
+	return api, fake
+}
+
+func TestAPI_DescribeInstance(t *testing.T) {
+	api, _ := newTestAPI(t)
+
+	instance, err := api.DescribeInstance(context.Background(), fooRef)
+	assert.NoError(t, err)
+	assert.Equal(t, "RUNNING", instance.Status)
+	assert.Equal(t, "1.2.3.4", instance.NetworkInterfaces[0].AccessConfigs[0].NatIP)
+
+	_, err = api.DescribeInstance(context.Background(), gcp.InstanceRef{Name: "no-such-instance", Project: "my-proj", Zone: "us-west1-a"})
+	assert.ErrorIs(t, err, gcp.ErrNotFound)
+}
+
+func TestAPI_StopInstance_operation(t *testing.T) {
+	api, fake := newTestAPI(t)
+
+	op, err := api.StopInstance(context.Background(), fooRef)
+	assert.NoError(t, err)
+	assert.False(t, op.Done())
+
+	op, err = gcp.WaitOperation(context.Background(), api, op, nil)
+	assert.NoError(t, err)
+	assert.True(t, op.Done())
+	assert.Equal(t, []string{
+		"POST projects/my-proj/zones/us-west1-a/instances/foo/stop",
+		"GET projects/my-proj/zones/us-west1-a/operations/op-1",
+	}, fake.requests)
+
+	// errors reported by the operation are returned
+	fake.opError = "something went wrong"
+	op, err = api.StopInstance(context.Background(), fooRef)
+	assert.NoError(t, err)
+	_, err = gcp.WaitOperation(context.Background(), api, op, nil)
+	assert.ErrorContains(t, err, "something went wrong")
+
+	// and classified by their error code
+	fake.opCode = "ZONE_RESOURCE_POOL_EXHAUSTED"
+	op, err = api.StopInstance(context.Background(), fooRef)
+	assert.NoError(t, err)
+	_, err = gcp.WaitOperation(context.Background(), api, op, nil)
+	assert.ErrorIs(t, err, gcp.ErrZoneResourceExhausted)
+}
+
+func TestAPI_StartInstance_csek(t *testing.T) {
+	api, fake := newTestAPI(t)
+
+	csek := gcp.CSEKBundle{{URI: gcp.DiskURI("my-proj", "us-west1-a", "foo"), Key: "a2V5", KeyType: "raw"}}
+	_, err := api.StartInstance(context.Background(), fooRef, csek)
+	assert.NoError(t, err)
+
+	var req compute.InstancesStartWithEncryptionKeyRequest
+	err = json.Unmarshal(fake.bodies["POST projects/my-proj/zones/us-west1-a/instances/foo/startWithEncryptionKey"], &req)
+	assert.NoError(t, err)
+	assert.Equal(t, gcp.DiskURI("my-proj", "us-west1-a", "foo"), req.Disks[0].Source)
+	assert.Equal(t, "a2V5", req.Disks[0].DiskEncryptionKey.RawKey)
+
+	// rsa-encrypted keys are passed as wrapped keys
+	csek[0].KeyType = gcp.KeyTypeRSAEncrypted
+	_, err = api.StartInstance(context.Background(), fooRef, csek)
+	assert.NoError(t, err)
+	req = compute.InstancesStartWithEncryptionKeyRequest{}
+	err = json.Unmarshal(fake.bodies["POST projects/my-proj/zones/us-west1-a/instances/foo/startWithEncryptionKey"], &req)
+	assert.NoError(t, err)
+	assert.Equal(t, "a2V5", req.Disks[0].DiskEncryptionKey.RsaEncryptedKey)
+	assert.Empty(t, req.Disks[0].DiskEncryptionKey.RawKey)
+}
+
+func TestAPI_CreateInstance(t *testing.T) {
+	api, fake := newTestAPI(t)
+
+	script := filepath.Join(t.TempDir(), "startup.sh")
+	assert.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\necho hi\n"), 0o600))
+
+	req := gcp.CreateRequest{
+		Name:             "foo",
+		Project:          "my-proj",
+		Zone:             "us-west1-a",
+		MachineType:      "n2d-standard-2",
+		BootDiskSize:     "1TB",
+		BootDiskType:     "pd-ssd",
+		ImageProject:     "ubuntu-os-cloud",
+		ImageFamily:      "ubuntu-2204-lts",
+		NoServiceAccount: true,
+		StartupScript:    script,
+	}
+	req.AddMetadata("block-project-ssh-keys", "true")
+
+	_, err := api.CreateInstance(context.Background(), req)
+	assert.NoError(t, err)
+
+	var instance compute.Instance
+	err = json.Unmarshal(fake.bodies["POST projects/my-proj/zones/us-west1-a/instances"], &instance)
+	assert.NoError(t, err)
+	assert.Equal(t, "zones/us-west1-a/machineTypes/n2d-standard-2", instance.MachineType)
+	assert.Equal(t, int64(1024), instance.Disks[0].InitializeParams.DiskSizeGb)
+	assert.Equal(t, "projects/ubuntu-os-cloud/global/images/family/ubuntu-2204-lts", instance.Disks[0].InitializeParams.SourceImage)
+	assert.Empty(t, instance.ServiceAccounts)
+
+	metadata := map[string]string{}
+	for _, item := range instance.Metadata.Items {
+		metadata[item.Key] = *item.Value
+	}
+	assert.Equal(t, "true", metadata["block-project-ssh-keys"])
+	assert.Equal(t, "#!/bin/sh\necho hi\n", metadata["startup-script"])
+	assert.Nil(t, instance.Disks[0].DiskEncryptionKey)
+	// the default network with an external IP
+	assert.Equal(t, "global/networks/default", instance.NetworkInterfaces[0].Network)
+	assert.Len(t, instance.NetworkInterfaces[0].AccessConfigs, 1)
+	assert.Nil(t, instance.Tags)
+
+	// the boot disk is encrypted with the KMS key
+	req.KMSKey = testKMSKey
+	_, err = api.CreateInstance(context.Background(), req)
+	assert.NoError(t, err)
+	instance = compute.Instance{}
+	err = json.Unmarshal(fake.bodies["POST projects/my-proj/zones/us-west1-a/instances"], &instance)
+	assert.NoError(t, err)
+	assert.Equal(t, testKMSKey, instance.Disks[0].DiskEncryptionKey.KmsKeyName)
+	req.KMSKey = ""
+
+	// a subnet without an external IP
+	req.Network = gcp.Network{Network: "dev", Subnet: "workstations", NoAddress: true, InternalIP: "10.1.2.3", Tags: []string{"ssh"}, StackType: gcp.StackTypeIPv4IPv6}
+	_, err = api.CreateInstance(context.Background(), req)
+	assert.NoError(t, err)
+	instance = compute.Instance{}
+	err = json.Unmarshal(fake.bodies["POST projects/my-proj/zones/us-west1-a/instances"], &instance)
+	assert.NoError(t, err)
+	nic := instance.NetworkInterfaces[0]
+	assert.Equal(t, "global/networks/dev", nic.Network)
+	assert.Equal(t, "regions/us-west1/subnetworks/workstations", nic.Subnetwork)
+	assert.Empty(t, nic.AccessConfigs)
+	assert.Equal(t, "10.1.2.3", nic.NetworkIP)
+	assert.Equal(t, "IPV4_IPV6", nic.StackType)
+	assert.Equal(t, []string{"ssh"}, instance.Tags.Items)
+	req.Network = gcp.Network{}
+
+	// a Spot instance is stopped when it is preempted by default
+	req.Scheduling = gcp.Scheduling{ProvisioningModel: gcp.ProvisioningModelSpot}
+	_, err = api.CreateInstance(context.Background(), req)
+	assert.NoError(t, err)
+	instance = compute.Instance{}
+	err = json.Unmarshal(fake.bodies["POST projects/my-proj/zones/us-west1-a/instances"], &instance)
+	assert.NoError(t, err)
+	assert.Equal(t, "SPOT", instance.Scheduling.ProvisioningModel)
+	assert.Equal(t, "STOP", instance.Scheduling.InstanceTerminationAction)
+	assert.Equal(t, "TERMINATE", instance.Scheduling.OnHostMaintenance)
+
+	// max run duration is only in the beta API
+	req.Scheduling.MaxRunDuration = time.Hour
+	_, err = api.CreateInstance(context.Background(), req)
+	assert.ErrorContains(t, err, "max run duration is not supported")
+	req.Scheduling = gcp.Scheduling{}
+
+	// invalid disk sizes are rejected before calling the API
+	req.BootDiskSize = "10MB"
+	_, err = api.CreateInstance(context.Background(), req)
+	assert.Error(t, err)
+}
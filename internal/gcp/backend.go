@@ -0,0 +1,95 @@
+package gcp
+
+import (
+	"context"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// InstanceRef identifies an instance and the account used to manage it.
+type InstanceRef struct {
+	Name    string
+	Account string
+	Project string
+	Zone    string
+}
+
+// Backend manages instances on Compute Engine. Mutating methods start a
+// long-running Operation and return without waiting for it to complete, use
+// WaitOperation to wait.
+//
+// Implementations:
+//   - Gcloud: runs the gcloud cli
+//   - API: calls the Compute API directly
+//   - Fake: in-memory simulation for testing
+type Backend interface {
+	// CurrentAccount returns the account used when none is specified. It may
+	// return an empty string if the backend does not use accounts.
+	CurrentAccount(ctx context.Context) (string, error)
+	CreateServiceAccount(ctx context.Context, account, project, name string) error
+
+	CreateInstance(ctx context.Context, req CreateRequest) (*Operation, error)
+	DeleteInstance(ctx context.Context, ref InstanceRef) (*Operation, error)
+	StartInstance(ctx context.Context, ref InstanceRef, csek CSEKBundle) (*Operation, error)
+	StopInstance(ctx context.Context, ref InstanceRef) (*Operation, error)
+	SuspendInstance(ctx context.Context, ref InstanceRef) (*Operation, error)
+	ResumeInstance(ctx context.Context, ref InstanceRef, csek CSEKBundle) (*Operation, error)
+	ResizeInstance(ctx context.Context, ref InstanceRef, machineType string) (*Operation, error)
+	DescribeInstance(ctx context.Context, ref InstanceRef) (compute.Instance, error)
+	// MoveInstance moves a stopped instance and its disks to 'zone' in the same
+	// region and waits for the move to complete. Moves are global operations so
+	// they cannot be waited for like zone operations.
+	MoveInstance(ctx context.Context, ref InstanceRef, zone string) error
+	// UpdateLabels adds or updates the instance's labels and waits for the
+	// update to complete. Labels that are not in 'labels' are kept.
+	UpdateLabels(ctx context.Context, ref InstanceRef, labels map[string]string) error
+	// UpdateMetadata adds or updates the instance's metadata and waits for the
+	// update to complete. Keys that are not in 'metadata' are kept.
+	UpdateMetadata(ctx context.Context, ref InstanceRef, metadata map[string]string) error
+	// ListZones returns the names of the zones in 'region' that are UP.
+	ListZones(ctx context.Context, account, project, region string) ([]string, error)
+
+	DescribeDisk(ctx context.Context, ref DiskRef) (compute.Disk, error)
+	CreateDisk(ctx context.Context, req DiskRequest) (*Operation, error)
+	DeleteDisk(ctx context.Context, ref DiskRef) (*Operation, error)
+	// ResizeDisk grows the disk to 'size', eg: "200GB". Disks cannot be shrunk.
+	ResizeDisk(ctx context.Context, ref DiskRef, size string) (*Operation, error)
+	// AttachDisk attaches a disk to a stopped instance, a boot disk can only be
+	// attached if the instance has none.
+	AttachDisk(ctx context.Context, ref InstanceRef, req AttachDiskRequest) (*Operation, error)
+	DetachDisk(ctx context.Context, ref InstanceRef, deviceName string) (*Operation, error)
+	// SetDiskAutoDelete sets whether the disk is deleted with the instance.
+	SetDiskAutoDelete(ctx context.Context, ref InstanceRef, deviceName string, autoDelete bool) (*Operation, error)
+	// CreateSnapshot snapshots the disk 'ref' to the snapshot 'name' in the disk's
+	// project. 'csek' holds the disk's key and the key to encrypt the snapshot
+	// with, if they are CSEK encrypted.
+	CreateSnapshot(ctx context.Context, ref DiskRef, name string, csek CSEKBundle) (*Operation, error)
+	// DeleteSnapshot deletes the snapshot 'name' in the disk's project and waits
+	// for it to be deleted, snapshots are global resources so their operations
+	// cannot be waited for like zone operations.
+	DeleteSnapshot(ctx context.Context, ref DiskRef, name string) error
+
+	// GetOperation returns the current state of the operation 'name' in the
+	// instance's project and zone.
+	GetOperation(ctx context.Context, ref InstanceRef, name string) (*Operation, error)
+	// ListOperations returns the recent operations that targeted the instance.
+	ListOperations(ctx context.Context, ref InstanceRef) ([]*Operation, error)
+
+	// SSHInstance opens an interactive ssh session to the instance, connecting as
+	// set by 'opts'.
+	SSHInstance(ctx context.Context, ref InstanceRef, opts SSHOptions) error
+	// HostKeys returns the ssh host keys the guest agent published in the
+	// instance's guest attributes, as "TYPE BASE64" lines. It returns none if the
+	// instance does not enable guest attributes or has not published them yet.
+	HostKeys(ctx context.Context, ref InstanceRef) ([]string, error)
+	// ImportOSLoginKey adds an ssh public key to the OS Login profile of
+	// 'account' and returns the profile's POSIX username.
+	ImportOSLoginKey(ctx context.Context, account, publicKey string) (string, error)
+}
+
+var (
+	_ Backend = (*Gcloud)(nil)
+	_ Backend = (*API)(nil)
+	_ Backend = (*Fake)(nil)
+	_ Backend = (*Retrying)(nil)
+)
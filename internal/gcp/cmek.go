@@ -0,0 +1,52 @@
+package gcp
+
+import (
+	"fmt"
+	"regexp"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// kmsKeyRe matches the resource name of a Cloud KMS key. Key rings and keys are
+// named with letters, numbers, underscores and hyphens.
+var kmsKeyRe = regexp.MustCompile(`^projects/[^/]+/locations/[a-z0-9-]+/keyRings/[a-zA-Z0-9_-]{1,63}/cryptoKeys/[a-zA-Z0-9_-]{1,63}$`)
+
+// ValidateKMSKey returns an error if 'name' is not the resource name of a Cloud
+// KMS key, eg: projects/my-proj/locations/us-west1/keyRings/my-ring/cryptoKeys/my-key.
+func ValidateKMSKey(name string) error {
+	if !kmsKeyRe.MatchString(name) {
+		return fmt.Errorf("invalid KMS key '%s', expected projects/PROJECT/locations/LOCATION/keyRings/KEY_RING/cryptoKeys/KEY", name)
+	}
+	return nil
+}
+
+// Encryption types of a disk, see DiskEncryption.
+const (
+	EncryptionCSEK          = "CSEK"
+	EncryptionCMEK          = "CMEK"
+	EncryptionGoogleManaged = "Google-managed"
+)
+
+// DiskEncryption returns how the instance's boot disk is encrypted: with a
+// customer-supplied key (CSEK), a Cloud KMS key (CMEK), or a Google-managed key.
+func DiskEncryption(instance compute.Instance) string {
+	for _, d := range instance.Disks {
+		if d.Boot {
+			return KeyEncryption(d.DiskEncryptionKey)
+		}
+	}
+	return EncryptionGoogleManaged
+}
+
+// KeyEncryption returns the encryption type of a disk with the encryption key
+// 'key', see DiskEncryption.
+func KeyEncryption(key *compute.CustomerEncryptionKey) string {
+	switch {
+	case key == nil:
+	case key.KmsKeyName != "":
+		return EncryptionCMEK
+	case key.Sha256 != "" || key.RawKey != "" || key.RsaEncryptedKey != "":
+		return EncryptionCSEK
+	}
+	return EncryptionGoogleManaged
+}
@@ -0,0 +1,58 @@
+package gcp_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/joemiller/gmachine/internal/gcp"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/compute/v1"
+)
+
+const testKMSKey = "projects/my-proj/locations/us-west1/keyRings/my-ring/cryptoKeys/my-key"
+
+func TestValidateKMSKey(t *testing.T) {
+	assert.NoError(t, gcp.ValidateKMSKey(testKMSKey))
+	assert.NoError(t, gcp.ValidateKMSKey("projects/example.com:my-proj/locations/global/keyRings/ring_1/cryptoKeys/key-1"))
+
+	for _, name := range []string{
+		"",
+		"my-key",
+		"projects/my-proj/locations/us-west1/keyRings/my-ring",
+		testKMSKey + "/cryptoKeyVersions/1",
+		"projects/my-proj/locations/us-west1/keyRings/my ring/cryptoKeys/my-key",
+		"//cloudkms.googleapis.com/" + testKMSKey,
+	} {
+		assert.ErrorContains(t, gcp.ValidateKMSKey(name), "invalid KMS key", name)
+	}
+}
+
+func TestDiskEncryption(t *testing.T) {
+	instance := func(key *compute.CustomerEncryptionKey) compute.Instance {
+		return compute.Instance{Disks: []*compute.AttachedDisk{
+			{Boot: false, DiskEncryptionKey: &compute.CustomerEncryptionKey{KmsKeyName: testKMSKey}},
+			{Boot: true, DiskEncryptionKey: key},
+		}}
+	}
+	assert.Equal(t, gcp.EncryptionGoogleManaged, gcp.DiskEncryption(instance(nil)))
+	assert.Equal(t, gcp.EncryptionGoogleManaged, gcp.DiskEncryption(compute.Instance{}))
+	assert.Equal(t, gcp.EncryptionCSEK, gcp.DiskEncryption(instance(&compute.CustomerEncryptionKey{Sha256: "abc"})))
+	assert.Equal(t, gcp.EncryptionCMEK, gcp.DiskEncryption(instance(&compute.CustomerEncryptionKey{KmsKeyName: testKMSKey + "/cryptoKeyVersions/1"})))
+}
+
+func TestFake_cmek(t *testing.T) {
+	ctx := context.Background()
+	fake := gcp.NewFake("", 0, nil)
+	req := newFakeRequest()
+	req.KMSKey = testKMSKey
+	assert.NoError(t, waiter(fake)(fake.CreateInstance(ctx, req)))
+
+	instance, err := fake.DescribeInstance(ctx, req.Ref())
+	assert.NoError(t, err)
+	assert.Equal(t, gcp.EncryptionCMEK, gcp.DiskEncryption(instance))
+
+	req.Name = "bar"
+	req.KMSKey = "my-key"
+	_, err = fake.CreateInstance(ctx, req)
+	assert.ErrorContains(t, err, "invalid KMS key")
+}
@@ -2,13 +2,24 @@ package gcp
 
 import (
 	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"google.golang.org/api/compute/v1"
 )
 
 /*
 Example CSEK JSON file with 2 keys from GCP's docs.
-Note, This library will only create a single item CSEK bundle and only supports the 'raw' key-type.
+Note, This library will only create a single item CSEK bundle per resource. Keys are 'raw', or
+'rsa-encrypted' when they are wrapped with Google's RSA certificate.
 [
   {
     "uri": "https://www.googleapis.com/compute/v1/projects/myproject/zones/us-central1-a/disks/example-disk",
@@ -29,13 +40,33 @@ type CSEKBundle []CSEKKey
 
 type CSEKKey struct {
 	URI     string `json:"uri" yaml:"uri"`
-	Key     string `json:"key" yaml:"key"`
+	Key     string `json:"key" yaml:"key,omitempty"`
 	KeyType string `json:"key-type" yaml:"key-type"`
+	// EncryptedKey is Key encrypted with the config file's passphrase, Key is
+	// empty until it is decrypted. It is never passed to Google Cloud.
+	EncryptedKey string `json:"-" yaml:"encrypted-key,omitempty"`
+	// KeyRef refers to the key in the config file's key store, Key is empty until
+	// it is read from the store. It is never passed to Google Cloud.
+	KeyRef string `json:"-" yaml:"key-ref,omitempty"`
 }
 
-// CreateCSEK generates a CSEKBundle for the resource specified by 'uri'.
-// Only key-type 'raw' is currently supported
+// Key types of CSEK keys.
+const (
+	KeyTypeRaw          = "raw"
+	KeyTypeRSAEncrypted = "rsa-encrypted"
+)
+
+// CreateCSEK generates a CSEKBundle for the resource specified by 'uri' with a
+// 'raw' key.
 func CreateCSEK(uri string) (CSEKBundle, error) {
+	return CreateWrappedCSEK(uri, nil)
+}
+
+// CreateWrappedCSEK generates a CSEKBundle for the resource specified by 'uri'.
+// If 'cert' is set the key is wrapped with it and its key-type is
+// 'rsa-encrypted', the raw key is discarded so that only Google can unwrap it.
+// Otherwise the key is 'raw'.
+func CreateWrappedCSEK(uri string, cert *rsa.PublicKey) (CSEKBundle, error) {
 	var bundle CSEKBundle
 
 	key := make([]byte, 32)
@@ -44,14 +75,73 @@ func CreateCSEK(uri string) (CSEKBundle, error) {
 		return bundle, err
 	}
 
+	keyType := KeyTypeRaw
+	if cert != nil {
+		// Google unwraps keys with RSA-OAEP and SHA-1, see
+		// https://cloud.google.com/compute/docs/disks/customer-supplied-encryption#rsa-encryption
+		key, err = rsa.EncryptOAEP(sha1.New(), rand.Reader, cert, key, nil)
+		if err != nil {
+			return bundle, fmt.Errorf("failed wrapping CSEK key: %w", err)
+		}
+		keyType = KeyTypeRSAEncrypted
+	}
+
 	bundle = append(bundle, CSEKKey{
 		URI:     uri,
 		Key:     base64.StdEncoding.EncodeToString(key),
-		KeyType: "raw",
+		KeyType: keyType,
 	})
 	return bundle, nil
 }
 
+// ReadRSACert reads the RSA public key to wrap CSEK keys with from the PEM file
+// 'path', a certificate like Google's
+// https://cloud-certs.storage.googleapis.com/google-cloud-csek-ingress.pem or a
+// public key.
+func ReadRSACert(path string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", path)
+	}
+
+	var pub any
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing certificate %s: %w", path, err)
+		}
+		pub = cert.PublicKey
+	case "PUBLIC KEY":
+		pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing public key %s: %w", path, err)
+		}
+	default:
+		return nil, fmt.Errorf("%s has a PEM block of type '%s', expected a CERTIFICATE or PUBLIC KEY", path, block.Type)
+	}
+	key, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New(path + " does not have an RSA public key")
+	}
+	return key, nil
+}
+
+// KeyType returns the key-type of the key for the resource 'uri', or an empty
+// string if the bundle does not contain a key for the resource.
+func (c CSEKBundle) KeyType(uri string) string {
+	for _, k := range c {
+		if k.URI == uri {
+			return k.KeyType
+		}
+	}
+	return ""
+}
+
 func (c CSEKBundle) Marshal() ([]byte, error) {
 	return json.Marshal(c)
 }
@@ -59,3 +149,61 @@ func (c CSEKBundle) Marshal() ([]byte, error) {
 func (c CSEKBundle) MarshalIndent() ([]byte, error) {
 	return json.MarshalIndent(c, "", " ")
 }
+
+// forURI returns a bundle with the key for the resource 'uri', or nil if the
+// bundle does not contain a key for the resource.
+func (c CSEKBundle) forURI(uri string) CSEKBundle {
+	for _, k := range c {
+		if k.URI == uri {
+			return CSEKBundle{k}
+		}
+	}
+	return nil
+}
+
+// encryptionKey returns the key for the resource 'uri' in the API's format, or
+// nil if the bundle does not contain a key for the resource.
+func (c CSEKBundle) encryptionKey(uri string) *compute.CustomerEncryptionKey {
+	for _, k := range c {
+		if k.URI == uri {
+			return k.encryptionKey()
+		}
+	}
+	return nil
+}
+
+// encryptionKey returns the key in the API's format.
+func (k CSEKKey) encryptionKey() *compute.CustomerEncryptionKey {
+	if k.KeyType == KeyTypeRSAEncrypted {
+		return &compute.CustomerEncryptionKey{RsaEncryptedKey: k.Key}
+	}
+	return &compute.CustomerEncryptionKey{RawKey: k.Key}
+}
+
+// Redacted returns a copy of the bundle with the keys replaced with Redacted, eg:
+// for printing.
+func (c CSEKBundle) Redacted() CSEKBundle {
+	if c == nil {
+		return nil
+	}
+	redacted := make(CSEKBundle, len(c))
+	for i, k := range c {
+		k.Key = Redacted
+		redacted[i] = k
+	}
+	return redacted
+}
+
+// LogValue implements slog.LogValuer so that keys are never logged.
+func (c CSEKBundle) LogValue() slog.Value {
+	uris := make([]string, len(c))
+	for i, k := range c {
+		uris[i] = k.URI
+	}
+	return slog.GroupValue(slog.Int("keys", len(c)), slog.Any("uris", uris))
+}
+
+// LogValue implements slog.LogValuer so that the key is never logged.
+func (k CSEKKey) LogValue() slog.Value {
+	return slog.GroupValue(slog.String("uri", k.URI), slog.String("key-type", k.KeyType), slog.String("key", Redacted))
+}
@@ -0,0 +1,96 @@
+package gcp_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/joemiller/gmachine/internal/gcp"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeRSACert writes a self-signed certificate like Google's CSEK certificate to
+// a temp dir and returns its path and private key.
+func writeRSACert(t *testing.T) (string, *rsa.PrivateKey) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "google-cloud-csek-ingress"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	assert.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "cert.pem")
+	assert.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	return path, priv
+}
+
+func TestCreateCSEK(t *testing.T) {
+	uri := gcp.DiskURI("my-proj", "us-west1-a", "foo")
+	csek, err := gcp.CreateCSEK(uri)
+	assert.NoError(t, err)
+	if assert.Len(t, csek, 1) {
+		assert.Equal(t, uri, csek[0].URI)
+		assert.Equal(t, gcp.KeyTypeRaw, csek[0].KeyType)
+		key, _ := base64.StdEncoding.DecodeString(csek[0].Key)
+		assert.Len(t, key, 32)
+	}
+}
+
+func TestCreateWrappedCSEK(t *testing.T) {
+	path, priv := writeRSACert(t)
+	cert, err := gcp.ReadRSACert(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, priv.PublicKey, *cert)
+
+	uri := gcp.DiskURI("my-proj", "us-west1-a", "foo")
+	csek, err := gcp.CreateWrappedCSEK(uri, cert)
+	assert.NoError(t, err)
+	if !assert.Len(t, csek, 1) {
+		return
+	}
+	assert.Equal(t, gcp.KeyTypeRSAEncrypted, csek[0].KeyType)
+	assert.Equal(t, gcp.KeyTypeRSAEncrypted, csek.KeyType(uri))
+
+	// only the holder of the certificate's private key can unwrap it
+	wrapped, _ := base64.StdEncoding.DecodeString(csek[0].Key)
+	key, err := rsa.DecryptOAEP(sha1.New(), nil, priv, wrapped, nil)
+	assert.NoError(t, err)
+	assert.Len(t, key, 32)
+}
+
+func TestReadRSACert(t *testing.T) {
+	dir := t.TempDir()
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	assert.NoError(t, err)
+	pub := filepath.Join(dir, "pub.pem")
+	assert.NoError(t, os.WriteFile(pub, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600))
+	cert, err := gcp.ReadRSACert(pub)
+	assert.NoError(t, err)
+	assert.Equal(t, priv.PublicKey, *cert)
+
+	bad := filepath.Join(dir, "priv.pem")
+	assert.NoError(t, os.WriteFile(bad, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}), 0o600))
+	_, err = gcp.ReadRSACert(bad)
+	assert.ErrorContains(t, err, "expected a CERTIFICATE or PUBLIC KEY")
+
+	assert.NoError(t, os.WriteFile(bad, []byte("not a pem"), 0o600))
+	_, err = gcp.ReadRSACert(bad)
+	assert.ErrorContains(t, err, "is not a PEM file")
+}
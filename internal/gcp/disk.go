@@ -1,7 +1,227 @@
 package gcp
 
-import "fmt"
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+
+	"google.golang.org/api/compute/v1"
+)
 
 func DiskURI(project, zone, disk string) string {
 	return fmt.Sprintf("https://www.googleapis.com/compute/v1/projects/%s/zones/%s/disks/%s", project, zone, disk)
 }
+
+func SnapshotURI(project, snapshot string) string {
+	return fmt.Sprintf("https://www.googleapis.com/compute/v1/projects/%s/global/snapshots/%s", project, snapshot)
+}
+
+// DiskRef identifies a disk and the account used to manage it. It has the same
+// fields as InstanceRef so that a disk in an instance's zone is
+// DiskRef{Name: disk, Account: ref.Account, Project: ref.Project, Zone: ref.Zone}.
+type DiskRef struct {
+	Name    string
+	Account string
+	Project string
+	Zone    string
+}
+
+// Disk returns the DiskRef of the disk 'name' in the instance's project and zone.
+func (r InstanceRef) Disk(name string) DiskRef {
+	return DiskRef{Name: name, Account: r.Account, Project: r.Project, Zone: r.Zone}
+}
+
+// URI returns the disk's URI, as used in CSEK key files.
+func (r DiskRef) URI() string {
+	return DiskURI(r.Project, r.Zone, r.Name)
+}
+
+// gcloudArgs returns the --account, --project, and --zone flags for the disk.
+func (r DiskRef) gcloudArgs() []string {
+	return InstanceRef(r).gcloudArgs()
+}
+
+// DiskRequest represents a configuration for creating a new disk with the
+// CreateDisk() func.
+type DiskRequest struct {
+	Ref            DiskRef
+	Size           string // eg: "10GB", defaults to the size of the source snapshot
+	Type           string // eg: "pd-balanced"
+	SourceSnapshot string // name of a snapshot in the disk's project, optional
+	// CSEK holds the key to encrypt the disk with and the key of the source
+	// snapshot, if they are CSEK encrypted.
+	CSEK CSEKBundle
+}
+
+// redacted returns a copy of the request with CSEK keys redacted.
+func (r DiskRequest) redacted() DiskRequest {
+	r.CSEK = r.CSEK.Redacted()
+	return r
+}
+
+// AttachDiskRequest represents a disk to attach to an instance with the
+// AttachDisk() func.
+type AttachDiskRequest struct {
+	Disk       string // name of a disk in the instance's zone
+	DeviceName string // defaults to the disk's name
+	Boot       bool
+	// CSEK holds the disk's key, if it is CSEK encrypted.
+	CSEK CSEKBundle
+}
+
+// redacted returns a copy of the request with CSEK keys redacted.
+func (r AttachDiskRequest) redacted() AttachDiskRequest {
+	r.CSEK = r.CSEK.Redacted()
+	return r
+}
+
+// BootDisk returns the name and device name of the instance's boot disk, or
+// empty strings if it has none, eg: while its boot disk is being replaced.
+func BootDisk(instance compute.Instance) (name, deviceName string) {
+	for _, d := range instance.Disks {
+		if d.Boot {
+			return path.Base(d.Source), d.DeviceName
+		}
+	}
+	return "", ""
+}
+
+// csekStdin returns the CSEK key file to pass to gcloud on stdin, and the flag
+// that reads it, or nothing if 'csek' is empty.
+func csekStdin(csek CSEKBundle) (io.Reader, []string, error) {
+	if len(csek) == 0 {
+		return nil, nil, nil
+	}
+	stdin, err := csek.Marshal()
+	if err != nil {
+		return nil, nil, err
+	}
+	return bytes.NewReader(stdin), []string{"--csek-key-file=-"}, nil
+}
+
+// DescribeDisk returns the disk resource from 'gcloud compute disks describe'.
+func (g *Gcloud) DescribeDisk(ctx context.Context, ref DiskRef) (compute.Disk, error) {
+	var disk compute.Disk
+
+	args := []string{"gcloud", "compute", "disks", "describe", ref.Name}
+	args = append(args, ref.gcloudArgs()...)
+	args = append(args, "--format=json")
+
+	b, err := output(ctx, args...)
+	if err != nil {
+		return disk, err
+	}
+	err = json.Unmarshal(b, &disk)
+	return disk, err
+}
+
+// CreateDisk creates a disk with 'gcloud compute disks create'. The CSEK keys are
+// passed to gcloud via stdin.
+func (g *Gcloud) CreateDisk(ctx context.Context, req DiskRequest) (*Operation, error) {
+	args := []string{"gcloud", "compute", "disks", "create", req.Ref.Name}
+	args = append(args, req.Ref.gcloudArgs()...)
+	if req.Size != "" {
+		args = append(args, "--size="+req.Size)
+	}
+	if req.Type != "" {
+		args = append(args, "--type="+req.Type)
+	}
+	if req.SourceSnapshot != "" {
+		args = append(args, "--source-snapshot="+req.SourceSnapshot)
+	}
+	stdin, csekArgs, err := csekStdin(req.CSEK)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, csekArgs...)
+	return g.async(ctx, InstanceRef(req.Ref), stdin, args)
+}
+
+// DeleteDisk deletes a disk with 'gcloud compute disks delete'.
+func (g *Gcloud) DeleteDisk(ctx context.Context, ref DiskRef) (*Operation, error) {
+	args := []string{"gcloud", "compute", "disks", "delete", ref.Name}
+	args = append(args, ref.gcloudArgs()...)
+	args = append(args, "-q")
+	return g.async(ctx, InstanceRef(ref), nil, args)
+}
+
+// ResizeDisk grows a disk with 'gcloud compute disks resize'.
+func (g *Gcloud) ResizeDisk(ctx context.Context, ref DiskRef, size string) (*Operation, error) {
+	args := []string{"gcloud", "compute", "disks", "resize", ref.Name}
+	args = append(args, ref.gcloudArgs()...)
+	args = append(args, "--size="+size, "-q")
+	return g.async(ctx, InstanceRef(ref), nil, args)
+}
+
+// AttachDisk attaches a disk with 'gcloud compute instances attach-disk'. The
+// CSEK key is passed to gcloud via stdin.
+func (g *Gcloud) AttachDisk(ctx context.Context, ref InstanceRef, req AttachDiskRequest) (*Operation, error) {
+	args := []string{"gcloud", "compute", "instances", "attach-disk", ref.Name}
+	args = append(args, ref.gcloudArgs()...)
+	args = append(args, "--disk="+req.Disk)
+	if req.DeviceName != "" {
+		args = append(args, "--device-name="+req.DeviceName)
+	}
+	if req.Boot {
+		args = append(args, "--boot")
+	}
+	stdin, csekArgs, err := csekStdin(req.CSEK)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, csekArgs...)
+	return g.async(ctx, ref, stdin, args)
+}
+
+// DetachDisk detaches a disk with 'gcloud compute instances detach-disk'.
+func (g *Gcloud) DetachDisk(ctx context.Context, ref InstanceRef, deviceName string) (*Operation, error) {
+	args := []string{"gcloud", "compute", "instances", "detach-disk", ref.Name}
+	args = append(args, ref.gcloudArgs()...)
+	args = append(args, "--device-name="+deviceName)
+	return g.async(ctx, ref, nil, args)
+}
+
+// SetDiskAutoDelete sets whether a disk is deleted with the instance with
+// 'gcloud compute instances set-disk-auto-delete'.
+func (g *Gcloud) SetDiskAutoDelete(ctx context.Context, ref InstanceRef, deviceName string, autoDelete bool) (*Operation, error) {
+	args := []string{"gcloud", "compute", "instances", "set-disk-auto-delete", ref.Name}
+	args = append(args, ref.gcloudArgs()...)
+	args = append(args, "--device-name="+deviceName)
+	if autoDelete {
+		args = append(args, "--auto-delete")
+	} else {
+		args = append(args, "--no-auto-delete")
+	}
+	return g.async(ctx, ref, nil, args)
+}
+
+// CreateSnapshot snapshots a disk with 'gcloud compute disks snapshot'. The CSEK
+// keys are passed to gcloud via stdin.
+func (g *Gcloud) CreateSnapshot(ctx context.Context, ref DiskRef, name string, csek CSEKBundle) (*Operation, error) {
+	args := []string{"gcloud", "compute", "disks", "snapshot", ref.Name}
+	args = append(args, ref.gcloudArgs()...)
+	args = append(args, "--snapshot-names="+name)
+	stdin, csekArgs, err := csekStdin(csek)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, csekArgs...)
+	return g.async(ctx, InstanceRef(ref), stdin, args)
+}
+
+// DeleteSnapshot deletes a snapshot with 'gcloud compute snapshots delete'.
+func (g *Gcloud) DeleteSnapshot(ctx context.Context, ref DiskRef, name string) error {
+	args := []string{"gcloud", "compute", "snapshots", "delete", name}
+	if ref.Account != "" {
+		args = append(args, "--account="+ref.Account)
+	}
+	args = append(args, "--project="+ref.Project, "-q")
+	if g.DryRun != nil {
+		printDryRunCommand(g.DryRun, args)
+		return nil
+	}
+	return run(ctx, nil, g.Stdout, g.Stderr, args...)
+}
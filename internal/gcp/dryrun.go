@@ -0,0 +1,128 @@
+package gcp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Redacted replaces secrets, such as CSEK keys, in dry-run output.
+const Redacted = "REDACTED"
+
+// dryRunOperation returns the completed operation that is returned by mutating
+// Backend calls in dry-run mode.
+func dryRunOperation(ref InstanceRef) *Operation {
+	return &Operation{
+		Name:    "dry-run",
+		Target:  ref.Name,
+		Account: ref.Account,
+		Project: ref.Project,
+		Zone:    ref.Zone,
+		Status:  "DONE",
+	}
+}
+
+// printDryRunCommand prints the command that would be run in dry-run mode. If the
+// command reads a CSEK key file from stdin the key file is not printed.
+func printDryRunCommand(w io.Writer, args []string) {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = shellQuote(a)
+	}
+	fmt.Fprintf(w, "[dry-run] %s\n", strings.Join(quoted, " "))
+	for _, a := range args {
+		if a == "--csek-key-file=-" {
+			fmt.Fprintf(w, "[dry-run]   (CSEK key file on stdin: %s)\n", Redacted)
+		}
+	}
+}
+
+// shellQuote quotes 's' for a POSIX shell if it contains any special characters.
+func shellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_=.,/:@%+", r))
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// dryRunTransport is an http.RoundTripper that prints mutating API requests
+// instead of sending them and responds with a completed operation. Read-only
+// (GET) requests are sent.
+type dryRunTransport struct {
+	base http.RoundTripper
+	w    io.Writer
+}
+
+func (t *dryRunTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodGet {
+		return t.base.RoundTrip(req)
+	}
+
+	fmt.Fprintf(t.w, "[dry-run] %s %s\n", req.Method, req.URL.Redacted())
+	if req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(body) > 0 {
+			fmt.Fprintf(t.w, "%s\n", redactJSON(body))
+		}
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(`{"name": "dry-run", "status": "DONE"}`)),
+		Request:    req,
+	}, nil
+}
+
+// redactJSON returns the JSON document 'b', indented, with the values of any
+// fields containing encryption keys replaced with Redacted. Documents that cannot
+// be parsed are returned as-is.
+func redactJSON(b []byte) []byte {
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return b
+	}
+	v = redactValue(v)
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return b
+	}
+	return bytes.TrimSpace(buf.Bytes())
+}
+
+// secretFields are the API fields that contain key material.
+var secretFields = map[string]bool{
+	"rawKey":          true,
+	"rsaEncryptedKey": true,
+}
+
+func redactValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, val := range v {
+			if secretFields[k] {
+				v[k] = Redacted
+				continue
+			}
+			v[k] = redactValue(val)
+		}
+	case []any:
+		for i := range v {
+			v[i] = redactValue(v[i])
+		}
+	}
+	return v
+}
@@ -0,0 +1,121 @@
+package gcp_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/joemiller/gmachine/internal/gcp"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/option"
+)
+
+func TestGcloud_dryRun(t *testing.T) {
+	var out bytes.Buffer
+	g := gcp.NewGcloud(nil, nil)
+	g.DryRun = &out
+
+	csek := gcp.CSEKBundle{{URI: gcp.DiskURI("my-proj", "us-west1-a", "foo"), Key: "c2VjcmV0", KeyType: "raw"}}
+	op, err := g.StartInstance(context.Background(), fooRef, csek)
+	assert.NoError(t, err)
+	assert.True(t, op.Done())
+
+	assert.Equal(t, "[dry-run] gcloud beta compute instances start foo --project=my-proj --zone=us-west1-a --csek-key-file=- --async --format=json\n"+
+		"[dry-run]   (CSEK key file on stdin: REDACTED)\n", out.String())
+
+	out.Reset()
+	_, err = g.CreateInstance(context.Background(), gcp.CreateRequest{
+		Name: "foo", Project: "my-proj", Zone: "us-west1-a", MachineType: "e2-small", BootDiskSize: "10GB",
+		BootDiskType: "pd-ssd", ImageProject: "ubuntu-os-cloud", ImageFamily: "ubuntu-2204-lts", KMSKey: testKMSKey,
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), " --boot-disk-kms-key="+testKMSKey+" ")
+
+	out.Reset()
+	_, err = g.CreateInstance(context.Background(), gcp.CreateRequest{
+		Name: "foo", Project: "my-proj", Zone: "us-west1-a",
+		Network: gcp.Network{Subnet: "workstations", NoAddress: true, InternalIP: "10.1.2.3", Tags: []string{"ssh", "dev"}, StackType: gcp.StackTypeIPv4IPv6},
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), " --subnet=workstations --no-address --private-network-ip=10.1.2.3 --tags=ssh,dev --stack-type=IPV4_IPV6 ")
+	assert.NotContains(t, out.String(), "--network=")
+
+	out.Reset()
+	_, err = g.CreateInstance(context.Background(), gcp.CreateRequest{
+		Name: "foo", Project: "my-proj", Zone: "us-west1-a",
+		Scheduling: gcp.Scheduling{ProvisioningModel: gcp.ProvisioningModelSpot, MaxRunDuration: 4 * time.Hour},
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), " --provisioning-model=SPOT --instance-termination-action=STOP --max-run-duration=14400s ")
+
+	out.Reset()
+	_, err = g.CreateInstance(context.Background(), gcp.CreateRequest{
+		Name: "foo", Project: "my-proj", Zone: "us-west1-a",
+		Metadata: map[string]string{"b": "2", "a": "1"}, Labels: map[string]string{"team": "infra"},
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), " --metadata=a=1,b=2 --labels=team=infra ")
+
+	out.Reset()
+	assert.NoError(t, g.UpdateLabels(context.Background(), fooRef, map[string]string{"team": "web", "env": "dev"}))
+	assert.Equal(t, "[dry-run] gcloud compute instances update foo --project=my-proj --zone=us-west1-a --update-labels=env=dev,team=web\n", out.String())
+
+	// values with commas are joined with another delimiter
+	out.Reset()
+	assert.NoError(t, g.UpdateMetadata(context.Background(), fooRef, map[string]string{"ssh-keys": "a,b", "x": "c:d"}))
+	assert.Equal(t, "[dry-run] gcloud compute instances add-metadata foo --project=my-proj --zone=us-west1-a '--metadata=^::^ssh-keys=a,b::x=c:d'\n", out.String())
+
+	out.Reset()
+	assert.NoError(t, g.MoveInstance(context.Background(), fooRef, "us-west1-b"))
+	assert.Equal(t, "[dry-run] gcloud compute instances move foo --project=my-proj --zone=us-west1-a --destination-zone=us-west1-b -q\n", out.String())
+
+	out.Reset()
+	_, err = g.ResizeDisk(context.Background(), fooRef.Disk("data"), "200GB")
+	assert.NoError(t, err)
+	assert.Equal(t, "[dry-run] gcloud compute disks resize data --project=my-proj --zone=us-west1-a --size=200GB -q --async --format=json\n", out.String())
+}
+
+func TestAPI_dryRun(t *testing.T) {
+	fake := &fakeComputeAPI{bodies: map[string][]byte{}}
+	srv := newTestServer(t, fake)
+
+	var out bytes.Buffer
+	api, err := gcp.NewDryRunAPI(context.Background(), &out,
+		option.WithEndpoint(srv.URL+"/compute/v1/"),
+		option.WithoutAuthentication(),
+	)
+	assert.NoError(t, err)
+
+	// read-only requests are sent
+	_, err = api.DescribeInstance(context.Background(), fooRef)
+	assert.NoError(t, err)
+
+	csek := gcp.CSEKBundle{{URI: gcp.DiskURI("my-proj", "us-west1-a", "foo"), Key: "c2VjcmV0", KeyType: "raw"}}
+	op, err := api.StartInstance(context.Background(), fooRef, csek)
+	assert.NoError(t, err)
+	assert.True(t, op.Done())
+
+	assert.Equal(t, []string{"GET projects/my-proj/zones/us-west1-a/instances/foo"}, fake.requests)
+	assert.Contains(t, out.String(), "[dry-run] POST "+srv.URL+"/compute/v1/projects/my-proj/zones/us-west1-a/instances/foo/startWithEncryptionKey")
+	assert.Contains(t, out.String(), `"rawKey": "REDACTED"`)
+	assert.NotContains(t, out.String(), "c2VjcmV0")
+}
+
+func TestFake_dryRun(t *testing.T) {
+	ctx := context.Background()
+	var out bytes.Buffer
+	fake := gcp.NewFake("", 0, nil)
+	req := newFakeRequest()
+	assert.NoError(t, waiter(fake)(fake.CreateInstance(ctx, req)))
+
+	fake.DryRun = &out
+	op, err := fake.StopInstance(ctx, req.Ref())
+	assert.NoError(t, err)
+	assert.True(t, op.Done())
+	assert.Contains(t, out.String(), "[dry-run] fake StopInstance")
+
+	instance, err := fake.DescribeInstance(ctx, req.Ref())
+	assert.NoError(t, err)
+	assert.Equal(t, "RUNNING", instance.Status)
+}
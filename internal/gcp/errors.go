@@ -0,0 +1,231 @@
+package gcp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// Classes of errors returned by a Backend. Use errors.Is to check the class of an
+// error, eg: errors.Is(err, gcp.ErrNotFound).
+var (
+	ErrNotFound              = errors.New("not found")
+	ErrPermissionDenied      = errors.New("permission denied")
+	ErrQuotaExceeded         = errors.New("quota exceeded")
+	ErrZoneResourceExhausted = errors.New("zone resources exhausted")
+	ErrAuthExpired           = errors.New("authentication expired")
+	ErrCSEKMissing           = errors.New("CSEK key missing or incorrect")
+	ErrInvalidState          = errors.New("instance is not in a valid state for the operation")
+	ErrAlreadyExists         = errors.New("already exists")
+	ErrUnavailable           = errors.New("service unavailable")
+
+	// ErrRateLimited is a short-term quota, it matches ErrQuotaExceeded.
+	ErrRateLimited = fmt.Errorf("rate limit exceeded: %w", ErrQuotaExceeded)
+	// ErrNotReady is a resource that is busy with another operation, eg: an
+	// instance that is still stopping. It matches ErrInvalidState.
+	ErrNotReady = fmt.Errorf("resource is not ready: %w", ErrInvalidState)
+)
+
+// IsTransient returns true if err is likely to succeed if retried later: rate
+// limits, server errors and resources that are not ready yet.
+func IsTransient(err error) bool {
+	return errors.Is(err, ErrRateLimited) || errors.Is(err, ErrUnavailable) || errors.Is(err, ErrNotReady)
+}
+
+// Error is a classified error from Google Cloud. It matches its Kind and the
+// underlying error with errors.Is.
+type Error struct {
+	Kind    error  // one of the Err* vars, eg: ErrNotFound
+	Message string // the message from the API or gcloud
+	Err     error  // the underlying error, may be nil
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return e.Kind.Error()
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// newError returns an Error of the given kind with a formatted message.
+func newError(kind error, format string, a ...any) error {
+	return &Error{Kind: kind, Message: fmt.Sprintf(format, a...)}
+}
+
+// classifyAPIError returns a classified Error for an error from a Google API
+// client, or err unchanged if its class is not known.
+func classifyAPIError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		return &Error{Kind: ErrAuthExpired, Message: err.Error(), Err: err}
+	}
+
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+
+	reasons := []string{}
+	for _, e := range apiErr.Errors {
+		reasons = append(reasons, e.Reason)
+	}
+
+	var kind error
+	switch {
+	case apiErr.Code == http.StatusUnauthorized:
+		kind = ErrAuthExpired
+	case apiErr.Code == http.StatusNotFound:
+		kind = ErrNotFound
+	case apiErr.Code == http.StatusConflict && hasAny(reasons, "alreadyExists"):
+		kind = ErrAlreadyExists
+	case apiErr.Code == http.StatusTooManyRequests || hasAny(reasons, "rateLimitExceeded", "userRateLimitExceeded"):
+		kind = ErrRateLimited
+	case hasAny(reasons, "quotaExceeded"):
+		kind = ErrQuotaExceeded
+	case apiErr.Code == http.StatusForbidden:
+		kind = ErrPermissionDenied
+	case apiErr.Code >= 500:
+		kind = ErrUnavailable
+	case hasAny(reasons, "resourceNotReady"):
+		kind = ErrNotReady
+	default:
+		kind = classifyMessage(strings.Join(reasons, " ") + " " + apiErr.Message)
+	}
+	if kind == nil {
+		return err
+	}
+
+	msg := apiErr.Message
+	if msg == "" {
+		msg = err.Error()
+	}
+	return &Error{Kind: kind, Message: msg, Err: err}
+}
+
+// classifyOperationError returns the class of an operation's error code, eg:
+// ZONE_RESOURCE_POOL_EXHAUSTED, or nil if it is not known.
+func classifyOperationError(code, message string) error {
+	switch code {
+	case "RESOURCE_NOT_FOUND":
+		return ErrNotFound
+	case "RESOURCE_ALREADY_EXISTS":
+		return ErrAlreadyExists
+	case "QUOTA_EXCEEDED":
+		return ErrQuotaExceeded
+	case "ZONE_RESOURCE_POOL_EXHAUSTED", "ZONE_RESOURCE_POOL_EXHAUSTED_WITH_DETAILS":
+		return ErrZoneResourceExhausted
+	case "RESOURCE_NOT_READY":
+		return ErrNotReady
+	case "UNSUPPORTED_OPERATION":
+		return ErrInvalidState
+	case "PERMISSIONS_ERROR":
+		return ErrPermissionDenied
+	}
+	return classifyMessage(code + " " + message)
+}
+
+// classifyGcloudError returns a classified Error for a failed gcloud command based
+// on what the command printed to stderr, or err unchanged if its class is not known.
+func classifyGcloudError(err error, stderr []byte) error {
+	if err == nil {
+		return nil
+	}
+
+	msg := gcloudErrorMessage(stderr)
+	// warnings and progress printed before the error are not classified
+	text := msg
+	if text == "" {
+		text = string(stderr)
+	}
+	kind := classifyMessage(text)
+	if kind == nil {
+		if msg == "" {
+			return err
+		}
+		return fmt.Errorf("%s (%w)", msg, err)
+	}
+	return &Error{Kind: kind, Message: msg, Err: err}
+}
+
+// gcloudErrorMessage returns the lines gcloud printed starting at the first
+// "ERROR:" line, eg: "ERROR: (gcloud.compute.instances.describe) Could not fetch
+// resource: ...".
+func gcloudErrorMessage(stderr []byte) string {
+	i := bytes.Index(stderr, []byte("ERROR: "))
+	if i < 0 {
+		return ""
+	}
+	return strings.TrimSpace(string(stderr[i+len("ERROR: "):]))
+}
+
+// classifyMessage classifies an error by the text of its message. The checks are
+// ordered from most to least specific since, for example, quota errors are also
+// permission errors (HTTP 403).
+func classifyMessage(msg string) error {
+	msg = strings.ToLower(msg)
+	switch {
+	case containsAny(msg,
+		"reauthentication", "refreshing your current auth tokens", "invalid_grant",
+		"gcloud auth login", "unauthenticated", "credentials have expired"):
+		return ErrAuthExpired
+	case containsAny(msg, "zone_resource_pool_exhausted", "does not have enough resources available"):
+		return ErrZoneResourceExhausted
+	case containsAny(msg, "ratelimitexceeded", "rate limit exceeded", "too many requests"):
+		return ErrRateLimited
+	case containsAny(msg, "quota"):
+		return ErrQuotaExceeded
+	case containsAny(msg, "backenderror", "internal error", "service unavailable", "bad gateway", "httperror 50"):
+		return ErrUnavailable
+	case containsAny(msg,
+		"customer-supplied encryption key", "customer supplied encryption key",
+		"resourceisencryptedwithcustomerencryptionkey"):
+		return ErrCSEKMissing
+	case containsAny(msg, "permission", "forbidden", "access denied", "not authorized"):
+		return ErrPermissionDenied
+	case containsAny(msg, "was not found", "not found", "notfound"):
+		return ErrNotFound
+	case containsAny(msg, "already exists", "alreadyexists"):
+		return ErrAlreadyExists
+	case containsAny(msg, "is not ready", "resourcenotready", "resource_not_ready"):
+		return ErrNotReady
+	case containsAny(msg, "invalid state", "unsupported_operation"):
+		return ErrInvalidState
+	}
+	return nil
+}
+
+func containsAny(s string, substrs ...string) bool {
+	for _, sub := range substrs {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAny(values []string, want ...string) bool {
+	for _, v := range values {
+		for _, w := range want {
+			if v == w {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package gcp_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/joemiller/gmachine/internal/gcp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyGcloudError(t *testing.T) {
+	exitErr := errors.New("exit status 1")
+
+	tests := []struct {
+		name    string
+		stderr  string
+		want    error
+		wantMsg string
+	}{
+		{
+			name:    "not found",
+			stderr:  "ERROR: (gcloud.compute.instances.describe) Could not fetch resource:\n - The resource 'projects/p/zones/z/instances/foo' was not found\n",
+			want:    gcp.ErrNotFound,
+			wantMsg: "(gcloud.compute.instances.describe) Could not fetch resource:\n - The resource 'projects/p/zones/z/instances/foo' was not found",
+		},
+		{
+			// resource names are not mistaken for the error's class
+			name:   "not found csek name",
+			stderr: "WARNING: reading the CSEK key file\nERROR: (gcloud.compute.instances.describe) Could not fetch resource:\n - The resource 'projects/p/zones/z/instances/csek-dev' was not found\n",
+			want:   gcp.ErrNotFound,
+		},
+		{
+			name:   "permission denied csek name",
+			stderr: "ERROR: (gcloud.compute.instances.stop) Could not fetch resource:\n - Required 'compute.instances.stop' permission for 'projects/p/zones/z/instances/csek-dev'\n",
+			want:   gcp.ErrPermissionDenied,
+		},
+		{
+			name:   "permission denied",
+			stderr: "ERROR: (gcloud.compute.instances.stop) Could not fetch resource:\n - Required 'compute.instances.stop' permission for 'projects/p/zones/z/instances/foo'\n",
+			want:   gcp.ErrPermissionDenied,
+		},
+		{
+			name:   "quota exceeded",
+			stderr: "ERROR: (gcloud.compute.instances.create) Could not fetch resource:\n - Quota 'CPUS' exceeded.  Limit: 24.0 in region us-west1.\n",
+			want:   gcp.ErrQuotaExceeded,
+		},
+		{
+			name:   "zone resources exhausted",
+			stderr: "ERROR: (gcloud.compute.instances.start) Could not fetch resource:\n - The zone 'projects/p/zones/z' does not have enough resources available to fulfill the request.\n",
+			want:   gcp.ErrZoneResourceExhausted,
+		},
+		{
+			name:   "auth expired",
+			stderr: "ERROR: (gcloud.compute.instances.describe) There was a problem refreshing your current auth tokens: Reauthentication failed.\nPlease run:\n\n  $ gcloud auth login\n",
+			want:   gcp.ErrAuthExpired,
+		},
+		{
+			name:   "csek missing",
+			stderr: "ERROR: (gcloud.compute.instances.start) Could not fetch resource:\n - The resource 'projects/p/zones/z/disks/foo' is encrypted with a customer-supplied encryption key, but the key was not provided.\n",
+			want:   gcp.ErrCSEKMissing,
+		},
+		{
+			name:   "invalid state",
+			stderr: "ERROR: (gcloud.compute.instances.suspend) Could not fetch resource:\n - The resource 'projects/p/zones/z/instances/foo' is not ready\n",
+			want:   gcp.ErrNotReady,
+		},
+		{
+			name:   "rate limited",
+			stderr: "ERROR: (gcloud.compute.instances.start) Could not fetch resource:\n - Rate Limit Exceeded\n",
+			want:   gcp.ErrRateLimited,
+		},
+		{
+			name:   "unavailable",
+			stderr: "ERROR: (gcloud.compute.instances.describe) Could not fetch resource:\n - Internal error. Please try again or contact Google Support. (Code: '5F2A')\n",
+			want:   gcp.ErrUnavailable,
+		},
+		{
+			name:    "unknown",
+			stderr:  "ERROR: (gcloud.compute.instances.stop) something unexpected\n",
+			want:    exitErr,
+			wantMsg: "(gcloud.compute.instances.stop) something unexpected (exit status 1)",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := gcp.ClassifyGcloudError(exitErr, []byte(tc.stderr))
+			assert.ErrorIs(t, err, tc.want)
+			assert.Equal(t, tc.want == gcp.ErrRateLimited || tc.want == gcp.ErrUnavailable || tc.want == gcp.ErrNotReady, gcp.IsTransient(err))
+			assert.ErrorIs(t, err, exitErr)
+			if tc.wantMsg != "" {
+				assert.EqualError(t, err, tc.wantMsg)
+			}
+		})
+	}
+
+	assert.NoError(t, gcp.ClassifyGcloudError(nil, []byte("ERROR: ignored")))
+}
@@ -1,40 +1,111 @@
 package gcp
 
 import (
+	"bytes"
+	"context"
 	"io"
+	"log/slog"
 	"os"
 	"os/exec"
 	"syscall"
+	"time"
 )
 
+// InterruptGracePeriod is how long a child process has to exit after being sent
+// SIGINT, when its context is canceled, before it is killed.
+var InterruptGracePeriod = 5 * time.Second
+
+// command returns an exec.Cmd that is interrupted with SIGINT when ctx is done,
+// giving gcloud a chance to clean up, and killed if it has not exited after
+// InterruptGracePeriod.
+func command(ctx context.Context, args ...string) *exec.Cmd {
+	exe := exec.CommandContext(ctx, args[0], args[1:]...)
+	exe.Cancel = func() error {
+		return exe.Process.Signal(os.Interrupt)
+	}
+	exe.WaitDelay = InterruptGracePeriod
+	exe.Env = append(os.Environ(), "PYTHONUNBUFFERED=1")
+	return exe
+}
+
 // run runs a command and connects the command's stdout and stderr to the provided
 // io.Writer's. Typically this will be os.Stdout and os.Stderr. An optional io.reader
-// can be passed as stdin to the command.
-var run = func(stdin io.Reader, stdout, stderr io.Writer, args ...string) error {
-	exe := exec.Command(args[0], args[1:]...)
+// can be passed as stdin to the command. If the command fails the error is
+// classified from what it printed to stderr, see classifyGcloudError.
+var run = func(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer, args ...string) error {
+	var errBuf bytes.Buffer
+	start := time.Now()
+	exe := command(ctx, args...)
 	exe.Stdout = stdout
-	exe.Stderr = stderr
+	exe.Stderr = io.MultiWriter(stderr, &errBuf)
 	exe.Stdin = stdin
-	env := os.Environ()
-	env = append(env, "PYTHONUNBUFFERED=1")
-	exe.Env = env
-	return exe.Run()
+	err := commandErr(ctx, exe.Run(), errBuf.Bytes())
+	logCommand(ctx, args, start, err)
+	return err
+}
+
+// runOutput runs a command and returns its stdout. The command's stderr is
+// connected to the provided io.Writer. An optional io.Reader can be passed as
+// stdin to the command.
+var runOutput = func(ctx context.Context, stdin io.Reader, stderr io.Writer, args ...string) ([]byte, error) {
+	var errBuf bytes.Buffer
+	start := time.Now()
+	exe := command(ctx, args...)
+	exe.Stderr = io.MultiWriter(stderr, &errBuf)
+	exe.Stdin = stdin
+	b, err := exe.Output()
+	err = commandErr(ctx, err, errBuf.Bytes())
+	logCommand(ctx, args, start, err)
+	return b, err
 }
 
 // execve replaces the current process with a new process.
-var execve = func(args []string) error {
+var execve = func(ctx context.Context, args []string) error {
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
 	path, err := exec.LookPath(args[0])
 	if err != nil {
 		return err
 	}
+	slog.DebugContext(ctx, "exec", "args", args)
 	// TODO: refactor? I think we're expected to use the unix pkg from x/sys instead of syscall. https://godoc.org/golang.org/x/sys/unix#Exec
 	return syscall.Exec(path, args, os.Environ())
 }
 
-var output = func(args ...string) ([]byte, error) {
-	exe := exec.Command(args[0], args[1:]...)
+var output = func(ctx context.Context, args ...string) ([]byte, error) {
+	var errBuf bytes.Buffer
+	start := time.Now()
+	exe := command(ctx, args...)
 	// pass thru stdin and stderr so that re-authentication prompts work
 	exe.Stdin = os.Stdin
-	exe.Stderr = os.Stderr
-	return exe.Output()
+	exe.Stderr = io.MultiWriter(os.Stderr, &errBuf)
+	b, err := exe.Output()
+	err = commandErr(ctx, err, errBuf.Bytes())
+	logCommand(ctx, args, start, err)
+	return b, err
+}
+
+// commandErr returns the error for a failed command. If the command failed because
+// the context was canceled or timed out the context's cause is returned since the
+// "signal: interrupt" error from the child is not useful to the user. Otherwise the
+// error is classified from the command's stderr.
+func commandErr(ctx context.Context, err error, stderr []byte) error {
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	return classifyGcloudError(err, stderr)
+}
+
+// logCommand logs a command that was run, how long it took and its error, if any.
+// Commands never include secrets: CSEK keys are passed to gcloud on stdin.
+func logCommand(ctx context.Context, args []string, start time.Time, err error) {
+	attrs := []any{"args", args, "duration", time.Since(start)}
+	if err != nil {
+		attrs = append(attrs, "error", err)
+	}
+	slog.DebugContext(ctx, "exec", attrs...)
 }
@@ -0,0 +1,6 @@
+package gcp
+
+// Exported for tests in the gcp_test package.
+var ClassifyGcloudError = classifyGcloudError
+var GcloudSSHArgs = gcloudSSHArgs
+var WriteGcloudKnownHosts = writeGcloudKnownHosts
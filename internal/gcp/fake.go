@@ -0,0 +1,1235 @@
+package gcp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// Fake is an in-memory Backend that simulates instance state transitions without
+// calling Google Cloud. It is intended for testing gmachine and scripts that
+// wrap it.
+//
+// Instances move through the same states as real instances:
+//
+//	create:  PROVISIONING -> RUNNING
+//	start:   STAGING      -> RUNNING
+//	stop:    STOPPING     -> TERMINATED
+//	suspend: SUSPENDING   -> SUSPENDED
+//	resume:  STAGING      -> RUNNING
+//	delete:  STOPPING     -> (deleted)
+//
+// Disks and snapshots are simulated too. Like real instances, starting an
+// instance requires the keys of its CSEK encrypted disks.
+//
+// Spot instances can be preempted with Preempt. Creating or starting an instance
+// in one of ExhaustedZones fails with ErrZoneResourceExhausted, eg: to test
+// starting a preempted instance in another zone. Each region has the zones a, b
+// and c.
+//
+// Each transitional state lasts for TransitionDelay. Every call takes Latency to
+// return, or until its context is done, which can be used to simulate a slow or
+// hung API. If StateFile is set the state is loaded from and saved to the file
+// on every call so that separate gmachine processes share the same fake project.
+// If DryRun is set, calls that would change anything are printed to it instead.
+type Fake struct {
+	TransitionDelay time.Duration
+	Latency         time.Duration
+	StateFile       string
+	Stdout          io.Writer
+	DryRun          io.Writer
+	ExhaustedZones  []string
+
+	mu         sync.Mutex
+	instances  map[string]*fakeInstance
+	disks      map[string]*fakeDisk
+	snapshots  map[string]*fakeSnapshot
+	operations []*fakeOperation
+	accounts   []string
+	nextIP     int
+	nextOp     int
+}
+
+type fakeInstance struct {
+	Ref            InstanceRef        `json:"ref"`
+	MachineType    string             `json:"machine_type"`
+	Status         string             `json:"status"`
+	Pending        string             `json:"pending,omitempty"`
+	PendingAt      time.Time          `json:"pending_at,omitempty"`
+	Disks          []fakeAttachedDisk `json:"disks,omitempty"`
+	ServiceAccount string             `json:"service_account,omitempty"`
+	InternalIP     string             `json:"internal_ip"`
+	ExternalIP     string             `json:"external_ip,omitempty"`
+	Network        Network            `json:"network,omitempty"`
+	Scheduling     Scheduling         `json:"scheduling,omitempty"`
+	Metadata       map[string]string  `json:"metadata,omitempty"`
+	Labels         map[string]string  `json:"labels,omitempty"`
+	HostKeys       []string           `json:"host_keys,omitempty"`
+}
+
+type fakeAttachedDisk struct {
+	Name       string `json:"name"`
+	DeviceName string `json:"device_name"`
+	Boot       bool   `json:"boot,omitempty"`
+	AutoDelete bool   `json:"auto_delete,omitempty"`
+}
+
+type fakeDisk struct {
+	Ref            DiskRef    `json:"ref"`
+	Type           string     `json:"type"`
+	SizeGB         int64      `json:"size_gb"`
+	SourceSnapshot string     `json:"source_snapshot,omitempty"`
+	CSEK           CSEKBundle `json:"csek,omitempty"`
+	KMSKey         string     `json:"kms_key,omitempty"`
+	User           string     `json:"user,omitempty"` // the instance the disk is attached to
+}
+
+type fakeSnapshot struct {
+	Project    string     `json:"project"`
+	Name       string     `json:"name"`
+	SourceDisk string     `json:"source_disk"`
+	Type       string     `json:"type"`
+	SizeGB     int64      `json:"size_gb"`
+	CSEK       CSEKBundle `json:"csek,omitempty"`
+}
+
+type fakeOperation struct {
+	Name      string      `json:"name"`
+	Type      string      `json:"type"`
+	Ref       InstanceRef `json:"ref"`
+	StartTime time.Time   `json:"start_time"`
+	DoneAt    time.Time   `json:"done_at"`
+}
+
+type fakeState struct {
+	Instances       []*fakeInstance  `json:"instances"`
+	Disks           []*fakeDisk      `json:"disks,omitempty"`
+	Snapshots       []*fakeSnapshot  `json:"snapshots,omitempty"`
+	Operations      []*fakeOperation `json:"operations"`
+	ServiceAccounts []string         `json:"service_accounts"`
+	NextIP          int              `json:"next_ip"`
+	NextOp          int              `json:"next_op"`
+}
+
+// maxFakeOperations is the number of operations the fake remembers.
+const maxFakeOperations = 100
+
+// deleted is the pending status of an instance that is being deleted.
+const deleted = "DELETED"
+
+// NewFake returns a Fake backend. If stateFile is not empty the fake's state is
+// persisted to it.
+func NewFake(stateFile string, delay time.Duration, stdout io.Writer) *Fake {
+	return &Fake{StateFile: stateFile, TransitionDelay: delay, Stdout: stdout}
+}
+
+func fakeKey(ref InstanceRef) string {
+	return ref.Project + "/" + ref.Zone + "/" + ref.Name
+}
+
+func fakeDiskKey(ref DiskRef) string {
+	return fakeKey(InstanceRef(ref))
+}
+
+func fakeSnapshotKey(project, name string) string {
+	return project + "/" + name
+}
+
+// CurrentAccount returns a fixed fake account.
+func (f *Fake) CurrentAccount(ctx context.Context) (string, error) {
+	return "fake@example.com", nil
+}
+
+// CreateServiceAccount records a new service account.
+func (f *Fake) CreateServiceAccount(ctx context.Context, account, project, name string) error {
+	if f.dryRun("CreateServiceAccount", map[string]string{"account": account, "project": project, "name": name}) {
+		return nil
+	}
+	return f.update(ctx, func() error {
+		email := fmt.Sprintf("%s@%s.iam.gserviceaccount.com", name, project)
+		for _, a := range f.accounts {
+			if a == email {
+				return fmt.Errorf("service account %s already exists", email)
+			}
+		}
+		f.accounts = append(f.accounts, email)
+		return nil
+	})
+}
+
+// CreateInstance adds a new instance in the PROVISIONING state.
+func (f *Fake) CreateInstance(ctx context.Context, req CreateRequest) (*Operation, error) {
+	if f.dryRun("CreateInstance", req.redacted()) {
+		return dryRunOperation(req.Ref()), nil
+	}
+	ref := req.Ref()
+	// like the API, the startup script is read into the metadata
+	metadata := map[string]string{}
+	for k, v := range req.Metadata {
+		metadata[k] = v
+	}
+	if req.StartupScriptURL != "" {
+		metadata["startup-script-url"] = req.StartupScriptURL
+	}
+	if req.StartupScript != "" {
+		script, err := os.ReadFile(req.StartupScript)
+		if err != nil {
+			return nil, fmt.Errorf("error reading startup script: %w", err)
+		}
+		metadata["startup-script"] = string(script)
+	}
+	var op *Operation
+	err := f.update(ctx, func() error {
+		if _, ok := f.instances[fakeKey(ref)]; ok {
+			return fmt.Errorf("instance %s already exists", ref.Name)
+		}
+		if err := req.Network.Validate(); err != nil {
+			return err
+		}
+		if err := req.Scheduling.Validate(); err != nil {
+			return err
+		}
+		if err := ValidateLabels(req.Labels); err != nil {
+			return err
+		}
+		if err := f.checkZone(ref.Zone); err != nil {
+			return err
+		}
+		disk := &fakeDisk{Ref: ref.Disk(req.Name), Type: req.BootDiskType, SizeGB: 10, User: ref.Name}
+		if _, ok := f.disks[fakeDiskKey(disk.Ref)]; ok {
+			return newError(ErrAlreadyExists, "disk %s already exists", disk.Ref.Name)
+		}
+		if size, err := ParseDiskSizeGB(req.BootDiskSize); err == nil {
+			disk.SizeGB = size
+		}
+		disk.CSEK = req.CSEK.forURI(disk.Ref.URI())
+		if req.KMSKey != "" {
+			if err := ValidateKMSKey(req.KMSKey); err != nil {
+				return err
+			}
+			disk.KMSKey = req.KMSKey
+		}
+		f.disks[fakeDiskKey(disk.Ref)] = disk
+		sa := req.ServiceAccount
+		if sa == "" && !req.NoServiceAccount {
+			sa = fmt.Sprintf("default@%s.iam.gserviceaccount.com", ref.Project)
+		}
+		f.nextIP++
+		internalIP := fmt.Sprintf("10.0.0.%d", f.nextIP)
+		if net.ParseIP(req.Network.InternalIP) != nil {
+			internalIP = req.Network.InternalIP
+		}
+		i := &fakeInstance{
+			Ref:            ref,
+			MachineType:    req.MachineType,
+			Status:         "PROVISIONING",
+			Disks:          []fakeAttachedDisk{{Name: req.Name, DeviceName: req.Name, Boot: true, AutoDelete: true}},
+			ServiceAccount: sa,
+			InternalIP:     internalIP,
+			Metadata:       metadata,
+			Labels:         req.Labels,
+			Network:        req.Network,
+			Scheduling:     req.Scheduling,
+			HostKeys:       fakeHostKeys(),
+		}
+		f.instances[fakeKey(ref)] = i
+		op = f.transition(i, "insert", "RUNNING")
+		return nil
+	})
+	return op, err
+}
+
+// DeleteInstance deletes an instance.
+func (f *Fake) DeleteInstance(ctx context.Context, ref InstanceRef) (*Operation, error) {
+	if f.dryRun("DeleteInstance", ref) {
+		return dryRunOperation(ref), nil
+	}
+	var op *Operation
+	err := f.update(ctx, func() error {
+		i, err := f.get(ref)
+		if err != nil {
+			return err
+		}
+		i.Status = "STOPPING"
+		op = f.transition(i, "delete", deleted)
+		return nil
+	})
+	return op, err
+}
+
+// StartInstance starts a TERMINATED instance. If the instance was created with a
+// CSEK key the same key must be provided.
+func (f *Fake) StartInstance(ctx context.Context, ref InstanceRef, csek CSEKBundle) (*Operation, error) {
+	if f.dryRun("StartInstance", ref, csek.Redacted()) {
+		return dryRunOperation(ref), nil
+	}
+	var op *Operation
+	err := f.update(ctx, func() error {
+		i, err := f.get(ref)
+		if err != nil {
+			return err
+		}
+		switch i.Status {
+		case "RUNNING", "STAGING", "PROVISIONING":
+			op = f.newOperation(ref, "start", time.Now())
+			return nil
+		case "TERMINATED":
+		default:
+			return newError(ErrInvalidState, "instance %s cannot be started while %s", ref.Name, i.Status)
+		}
+		if err := f.checkCSEK(i, csek); err != nil {
+			return err
+		}
+		if err := f.checkZone(ref.Zone); err != nil {
+			return err
+		}
+		i.Status = "STAGING"
+		op = f.transition(i, "start", "RUNNING")
+		return nil
+	})
+	return op, err
+}
+
+// StopInstance stops a RUNNING or SUSPENDED instance.
+func (f *Fake) StopInstance(ctx context.Context, ref InstanceRef) (*Operation, error) {
+	if f.dryRun("StopInstance", ref) {
+		return dryRunOperation(ref), nil
+	}
+	var op *Operation
+	err := f.update(ctx, func() error {
+		i, err := f.get(ref)
+		if err != nil {
+			return err
+		}
+		switch i.Status {
+		case "TERMINATED", "STOPPING":
+			op = f.newOperation(ref, "stop", time.Now())
+			return nil
+		case "RUNNING", "SUSPENDED":
+		default:
+			return newError(ErrInvalidState, "instance %s cannot be stopped while %s", ref.Name, i.Status)
+		}
+		i.Status = "STOPPING"
+		op = f.transition(i, "stop", "TERMINATED")
+		return nil
+	})
+	return op, err
+}
+
+// SuspendInstance suspends a RUNNING instance. Like real instances, CSEK encrypted
+// instances cannot be suspended.
+func (f *Fake) SuspendInstance(ctx context.Context, ref InstanceRef) (*Operation, error) {
+	if f.dryRun("SuspendInstance", ref) {
+		return dryRunOperation(ref), nil
+	}
+	var op *Operation
+	err := f.update(ctx, func() error {
+		i, err := f.get(ref)
+		if err != nil {
+			return err
+		}
+		if f.encrypted(i) {
+			return newError(ErrInvalidState, "instance %s has CSEK encrypted disks and cannot be suspended", ref.Name)
+		}
+		switch i.Status {
+		case "SUSPENDED", "SUSPENDING":
+			op = f.newOperation(ref, "suspend", time.Now())
+			return nil
+		case "RUNNING":
+		default:
+			return newError(ErrInvalidState, "instance %s cannot be suspended while %s", ref.Name, i.Status)
+		}
+		i.Status = "SUSPENDING"
+		op = f.transition(i, "suspend", "SUSPENDED")
+		return nil
+	})
+	return op, err
+}
+
+// ResumeInstance resumes a SUSPENDED instance.
+func (f *Fake) ResumeInstance(ctx context.Context, ref InstanceRef, csek CSEKBundle) (*Operation, error) {
+	if f.dryRun("ResumeInstance", ref, csek.Redacted()) {
+		return dryRunOperation(ref), nil
+	}
+	var op *Operation
+	err := f.update(ctx, func() error {
+		i, err := f.get(ref)
+		if err != nil {
+			return err
+		}
+		switch i.Status {
+		case "RUNNING", "STAGING":
+			op = f.newOperation(ref, "resume", time.Now())
+			return nil
+		case "SUSPENDED":
+		default:
+			return newError(ErrInvalidState, "instance %s cannot be resumed while %s", ref.Name, i.Status)
+		}
+		i.Status = "STAGING"
+		op = f.transition(i, "resume", "RUNNING")
+		return nil
+	})
+	return op, err
+}
+
+// ResizeInstance changes the machine-type of a TERMINATED instance.
+func (f *Fake) ResizeInstance(ctx context.Context, ref InstanceRef, machineType string) (*Operation, error) {
+	if f.dryRun("ResizeInstance", ref, machineType) {
+		return dryRunOperation(ref), nil
+	}
+	var op *Operation
+	err := f.update(ctx, func() error {
+		i, err := f.get(ref)
+		if err != nil {
+			return err
+		}
+		if i.Status != "TERMINATED" {
+			return newError(ErrInvalidState, "instance %s must be stopped before it can be resized", ref.Name)
+		}
+		i.MachineType = machineType
+		op = f.newOperation(ref, "setMachineType", time.Now())
+		return nil
+	})
+	return op, err
+}
+
+// Preempt preempts a RUNNING Spot instance like Compute Engine does when it needs
+// the capacity back: the instance is stopped, or deleted if its termination
+// action is TerminationActionDelete.
+func (f *Fake) Preempt(ctx context.Context, ref InstanceRef) error {
+	return f.update(ctx, func() error {
+		i, err := f.get(ref)
+		if err != nil {
+			return err
+		}
+		if i.Scheduling.ProvisioningModel != ProvisioningModelSpot {
+			return newError(ErrInvalidState, "instance %s is not a Spot instance", ref.Name)
+		}
+		if i.Status != "RUNNING" {
+			return newError(ErrInvalidState, "instance %s cannot be preempted while %s", ref.Name, i.Status)
+		}
+		i.Status = "STOPPING"
+		to := "TERMINATED"
+		if i.Scheduling.terminationAction() == TerminationActionDelete {
+			to = deleted
+		}
+		f.transition(i, preemptedOperation, to)
+		return nil
+	})
+}
+
+// MoveInstance moves a TERMINATED instance and its disks to another zone in the
+// same region. Instances with CSEK encrypted disks cannot be moved.
+func (f *Fake) MoveInstance(ctx context.Context, ref InstanceRef, zone string) error {
+	if f.dryRun("MoveInstance", ref, zone) {
+		return nil
+	}
+	return f.update(ctx, func() error {
+		i, err := f.get(ref)
+		if err != nil {
+			return err
+		}
+		if Region(zone) != Region(ref.Zone) {
+			return fmt.Errorf("instance %s cannot be moved to zone %s in another region", ref.Name, zone)
+		}
+		if i.Status != "TERMINATED" {
+			return newError(ErrInvalidState, "instance %s must be stopped before it can be moved", ref.Name)
+		}
+		if f.encrypted(i) {
+			return newError(ErrInvalidState, "instance %s has CSEK encrypted disks and cannot be moved", ref.Name)
+		}
+		dest := ref
+		dest.Zone = zone
+		if _, ok := f.instances[fakeKey(dest)]; ok {
+			return newError(ErrAlreadyExists, "instance %s already exists in zone %s", ref.Name, zone)
+		}
+		for _, a := range i.Disks {
+			if d, ok := f.disks[fakeDiskKey(ref.Disk(a.Name))]; ok {
+				delete(f.disks, fakeDiskKey(d.Ref))
+				d.Ref.Zone = zone
+				f.disks[fakeDiskKey(d.Ref)] = d
+			}
+		}
+		delete(f.instances, fakeKey(ref))
+		i.Ref = dest
+		f.instances[fakeKey(dest)] = i
+		return nil
+	})
+}
+
+// UpdateLabels merges the labels with the instance's labels.
+func (f *Fake) UpdateLabels(ctx context.Context, ref InstanceRef, labels map[string]string) error {
+	if f.dryRun("UpdateLabels", ref, labels) {
+		return nil
+	}
+	return f.update(ctx, func() error {
+		i, err := f.get(ref)
+		if err != nil {
+			return err
+		}
+		if err := ValidateLabels(labels); err != nil {
+			return err
+		}
+		if i.Labels == nil {
+			i.Labels = map[string]string{}
+		}
+		for k, v := range labels {
+			i.Labels[k] = v
+		}
+		f.newOperation(ref, "setLabels", time.Now())
+		return nil
+	})
+}
+
+// UpdateMetadata merges the metadata with the instance's metadata.
+func (f *Fake) UpdateMetadata(ctx context.Context, ref InstanceRef, metadata map[string]string) error {
+	if f.dryRun("UpdateMetadata", ref, metadata) {
+		return nil
+	}
+	return f.update(ctx, func() error {
+		i, err := f.get(ref)
+		if err != nil {
+			return err
+		}
+		if i.Metadata == nil {
+			i.Metadata = map[string]string{}
+		}
+		for k, v := range metadata {
+			i.Metadata[k] = v
+		}
+		f.newOperation(ref, "setMetadata", time.Now())
+		return nil
+	})
+}
+
+// ListZones returns the zones a, b and c of the region.
+func (f *Fake) ListZones(ctx context.Context, account, project, region string) ([]string, error) {
+	return []string{region + "-a", region + "-b", region + "-c"}, nil
+}
+
+// DescribeDisk returns the disk as a compute.Disk populated with the fields
+// gmachine uses.
+func (f *Fake) DescribeDisk(ctx context.Context, ref DiskRef) (compute.Disk, error) {
+	var disk compute.Disk
+	err := f.update(ctx, func() error {
+		d, err := f.getDisk(ref)
+		if err != nil {
+			return err
+		}
+		zoneURL := fmt.Sprintf("https://www.googleapis.com/compute/v1/projects/%s/zones/%s", ref.Project, ref.Zone)
+		disk = compute.Disk{
+			Name:     ref.Name,
+			Zone:     zoneURL,
+			SelfLink: ref.URI(),
+			Type:     zoneURL + "/diskTypes/" + d.Type,
+			SizeGb:   d.SizeGB,
+			Status:   "READY",
+		}
+		if d.SourceSnapshot != "" {
+			disk.SourceSnapshot = SnapshotURI(ref.Project, d.SourceSnapshot)
+		}
+		if d.User != "" {
+			disk.Users = []string{zoneURL + "/instances/" + d.User}
+		}
+		if len(d.CSEK) > 0 {
+			disk.DiskEncryptionKey = &compute.CustomerEncryptionKey{Sha256: "fake-sha256"}
+		}
+		return nil
+	})
+	return disk, err
+}
+
+// CreateDisk creates a disk, empty or from a snapshot. The snapshot's key must be
+// provided if it is CSEK encrypted.
+func (f *Fake) CreateDisk(ctx context.Context, req DiskRequest) (*Operation, error) {
+	if f.dryRun("CreateDisk", req.redacted()) {
+		return dryRunOperation(InstanceRef(req.Ref)), nil
+	}
+	var op *Operation
+	err := f.update(ctx, func() error {
+		if _, ok := f.disks[fakeDiskKey(req.Ref)]; ok {
+			return newError(ErrAlreadyExists, "disk %s already exists", req.Ref.Name)
+		}
+		disk := &fakeDisk{Ref: req.Ref, Type: req.Type, SizeGB: 10, SourceSnapshot: req.SourceSnapshot}
+		if req.SourceSnapshot != "" {
+			s, ok := f.snapshots[fakeSnapshotKey(req.Ref.Project, req.SourceSnapshot)]
+			if !ok {
+				return newError(ErrNotFound, "snapshot %s not found in project %s", req.SourceSnapshot, req.Ref.Project)
+			}
+			if err := checkFakeCSEK(s.CSEK, req.CSEK); err != nil {
+				return err
+			}
+			disk.SizeGB = s.SizeGB
+			if disk.Type == "" {
+				disk.Type = s.Type
+			}
+		}
+		if disk.Type == "" {
+			disk.Type = "pd-standard"
+		}
+		if req.Size != "" {
+			size, err := ParseDiskSizeGB(req.Size)
+			if err != nil {
+				return err
+			}
+			disk.SizeGB = size
+		}
+		disk.CSEK = req.CSEK.forURI(req.Ref.URI())
+		f.disks[fakeDiskKey(req.Ref)] = disk
+		op = f.newOperation(InstanceRef(req.Ref), "insert", time.Now().Add(f.TransitionDelay))
+		return nil
+	})
+	return op, err
+}
+
+// DeleteDisk deletes a disk that is not attached to an instance.
+func (f *Fake) DeleteDisk(ctx context.Context, ref DiskRef) (*Operation, error) {
+	if f.dryRun("DeleteDisk", ref) {
+		return dryRunOperation(InstanceRef(ref)), nil
+	}
+	var op *Operation
+	err := f.update(ctx, func() error {
+		d, err := f.getDisk(ref)
+		if err != nil {
+			return err
+		}
+		if d.User != "" {
+			return newError(ErrInvalidState, "disk %s is in use by instance %s", ref.Name, d.User)
+		}
+		delete(f.disks, fakeDiskKey(ref))
+		op = f.newOperation(InstanceRef(ref), "delete", time.Now().Add(f.TransitionDelay))
+		return nil
+	})
+	return op, err
+}
+
+// ResizeDisk grows a disk. Like real disks, it cannot be shrunk.
+func (f *Fake) ResizeDisk(ctx context.Context, ref DiskRef, size string) (*Operation, error) {
+	if f.dryRun("ResizeDisk", ref, size) {
+		return dryRunOperation(InstanceRef(ref)), nil
+	}
+	var op *Operation
+	err := f.update(ctx, func() error {
+		d, err := f.getDisk(ref)
+		if err != nil {
+			return err
+		}
+		sizeGB, err := ParseDiskSizeGB(size)
+		if err != nil {
+			return err
+		}
+		if sizeGB < d.SizeGB {
+			return fmt.Errorf("disk %s cannot be shrunk from %dGB to %dGB", ref.Name, d.SizeGB, sizeGB)
+		}
+		d.SizeGB = sizeGB
+		op = f.newOperation(InstanceRef(ref), "resize", time.Now())
+		return nil
+	})
+	return op, err
+}
+
+// AttachDisk attaches a disk to an instance. Like real instances, a boot disk can
+// only be attached to a TERMINATED instance that has no boot disk.
+func (f *Fake) AttachDisk(ctx context.Context, ref InstanceRef, req AttachDiskRequest) (*Operation, error) {
+	if f.dryRun("AttachDisk", ref, req.redacted()) {
+		return dryRunOperation(ref), nil
+	}
+	var op *Operation
+	err := f.update(ctx, func() error {
+		i, err := f.get(ref)
+		if err != nil {
+			return err
+		}
+		d, err := f.getDisk(ref.Disk(req.Disk))
+		if err != nil {
+			return err
+		}
+		if d.User != "" {
+			return newError(ErrInvalidState, "disk %s is already in use by instance %s", req.Disk, d.User)
+		}
+		if err := checkFakeCSEK(d.CSEK, req.CSEK); err != nil {
+			return err
+		}
+		deviceName := req.DeviceName
+		if deviceName == "" {
+			deviceName = req.Disk
+		}
+		for _, a := range i.Disks {
+			if req.Boot && a.Boot {
+				return newError(ErrInvalidState, "instance %s already has a boot disk", ref.Name)
+			}
+			if a.DeviceName == deviceName {
+				return newError(ErrInvalidState, "instance %s already has a disk with device name %s", ref.Name, deviceName)
+			}
+		}
+		if req.Boot && i.Status != "TERMINATED" {
+			return newError(ErrInvalidState, "instance %s must be stopped before a boot disk can be attached", ref.Name)
+		}
+		attached := fakeAttachedDisk{Name: req.Disk, DeviceName: deviceName, Boot: req.Boot}
+		if req.Boot {
+			// the boot disk is always the first disk
+			i.Disks = append([]fakeAttachedDisk{attached}, i.Disks...)
+		} else {
+			i.Disks = append(i.Disks, attached)
+		}
+		d.User = ref.Name
+		op = f.newOperation(ref, "attachDisk", time.Now().Add(f.TransitionDelay))
+		return nil
+	})
+	return op, err
+}
+
+// DetachDisk detaches a disk from an instance. Like real instances, the boot disk
+// can only be detached from a TERMINATED instance.
+func (f *Fake) DetachDisk(ctx context.Context, ref InstanceRef, deviceName string) (*Operation, error) {
+	if f.dryRun("DetachDisk", ref, deviceName) {
+		return dryRunOperation(ref), nil
+	}
+	var op *Operation
+	err := f.update(ctx, func() error {
+		i, err := f.get(ref)
+		if err != nil {
+			return err
+		}
+		for n, a := range i.Disks {
+			if a.DeviceName != deviceName {
+				continue
+			}
+			if a.Boot && i.Status != "TERMINATED" {
+				return newError(ErrInvalidState, "instance %s must be stopped before its boot disk can be detached", ref.Name)
+			}
+			i.Disks = append(i.Disks[:n:n], i.Disks[n+1:]...)
+			if d, ok := f.disks[fakeDiskKey(ref.Disk(a.Name))]; ok {
+				d.User = ""
+			}
+			op = f.newOperation(ref, "detachDisk", time.Now().Add(f.TransitionDelay))
+			return nil
+		}
+		return newError(ErrNotFound, "instance %s has no disk with device name %s", ref.Name, deviceName)
+	})
+	return op, err
+}
+
+// SetDiskAutoDelete sets whether a disk is deleted with the instance.
+func (f *Fake) SetDiskAutoDelete(ctx context.Context, ref InstanceRef, deviceName string, autoDelete bool) (*Operation, error) {
+	if f.dryRun("SetDiskAutoDelete", ref, deviceName, autoDelete) {
+		return dryRunOperation(ref), nil
+	}
+	var op *Operation
+	err := f.update(ctx, func() error {
+		i, err := f.get(ref)
+		if err != nil {
+			return err
+		}
+		for n := range i.Disks {
+			if i.Disks[n].DeviceName == deviceName {
+				i.Disks[n].AutoDelete = autoDelete
+				op = f.newOperation(ref, "setDiskAutoDelete", time.Now())
+				return nil
+			}
+		}
+		return newError(ErrNotFound, "instance %s has no disk with device name %s", ref.Name, deviceName)
+	})
+	return op, err
+}
+
+// CreateSnapshot snapshots a disk. The disk's key must be provided if it is CSEK
+// encrypted.
+func (f *Fake) CreateSnapshot(ctx context.Context, ref DiskRef, name string, csek CSEKBundle) (*Operation, error) {
+	if f.dryRun("CreateSnapshot", ref, name, csek.Redacted()) {
+		return dryRunOperation(InstanceRef(ref)), nil
+	}
+	var op *Operation
+	err := f.update(ctx, func() error {
+		d, err := f.getDisk(ref)
+		if err != nil {
+			return err
+		}
+		if _, ok := f.snapshots[fakeSnapshotKey(ref.Project, name)]; ok {
+			return newError(ErrAlreadyExists, "snapshot %s already exists", name)
+		}
+		if err := checkFakeCSEK(d.CSEK, csek); err != nil {
+			return err
+		}
+		f.snapshots[fakeSnapshotKey(ref.Project, name)] = &fakeSnapshot{
+			Project:    ref.Project,
+			Name:       name,
+			SourceDisk: ref.Name,
+			Type:       d.Type,
+			SizeGB:     d.SizeGB,
+			CSEK:       csek.forURI(SnapshotURI(ref.Project, name)),
+		}
+		op = f.newOperation(InstanceRef(ref), "createSnapshot", time.Now().Add(f.TransitionDelay))
+		return nil
+	})
+	return op, err
+}
+
+// DeleteSnapshot deletes a snapshot.
+func (f *Fake) DeleteSnapshot(ctx context.Context, ref DiskRef, name string) error {
+	if f.dryRun("DeleteSnapshot", ref.Project, name) {
+		return nil
+	}
+	return f.update(ctx, func() error {
+		if _, ok := f.snapshots[fakeSnapshotKey(ref.Project, name)]; !ok {
+			return newError(ErrNotFound, "snapshot %s not found in project %s", name, ref.Project)
+		}
+		delete(f.snapshots, fakeSnapshotKey(ref.Project, name))
+		return nil
+	})
+}
+
+// GetOperation returns the current state of an operation.
+func (f *Fake) GetOperation(ctx context.Context, ref InstanceRef, name string) (*Operation, error) {
+	var op *Operation
+	err := f.update(ctx, func() error {
+		for _, o := range f.operations {
+			if o.Name == name && o.Ref.Project == ref.Project && o.Ref.Zone == ref.Zone {
+				op = o.toOperation()
+				return nil
+			}
+		}
+		return newError(ErrNotFound, "operation %s not found in project %s zone %s", name, ref.Project, ref.Zone)
+	})
+	return op, err
+}
+
+// ListOperations returns the operations that targeted the instance, most recent first.
+func (f *Fake) ListOperations(ctx context.Context, ref InstanceRef) ([]*Operation, error) {
+	ops := []*Operation{}
+	err := f.update(ctx, func() error {
+		for i := len(f.operations) - 1; i >= 0; i-- {
+			if o := f.operations[i]; fakeKey(o.Ref) == fakeKey(ref) {
+				ops = append(ops, o.toOperation())
+			}
+		}
+		return nil
+	})
+	return ops, err
+}
+
+// DescribeInstance returns the instance as a compute.Instance populated with the
+// fields gmachine uses.
+func (f *Fake) DescribeInstance(ctx context.Context, ref InstanceRef) (compute.Instance, error) {
+	var instance compute.Instance
+	err := f.update(ctx, func() error {
+		i, err := f.get(ref)
+		if err != nil {
+			return err
+		}
+		instance = f.toCompute(i)
+		return nil
+	})
+	return instance, err
+}
+
+// SSHInstance prints the ssh target instead of connecting. The instance, and the
+// jump host if there is one, must be RUNNING.
+func (f *Fake) SSHInstance(ctx context.Context, ref InstanceRef, opts SSHOptions) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	instance, err := f.runningInstance(ctx, ref)
+	if err != nil {
+		return err
+	}
+	internalIP := instance.NetworkInterfaces[0].NetworkIP
+	var target string
+	switch {
+	case opts.JumpHost != nil:
+		jump, err := f.runningInstance(ctx, *opts.JumpHost)
+		if err != nil {
+			return err
+		}
+		target = fmt.Sprintf("%s (via %s)", internalIP, jump.Name)
+	case opts.Mode == SSHModeInternalIP:
+		target = internalIP
+	case opts.Mode == SSHModeIAP || externalIPOf(instance) == "":
+		// like gcloud, without an external IP ssh tunnels through IAP
+		target = fmt.Sprintf("(IAP tunnel) %s", internalIP)
+	default:
+		target = externalIPOf(instance)
+	}
+	if f.Stdout != nil {
+		fmt.Fprintf(f.Stdout, "ssh %s %v\n", target, opts.Args)
+	}
+	return nil
+}
+
+// runningInstance returns the instance 'ref', or an error like ssh's if it is not
+// RUNNING.
+func (f *Fake) runningInstance(ctx context.Context, ref InstanceRef) (compute.Instance, error) {
+	instance, err := f.DescribeInstance(ctx, ref)
+	if err != nil {
+		return instance, err
+	}
+	if instance.Status != "RUNNING" {
+		return instance, fmt.Errorf("ssh: connect to instance %s: instance is %s", ref.Name, instance.Status)
+	}
+	return instance, nil
+}
+
+// toCompute returns the instance as a compute.Instance. f.mu must be held.
+func (f *Fake) toCompute(i *fakeInstance) compute.Instance {
+	zoneURL := fmt.Sprintf("https://www.googleapis.com/compute/v1/projects/%s/zones/%s", i.Ref.Project, i.Ref.Zone)
+
+	disks := []*compute.AttachedDisk{}
+	for _, d := range i.Disks {
+		disk := &compute.AttachedDisk{
+			Boot:       d.Boot,
+			AutoDelete: d.AutoDelete,
+			DeviceName: d.DeviceName,
+			Source:     DiskURI(i.Ref.Project, i.Ref.Zone, d.Name),
+		}
+		if fd, ok := f.disks[fakeDiskKey(i.Ref.Disk(d.Name))]; ok {
+			switch {
+			case len(fd.CSEK) > 0:
+				disk.DiskEncryptionKey = &compute.CustomerEncryptionKey{Sha256: "fake-sha256"}
+			case fd.KMSKey != "":
+				// like the API, the key version the disk was encrypted with
+				disk.DiskEncryptionKey = &compute.CustomerEncryptionKey{KmsKeyName: fd.KMSKey + "/cryptoKeyVersions/1"}
+			}
+		}
+		disks = append(disks, disk)
+	}
+
+	nic := i.Network.networkInterface(i.Ref.Zone)
+	nic.Network = fmt.Sprintf("https://www.googleapis.com/compute/v1/projects/%s/%s", i.Ref.Project, nic.Network)
+	if nic.Subnetwork != "" {
+		nic.Subnetwork = fmt.Sprintf("https://www.googleapis.com/compute/v1/projects/%s/%s", i.Ref.Project, nic.Subnetwork)
+	}
+	nic.NetworkIP = i.InternalIP
+	if len(nic.AccessConfigs) > 0 {
+		// like real instances, a stopped instance keeps the access config but not the ephemeral IP
+		nic.AccessConfigs[0].NatIP = i.ExternalIP
+	}
+	if i.Network.StackType == StackTypeIPv4IPv6 {
+		nic.Ipv6Address = "fd20::" + strings.TrimPrefix(i.InternalIP, "10.0.0.")
+	}
+
+	instance := compute.Instance{
+		Name:              i.Ref.Name,
+		Zone:              zoneURL,
+		MachineType:       zoneURL + "/machineTypes/" + i.MachineType,
+		Status:            i.Status,
+		Scheduling:        i.Scheduling.scheduling(),
+		Disks:             disks,
+		NetworkInterfaces: []*compute.NetworkInterface{nic},
+	}
+	if len(i.Network.Tags) > 0 {
+		instance.Tags = &compute.Tags{Items: i.Network.Tags}
+	}
+	if len(i.Labels) > 0 {
+		instance.Labels = i.Labels
+	}
+	if i.ServiceAccount != "" {
+		instance.ServiceAccounts = []*compute.ServiceAccount{{Email: i.ServiceAccount}}
+	}
+	if len(i.Metadata) > 0 {
+		keys := []string{}
+		for k := range i.Metadata {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		instance.Metadata = &compute.Metadata{}
+		for _, k := range keys {
+			v := i.Metadata[k]
+			instance.Metadata.Items = append(instance.Metadata.Items, &compute.MetadataItems{Key: k, Value: &v})
+		}
+	}
+	return instance
+}
+
+func externalIPOf(instance compute.Instance) string {
+	if len(instance.NetworkInterfaces) == 0 || len(instance.NetworkInterfaces[0].AccessConfigs) == 0 {
+		return ""
+	}
+	return instance.NetworkInterfaces[0].AccessConfigs[0].NatIP
+}
+
+// checkZone returns ErrZoneResourceExhausted if 'zone' is one of ExhaustedZones.
+func (f *Fake) checkZone(zone string) error {
+	for _, z := range f.ExhaustedZones {
+		if z == zone {
+			return newError(ErrZoneResourceExhausted, "the zone '%s' does not have enough resources available to fulfill the request", zone)
+		}
+	}
+	return nil
+}
+
+// checkCSEK returns an error if 'csek' does not have the keys of the instance's
+// CSEK encrypted disks. f.mu must be held.
+func (f *Fake) checkCSEK(i *fakeInstance, csek CSEKBundle) error {
+	for _, d := range i.Disks {
+		if disk, ok := f.disks[fakeDiskKey(i.Ref.Disk(d.Name))]; ok {
+			if err := checkFakeCSEK(disk.CSEK, csek); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// encrypted returns true if any of the instance's disks are CSEK encrypted. f.mu
+// must be held.
+func (f *Fake) encrypted(i *fakeInstance) bool {
+	for _, d := range i.Disks {
+		if disk, ok := f.disks[fakeDiskKey(i.Ref.Disk(d.Name))]; ok && len(disk.CSEK) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// checkFakeCSEK returns an error if 'csek' does not have all of the keys in 'want'.
+func checkFakeCSEK(want, csek CSEKBundle) error {
+	for _, w := range want {
+		found := false
+		for _, k := range csek {
+			if k.URI == w.URI && k.Key == w.Key && k.KeyType == w.KeyType {
+				found = true
+			}
+		}
+		if !found {
+			return newError(ErrCSEKMissing, "missing or incorrect CSEK key for %s", w.URI)
+		}
+	}
+	return nil
+}
+
+// dryRun prints the call and its arguments as JSON and returns true if the fake is
+// in dry-run mode.
+func (f *Fake) dryRun(call string, args ...any) bool {
+	if f.DryRun == nil {
+		return false
+	}
+	b, _ := json.Marshal(args)
+	fmt.Fprintf(f.DryRun, "[dry-run] fake %s %s\n", call, b)
+	return true
+}
+
+// get returns the instance 'ref'. f.mu must be held.
+func (f *Fake) get(ref InstanceRef) (*fakeInstance, error) {
+	i, ok := f.instances[fakeKey(ref)]
+	if !ok {
+		return nil, newError(ErrNotFound, "instance %s not found in project %s zone %s", ref.Name, ref.Project, ref.Zone)
+	}
+	return i, nil
+}
+
+// getDisk returns the disk 'ref'. f.mu must be held.
+func (f *Fake) getDisk(ref DiskRef) (*fakeDisk, error) {
+	d, ok := f.disks[fakeDiskKey(ref)]
+	if !ok {
+		return nil, newError(ErrNotFound, "disk %s not found in project %s zone %s", ref.Name, ref.Project, ref.Zone)
+	}
+	return d, nil
+}
+
+// transition schedules instance 'i' to move to status 'to' after TransitionDelay
+// and returns the operation tracking the transition. f.mu must be held.
+func (f *Fake) transition(i *fakeInstance, opType, to string) *Operation {
+	i.Pending = to
+	i.PendingAt = time.Now().Add(f.TransitionDelay)
+	op := f.newOperation(i.Ref, opType, i.PendingAt)
+	f.settle()
+	return op
+}
+
+// newOperation records an operation that will be DONE at 'doneAt'. f.mu must be held.
+func (f *Fake) newOperation(ref InstanceRef, opType string, doneAt time.Time) *Operation {
+	f.nextOp++
+	o := &fakeOperation{
+		Name:      fmt.Sprintf("operation-fake-%d", f.nextOp),
+		Type:      opType,
+		Ref:       ref,
+		StartTime: time.Now(),
+		DoneAt:    doneAt,
+	}
+	f.operations = append(f.operations, o)
+	return o.toOperation()
+}
+
+func (o *fakeOperation) toOperation() *Operation {
+	op := &Operation{
+		Name:      o.Name,
+		Type:      o.Type,
+		Target:    o.Ref.Name,
+		Account:   o.Ref.Account,
+		Project:   o.Ref.Project,
+		Zone:      o.Ref.Zone,
+		Status:    "RUNNING",
+		StartTime: o.StartTime,
+	}
+	if !time.Now().Before(o.DoneAt) {
+		op.Status = "DONE"
+		op.Progress = 100
+		op.EndTime = o.DoneAt
+	}
+	return op
+}
+
+// settle completes all transitions that are due. f.mu must be held.
+func (f *Fake) settle() {
+	now := time.Now()
+	for key, i := range f.instances {
+		if i.Pending == "" || now.Before(i.PendingAt) {
+			continue
+		}
+		switch i.Pending {
+		case deleted:
+			for _, d := range i.Disks {
+				if disk, ok := f.disks[fakeDiskKey(i.Ref.Disk(d.Name))]; ok {
+					if d.AutoDelete {
+						delete(f.disks, fakeDiskKey(disk.Ref))
+					} else {
+						disk.User = ""
+					}
+				}
+			}
+			delete(f.instances, key)
+			continue
+		case "RUNNING":
+			if !i.Network.NoAddress {
+				f.nextIP++
+				i.ExternalIP = fmt.Sprintf("203.0.113.%d", f.nextIP)
+			}
+		case "TERMINATED":
+			i.ExternalIP = ""
+		}
+		i.Status = i.Pending
+		i.Pending = ""
+		i.PendingAt = time.Time{}
+	}
+}
+
+// update waits for Latency, loads the state, settles any due transitions, calls
+// fn and saves the state if fn succeeded.
+func (f *Fake) update(ctx context.Context, fn func() error) error {
+	select {
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	case <-time.After(f.Latency):
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.load(); err != nil {
+		return err
+	}
+	f.settle()
+	if err := fn(); err != nil {
+		return err
+	}
+	return f.save()
+}
+
+func (f *Fake) load() error {
+	if f.instances == nil {
+		f.instances = map[string]*fakeInstance{}
+		f.disks = map[string]*fakeDisk{}
+		f.snapshots = map[string]*fakeSnapshot{}
+	}
+	if f.StateFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(f.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading fake backend state: %w", err)
+	}
+
+	var state fakeState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("error parsing fake backend state %s: %w", f.StateFile, err)
+	}
+	f.instances = map[string]*fakeInstance{}
+	for _, i := range state.Instances {
+		f.instances[fakeKey(i.Ref)] = i
+	}
+	f.disks = map[string]*fakeDisk{}
+	for _, d := range state.Disks {
+		f.disks[fakeDiskKey(d.Ref)] = d
+	}
+	f.snapshots = map[string]*fakeSnapshot{}
+	for _, s := range state.Snapshots {
+		f.snapshots[fakeSnapshotKey(s.Project, s.Name)] = s
+	}
+	f.operations = state.Operations
+	f.accounts = state.ServiceAccounts
+	f.nextIP = state.NextIP
+	f.nextOp = state.NextOp
+	return nil
+}
+
+func (f *Fake) save() error {
+	if f.StateFile == "" {
+		return nil
+	}
+
+	if len(f.operations) > maxFakeOperations {
+		f.operations = f.operations[len(f.operations)-maxFakeOperations:]
+	}
+	state := fakeState{
+		Operations:      f.operations,
+		ServiceAccounts: f.accounts,
+		NextIP:          f.nextIP,
+		NextOp:          f.nextOp,
+	}
+	for _, i := range f.instances {
+		state.Instances = append(state.Instances, i)
+	}
+	sort.Slice(state.Instances, func(a, b int) bool {
+		return fakeKey(state.Instances[a].Ref) < fakeKey(state.Instances[b].Ref)
+	})
+	for _, d := range f.disks {
+		state.Disks = append(state.Disks, d)
+	}
+	sort.Slice(state.Disks, func(a, b int) bool {
+		return fakeDiskKey(state.Disks[a].Ref) < fakeDiskKey(state.Disks[b].Ref)
+	})
+	for _, s := range f.snapshots {
+		state.Snapshots = append(state.Snapshots, s)
+	}
+	sort.Slice(state.Snapshots, func(a, b int) bool {
+		return fakeSnapshotKey(state.Snapshots[a].Project, state.Snapshots[a].Name) < fakeSnapshotKey(state.Snapshots[b].Project, state.Snapshots[b].Name)
+	})
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(f.StateFile), 0o700); err != nil {
+		return err
+	}
+	// write to a temp file and rename it so other processes never read a partial file
+	tmp, err := os.CreateTemp(filepath.Dir(f.StateFile), filepath.Base(f.StateFile)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), f.StateFile)
+}
@@ -0,0 +1,266 @@
+package gcp_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/joemiller/gmachine/internal/gcp"
+	"github.com/stretchr/testify/assert"
+)
+
+func newFakeRequest() gcp.CreateRequest {
+	return gcp.CreateRequest{
+		Name:        "foo",
+		Account:     "me@example.com",
+		Project:     "my-proj",
+		Zone:        "us-west1-a",
+		MachineType: "e2-small",
+	}
+}
+
+// waiter returns a func that waits for the operation started by a Backend
+// method to complete.
+func waiter(b gcp.Backend) func(*gcp.Operation, error) error {
+	return func(op *gcp.Operation, err error) error {
+		if err != nil {
+			return err
+		}
+		_, err = gcp.WaitOperation(context.Background(), b, op, nil)
+		return err
+	}
+}
+
+func TestFake_lifecycle(t *testing.T) {
+	ctx := context.Background()
+	fake := gcp.NewFake("", 0, nil)
+	req := newFakeRequest()
+
+	wait := waiter(fake)
+
+	err := wait(fake.CreateInstance(ctx, req))
+	assert.NoError(t, err)
+
+	instance, err := fake.DescribeInstance(ctx, req.Ref())
+	assert.NoError(t, err)
+	assert.Equal(t, "RUNNING", instance.Status)
+	assert.NotEmpty(t, instance.NetworkInterfaces[0].AccessConfigs[0].NatIP)
+
+	// resize is only allowed when stopped
+	assert.ErrorIs(t, wait(fake.ResizeInstance(ctx, req.Ref(), "e2-medium")), gcp.ErrInvalidState)
+
+	assert.NoError(t, wait(fake.StopInstance(ctx, req.Ref())))
+	instance, _ = fake.DescribeInstance(ctx, req.Ref())
+	assert.Equal(t, "TERMINATED", instance.Status)
+	// the ephemeral external IP is released, the access config is kept
+	assert.True(t, gcp.HasExternalAddress(instance))
+	assert.Empty(t, instance.NetworkInterfaces[0].AccessConfigs[0].NatIP)
+
+	assert.NoError(t, wait(fake.ResizeInstance(ctx, req.Ref(), "e2-medium")))
+	instance, _ = fake.DescribeInstance(ctx, req.Ref())
+	assert.Contains(t, instance.MachineType, "/machineTypes/e2-medium")
+
+	assert.NoError(t, wait(fake.StartInstance(ctx, req.Ref(), nil)))
+	assert.NoError(t, wait(fake.SuspendInstance(ctx, req.Ref())))
+	instance, _ = fake.DescribeInstance(ctx, req.Ref())
+	assert.Equal(t, "SUSPENDED", instance.Status)
+
+	// a suspended instance must be resumed, not started
+	assert.Error(t, wait(fake.StartInstance(ctx, req.Ref(), nil)))
+	assert.NoError(t, wait(fake.ResumeInstance(ctx, req.Ref(), nil)))
+
+	assert.NoError(t, wait(fake.DeleteInstance(ctx, req.Ref())))
+	_, err = fake.DescribeInstance(ctx, req.Ref())
+	assert.ErrorIs(t, err, gcp.ErrNotFound)
+}
+
+func TestFake_transitional_states(t *testing.T) {
+	ctx := context.Background()
+	stateFile := filepath.Join(t.TempDir(), "fake.json")
+	req := newFakeRequest()
+
+	_, err := gcp.NewFake(stateFile, 0, nil).CreateInstance(ctx, req)
+	assert.NoError(t, err)
+
+	// stop the instance in one "process" and observe it from another while the
+	// transition is in progress
+	stopper := gcp.NewFake(stateFile, 500*time.Millisecond, nil)
+	op, err := stopper.StopInstance(ctx, req.Ref())
+	assert.NoError(t, err)
+	assert.False(t, op.Done())
+
+	observer := gcp.NewFake(stateFile, 0, nil)
+	assert.Eventually(t, func() bool {
+		instance, err := observer.DescribeInstance(ctx, req.Ref())
+		return err == nil && instance.Status == "STOPPING"
+	}, time.Second, 10*time.Millisecond)
+
+	// the operation can be waited on from any process
+	op, err = gcp.WaitOperation(ctx, observer, op, nil)
+	assert.NoError(t, err)
+	assert.True(t, op.Done())
+
+	ops, err := observer.ListOperations(ctx, req.Ref())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"stop", "insert"}, []string{ops[0].Type, ops[1].Type})
+
+	instance, err := observer.DescribeInstance(ctx, req.Ref())
+	assert.NoError(t, err)
+	assert.Equal(t, "TERMINATED", instance.Status)
+}
+
+func TestFake_csek(t *testing.T) {
+	ctx := context.Background()
+	fake := gcp.NewFake("", 0, nil)
+	wait := waiter(fake)
+	req := newFakeRequest()
+
+	csek, err := gcp.CreateCSEK(gcp.DiskURI(req.Project, req.Zone, req.Name))
+	assert.NoError(t, err)
+	req.CSEK = csek
+
+	assert.NoError(t, wait(fake.CreateInstance(ctx, req)))
+	assert.Error(t, wait(fake.SuspendInstance(ctx, req.Ref())))
+	assert.NoError(t, wait(fake.StopInstance(ctx, req.Ref())))
+
+	// starting without the key fails
+	assert.ErrorIs(t, wait(fake.StartInstance(ctx, req.Ref(), nil)), gcp.ErrCSEKMissing)
+	// the key-type must match too
+	wrongType := gcp.CSEKBundle{csek[0]}
+	wrongType[0].KeyType = gcp.KeyTypeRSAEncrypted
+	assert.ErrorIs(t, wait(fake.StartInstance(ctx, req.Ref(), wrongType)), gcp.ErrCSEKMissing)
+	assert.NoError(t, wait(fake.StartInstance(ctx, req.Ref(), csek)))
+}
+
+func TestFake_network(t *testing.T) {
+	ctx := context.Background()
+	fake := gcp.NewFake("", 0, nil)
+	wait := waiter(fake)
+	req := newFakeRequest()
+	req.Network = gcp.Network{Network: "dev", Subnet: "workstations", NoAddress: true, InternalIP: "10.1.2.3", Tags: []string{"ssh"}}
+	assert.NoError(t, wait(fake.CreateInstance(ctx, req)))
+
+	instance, err := fake.DescribeInstance(ctx, req.Ref())
+	assert.NoError(t, err)
+	assert.False(t, gcp.HasExternalAddress(instance))
+	nic := instance.NetworkInterfaces[0]
+	assert.Equal(t, "10.1.2.3", nic.NetworkIP)
+	assert.Equal(t, "https://www.googleapis.com/compute/v1/projects/my-proj/regions/us-west1/subnetworks/workstations", nic.Subnetwork)
+	assert.Equal(t, []string{"ssh"}, instance.Tags.Items)
+
+	// no external IP after a restart either
+	assert.NoError(t, wait(fake.StopInstance(ctx, req.Ref())))
+	assert.NoError(t, wait(fake.StartInstance(ctx, req.Ref(), nil)))
+	instance, _ = fake.DescribeInstance(ctx, req.Ref())
+	assert.Empty(t, instance.NetworkInterfaces[0].AccessConfigs)
+
+	req.Name = "bar"
+	req.Network = gcp.Network{Tags: []string{"SSH"}}
+	assert.ErrorContains(t, wait(fake.CreateInstance(ctx, req)), "invalid network tag")
+}
+
+func TestFake_labelsMetadata(t *testing.T) {
+	ctx := context.Background()
+	fake := gcp.NewFake("", 0, nil)
+	wait := waiter(fake)
+	req := newFakeRequest()
+	req.Labels = map[string]string{"team": "infra", "env": "dev"}
+	req.AddMetadata("foo", "bar")
+	assert.NoError(t, wait(fake.CreateInstance(ctx, req)))
+
+	// keys that are not updated are kept
+	assert.NoError(t, fake.UpdateLabels(ctx, req.Ref(), map[string]string{"team": "web"}))
+	assert.NoError(t, fake.UpdateMetadata(ctx, req.Ref(), map[string]string{"baz": "qux"}))
+	instance, err := fake.DescribeInstance(ctx, req.Ref())
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"team": "web", "env": "dev"}, instance.Labels)
+	if assert.NotNil(t, instance.Metadata) && assert.Len(t, instance.Metadata.Items, 2) {
+		assert.Equal(t, "baz", instance.Metadata.Items[0].Key)
+		assert.Equal(t, "foo", instance.Metadata.Items[1].Key)
+	}
+
+	assert.ErrorContains(t, fake.UpdateLabels(ctx, req.Ref(), map[string]string{"Team": "web"}), "invalid label key")
+	req.Name = "bar"
+	req.Labels = map[string]string{"team": "Web"}
+	assert.ErrorContains(t, wait(fake.CreateInstance(ctx, req)), "invalid value")
+}
+
+func TestFake_disks(t *testing.T) {
+	ctx := context.Background()
+	fake := gcp.NewFake("", 0, nil)
+	wait := waiter(fake)
+	req := newFakeRequest()
+	ref := req.Ref()
+	assert.NoError(t, wait(fake.CreateInstance(ctx, req)))
+
+	// the boot disk is created with the instance
+	disk, err := fake.DescribeDisk(ctx, ref.Disk("foo"))
+	assert.NoError(t, err)
+	assert.Len(t, disk.Users, 1)
+	assert.ErrorIs(t, wait(fake.DeleteDisk(ctx, ref.Disk("foo"))), gcp.ErrInvalidState)
+
+	csek, err := gcp.CreateCSEK(ref.Disk("data").URI())
+	assert.NoError(t, err)
+	assert.NoError(t, wait(fake.CreateDisk(ctx, gcp.DiskRequest{Ref: ref.Disk("data"), Size: "50GB", CSEK: csek})))
+	assert.ErrorIs(t, wait(fake.CreateDisk(ctx, gcp.DiskRequest{Ref: ref.Disk("data")})), gcp.ErrAlreadyExists)
+
+	// a CSEK encrypted disk needs its key to be attached, or snapshotted
+	assert.ErrorIs(t, wait(fake.AttachDisk(ctx, ref, gcp.AttachDiskRequest{Disk: "data"})), gcp.ErrCSEKMissing)
+	assert.NoError(t, wait(fake.AttachDisk(ctx, ref, gcp.AttachDiskRequest{Disk: "data", CSEK: csek})))
+	assert.ErrorIs(t, wait(fake.CreateSnapshot(ctx, ref.Disk("data"), "snap", nil)), gcp.ErrCSEKMissing)
+	assert.NoError(t, wait(fake.CreateSnapshot(ctx, ref.Disk("data"), "snap", csek)))
+
+	// disks can grow, but not shrink
+	assert.NoError(t, wait(fake.ResizeDisk(ctx, ref.Disk("data"), "100GB")))
+	disk, err = fake.DescribeDisk(ctx, ref.Disk("data"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), disk.SizeGb)
+	assert.ErrorContains(t, wait(fake.ResizeDisk(ctx, ref.Disk("data"), "50GB")), "cannot be shrunk")
+
+	// the boot disk can only be replaced while the instance is stopped
+	assert.ErrorIs(t, wait(fake.DetachDisk(ctx, ref, "foo")), gcp.ErrInvalidState)
+	assert.NoError(t, wait(fake.StopInstance(ctx, ref)))
+	assert.NoError(t, wait(fake.DetachDisk(ctx, ref, "foo")))
+	instance, _ := fake.DescribeInstance(ctx, ref)
+	name, _ := gcp.BootDisk(instance)
+	assert.Empty(t, name)
+
+	// deleting the instance deletes the auto-delete disks only
+	assert.NoError(t, wait(fake.SetDiskAutoDelete(ctx, ref, "data", true)))
+	assert.NoError(t, wait(fake.DeleteInstance(ctx, ref)))
+	_, err = fake.DescribeDisk(ctx, ref.Disk("data"))
+	assert.ErrorIs(t, err, gcp.ErrNotFound)
+	disk, err = fake.DescribeDisk(ctx, ref.Disk("foo"))
+	assert.NoError(t, err)
+	assert.Empty(t, disk.Users)
+
+	assert.NoError(t, fake.DeleteSnapshot(ctx, ref.Disk("data"), "snap"))
+	assert.ErrorIs(t, fake.DeleteSnapshot(ctx, ref.Disk("data"), "snap"), gcp.ErrNotFound)
+}
+
+func TestFake_context(t *testing.T) {
+	fake := gcp.NewFake("", 0, nil)
+	req := newFakeRequest()
+	assert.NoError(t, waiter(fake)(fake.CreateInstance(context.Background(), req)))
+
+	// a slow call is abandoned when the context times out
+	fake.Latency = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := fake.DescribeInstance(ctx, req.Ref())
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// waiting for an operation stops when the context is canceled
+	fake.Latency = 0
+	fake.TransitionDelay = time.Minute
+	op, err := fake.StopInstance(context.Background(), req.Ref())
+	assert.NoError(t, err)
+
+	cause := errors.New("interrupted")
+	ctx, cancelCause := context.WithCancelCause(context.Background())
+	cancelCause(cause)
+	_, err = gcp.WaitOperation(ctx, fake, op, nil)
+	assert.ErrorIs(t, err, cause)
+}
@@ -0,0 +1,102 @@
+package gcp
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/api/compute/v1"
+)
+
+// GuestAttributesEnabled returns true if the instance's metadata enables guest
+// attributes, which the guest agent publishes the instance's host keys in.
+func GuestAttributesEnabled(instance compute.Instance) bool {
+	return strings.EqualFold(MetadataValue(instance, "enable-guest-attributes"), "true")
+}
+
+// hostKeys returns the host keys in guest attributes entries of the 'hostkeys/'
+// namespace as sorted "TYPE BASE64" lines.
+func hostKeys(entries []*compute.GuestAttributesEntry) []string {
+	keys := []string{}
+	for _, e := range entries {
+		if e.Namespace == "hostkeys" && e.Key != "" && e.Value != "" {
+			keys = append(keys, e.Key+" "+strings.TrimSpace(e.Value))
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// HostKeys returns the host keys of an instance from its guest attributes with
+// 'gcloud compute instances get-guest-attributes'.
+func (g *Gcloud) HostKeys(ctx context.Context, ref InstanceRef) ([]string, error) {
+	args := []string{"gcloud", "compute", "instances", "get-guest-attributes", ref.Name}
+	args = append(args, ref.gcloudArgs()...)
+	args = append(args, "--query-path=hostkeys/", "--format=json")
+	out, err := output(ctx, args...)
+	if errors.Is(err, ErrNotFound) {
+		// nothing has been published in the namespace yet
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := []*compute.GuestAttributesEntry{}
+	if err := json.Unmarshal(out, &entries); err != nil {
+		return nil, fmt.Errorf("error parsing guest attributes: %w", err)
+	}
+	return hostKeys(entries), nil
+}
+
+// HostKeys returns the host keys of an instance from its guest attributes.
+func (a *API) HostKeys(ctx context.Context, ref InstanceRef) ([]string, error) {
+	attrs, err := a.svc.Instances.GetGuestAttributes(ref.Project, ref.Zone, ref.Name).QueryPath("hostkeys/").Context(ctx).Do()
+	err = classifyAPIError(err)
+	if errors.Is(err, ErrNotFound) {
+		// nothing has been published in the namespace yet
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if attrs.QueryValue == nil {
+		return nil, nil
+	}
+	return hostKeys(attrs.QueryValue.Items), nil
+}
+
+// HostKeys returns the instance's host keys if it is RUNNING and enables guest
+// attributes, like the guest agent publishes them.
+func (f *Fake) HostKeys(ctx context.Context, ref InstanceRef) ([]string, error) {
+	var keys []string
+	err := f.update(ctx, func() error {
+		i, err := f.get(ref)
+		if err != nil {
+			return err
+		}
+		if i.Status == "RUNNING" && strings.EqualFold(i.Metadata["enable-guest-attributes"], "true") {
+			keys = append(keys, i.HostKeys...)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// fakeHostKeys returns a new ed25519 host key as "TYPE BASE64" lines.
+func fakeHostKeys() []string {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		panic(err)
+	}
+	return []string{strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))}
+}
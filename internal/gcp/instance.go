@@ -2,11 +2,11 @@ package gcp
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
-	"strings"
 
 	"google.golang.org/api/compute/v1"
 )
@@ -24,7 +24,11 @@ type CreateRequest struct {
 	ImageProject     string
 	ImageFamily      string
 	Metadata         map[string]string
+	Labels           map[string]string
 	CSEK             CSEKBundle
+	KMSKey           string // Cloud KMS key to encrypt the boot disk with (CMEK), optional
+	Network          Network
+	Scheduling       Scheduling
 	ServiceAccount   string
 	NoServiceAccount bool
 	StartupScript    string
@@ -39,22 +43,62 @@ func (r *CreateRequest) AddMetadata(key, val string) {
 	r.Metadata[key] = val
 }
 
-// TODO doc
-func CreateInstance(log, logerr io.Writer, req CreateRequest) error {
+// redacted returns a copy of the request with CSEK keys redacted.
+func (r CreateRequest) redacted() CreateRequest {
+	r.CSEK = r.CSEK.Redacted()
+	return r
+}
+
+// Ref returns the InstanceRef of the instance to be created.
+func (r CreateRequest) Ref() InstanceRef {
+	return InstanceRef{Name: r.Name, Account: r.Account, Project: r.Project, Zone: r.Zone}
+}
+
+// Gcloud manages instances by running the gcloud cli. Output from gcloud is
+// written to Stdout and Stderr.
+//
+// If DryRun is set, gcloud commands that would change anything are printed to it
+// instead of being run. Read-only commands, eg: describe, are still run.
+type Gcloud struct {
+	Stdout io.Writer
+	Stderr io.Writer
+	DryRun io.Writer
+}
+
+// NewGcloud returns a Gcloud backend that writes gcloud's output to stdout and stderr.
+func NewGcloud(stdout, stderr io.Writer) *Gcloud {
+	return &Gcloud{Stdout: stdout, Stderr: stderr}
+}
+
+// gcloudArgs returns the --account, --project, and --zone flags for the instance.
+// The --account flag is omitted if no account is set so gcloud uses its default.
+func (r InstanceRef) gcloudArgs() []string {
+	args := []string{}
+	if r.Account != "" {
+		args = append(args, "--account="+r.Account)
+	}
+	return append(args, "--project="+r.Project, "--zone="+r.Zone)
+}
+
+// CreateInstance creates a new instance with 'gcloud compute instances create'.
+func (g *Gcloud) CreateInstance(ctx context.Context, req CreateRequest) (*Operation, error) {
 	var err error
 
-	args := []string{
-		"gcloud", "beta", "compute", "instances", "create",
-		req.Name,
-		"--account=" + req.Account,
-		"--project=" + req.Project,
-		"--zone=" + req.Zone,
-		"--machine-type=" + req.MachineType,
-		"--boot-disk-size=" + req.BootDiskSize,
-		"--boot-disk-type=" + req.BootDiskType,
-		"--image-project=" + req.ImageProject,
-		"--image-family=" + req.ImageFamily,
+	args := []string{"gcloud", "beta", "compute", "instances", "create", req.Name}
+	args = append(args, req.Ref().gcloudArgs()...)
+	args = append(args,
+		"--machine-type="+req.MachineType,
+		"--boot-disk-size="+req.BootDiskSize,
+		"--boot-disk-type="+req.BootDiskType,
+		"--image-project="+req.ImageProject,
+		"--image-family="+req.ImageFamily,
+	)
+
+	if req.KMSKey != "" {
+		args = append(args, "--boot-disk-kms-key="+req.KMSKey)
 	}
+	args = append(args, req.Network.gcloudArgs()...)
+	args = append(args, req.Scheduling.gcloudArgs()...)
 
 	if !req.NoServiceAccount && req.ServiceAccount != "" {
 		args = append(args, "--service-account="+req.ServiceAccount)
@@ -64,18 +108,19 @@ func CreateInstance(log, logerr io.Writer, req CreateRequest) error {
 	}
 
 	// [--metadata=KEY=VALUE,[KEY=VALUE,...]]
-	metadata := []string{}
-	if len(req.Metadata) > 0 {
-		for k, v := range req.Metadata {
-			metadata = append(metadata, fmt.Sprintf("%s=%s", k, v))
-		}
+	metadata := map[string]string{}
+	for k, v := range req.Metadata {
+		metadata[k] = v
 	}
 	// --metadata=startup-script-url=URL
 	if req.StartupScriptURL != "" {
-		metadata = append(metadata, "startup-script-url="+req.StartupScriptURL)
+		metadata["startup-script-url"] = req.StartupScriptURL
 	}
 	if len(metadata) > 0 {
-		args = append(args, "--metadata="+strings.Join(metadata, ","))
+		args = append(args, "--metadata="+gcloudMap(metadata))
+	}
+	if len(req.Labels) > 0 {
+		args = append(args, "--labels="+gcloudMap(req.Labels))
 	}
 
 	// startup-script-url uses `--metadata-from-file=``
@@ -88,200 +133,159 @@ func CreateInstance(log, logerr io.Writer, req CreateRequest) error {
 	if len(req.CSEK) > 0 {
 		stdin, err = req.CSEK.Marshal()
 		if err != nil {
-			return err
+			return nil, err
 		}
 		args = append(args, "--csek-key-file=-")
 	}
 
-	return run(bytes.NewReader(stdin), log, logerr, args...)
-}
-
-// TODO doc
-func DeleteInstance(log, logerr io.Writer, name, account, project, zone string) error {
-	args := []string{
-		"gcloud", "compute", "instances", "delete",
-		name,
-		"--account=" + account,
-		"--project=" + project,
-		"--zone=" + zone,
-		"-q",
-	}
-	return run(nil, log, logerr, args...)
+	return g.async(ctx, req.Ref(), bytes.NewReader(stdin), args)
 }
 
-// TODO doc
-// TODO support more gcloud-ssh flags like iap-tunnel. maybe make this a struct like SSHInput{}
-func SSHInstance(name, account, project, zone string, extra string) error {
-	args := []string{
-		"gcloud", "compute", "ssh",
-		name,
-		"--account=" + account,
-		"--project=" + project,
-		"--zone=" + zone,
-	}
-	if extra != "" {
-		f := strings.Fields(extra)
-		args = append(args, "--")
-		args = append(args, f...)
-	}
-	return execve(args)
+// DeleteInstance deletes an instance with 'gcloud compute instances delete'.
+func (g *Gcloud) DeleteInstance(ctx context.Context, ref InstanceRef) (*Operation, error) {
+	args := []string{"gcloud", "compute", "instances", "delete", ref.Name}
+	args = append(args, ref.gcloudArgs()...)
+	args = append(args, "-q")
+	return g.async(ctx, ref, nil, args)
 }
 
-// TODO doc
-func StopInstance(log, logerr io.Writer, name, account, project, zone string) error {
-	args := []string{
-		"gcloud", "compute", "instances", "stop",
-		name,
-		"--account=" + account,
-		"--project=" + project,
-		"--zone=" + zone,
-	}
-	return run(os.Stdin, log, logerr, args...)
+// StopInstance stops an instance with 'gcloud compute instances stop'.
+func (g *Gcloud) StopInstance(ctx context.Context, ref InstanceRef) (*Operation, error) {
+	args := []string{"gcloud", "compute", "instances", "stop", ref.Name}
+	args = append(args, ref.gcloudArgs()...)
+	return g.async(ctx, ref, os.Stdin, args)
 }
 
-// TODO doc
-func StartInstance(log, logerr io.Writer, name, account, project, zone string, csek CSEKBundle) error {
+// StartInstance starts an instance with 'gcloud compute instances start'. The
+// CSEK keys are passed to gcloud via stdin.
+func (g *Gcloud) StartInstance(ctx context.Context, ref InstanceRef, csek CSEKBundle) (*Operation, error) {
 	var err error
 	var stdin []byte
 
-	args := []string{
-		"gcloud", "beta", "compute", "instances", "start",
-		name,
-		"--account=" + account,
-		"--project=" + project,
-		"--zone=" + zone,
-	}
+	args := []string{"gcloud", "beta", "compute", "instances", "start", ref.Name}
+	args = append(args, ref.gcloudArgs()...)
 
 	// marshal CSEK to json and pass into gcloud via stdin
 	if len(csek) > 0 {
 		stdin, err = csek.Marshal()
 		if err != nil {
-			return err
+			return nil, err
 		}
 		args = append(args, "--csek-key-file=-")
 	}
 
-	// return run(bytes.NewReader(stdin), log, logerr, args...)
-	return run(bytes.NewReader(stdin), os.Stdout, os.Stderr, args...)
+	return g.async(ctx, ref, bytes.NewReader(stdin), args)
 }
 
-// TODO doc
-func SuspendInstance(log, logerr io.Writer, name, account, project, zone string) error {
-	args := []string{
-		"gcloud", "beta", "compute", "instances", "suspend",
-		name,
-		"--account=" + account,
-		"--project=" + project,
-		"--zone=" + zone,
-	}
-	return run(os.Stdin, log, logerr, args...)
+// SuspendInstance suspends an instance with 'gcloud compute instances suspend'.
+func (g *Gcloud) SuspendInstance(ctx context.Context, ref InstanceRef) (*Operation, error) {
+	args := []string{"gcloud", "beta", "compute", "instances", "suspend", ref.Name}
+	args = append(args, ref.gcloudArgs()...)
+	return g.async(ctx, ref, os.Stdin, args)
 }
 
-// TODO doc
-func ResumeInstance(log, logerr io.Writer, name, account, project, zone string, csek CSEKBundle) error {
+// ResumeInstance resumes an instance with 'gcloud compute instances resume'. The
+// CSEK keys are passed to gcloud via stdin.
+func (g *Gcloud) ResumeInstance(ctx context.Context, ref InstanceRef, csek CSEKBundle) (*Operation, error) {
 	var err error
 	var stdin []byte
 
-	args := []string{
-		"gcloud", "beta", "compute", "instances", "resume",
-		name,
-		"--account=" + account,
-		"--project=" + project,
-		"--zone=" + zone,
-	}
+	args := []string{"gcloud", "beta", "compute", "instances", "resume", ref.Name}
+	args = append(args, ref.gcloudArgs()...)
 
 	// marshal CSEK to json and pass into gcloud via stdin
 	if len(csek) > 0 {
 		stdin, err = csek.Marshal()
 		if err != nil {
-			return err
+			return nil, err
 		}
 		args = append(args, "--csek-key-file=-")
 	}
 
-	return run(bytes.NewReader(stdin), log, logerr, args...)
+	return g.async(ctx, ref, bytes.NewReader(stdin), args)
 }
 
-// From google-cloud-sdk/lib/googlecloudsdk/command_lib/compute/instances/flags.py
-// the default table format for 'gcloud compute instances list' command:
-const statusTable = `
-table(
-	name,
-	zone.basename(),
-	machineType.machine_type().basename(),
-	scheduling.preemptible.yesno(yes=true, no=''),
-	networkInterfaces[].networkIP.notnull().list():label=INTERNAL_IP,
-	networkInterfaces[].accessConfigs[0].natIP.notnull().list():label=EXTERNAL_IP,
-	status)
-`
+// DescribeInstance returns the full instance resource from 'gcloud compute instances describe'.
+func (g *Gcloud) DescribeInstance(ctx context.Context, ref InstanceRef) (compute.Instance, error) {
+	var instance compute.Instance
 
-// TODO doc
-func StatusInstance(log, logerr io.Writer, name, account, project, zone string) error {
-	args := []string{
-		"gcloud", "beta", "compute", "instances", "describe",
-		name,
-		"--account=" + account,
-		"--project=" + project,
-		"--zone=" + zone,
-		"--format=" + statusTable,
+	args := []string{"gcloud", "beta", "compute", "instances", "describe", ref.Name}
+	args = append(args, ref.gcloudArgs()...)
+	args = append(args, "--format=json")
+
+	b, err := output(ctx, args...)
+	if err != nil {
+		return instance, err
 	}
-	return run(os.Stdin, log, logerr, args...)
-}
 
-// TODO doc
-func PrintIP(log, logerr io.Writer, name, account, project, zone string) error {
-	args := []string{
-		"gcloud", "beta", "compute", "instances", "describe",
-		name,
-		"--account=" + account,
-		"--project=" + project,
-		"--zone=" + zone,
-		"--format=get(networkInterfaces[0].accessConfigs[0].natIP)",
+	err = json.Unmarshal(b, &instance)
+	if err != nil {
+		return instance, err
 	}
-	return run(os.Stdin, log, logerr, args...)
+
+	return instance, nil
 }
 
-// TODO doc
-func DescribeInstance(name, account, project, zone string) (compute.Instance, error) {
-	var instance compute.Instance
+// ResizeInstance changes the machine-type of a stopped instance with
+// 'gcloud compute instances set-machine-type'.
+func (g *Gcloud) ResizeInstance(ctx context.Context, ref InstanceRef, size string) (*Operation, error) {
+	args := []string{"gcloud", "compute", "instances", "set-machine-type", ref.Name}
+	args = append(args, ref.gcloudArgs()...)
+	args = append(args, "--machine-type="+size)
+	return g.async(ctx, ref, os.Stdin, args)
+}
 
-	args := []string{
-		"gcloud", "beta", "compute", "instances", "describe",
-		name,
-		"--account=" + account,
-		"--project=" + project,
-		"--zone=" + zone,
-		"--format=json",
-	}
+// GetOperation returns an operation from 'gcloud compute operations describe'.
+func (g *Gcloud) GetOperation(ctx context.Context, ref InstanceRef, name string) (*Operation, error) {
+	args := []string{"gcloud", "compute", "operations", "describe", name}
+	args = append(args, ref.gcloudArgs()...)
+	args = append(args, "--format=json")
 
-	b, err := output(args...)
+	b, err := output(ctx, args...)
 	if err != nil {
-		return instance, fmt.Errorf("(%s) %s", err, b)
+		return nil, err
 	}
+	return parseGcloudOperation(ref, b)
+}
 
-	err = json.Unmarshal(b, &instance)
-	if err != nil {
-		return instance, err
+// ListOperations returns the operations that targeted the instance from
+// 'gcloud compute operations list'.
+func (g *Gcloud) ListOperations(ctx context.Context, ref InstanceRef) ([]*Operation, error) {
+	args := []string{"gcloud", "compute", "operations", "list"}
+	if ref.Account != "" {
+		args = append(args, "--account="+ref.Account)
 	}
+	args = append(args,
+		"--project="+ref.Project,
+		"--zones="+ref.Zone,
+		fmt.Sprintf("--filter=targetLink ~ /instances/%s$", ref.Name),
+		"--sort-by=~insertTime",
+		"--format=json",
+	)
 
-	return instance, nil
+	b, err := output(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	return parseGcloudOperations(ref, b)
 }
 
-// TODO doc
-func ResizeInstance(log, logerr io.Writer, name, account, project, zone, size string) error {
-	args := []string{
-		"gcloud", "compute", "instances", "set-machine-type",
-		name,
-		"--account=" + account,
-		"--project=" + project,
-		"--zone=" + zone,
-		"--machine-type=" + size,
+// async runs a gcloud command with --async and returns the operation it started.
+func (g *Gcloud) async(ctx context.Context, ref InstanceRef, stdin io.Reader, args []string) (*Operation, error) {
+	args = append(args, "--async", "--format=json")
+	if g.DryRun != nil {
+		printDryRunCommand(g.DryRun, args)
+		return dryRunOperation(ref), nil
+	}
+	b, err := runOutput(ctx, stdin, g.Stderr, args...)
+	if err != nil {
+		return nil, err
 	}
-	return run(os.Stdin, log, logerr, args...)
+	return parseGcloudOperation(ref, b)
 }
 
 // TODO doc
-func OpenConsole(log, logerr io.Writer, name, project, zone, authuser string) error {
+func OpenConsole(ctx context.Context, log, logerr io.Writer, name, project, zone, authuser string) error {
 	// https://console.cloud.google.com/compute/instancesDetail/zones/us-west2-a/instances/joe-amd-dev1?authuser=1&project=planetscale-development
 	url := fmt.Sprintf("https://console.cloud.google.com/compute/instancesDetail/zones/%s/instances/%s?project=%s",
 		zone, name, project,
@@ -293,5 +297,5 @@ func OpenConsole(log, logerr io.Writer, name, project, zone, authuser string) er
 	args := []string{
 		"open", url,
 	}
-	return run(os.Stdin, log, logerr, args...)
+	return run(ctx, os.Stdin, log, logerr, args...)
 }
@@ -0,0 +1,97 @@
+package gcp
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"google.golang.org/api/compute/v1"
+)
+
+var (
+	// labelKeyRe and labelValueRe match the keys and values of labels: lowercase
+	// letters, numbers, underscores and hyphens. Keys start with a letter.
+	labelKeyRe   = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,62}$`)
+	labelValueRe = regexp.MustCompile(`^[a-z0-9_-]{0,63}$`)
+)
+
+// ValidateLabels returns an error if any of the labels is invalid.
+func ValidateLabels(labels map[string]string) error {
+	for k, v := range labels {
+		if !labelKeyRe.MatchString(k) {
+			return fmt.Errorf("invalid label key '%s', keys are lowercase letters, numbers, underscores and hyphens, starting with a letter", k)
+		}
+		if !labelValueRe.MatchString(v) {
+			return fmt.Errorf("invalid value '%s' of label '%s', values are lowercase letters, numbers, underscores and hyphens", v, k)
+		}
+	}
+	return nil
+}
+
+// MetadataValue returns the value of the instance's metadata 'key', or "" if it
+// is not set.
+func MetadataValue(instance compute.Instance, key string) string {
+	if instance.Metadata == nil {
+		return ""
+	}
+	for _, item := range instance.Metadata.Items {
+		if item.Key == key && item.Value != nil {
+			return *item.Value
+		}
+	}
+	return ""
+}
+
+// gcloudMap returns the KEY=VALUE,... value of a gcloud map flag, eg:
+// --metadata. If a value contains a comma the pairs are joined with another
+// delimiter using gcloud's ^DELIM^ syntax, see 'gcloud topic escaping'.
+func gcloudMap(m map[string]string) string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := []string{}
+	escape := false
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+m[k])
+		escape = escape || strings.Contains(m[k], ",")
+	}
+	if !escape {
+		return strings.Join(pairs, ",")
+	}
+	delim := ":"
+	for strings.Contains(strings.Join(pairs, ""), delim) {
+		delim += ":"
+	}
+	return "^" + delim + "^" + strings.Join(pairs, delim)
+}
+
+// UpdateLabels adds or updates labels of an instance with 'gcloud compute
+// instances update --update-labels'.
+func (g *Gcloud) UpdateLabels(ctx context.Context, ref InstanceRef, labels map[string]string) error {
+	args := []string{"gcloud", "compute", "instances", "update", ref.Name}
+	args = append(args, ref.gcloudArgs()...)
+	args = append(args, "--update-labels="+gcloudMap(labels))
+	if g.DryRun != nil {
+		printDryRunCommand(g.DryRun, args)
+		return nil
+	}
+	return run(ctx, nil, g.Stdout, g.Stderr, args...)
+}
+
+// UpdateMetadata adds or updates metadata of an instance with 'gcloud compute
+// instances add-metadata'.
+func (g *Gcloud) UpdateMetadata(ctx context.Context, ref InstanceRef, metadata map[string]string) error {
+	args := []string{"gcloud", "compute", "instances", "add-metadata", ref.Name}
+	args = append(args, ref.gcloudArgs()...)
+	args = append(args, "--metadata="+gcloudMap(metadata))
+	if g.DryRun != nil {
+		printDryRunCommand(g.DryRun, args)
+		return nil
+	}
+	return run(ctx, nil, g.Stdout, g.Stderr, args...)
+}
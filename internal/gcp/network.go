@@ -0,0 +1,118 @@
+package gcp
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// Stack types of a network interface, see Network.
+const (
+	StackTypeIPv4     = "IPV4_ONLY"
+	StackTypeIPv4IPv6 = "IPV4_IPV6"
+)
+
+// Network holds the settings of an instance's network interface. The zero value
+// is the default network with an ephemeral external IP. It is saved in the config
+// file with the machine.
+type Network struct {
+	// Network is the name of the VPC network, defaults to "default"
+	Network string `json:"network,omitempty" yaml:"network,omitempty"`
+	// Subnet is the name of the subnet in the instance's region, required for
+	// custom mode networks
+	Subnet string `json:"subnet,omitempty" yaml:"subnet,omitempty"`
+	// NoAddress creates the instance without an external IP
+	NoAddress bool `json:"no_address,omitempty" yaml:"no_address,omitempty"`
+	// InternalIP is a static internal IP, or the name of a reserved internal
+	// address, defaults to an ephemeral internal IP
+	InternalIP string   `json:"internal_ip,omitempty" yaml:"internal_ip,omitempty"`
+	Tags       []string `json:"tags,omitempty" yaml:"tags,omitempty"`
+	// StackType is StackTypeIPv4 (the default) or StackTypeIPv4IPv6
+	StackType string `json:"stack_type,omitempty" yaml:"stack_type,omitempty"`
+}
+
+// IsZero returns true if the network has the default settings.
+func (n Network) IsZero() bool {
+	return n.Network == "" && n.Subnet == "" && !n.NoAddress && n.InternalIP == "" && len(n.Tags) == 0 && n.StackType == ""
+}
+
+// tagRe matches a network tag: lowercase letters, numbers and hyphens, starting
+// with a letter.
+var tagRe = regexp.MustCompile(`^[a-z]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+// Validate returns an error if the network settings are invalid.
+func (n Network) Validate() error {
+	switch n.StackType {
+	case "", StackTypeIPv4, StackTypeIPv4IPv6:
+	default:
+		return fmt.Errorf("invalid stack type '%s', expected %s or %s", n.StackType, StackTypeIPv4, StackTypeIPv4IPv6)
+	}
+	for _, tag := range n.Tags {
+		if !tagRe.MatchString(tag) {
+			return fmt.Errorf("invalid network tag '%s', tags are lowercase letters, numbers and hyphens, starting with a letter", tag)
+		}
+	}
+	return nil
+}
+
+// gcloudArgs returns the gcloud compute instances create flags for the network.
+func (n Network) gcloudArgs() []string {
+	args := []string{}
+	if n.Network != "" {
+		args = append(args, "--network="+n.Network)
+	}
+	if n.Subnet != "" {
+		args = append(args, "--subnet="+n.Subnet)
+	}
+	if n.NoAddress {
+		args = append(args, "--no-address")
+	}
+	if n.InternalIP != "" {
+		args = append(args, "--private-network-ip="+n.InternalIP)
+	}
+	if len(n.Tags) > 0 {
+		args = append(args, "--tags="+strings.Join(n.Tags, ","))
+	}
+	if n.StackType != "" {
+		args = append(args, "--stack-type="+n.StackType)
+	}
+	return args
+}
+
+// networkInterface returns the network interface of an instance in 'zone' with
+// the network settings.
+func (n Network) networkInterface(zone string) *compute.NetworkInterface {
+	network := n.Network
+	if network == "" {
+		network = "default"
+	}
+	nic := &compute.NetworkInterface{
+		Network:   "global/networks/" + network,
+		NetworkIP: n.InternalIP,
+		StackType: n.StackType,
+	}
+	if n.Subnet != "" {
+		nic.Subnetwork = fmt.Sprintf("regions/%s/subnetworks/%s", Region(zone), n.Subnet)
+	}
+	if !n.NoAddress {
+		nic.AccessConfigs = []*compute.AccessConfig{{Name: "External NAT", Type: "ONE_TO_ONE_NAT"}}
+	}
+	return nic
+}
+
+// Region returns the region of 'zone', eg: us-west1 for us-west1-a.
+func Region(zone string) string {
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		return zone[:i]
+	}
+	return zone
+}
+
+// HasExternalAddress returns true if the instance's network interface has an
+// external access config. A stopped instance with an ephemeral external IP has
+// the access config, but no IP until it is started again.
+func HasExternalAddress(instance compute.Instance) bool {
+	return len(instance.NetworkInterfaces) > 0 && len(instance.NetworkInterfaces[0].AccessConfigs) > 0
+}
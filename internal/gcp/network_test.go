@@ -0,0 +1,29 @@
+package gcp_test
+
+import (
+	"testing"
+
+	"github.com/joemiller/gmachine/internal/gcp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNetwork_Validate(t *testing.T) {
+	assert.NoError(t, gcp.Network{}.Validate())
+	assert.NoError(t, gcp.Network{StackType: gcp.StackTypeIPv4IPv6, Tags: []string{"ssh", "dev-workstation"}}.Validate())
+	assert.ErrorContains(t, gcp.Network{StackType: "ipv6"}.Validate(), "invalid stack type 'ipv6'")
+	for _, tag := range []string{"", "SSH", "1ssh", "ssh-", "ssh_in"} {
+		assert.ErrorContains(t, gcp.Network{Tags: []string{tag}}.Validate(), "invalid network tag", tag)
+	}
+}
+
+func TestNetwork_IsZero(t *testing.T) {
+	assert.True(t, gcp.Network{}.IsZero())
+	assert.True(t, gcp.Network{Tags: []string{}}.IsZero())
+	assert.False(t, gcp.Network{NoAddress: true}.IsZero())
+}
+
+func TestRegion(t *testing.T) {
+	assert.Equal(t, "us-west1", gcp.Region("us-west1-a"))
+	assert.Equal(t, "europe-west4", gcp.Region("europe-west4-c"))
+	assert.Equal(t, "local", gcp.Region("local"))
+}
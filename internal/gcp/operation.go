@@ -0,0 +1,137 @@
+package gcp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// Operation is a long-running zone operation started by a Backend, eg: stopping
+// an instance.
+type Operation struct {
+	Name      string
+	Type      string // eg: "stop", "insert"
+	Target    string // name of the instance
+	Account   string
+	Project   string
+	Zone      string
+	Status    string // PENDING, RUNNING or DONE
+	Progress  int64
+	Error     string
+	ErrorCode string // code of the first error, eg: ZONE_RESOURCE_POOL_EXHAUSTED
+	StartTime time.Time
+	EndTime   time.Time
+}
+
+// Done returns true if the operation has completed, successfully or not.
+func (o *Operation) Done() bool {
+	return o.Status == "DONE"
+}
+
+// Err returns an error if the operation completed with errors. The error is an
+// *Error if the class of the error code is known.
+func (o *Operation) Err() error {
+	if o.Error == "" {
+		return nil
+	}
+	msg := fmt.Sprintf("operation %s failed: %s", o.Name, o.Error)
+	if kind := classifyOperationError(o.ErrorCode, o.Error); kind != nil {
+		return &Error{Kind: kind, Message: msg}
+	}
+	return errors.New(msg)
+}
+
+// PollInterval is how often WaitOperation checks the status of an operation.
+var PollInterval = 2 * time.Second
+
+// WaitOperation polls the status of 'op' until it is DONE. If progress is not nil
+// it is called with the latest state of the operation after every poll. The
+// final state of the operation is returned along with the operation's error,
+// if any.
+func WaitOperation(ctx context.Context, b Backend, op *Operation, progress func(*Operation)) (*Operation, error) {
+	ref := InstanceRef{Name: op.Target, Account: op.Account, Project: op.Project, Zone: op.Zone}
+	for !op.Done() {
+		select {
+		case <-ctx.Done():
+			return op, context.Cause(ctx)
+		case <-time.After(PollInterval):
+		}
+
+		latest, err := b.GetOperation(ctx, ref, op.Name)
+		if err != nil {
+			return op, err
+		}
+		op = latest
+		if progress != nil {
+			progress(op)
+		}
+	}
+	return op, op.Err()
+}
+
+// operationFromCompute converts an API operation resource for an operation on
+// the instance 'ref'.
+func operationFromCompute(ref InstanceRef, op *compute.Operation) *Operation {
+	o := &Operation{
+		Name:     op.Name,
+		Type:     op.OperationType,
+		Target:   ref.Name,
+		Account:  ref.Account,
+		Project:  ref.Project,
+		Zone:     ref.Zone,
+		Status:   op.Status,
+		Progress: op.Progress,
+	}
+	if op.TargetLink != "" {
+		o.Target = path.Base(op.TargetLink)
+	}
+	o.StartTime, _ = time.Parse(time.RFC3339, op.StartTime)
+	o.EndTime, _ = time.Parse(time.RFC3339, op.EndTime)
+	if op.Error != nil && len(op.Error.Errors) > 0 {
+		msgs := []string{}
+		for _, e := range op.Error.Errors {
+			msgs = append(msgs, e.Message)
+		}
+		o.Error = strings.Join(msgs, "; ")
+		o.ErrorCode = op.Error.Errors[0].Code
+	}
+	return o
+}
+
+// parseGcloudOperations parses the operation(s) printed by a gcloud command run
+// with --async --format=json. gcloud prints either a single resource or a list.
+func parseGcloudOperations(ref InstanceRef, b []byte) ([]*Operation, error) {
+	var list []*compute.Operation
+	if err := json.Unmarshal(b, &list); err != nil {
+		var op compute.Operation
+		if err := json.Unmarshal(b, &op); err != nil {
+			return nil, fmt.Errorf("error parsing gcloud operation output: %w", err)
+		}
+		list = []*compute.Operation{&op}
+	}
+
+	ops := []*Operation{}
+	for _, op := range list {
+		ops = append(ops, operationFromCompute(ref, op))
+	}
+	return ops, nil
+}
+
+// parseGcloudOperation parses the single operation printed by a gcloud command
+// run with --async --format=json.
+func parseGcloudOperation(ref InstanceRef, b []byte) (*Operation, error) {
+	ops, err := parseGcloudOperations(ref, b)
+	if err != nil {
+		return nil, err
+	}
+	if len(ops) == 0 {
+		return nil, errors.New("gcloud did not return an operation")
+	}
+	return ops[0], nil
+}
@@ -0,0 +1,83 @@
+package gcp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"google.golang.org/api/oslogin/v1"
+)
+
+// osLoginUsername returns the POSIX username of an OS Login profile: the primary
+// account's, or else the first's.
+func osLoginUsername(profile *oslogin.LoginProfile) (string, error) {
+	if profile == nil || len(profile.PosixAccounts) == 0 {
+		return "", fmt.Errorf("OS Login profile has no POSIX accounts")
+	}
+	for _, a := range profile.PosixAccounts {
+		if a.Primary {
+			return a.Username, nil
+		}
+	}
+	return profile.PosixAccounts[0].Username, nil
+}
+
+// ImportOSLoginKey adds the public key to the OS Login profile of 'account', or
+// the active account, with 'gcloud compute os-login ssh-keys add' and returns the
+// profile's POSIX username.
+func (g *Gcloud) ImportOSLoginKey(ctx context.Context, account, publicKey string) (string, error) {
+	args := []string{"gcloud", "compute", "os-login", "ssh-keys", "add", "--key=" + strings.TrimSpace(publicKey)}
+	if account != "" {
+		args = append(args, "--account="+account)
+	}
+	if g.DryRun != nil {
+		printDryRunCommand(g.DryRun, args)
+	} else if _, err := runOutput(ctx, nil, os.Stderr, args...); err != nil {
+		return "", err
+	}
+
+	args = []string{"gcloud", "compute", "os-login", "describe-profile", "--format=json"}
+	if account != "" {
+		args = append(args, "--account="+account)
+	}
+	out, err := output(ctx, args...)
+	if err != nil {
+		return "", err
+	}
+	profile := &oslogin.LoginProfile{}
+	if err := json.Unmarshal(out, profile); err != nil {
+		return "", fmt.Errorf("error parsing OS Login profile: %w", err)
+	}
+	return osLoginUsername(profile)
+}
+
+// ImportOSLoginKey adds the public key to the OS Login profile of 'account' and
+// returns the profile's POSIX username. The API backend does not know the
+// account of its Application Default Credentials so 'account' must be set.
+func (a *API) ImportOSLoginKey(ctx context.Context, account, publicKey string) (string, error) {
+	if account == "" {
+		return "", fmt.Errorf("the API backend needs the machine's account to add a key to its OS Login profile")
+	}
+	resp, err := a.oslogin.Users.ImportSshPublicKey("users/"+account, &oslogin.SshPublicKey{Key: strings.TrimSpace(publicKey)}).Context(ctx).Do()
+	if err != nil {
+		return "", classifyAPIError(err)
+	}
+	return osLoginUsername(resp.LoginProfile)
+}
+
+// fakeOSLoginUsernameRe matches the characters OS Login replaces with '_' when
+// deriving a username from an account.
+var fakeOSLoginUsernameRe = regexp.MustCompile(`[^a-z0-9_]`)
+
+// ImportOSLoginKey returns the username OS Login derives from the account, eg:
+// "me_example_com" for "me@example.com". The key is not stored.
+func (f *Fake) ImportOSLoginKey(ctx context.Context, account, publicKey string) (string, error) {
+	if account == "" {
+		account = "fake@example.com"
+	}
+	f.dryRun("ImportOSLoginKey", account, publicKey)
+	return fakeOSLoginUsernameRe.ReplaceAllString(strings.ToLower(account), "_"), nil
+}
@@ -0,0 +1,198 @@
+package gcp
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// RetryPolicy controls how transient errors are retried, see IsTransient. The
+// delay before each retry grows exponentially from InitialDelay up to MaxDelay and
+// is jittered so that many clients retrying at once are spread out.
+type RetryPolicy struct {
+	Retries      int // number of retries after the first attempt, 0 disables retries
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+}
+
+// DefaultRetryPolicy is used when the policy is not configured.
+var DefaultRetryPolicy = RetryPolicy{
+	Retries:      4,
+	InitialDelay: time.Second,
+	MaxDelay:     30 * time.Second,
+}
+
+// delay returns the jittered delay before retry number 'n', starting at 1.
+func (p RetryPolicy) delay(n int) time.Duration {
+	d := p.InitialDelay
+	for i := 1; i < n && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	// "equal jitter": half the delay plus a random amount up to the other half
+	half := int64(d / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// Do calls fn until it succeeds, returns an error that is not transient, or the
+// policy's retries are exhausted. 'desc' describes the call in log messages.
+func (p RetryPolicy) Do(ctx context.Context, desc string, fn func() error) error {
+	for n := 1; ; n++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if !IsTransient(err) {
+			slog.DebugContext(ctx, "not retrying, error is not transient", "call", desc, "error", err)
+			return err
+		}
+		if n > p.Retries {
+			slog.DebugContext(ctx, "not retrying, retries exhausted", "call", desc, "retries", p.Retries, "error", err)
+			return err
+		}
+
+		delay := p.delay(n)
+		slog.InfoContext(ctx, "retrying", "call", desc, "retry", n, "retries", p.Retries, "delay", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Retrying is a Backend that retries the idempotent calls of another Backend
+// when they fail with a transient error: describing instances, disks and
+// operations, listing zones, starting, stopping, suspending, resuming and
+// resizing instances, getting their host keys, and importing OS Login keys.
+// Repeating these calls has no effect if the instance is already in the target
+// state, or the key already imported. Creating, deleting and moving instances,
+// updating their labels and metadata, creating and deleting disks, snapshots and
+// service accounts, and attaching and detaching disks, are not retried.
+type Retrying struct {
+	Backend
+	Policy RetryPolicy
+}
+
+// NewRetrying returns a Backend that retries the idempotent calls of 'b' using
+// 'policy'.
+func NewRetrying(b Backend, policy RetryPolicy) *Retrying {
+	return &Retrying{Backend: b, Policy: policy}
+}
+
+func (r *Retrying) do(ctx context.Context, desc string, fn func() error) error {
+	return r.Policy.Do(ctx, desc, fn)
+}
+
+// StartInstance retries Backend.StartInstance.
+func (r *Retrying) StartInstance(ctx context.Context, ref InstanceRef, csek CSEKBundle) (op *Operation, err error) {
+	err = r.do(ctx, "start "+ref.Name, func() error {
+		op, err = r.Backend.StartInstance(ctx, ref, csek)
+		return err
+	})
+	return op, err
+}
+
+// StopInstance retries Backend.StopInstance.
+func (r *Retrying) StopInstance(ctx context.Context, ref InstanceRef) (op *Operation, err error) {
+	err = r.do(ctx, "stop "+ref.Name, func() error {
+		op, err = r.Backend.StopInstance(ctx, ref)
+		return err
+	})
+	return op, err
+}
+
+// SuspendInstance retries Backend.SuspendInstance.
+func (r *Retrying) SuspendInstance(ctx context.Context, ref InstanceRef) (op *Operation, err error) {
+	err = r.do(ctx, "suspend "+ref.Name, func() error {
+		op, err = r.Backend.SuspendInstance(ctx, ref)
+		return err
+	})
+	return op, err
+}
+
+// ResumeInstance retries Backend.ResumeInstance.
+func (r *Retrying) ResumeInstance(ctx context.Context, ref InstanceRef, csek CSEKBundle) (op *Operation, err error) {
+	err = r.do(ctx, "resume "+ref.Name, func() error {
+		op, err = r.Backend.ResumeInstance(ctx, ref, csek)
+		return err
+	})
+	return op, err
+}
+
+// ResizeInstance retries Backend.ResizeInstance.
+func (r *Retrying) ResizeInstance(ctx context.Context, ref InstanceRef, machineType string) (op *Operation, err error) {
+	err = r.do(ctx, "resize "+ref.Name, func() error {
+		op, err = r.Backend.ResizeInstance(ctx, ref, machineType)
+		return err
+	})
+	return op, err
+}
+
+// DescribeInstance retries Backend.DescribeInstance.
+func (r *Retrying) DescribeInstance(ctx context.Context, ref InstanceRef) (instance compute.Instance, err error) {
+	err = r.do(ctx, "describe "+ref.Name, func() error {
+		instance, err = r.Backend.DescribeInstance(ctx, ref)
+		return err
+	})
+	return instance, err
+}
+
+// ListZones retries Backend.ListZones.
+func (r *Retrying) ListZones(ctx context.Context, account, project, region string) (zones []string, err error) {
+	err = r.do(ctx, "list zones "+region, func() error {
+		zones, err = r.Backend.ListZones(ctx, account, project, region)
+		return err
+	})
+	return zones, err
+}
+
+// DescribeDisk retries Backend.DescribeDisk.
+func (r *Retrying) DescribeDisk(ctx context.Context, ref DiskRef) (disk compute.Disk, err error) {
+	err = r.do(ctx, "describe disk "+ref.Name, func() error {
+		disk, err = r.Backend.DescribeDisk(ctx, ref)
+		return err
+	})
+	return disk, err
+}
+
+// GetOperation retries Backend.GetOperation.
+func (r *Retrying) GetOperation(ctx context.Context, ref InstanceRef, name string) (op *Operation, err error) {
+	err = r.do(ctx, "get operation "+name, func() error {
+		op, err = r.Backend.GetOperation(ctx, ref, name)
+		return err
+	})
+	return op, err
+}
+
+// HostKeys retries Backend.HostKeys.
+func (r *Retrying) HostKeys(ctx context.Context, ref InstanceRef) (keys []string, err error) {
+	err = r.do(ctx, "get host keys "+ref.Name, func() error {
+		keys, err = r.Backend.HostKeys(ctx, ref)
+		return err
+	})
+	return keys, err
+}
+
+// ImportOSLoginKey retries Backend.ImportOSLoginKey.
+func (r *Retrying) ImportOSLoginKey(ctx context.Context, account, publicKey string) (username string, err error) {
+	err = r.do(ctx, "import OS Login key "+account, func() error {
+		username, err = r.Backend.ImportOSLoginKey(ctx, account, publicKey)
+		return err
+	})
+	return username, err
+}
+
+// ListOperations retries Backend.ListOperations.
+func (r *Retrying) ListOperations(ctx context.Context, ref InstanceRef) (ops []*Operation, err error) {
+	err = r.do(ctx, "list operations "+ref.Name, func() error {
+		ops, err = r.Backend.ListOperations(ctx, ref)
+		return err
+	})
+	return ops, err
+}
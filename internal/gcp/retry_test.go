@@ -0,0 +1,107 @@
+package gcp_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joemiller/gmachine/internal/gcp"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/compute/v1"
+)
+
+// flakyBackend fails DescribeInstance and StopInstance with 'err' the first
+// 'failures' times they are called.
+type flakyBackend struct {
+	gcp.Backend
+	err      error
+	failures int
+	calls    int
+}
+
+func (f *flakyBackend) DescribeInstance(ctx context.Context, ref gcp.InstanceRef) (compute.Instance, error) {
+	f.calls++
+	if f.calls <= f.failures {
+		return compute.Instance{}, f.err
+	}
+	return compute.Instance{Name: ref.Name, Status: "RUNNING"}, nil
+}
+
+func (f *flakyBackend) StopInstance(ctx context.Context, ref gcp.InstanceRef) (*gcp.Operation, error) {
+	f.calls++
+	if f.calls <= f.failures {
+		return nil, f.err
+	}
+	return &gcp.Operation{Name: "op-1", Status: "DONE"}, nil
+}
+
+// captureLogs sends the default logger's output to the returned buffer for the
+// duration of the test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	orig := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(orig) })
+	return &buf
+}
+
+func TestRetrying(t *testing.T) {
+	ctx := context.Background()
+	policy := gcp.RetryPolicy{Retries: 3, InitialDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+	unavailable := &gcp.Error{Kind: gcp.ErrUnavailable, Message: "backendError"}
+
+	tests := []struct {
+		name      string
+		err       error
+		failures  int
+		wantErr   error
+		wantCalls int
+	}{
+		{"succeeds after transient errors", unavailable, 2, nil, 3},
+		{"rate limited", &gcp.Error{Kind: gcp.ErrRateLimited}, 1, nil, 2},
+		{"not ready", &gcp.Error{Kind: gcp.ErrNotReady}, 1, nil, 2},
+		{"retries exhausted", unavailable, 10, gcp.ErrUnavailable, 4},
+		{"not transient", &gcp.Error{Kind: gcp.ErrPermissionDenied}, 10, gcp.ErrPermissionDenied, 1},
+		{"invalid state is not transient", &gcp.Error{Kind: gcp.ErrInvalidState}, 10, gcp.ErrInvalidState, 1},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			flaky := &flakyBackend{err: tc.err, failures: tc.failures}
+			logs := captureLogs(t)
+			b := gcp.NewRetrying(flaky, policy)
+
+			_, err := b.DescribeInstance(ctx, fooRef)
+			if tc.wantErr == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, tc.wantErr)
+			}
+			assert.Equal(t, tc.wantCalls, flaky.calls)
+			assert.Equal(t, tc.wantCalls-1, strings.Count(logs.String(), "msg=retrying"))
+		})
+	}
+}
+
+func TestRetrying_mutating(t *testing.T) {
+	ctx := context.Background()
+	policy := gcp.RetryPolicy{Retries: 3, InitialDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+	flaky := &flakyBackend{err: &gcp.Error{Kind: gcp.ErrNotReady}, failures: 2}
+	op, err := gcp.NewRetrying(flaky, policy).StopInstance(ctx, fooRef)
+	assert.NoError(t, err)
+	assert.Equal(t, "op-1", op.Name)
+	assert.Equal(t, 3, flaky.calls)
+
+	// retries stop when the context is canceled
+	cause := fmt.Errorf("interrupted")
+	ctx, cancel := context.WithCancelCause(ctx)
+	cancel(cause)
+	flaky = &flakyBackend{err: &gcp.Error{Kind: gcp.ErrNotReady}, failures: 10}
+	_, err = gcp.NewRetrying(flaky, gcp.RetryPolicy{Retries: 3, InitialDelay: time.Hour, MaxDelay: time.Hour}).StopInstance(ctx, fooRef)
+	assert.ErrorIs(t, err, cause)
+	assert.Equal(t, 1, flaky.calls)
+}
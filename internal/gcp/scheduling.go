@@ -0,0 +1,135 @@
+package gcp
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// Provisioning models and termination actions of an instance, see Scheduling.
+const (
+	ProvisioningModelStandard = "STANDARD"
+	ProvisioningModelSpot     = "SPOT"
+
+	TerminationActionStop   = "STOP"
+	TerminationActionDelete = "DELETE"
+)
+
+// preemptedOperation is the type of the operation Compute Engine records when it
+// preempts a Spot or preemptible instance.
+const preemptedOperation = "compute.instances.preempted"
+
+// Limits of Scheduling.MaxRunDuration.
+const (
+	minRunDuration = 30 * time.Second
+	maxRunDuration = 120 * 24 * time.Hour
+)
+
+// Scheduling holds the provisioning model of an instance and what happens to it
+// when it is terminated by Compute Engine. The zero value is a standard instance.
+type Scheduling struct {
+	// ProvisioningModel is ProvisioningModelStandard (the default) or
+	// ProvisioningModelSpot
+	ProvisioningModel string `json:"provisioning_model,omitempty" yaml:"provisioning_model,omitempty"`
+	// TerminationAction is what happens to a Spot instance when it is preempted,
+	// or to any instance when it reaches MaxRunDuration: TerminationActionStop
+	// (the default) or TerminationActionDelete
+	TerminationAction string `json:"termination_action,omitempty" yaml:"termination_action,omitempty"`
+	// MaxRunDuration limits how long the instance runs before it is terminated,
+	// optional
+	MaxRunDuration time.Duration `json:"max_run_duration,omitempty" yaml:"max_run_duration,omitempty"`
+}
+
+// Validate returns an error if the scheduling settings are invalid.
+func (s Scheduling) Validate() error {
+	switch s.ProvisioningModel {
+	case "", ProvisioningModelStandard, ProvisioningModelSpot:
+	default:
+		return fmt.Errorf("invalid provisioning model '%s', expected %s or %s",
+			strings.ToLower(s.ProvisioningModel), strings.ToLower(ProvisioningModelSpot), strings.ToLower(ProvisioningModelStandard))
+	}
+	switch s.TerminationAction {
+	case "", TerminationActionStop, TerminationActionDelete:
+	default:
+		return fmt.Errorf("invalid instance termination action '%s', expected %s or %s",
+			strings.ToLower(s.TerminationAction), strings.ToLower(TerminationActionStop), strings.ToLower(TerminationActionDelete))
+	}
+	if s.TerminationAction != "" && s.ProvisioningModel != ProvisioningModelSpot && s.MaxRunDuration == 0 {
+		return fmt.Errorf("an instance termination action requires the spot provisioning model or a max run duration")
+	}
+	if s.MaxRunDuration != 0 && (s.MaxRunDuration < minRunDuration || s.MaxRunDuration > maxRunDuration) {
+		return fmt.Errorf("invalid max run duration %s, it must be between %s and %s", s.MaxRunDuration, minRunDuration, maxRunDuration)
+	}
+	return nil
+}
+
+// terminationAction returns the termination action of the instance, defaulting
+// to TerminationActionStop if the instance can be terminated, or "".
+func (s Scheduling) terminationAction() string {
+	if s.TerminationAction == "" && (s.ProvisioningModel == ProvisioningModelSpot || s.MaxRunDuration != 0) {
+		return TerminationActionStop
+	}
+	return s.TerminationAction
+}
+
+// gcloudArgs returns the gcloud compute instances create flags for the scheduling.
+func (s Scheduling) gcloudArgs() []string {
+	args := []string{}
+	if s.ProvisioningModel != "" {
+		args = append(args, "--provisioning-model="+s.ProvisioningModel)
+	}
+	if action := s.terminationAction(); action != "" {
+		args = append(args, "--instance-termination-action="+action)
+	}
+	if s.MaxRunDuration != 0 {
+		args = append(args, fmt.Sprintf("--max-run-duration=%ds", int64(s.MaxRunDuration/time.Second)))
+	}
+	return args
+}
+
+// scheduling returns the scheduling of an instance with the settings. Like
+// gcloud, Spot instances are not restarted automatically and are terminated
+// during host maintenance.
+func (s Scheduling) scheduling() *compute.Scheduling {
+	sched := &compute.Scheduling{
+		ProvisioningModel:         s.ProvisioningModel,
+		InstanceTerminationAction: s.terminationAction(),
+	}
+	if s.ProvisioningModel == ProvisioningModelSpot {
+		autoRestart := false
+		sched.AutomaticRestart = &autoRestart
+		sched.OnHostMaintenance = "TERMINATE"
+	}
+	return sched
+}
+
+// IsSpot returns true if the instance can be preempted: a Spot or a legacy
+// preemptible instance.
+func IsSpot(instance compute.Instance) bool {
+	return instance.Scheduling != nil &&
+		(instance.Scheduling.Preemptible || instance.Scheduling.ProvisioningModel == ProvisioningModelSpot)
+}
+
+// Preempted returns true if the instance was last stopped because it was
+// preempted, rather than by a user. It checks the instance's recent operations,
+// Compute Engine does not keep the reason on the instance.
+func Preempted(ctx context.Context, b Backend, ref InstanceRef) (bool, error) {
+	ops, err := b.ListOperations(ctx, ref)
+	if err != nil {
+		return false, err
+	}
+	// most recent first, the first operation that changed whether the instance
+	// is running decides
+	for _, op := range ops {
+		switch op.Type {
+		case preemptedOperation:
+			return true, nil
+		case "insert", "start", "stop", "suspend", "resume":
+			return false, nil
+		}
+	}
+	return false, nil
+}
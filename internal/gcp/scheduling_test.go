@@ -0,0 +1,85 @@
+package gcp_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/joemiller/gmachine/internal/gcp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduling_Validate(t *testing.T) {
+	assert.NoError(t, gcp.Scheduling{}.Validate())
+	assert.NoError(t, gcp.Scheduling{ProvisioningModel: gcp.ProvisioningModelSpot, TerminationAction: gcp.TerminationActionDelete}.Validate())
+	assert.NoError(t, gcp.Scheduling{TerminationAction: gcp.TerminationActionStop, MaxRunDuration: time.Hour}.Validate())
+	assert.ErrorContains(t, gcp.Scheduling{ProvisioningModel: "RESERVED"}.Validate(), "invalid provisioning model 'reserved'")
+	assert.ErrorContains(t, gcp.Scheduling{ProvisioningModel: gcp.ProvisioningModelSpot, TerminationAction: "SUSPEND"}.Validate(), "invalid instance termination action 'suspend'")
+	assert.ErrorContains(t, gcp.Scheduling{TerminationAction: gcp.TerminationActionStop}.Validate(), "requires the spot provisioning model")
+	assert.ErrorContains(t, gcp.Scheduling{MaxRunDuration: time.Second}.Validate(), "invalid max run duration")
+	assert.ErrorContains(t, gcp.Scheduling{MaxRunDuration: 200 * 24 * time.Hour}.Validate(), "invalid max run duration")
+}
+
+func TestFake_spot(t *testing.T) {
+	ctx := context.Background()
+	fake := gcp.NewFake("", 0, nil)
+	wait := waiter(fake)
+
+	req := newFakeRequest()
+	req.Scheduling = gcp.Scheduling{ProvisioningModel: gcp.ProvisioningModelSpot}
+	assert.NoError(t, wait(fake.CreateInstance(ctx, req)))
+	instance, _ := fake.DescribeInstance(ctx, req.Ref())
+	assert.True(t, gcp.IsSpot(instance))
+	assert.Equal(t, "STOP", instance.Scheduling.InstanceTerminationAction)
+
+	// stopped by a user
+	assert.NoError(t, wait(fake.StopInstance(ctx, req.Ref())))
+	preempted, err := gcp.Preempted(ctx, fake, req.Ref())
+	assert.NoError(t, err)
+	assert.False(t, preempted)
+
+	assert.NoError(t, wait(fake.StartInstance(ctx, req.Ref(), nil)))
+	assert.NoError(t, fake.Preempt(ctx, req.Ref()))
+	instance, _ = fake.DescribeInstance(ctx, req.Ref())
+	assert.Equal(t, "TERMINATED", instance.Status)
+	preempted, err = gcp.Preempted(ctx, fake, req.Ref())
+	assert.NoError(t, err)
+	assert.True(t, preempted)
+
+	// no capacity in the zone, move the instance to another zone in the region
+	fake.ExhaustedZones = []string{"us-west1-a"}
+	assert.ErrorIs(t, wait(fake.StartInstance(ctx, req.Ref(), nil)), gcp.ErrZoneResourceExhausted)
+	zones, err := fake.ListZones(ctx, req.Account, req.Project, "us-west1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"us-west1-a", "us-west1-b", "us-west1-c"}, zones)
+	assert.Error(t, fake.MoveInstance(ctx, req.Ref(), "us-east1-b"))
+	assert.NoError(t, fake.MoveInstance(ctx, req.Ref(), "us-west1-b"))
+	_, err = fake.DescribeInstance(ctx, req.Ref())
+	assert.ErrorIs(t, err, gcp.ErrNotFound)
+	moved := req.Ref()
+	moved.Zone = "us-west1-b"
+	assert.NoError(t, wait(fake.StartInstance(ctx, moved, nil)))
+	_, err = fake.DescribeDisk(ctx, moved.Disk("foo"))
+	assert.NoError(t, err)
+
+	// a running instance can't be moved, a standard instance can't be preempted
+	assert.ErrorIs(t, fake.MoveInstance(ctx, moved, "us-west1-c"), gcp.ErrInvalidState)
+	req.Name = "bar"
+	req.Scheduling = gcp.Scheduling{}
+	req.Zone = "us-west1-b"
+	assert.NoError(t, wait(fake.CreateInstance(ctx, req)))
+	assert.ErrorIs(t, fake.Preempt(ctx, req.Ref()), gcp.ErrInvalidState)
+}
+
+func TestFake_spot_delete(t *testing.T) {
+	ctx := context.Background()
+	fake := gcp.NewFake("", 0, nil)
+	wait := waiter(fake)
+
+	req := newFakeRequest()
+	req.Scheduling = gcp.Scheduling{ProvisioningModel: gcp.ProvisioningModelSpot, TerminationAction: gcp.TerminationActionDelete}
+	assert.NoError(t, wait(fake.CreateInstance(ctx, req)))
+	assert.NoError(t, fake.Preempt(ctx, req.Ref()))
+	_, err := fake.DescribeInstance(ctx, req.Ref())
+	assert.ErrorIs(t, err, gcp.ErrNotFound)
+}
@@ -1,16 +1,20 @@
 package gcp
 
 import (
-	"io"
+	"context"
 	"os"
 )
 
-func CreateServiceAccount(log, logerr io.Writer, name, account, project string) error {
-	args := []string{
-		"gcloud", "iam", "service-accounts", "create",
-		name,
-		"--account=" + account,
-		"--project=" + project,
+// CreateServiceAccount creates a new service account 'name' in 'project' with
+// 'gcloud iam service-accounts create'.
+func (g *Gcloud) CreateServiceAccount(ctx context.Context, account, project, name string) error {
+	args := []string{"gcloud", "iam", "service-accounts", "create", name, "--project=" + project}
+	if account != "" {
+		args = append(args, "--account="+account)
 	}
-	return run(os.Stdin, log, logerr, args...)
+	if g.DryRun != nil {
+		printDryRunCommand(g.DryRun, args)
+		return nil
+	}
+	return run(ctx, os.Stdin, g.Stdout, g.Stderr, args...)
 }
@@ -0,0 +1,173 @@
+package gcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/joemiller/gmachine/internal/sshclient"
+	"google.golang.org/api/compute/v1"
+)
+
+// SSH connection modes, see SSHOptions.
+const (
+	// SSHModeIAP tunnels the connection through Identity-Aware Proxy
+	SSHModeIAP = "iap"
+	// SSHModeInternalIP connects to the instance's internal IP, eg: over a VPN
+	SSHModeInternalIP = "internal-ip"
+)
+
+// SSHOptions holds how SSHInstance connects to an instance.
+type SSHOptions struct {
+	// Mode is how the instance is reached: SSHModeIAP, SSHModeInternalIP, or ""
+	// for its external IP, which tunnels through IAP if it has none
+	Mode string
+	// JumpHost is another instance to connect through, to the instance's
+	// internal IP. Optional
+	JumpHost *InstanceRef
+	// Args are additional arguments passed through to ssh
+	Args []string
+	// HostKeys are the instance's pinned host keys as "TYPE BASE64" lines. If set,
+	// other host keys are rejected instead of being trusted on first use
+	HostKeys []string
+	// JumpHostKeys are the jump host's pinned host keys, as HostKeys
+	JumpHostKeys []string
+}
+
+// Validate returns an error if the options are invalid.
+func (o SSHOptions) Validate() error {
+	switch o.Mode {
+	case "", SSHModeIAP, SSHModeInternalIP:
+	default:
+		return fmt.Errorf("invalid ssh mode '%s', expected %s or %s", o.Mode, SSHModeIAP, SSHModeInternalIP)
+	}
+	if o.JumpHost != nil && o.Mode == SSHModeIAP {
+		return errors.New("cannot connect through both a jump host and an IAP tunnel")
+	}
+	return nil
+}
+
+// OSLoginEnabled returns true if the instance's metadata enables OS Login, in
+// which case keys in its ssh-keys metadata are ignored. Project metadata is not
+// checked.
+func OSLoginEnabled(instance compute.Instance) bool {
+	return strings.EqualFold(MetadataValue(instance, "enable-oslogin"), "true")
+}
+
+// AddSSHKey adds the public key for 'user' to the instance's ssh-keys metadata,
+// unless it is already there, and waits for the update to complete. The guest
+// agent creates the user and installs the key.
+func AddSSHKey(ctx context.Context, b Backend, ref InstanceRef, user, publicKey string) error {
+	instance, err := b.DescribeInstance(ctx, ref)
+	if err != nil {
+		return err
+	}
+	entry := user + ":" + strings.TrimSpace(publicKey)
+	keys := strings.TrimRight(MetadataValue(instance, "ssh-keys"), "\n")
+	for _, line := range strings.Split(keys, "\n") {
+		if strings.TrimSpace(line) == entry {
+			return nil
+		}
+	}
+	if keys != "" {
+		keys += "\n"
+	}
+	return b.UpdateMetadata(ctx, ref, map[string]string{"ssh-keys": keys + entry})
+}
+
+// IAPTunnelCommand returns the 'gcloud compute start-iap-tunnel' command that
+// forwards its stdin and stdout to the instance's ssh port through IAP, eg: for
+// an ssh ProxyCommand.
+func IAPTunnelCommand(ref InstanceRef) []string {
+	args := []string{"gcloud", "compute", "start-iap-tunnel", ref.Name, "22", "--listen-on-stdin"}
+	return append(args, ref.gcloudArgs()...)
+}
+
+// gcloudSSHArgs returns the 'gcloud compute ssh' command that connects to the
+// instance with the options.
+func gcloudSSHArgs(ref InstanceRef, opts SSHOptions) []string {
+	args := []string{"gcloud", "compute", "ssh", ref.Name}
+	args = append(args, ref.gcloudArgs()...)
+	switch {
+	case opts.Mode == SSHModeIAP:
+		args = append(args, "--tunnel-through-iap")
+	case opts.Mode == SSHModeInternalIP || opts.JumpHost != nil:
+		args = append(args, "--internal-ip")
+	}
+	if len(opts.HostKeys) > 0 {
+		args = append(args, "--strict-host-key-checking=yes")
+	}
+
+	extra := opts.Args
+	if opts.JumpHost != nil {
+		// ssh runs the proxy command with the user's shell
+		proxy := append([]string{"gcloud", "compute", "ssh", opts.JumpHost.Name}, opts.JumpHost.gcloudArgs()...)
+		if len(opts.JumpHostKeys) > 0 {
+			proxy = append(proxy, "--strict-host-key-checking=yes")
+		}
+		proxy = append(proxy, "--", "-W", "%h:%p")
+		extra = append([]string{"-o", "ProxyCommand=" + sshclient.ShellJoin(proxy)}, extra...)
+	}
+	if len(extra) > 0 {
+		args = append(args, "--")
+		args = append(args, extra...)
+	}
+	return args
+}
+
+// SSHInstance replaces the current process with 'gcloud compute ssh'. Pinned host
+// keys are written to gcloud's known_hosts file first, see pinGcloudHostKeys.
+func (g *Gcloud) SSHInstance(ctx context.Context, ref InstanceRef, opts SSHOptions) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	if err := g.pinGcloudHostKeys(ctx, ref, opts.HostKeys); err != nil {
+		return err
+	}
+	if opts.JumpHost != nil {
+		if err := g.pinGcloudHostKeys(ctx, *opts.JumpHost, opts.JumpHostKeys); err != nil {
+			return fmt.Errorf("jump host %s: %w", opts.JumpHost.Name, err)
+		}
+	}
+	return execve(ctx, gcloudSSHArgs(ref, opts))
+}
+
+// gcloudKnownHostsFile returns the known_hosts file that 'gcloud compute ssh'
+// passes to ssh, ahead of any ssh args, so it is the one host keys are checked
+// against.
+var gcloudKnownHostsFile = func() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".ssh", "google_compute_known_hosts"), nil
+}
+
+// pinGcloudHostKeys writes the instance's pinned host keys, if any, to gcloud's
+// known_hosts file in place of the keys gcloud has for the instance, eg: ones it
+// trusted the first time it connected.
+func (g *Gcloud) pinGcloudHostKeys(ctx context.Context, ref InstanceRef, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	instance, err := g.DescribeInstance(ctx, ref)
+	if err != nil {
+		return err
+	}
+	file, err := gcloudKnownHostsFile()
+	if err != nil {
+		return err
+	}
+	return writeGcloudKnownHosts(file, instance, keys)
+}
+
+// writeGcloudKnownHosts replaces the host keys of the instance in the gcloud
+// known_hosts file 'file' with 'keys'. gcloud keeps them under the alias
+// compute.ID, the instance's numeric ID, which changes when it is recreated.
+func writeGcloudKnownHosts(file string, instance compute.Instance, keys []string) error {
+	alias := fmt.Sprintf("compute.%d", instance.Id)
+	return sshclient.WriteKnownHosts(file, map[string][]string{alias: keys}, func(string) bool { return true })
+}
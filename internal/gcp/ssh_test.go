@@ -0,0 +1,230 @@
+package gcp_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/joemiller/gmachine/internal/gcp"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/api/compute/v1"
+)
+
+func TestGcloudSSHArgs(t *testing.T) {
+	bastion := gcp.InstanceRef{Name: "bastion", Account: "me@example.com", Project: "my-proj", Zone: "us-west1-b"}
+	tests := []struct {
+		opts gcp.SSHOptions
+		want []string
+	}{
+		{gcp.SSHOptions{}, []string{"gcloud", "compute", "ssh", "foo", "--project=my-proj", "--zone=us-west1-a"}},
+		{gcp.SSHOptions{Mode: gcp.SSHModeIAP, Args: []string{"-A"}},
+			[]string{"gcloud", "compute", "ssh", "foo", "--project=my-proj", "--zone=us-west1-a", "--tunnel-through-iap", "--", "-A"}},
+		{gcp.SSHOptions{Mode: gcp.SSHModeInternalIP}, []string{"gcloud", "compute", "ssh", "foo", "--project=my-proj", "--zone=us-west1-a", "--internal-ip"}},
+		{gcp.SSHOptions{HostKeys: []string{"ssh-ed25519 AAAA"}}, []string{"gcloud", "compute", "ssh", "foo", "--project=my-proj", "--zone=us-west1-a", "--strict-host-key-checking=yes"}},
+		{gcp.SSHOptions{JumpHost: &bastion, JumpHostKeys: []string{"ssh-ed25519 AAAA"}},
+			[]string{"gcloud", "compute", "ssh", "foo", "--project=my-proj", "--zone=us-west1-a", "--internal-ip", "--",
+				"-o", "ProxyCommand=gcloud compute ssh bastion --account=me@example.com --project=my-proj --zone=us-west1-b --strict-host-key-checking=yes -- -W %h:%p"}},
+		{gcp.SSHOptions{JumpHost: &bastion, Args: []string{"-A"}},
+			[]string{"gcloud", "compute", "ssh", "foo", "--project=my-proj", "--zone=us-west1-a", "--internal-ip", "--",
+				"-o", "ProxyCommand=gcloud compute ssh bastion --account=me@example.com --project=my-proj --zone=us-west1-b -- -W %h:%p", "-A"}},
+		// the ProxyCommand is quoted for the shell
+		{gcp.SSHOptions{JumpHost: &gcp.InstanceRef{Name: "bastion", Account: "o'brien@example.com", Project: "my-proj", Zone: "us-west1-b"}},
+			[]string{"gcloud", "compute", "ssh", "foo", "--project=my-proj", "--zone=us-west1-a", "--internal-ip", "--",
+				"-o", `ProxyCommand=gcloud compute ssh bastion '--account=o'\''brien@example.com' --project=my-proj --zone=us-west1-b -- -W %h:%p`}},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, gcp.GcloudSSHArgs(fooRef, tt.opts))
+	}
+}
+
+func TestFake_SSHInstance(t *testing.T) {
+	ctx := context.Background()
+	var out bytes.Buffer
+	fake := gcp.NewFake("", 0, nil)
+	fake.Stdout = &out
+	wait := waiter(fake)
+	req := newFakeRequest()
+	assert.NoError(t, wait(fake.CreateInstance(ctx, req)))
+	bastion := newFakeRequest()
+	bastion.Name = "bastion"
+	assert.NoError(t, wait(fake.CreateInstance(ctx, bastion)))
+	bastionRef := bastion.Ref()
+
+	assert.NoError(t, fake.SSHInstance(ctx, req.Ref(), gcp.SSHOptions{Args: []string{"-A"}}))
+	assert.Regexp(t, `^ssh 203\.0\.113\.\d+ \[-A\]\n$`, out.String())
+
+	out.Reset()
+	assert.NoError(t, fake.SSHInstance(ctx, req.Ref(), gcp.SSHOptions{Mode: gcp.SSHModeIAP}))
+	assert.Equal(t, "ssh (IAP tunnel) 10.0.0.1 []\n", out.String())
+
+	out.Reset()
+	assert.NoError(t, fake.SSHInstance(ctx, req.Ref(), gcp.SSHOptions{JumpHost: &bastionRef}))
+	assert.Equal(t, "ssh 10.0.0.1 (via bastion) []\n", out.String())
+
+	assert.ErrorContains(t, fake.SSHInstance(ctx, req.Ref(), gcp.SSHOptions{Mode: gcp.SSHModeIAP, JumpHost: &bastionRef}), "cannot connect through both")
+	assert.NoError(t, wait(fake.StopInstance(ctx, bastionRef)))
+	assert.ErrorContains(t, fake.SSHInstance(ctx, req.Ref(), gcp.SSHOptions{JumpHost: &bastionRef}), "connect to instance bastion: instance is TERMINATED")
+}
+
+func TestAddSSHKey(t *testing.T) {
+	ctx := context.Background()
+	fake := gcp.NewFake("", 0, nil)
+	wait := waiter(fake)
+	req := newFakeRequest()
+	req.AddMetadata("ssh-keys", "alice:ssh-ed25519 AAAA alice\n")
+	assert.NoError(t, wait(fake.CreateInstance(ctx, req)))
+
+	assert.NoError(t, gcp.AddSSHKey(ctx, fake, req.Ref(), "bob", "ssh-ed25519 BBBB gmachine-foo\n"))
+	instance, err := fake.DescribeInstance(ctx, req.Ref())
+	assert.NoError(t, err)
+	assert.Equal(t, "alice:ssh-ed25519 AAAA alice\nbob:ssh-ed25519 BBBB gmachine-foo", gcp.MetadataValue(instance, "ssh-keys"))
+	assert.False(t, gcp.OSLoginEnabled(instance))
+
+	// the key is only added once
+	ops, _ := fake.ListOperations(ctx, req.Ref())
+	assert.NoError(t, gcp.AddSSHKey(ctx, fake, req.Ref(), "bob", "ssh-ed25519 BBBB gmachine-foo"))
+	ops2, _ := fake.ListOperations(ctx, req.Ref())
+	assert.Len(t, ops2, len(ops))
+}
+
+func TestAPI_AddSSHKey(t *testing.T) {
+	api, fake := newTestAPI(t)
+
+	assert.NoError(t, gcp.AddSSHKey(context.Background(), api, fooRef, "bob", "ssh-ed25519 BBBB gmachine-foo"))
+	req := compute.Metadata{}
+	if !assert.NoError(t, json.Unmarshal(fake.bodies["POST projects/my-proj/zones/us-west1-a/instances/foo/setMetadata"], &req)) {
+		return
+	}
+	if assert.Len(t, req.Items, 1) {
+		assert.Equal(t, "ssh-keys", req.Items[0].Key)
+		assert.Equal(t, "bob:ssh-ed25519 BBBB gmachine-foo", *req.Items[0].Value)
+	}
+}
+
+func TestAPI_ImportOSLoginKey(t *testing.T) {
+	api, fake := newTestAPI(t)
+
+	user, err := api.ImportOSLoginKey(context.Background(), "me@example.com", "ssh-ed25519 BBBB gmachine-foo\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "me_example_com", user)
+	assert.Contains(t, fake.requests, "POST v1/users/me@example.com:importSshPublicKey")
+
+	_, err = api.ImportOSLoginKey(context.Background(), "", "ssh-ed25519 BBBB")
+	assert.ErrorContains(t, err, "needs the machine's account")
+}
+
+func TestAPI_HostKeys(t *testing.T) {
+	api, fake := newTestAPI(t)
+
+	keys, err := api.HostKeys(context.Background(), fooRef)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ssh-ed25519 AAAA", "ssh-rsa BBBB"}, keys)
+	assert.Contains(t, fake.requests, "GET projects/my-proj/zones/us-west1-a/instances/foo/getGuestAttributes")
+
+	// nothing published yet
+	keys, err = api.HostKeys(context.Background(), gcp.InstanceRef{Name: "bar", Project: "my-proj", Zone: "us-west1-a"})
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestFake_HostKeys(t *testing.T) {
+	ctx := context.Background()
+	fake := gcp.NewFake("", 0, nil)
+	wait := waiter(fake)
+	req := newFakeRequest()
+	assert.NoError(t, wait(fake.CreateInstance(ctx, req)))
+
+	// guest attributes are not enabled
+	keys, err := fake.HostKeys(ctx, req.Ref())
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+
+	assert.NoError(t, fake.UpdateMetadata(ctx, req.Ref(), map[string]string{"enable-guest-attributes": "TRUE"}))
+	instance, _ := fake.DescribeInstance(ctx, req.Ref())
+	assert.True(t, gcp.GuestAttributesEnabled(instance))
+	keys, err = fake.HostKeys(ctx, req.Ref())
+	assert.NoError(t, err)
+	if assert.Len(t, keys, 1) {
+		assert.Regexp(t, `^ssh-ed25519 \S+$`, keys[0])
+	}
+
+	// the keys are kept when the instance is restarted, and not published while
+	// it is stopped
+	assert.NoError(t, wait(fake.StopInstance(ctx, req.Ref())))
+	stopped, err := fake.HostKeys(ctx, req.Ref())
+	assert.NoError(t, err)
+	assert.Empty(t, stopped)
+	assert.NoError(t, wait(fake.StartInstance(ctx, req.Ref(), nil)))
+	restarted, _ := fake.HostKeys(ctx, req.Ref())
+	assert.Equal(t, keys, restarted)
+}
+
+func TestWriteGcloudKnownHosts_ssh(t *testing.T) {
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("ssh not found")
+	}
+	// a server that only gets as far as refusing to authenticate the client
+	_, hostKey, _ := ed25519.GenerateKey(rand.Reader)
+	signer, _ := ssh.NewSignerFromKey(hostKey)
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, errors.New("unknown key")
+		},
+	}
+	config.AddHostKey(signer)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _, _, _ = ssh.NewServerConn(conn, config)
+			}()
+		}
+	}()
+	serverKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	otherSigner, _ := ssh.NewSignerFromKey(otherKey)
+	pinnedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(otherSigner.PublicKey())))
+
+	// gcloud trusted the server's key the first time it connected
+	file := filepath.Join(t.TempDir(), "google_compute_known_hosts")
+	if !assert.NoError(t, os.WriteFile(file, []byte("compute.42 ssh-ed25519 AAAA\ncompute.1234 "+serverKey+"\n"), 0o600)) {
+		return
+	}
+	// the options 'gcloud compute ssh --strict-host-key-checking=yes' passes to ssh
+	run := func() string {
+		out, _ := exec.Command("ssh", "-F", "/dev/null", "-o", "BatchMode=yes", "-o", "CheckHostIP=no",
+			"-o", "HostKeyAlias=compute.1234", "-o", "StrictHostKeyChecking=yes", "-o", "UserKnownHostsFile="+file,
+			"-p", strconv.Itoa(l.Addr().(*net.TCPAddr).Port), "me@127.0.0.1", "true").CombinedOutput()
+		return string(out)
+	}
+	assert.Contains(t, run(), "Permission denied")
+
+	// a host key that is not pinned is rejected
+	assert.NoError(t, gcp.WriteGcloudKnownHosts(file, compute.Instance{Id: 1234}, []string{pinnedKey}))
+	assert.Contains(t, run(), "Host key verification failed")
+
+	assert.NoError(t, gcp.WriteGcloudKnownHosts(file, compute.Instance{Id: 1234}, []string{serverKey}))
+	assert.Contains(t, run(), "Permission denied")
+	known, _ := os.ReadFile(file)
+	assert.Equal(t, "compute.42 ssh-ed25519 AAAA\ncompute.1234 "+serverKey+"\n", string(known))
+}
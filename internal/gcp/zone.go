@@ -0,0 +1,54 @@
+package gcp
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"sort"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// upZones returns the names of the zones in 'region' that are UP, sorted.
+func upZones(zones []*compute.Zone, region string) []string {
+	names := []string{}
+	for _, z := range zones {
+		if path.Base(z.Region) == region && z.Status == "UP" {
+			names = append(names, z.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ListZones returns the zones of a region from 'gcloud compute zones list'.
+func (g *Gcloud) ListZones(ctx context.Context, account, project, region string) ([]string, error) {
+	args := []string{"gcloud", "compute", "zones", "list"}
+	if account != "" {
+		args = append(args, "--account="+account)
+	}
+	args = append(args, "--project="+project, "--filter=region:"+region, "--format=json")
+
+	b, err := output(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	var zones []*compute.Zone
+	if err := json.Unmarshal(b, &zones); err != nil {
+		return nil, err
+	}
+	return upZones(zones, region), nil
+}
+
+// MoveInstance moves a stopped instance and its disks to another zone with
+// 'gcloud compute instances move'.
+func (g *Gcloud) MoveInstance(ctx context.Context, ref InstanceRef, zone string) error {
+	args := []string{"gcloud", "compute", "instances", "move", ref.Name}
+	args = append(args, ref.gcloudArgs()...)
+	args = append(args, "--destination-zone="+zone, "-q")
+	if g.DryRun != nil {
+		printDryRunCommand(g.DryRun, args)
+		return nil
+	}
+	return run(ctx, nil, g.Stdout, g.Stderr, args...)
+}
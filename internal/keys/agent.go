@@ -0,0 +1,269 @@
+package keys
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrNoAgent is returned by the agent client functions when no agent is running.
+var ErrNoAgent = errors.New("no agent is running")
+
+// agentTimeout limits how long a client waits for the agent to respond.
+const agentTimeout = 5 * time.Second
+
+// maxSocketPath is the longest unix socket path that works on all platforms,
+// sockaddr_un.sun_path is 104 bytes on macOS and the BSDs.
+const maxSocketPath = 100
+
+// errPeerCredUnsupported is returned by getPeerUID on platforms where the user
+// of a unix socket's peer cannot be checked.
+var errPeerCredUnsupported = errors.New("peer credentials are not supported")
+
+// AgentSocket returns the path of the unix socket of the agent that caches the
+// key for the config file 'configFile'. The socket is next to the config file,
+// or in the user's socket directory if that path is too long for a socket, see
+// agentSocketDir.
+func AgentSocket(configFile string) string {
+	socket := configFile + ".agent.sock"
+	if len(socket) <= maxSocketPath {
+		return socket
+	}
+	sum := sha256.Sum256([]byte(configFile))
+	return filepath.Join(agentSocketDir(), fmt.Sprintf("gmachine-%x.sock", sum[:8]))
+}
+
+// agentSocketDir returns the directory of agent sockets that do not fit next to
+// their config file: 'gmachine' in $XDG_RUNTIME_DIR, or else 'gmachine-UID' in
+// the temp dir. Only the user can access it.
+func agentSocketDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "gmachine")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("gmachine-%d", os.Getuid()))
+}
+
+// checkSocketDir returns an error unless the directory of 'socket' is owned by
+// the user and other users cannot write to it, so that they cannot replace the
+// socket. Other users cannot access agentSocketDir at all, it is created with
+// 'create' if it does not exist.
+func checkSocketDir(socket string, create bool) error {
+	dir := filepath.Dir(socket)
+	others := fs.FileMode(0o022)
+	if dir == agentSocketDir() {
+		others = 0o077
+		if create {
+			if err := os.Mkdir(dir, 0o700); err != nil && !errors.Is(err, fs.ErrExist) {
+				return err
+			}
+		}
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !fi.IsDir() || !ok || int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("agent socket directory %s is not a directory owned by the current user", dir)
+	}
+	if fi.Mode().Perm()&others != 0 {
+		return fmt.Errorf("agent socket directory %s is accessible by other users (%s)", dir, fi.Mode().Perm())
+	}
+	return nil
+}
+
+// checkPeer returns an error unless the process on the other end of the unix
+// socket connection runs as the current user.
+func checkPeer(conn net.Conn) error {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return errors.New("not a unix socket connection")
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	uid := -1
+	var uidErr error
+	if err := raw.Control(func(fd uintptr) { uid, uidErr = getPeerUID(int(fd)) }); err != nil {
+		return err
+	}
+	if errors.Is(uidErr, errPeerCredUnsupported) {
+		return nil
+	}
+	if uidErr != nil {
+		return fmt.Errorf("error getting the agent socket's peer: %w", uidErr)
+	}
+	if uid != os.Getuid() {
+		return fmt.Errorf("the agent socket's peer runs as another user (uid %d)", uid)
+	}
+	return nil
+}
+
+type agentRequest struct {
+	Op  string        `json:"op"` // get, set or forget
+	Key []byte        `json:"key,omitempty"`
+	TTL time.Duration `json:"ttl,omitempty"`
+}
+
+type agentResponse struct {
+	Key   []byte `json:"key,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// agent holds a key in memory until it expires.
+type agent struct {
+	mu     sync.Mutex
+	key    []byte
+	timer  *time.Timer
+	cancel context.CancelFunc
+}
+
+// ServeAgent caches 'key' in memory and serves it to gmachine commands on the
+// unix socket 'socket', like ssh-agent. It returns when the key expires after
+// 'ttl', is forgotten with AgentForget, or ctx is canceled.
+//
+// The socket is created with a 077 umask so that only the current user can
+// connect to it, in a directory that other users cannot write to, and
+// connections from other users are refused.
+func ServeAgent(ctx context.Context, socket string, key []byte, ttl time.Duration) error {
+	if err := checkSocketDir(socket, true); err != nil {
+		return err
+	}
+	// remove a socket left behind by an agent that did not exit cleanly
+	if _, err := AgentKey(socket); errors.Is(err, ErrNoAgent) {
+		os.Remove(socket)
+	}
+
+	old := unix.Umask(0o077)
+	ln, err := net.Listen("unix", socket)
+	unix.Umask(old)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	a := &agent{key: key, timer: time.AfterFunc(ttl, cancel), cancel: cancel}
+	defer a.forget()
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go a.handle(conn)
+	}
+}
+
+func (a *agent) handle(conn net.Conn) {
+	defer conn.Close()
+	if err := checkPeer(conn); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Now().Add(agentTimeout))
+
+	var req agentRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		return
+	}
+
+	var resp agentResponse
+	a.mu.Lock()
+	switch req.Op {
+	case "get":
+		resp.Key = append([]byte(nil), a.key...)
+	case "set":
+		a.key = req.Key
+		a.timer.Reset(req.TTL)
+	case "forget":
+		defer a.cancel()
+	default:
+		resp.Error = fmt.Sprintf("unknown request '%s'", req.Op)
+	}
+	a.mu.Unlock()
+
+	json.NewEncoder(conn).Encode(resp)
+}
+
+// forget overwrites the key in memory.
+func (a *agent) forget() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i := range a.key {
+		a.key[i] = 0
+	}
+	a.key = nil
+}
+
+// AgentKey returns the key cached by the agent listening on 'socket'.
+func AgentKey(socket string) ([]byte, error) {
+	resp, err := agentCall(socket, agentRequest{Op: "get"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Key, nil
+}
+
+// AgentSetKey replaces the key cached by the agent listening on 'socket'. It
+// expires after 'ttl'.
+func AgentSetKey(socket string, key []byte, ttl time.Duration) error {
+	_, err := agentCall(socket, agentRequest{Op: "set", Key: key, TTL: ttl})
+	return err
+}
+
+// AgentForget makes the agent listening on 'socket' forget its key and exit.
+func AgentForget(socket string) error {
+	_, err := agentCall(socket, agentRequest{Op: "forget"})
+	return err
+}
+
+func agentCall(socket string, req agentRequest) (agentResponse, error) {
+	var resp agentResponse
+	if err := checkSocketDir(socket, false); errors.Is(err, fs.ErrNotExist) {
+		return resp, fmt.Errorf("%w: %w", ErrNoAgent, err)
+	} else if err != nil {
+		return resp, err
+	}
+	conn, err := net.DialTimeout("unix", socket, agentTimeout)
+	if err != nil {
+		return resp, fmt.Errorf("%w: %w", ErrNoAgent, err)
+	}
+	defer conn.Close()
+	// the key is only sent to, or taken from, an agent of the current user
+	if err := checkPeer(conn); err != nil {
+		return resp, err
+	}
+	conn.SetDeadline(time.Now().Add(agentTimeout))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return resp, err
+	}
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return resp, fmt.Errorf("error reading agent response: %w", err)
+	}
+	if resp.Error != "" {
+		return resp, errors.New(resp.Error)
+	}
+	return resp, nil
+}
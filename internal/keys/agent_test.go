@@ -0,0 +1,120 @@
+package keys_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/joemiller/gmachine/internal/keys"
+	"github.com/stretchr/testify/assert"
+)
+
+// startAgent serves 'key' on a socket in a temp dir and returns the socket and a
+// channel that receives ServeAgent's error when it returns.
+func startAgent(t *testing.T, key []byte, ttl time.Duration) (string, chan error) {
+	// not t.TempDir(), its path can be too long for a unix socket
+	dir, err := os.MkdirTemp("", "agent")
+	assert.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "agent.sock")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	done := make(chan error, 1)
+	go func() { done <- keys.ServeAgent(ctx, socket, key, ttl) }()
+
+	assert.Eventually(t, func() bool {
+		_, err := keys.AgentKey(socket)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	return socket, done
+}
+
+func TestAgent(t *testing.T) {
+	socket, done := startAgent(t, []byte("key1"), time.Minute)
+
+	fi, err := os.Stat(socket)
+	assert.NoError(t, err)
+	assert.Zero(t, fi.Mode().Perm()&0o077, "only the owner can connect")
+
+	key, err := keys.AgentKey(socket)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("key1"), key)
+
+	assert.NoError(t, keys.AgentSetKey(socket, []byte("key2"), time.Minute))
+	key, err = keys.AgentKey(socket)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("key2"), key)
+
+	// forgetting the key stops the agent
+	assert.NoError(t, keys.AgentForget(socket))
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not exit")
+	}
+	_, err = keys.AgentKey(socket)
+	assert.ErrorIs(t, err, keys.ErrNoAgent)
+	assert.NoFileExists(t, socket)
+}
+
+func TestAgent_expires(t *testing.T) {
+	socket, done := startAgent(t, []byte("key1"), 200*time.Millisecond)
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not exit")
+	}
+	_, err := keys.AgentKey(socket)
+	assert.ErrorIs(t, err, keys.ErrNoAgent)
+}
+
+func TestAgentSocket(t *testing.T) {
+	assert.Equal(t, "/home/me/.config/gmachine/gmachine.yaml.agent.sock", keys.AgentSocket("/home/me/.config/gmachine/gmachine.yaml"))
+
+	// too long for a socket, it is in the user's socket directory instead
+	long := "/" + string(make([]byte, 200)) + "/gmachine.yaml"
+	t.Setenv("XDG_RUNTIME_DIR", "")
+	socket := keys.AgentSocket(long)
+	assert.Equal(t, filepath.Join(os.TempDir(), fmt.Sprintf("gmachine-%d", os.Getuid())), filepath.Dir(socket))
+	assert.Equal(t, socket, keys.AgentSocket(long))
+	t.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
+	assert.Equal(t, "/run/user/1000/gmachine", filepath.Dir(keys.AgentSocket(long)))
+}
+
+func TestAgent_socketDir(t *testing.T) {
+	// not t.TempDir(), its path can be too long for a unix socket
+	runtime, err := os.MkdirTemp("", "agent")
+	assert.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(runtime) })
+	t.Setenv("XDG_RUNTIME_DIR", runtime)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the user's socket directory is created so that only they can access it
+	socket := keys.AgentSocket("/" + string(make([]byte, 200)) + "/gmachine.yaml")
+	go keys.ServeAgent(ctx, socket, []byte("key1"), time.Minute)
+	assert.Eventually(t, func() bool {
+		key, err := keys.AgentKey(socket)
+		return err == nil && string(key) == "key1"
+	}, 5*time.Second, 10*time.Millisecond)
+	fi, err := os.Stat(filepath.Dir(socket))
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0o700), fi.Mode().Perm())
+	}
+
+	// other users could replace the socket
+	assert.NoError(t, os.Chmod(filepath.Dir(socket), 0o755))
+	_, err = keys.AgentKey(socket)
+	assert.ErrorContains(t, err, "accessible by other users")
+	shared := filepath.Join(runtime, "shared")
+	assert.NoError(t, os.Mkdir(shared, 0o777))
+	assert.NoError(t, os.Chmod(shared, 0o777))
+	assert.ErrorContains(t, keys.ServeAgent(ctx, filepath.Join(shared, "agent.sock"), []byte("key1"), time.Minute), "accessible by other users")
+}
@@ -0,0 +1,113 @@
+// Package keys encrypts CSEK keys at rest with a key derived from a passphrase,
+// prompts for passphrases and caches the derived key in an agent process so that
+// the passphrase is not needed for every command.
+package keys
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// KeySize is the size of the keys used with Seal and Open, AES-256.
+const KeySize = 32
+
+// KDFScrypt is the only supported key derivation function.
+const KDFScrypt = "scrypt"
+
+// ErrDecrypt is returned when data cannot be decrypted, usually because the
+// passphrase is wrong.
+var ErrDecrypt = errors.New("decryption failed, wrong passphrase or key")
+
+// KDFParams are the parameters used to derive a key from a passphrase. They are
+// stored with the encrypted data, the salt is not secret.
+type KDFParams struct {
+	KDF  string `yaml:"kdf"`
+	N    int    `yaml:"cost"`        // scrypt N
+	R    int    `yaml:"block_size"`  // scrypt r
+	P    int    `yaml:"parallelism"` // scrypt p
+	Salt string `yaml:"salt"`        // base64
+}
+
+// NewKDFParams returns scrypt parameters with a new random salt. The cost
+// parameters are the ones recommended for interactive logins in the scrypt docs.
+func NewKDFParams() (KDFParams, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return KDFParams{}, err
+	}
+	return KDFParams{KDF: KDFScrypt, N: 1 << 15, R: 8, P: 1, Salt: base64.StdEncoding.EncodeToString(salt)}, nil
+}
+
+// DeriveKey derives a KeySize key from 'passphrase'.
+func (p KDFParams) DeriveKey(passphrase []byte) ([]byte, error) {
+	if p.KDF != KDFScrypt {
+		return nil, fmt.Errorf("unsupported key derivation function '%s'", p.KDF)
+	}
+	salt, err := base64.StdEncoding.DecodeString(p.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid salt: %w", err)
+	}
+	return scrypt.Key(passphrase, salt, p.N, p.R, p.P, KeySize)
+}
+
+// NewKey returns a new random KeySize key.
+func NewKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Seal encrypts and authenticates 'plaintext' with AES-GCM and returns the nonce
+// and ciphertext, base64 encoded. 'aad' is authenticated but not encrypted, it
+// binds the ciphertext to its context, eg: the URI of the disk a CSEK key is for,
+// and must be passed to Open unchanged.
+func Seal(key, plaintext, aad []byte) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, plaintext, aad)), nil
+}
+
+// Open decrypts 'sealed' from Seal.
+func Open(key []byte, sealed string, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	b, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encrypted data: %w", err)
+	}
+	if len(b) < gcm.NonceSize() {
+		return nil, errors.New("invalid encrypted data: too short")
+	}
+	plaintext, err := gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], aad)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("invalid key size %d, must be %d", len(key), KeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
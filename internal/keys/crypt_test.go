@@ -0,0 +1,69 @@
+package keys_test
+
+import (
+	"testing"
+
+	"github.com/joemiller/gmachine/internal/keys"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSealOpen(t *testing.T) {
+	key, err := keys.NewKey()
+	assert.NoError(t, err)
+
+	sealed, err := keys.Seal(key, []byte("secret"), []byte("disk-uri"))
+	assert.NoError(t, err)
+	assert.NotContains(t, sealed, "secret")
+
+	plaintext, err := keys.Open(key, sealed, []byte("disk-uri"))
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", string(plaintext))
+
+	// the same plaintext encrypts differently each time
+	sealed2, err := keys.Seal(key, []byte("secret"), []byte("disk-uri"))
+	assert.NoError(t, err)
+	assert.NotEqual(t, sealed, sealed2)
+
+	// wrong key
+	other, _ := keys.NewKey()
+	_, err = keys.Open(other, sealed, []byte("disk-uri"))
+	assert.ErrorIs(t, err, keys.ErrDecrypt)
+
+	// wrong aad, eg: a key moved to another disk
+	_, err = keys.Open(key, sealed, []byte("other-disk-uri"))
+	assert.ErrorIs(t, err, keys.ErrDecrypt)
+
+	// corrupt
+	_, err = keys.Open(key, "AAAA", nil)
+	assert.Error(t, err)
+	_, err = keys.Seal([]byte("short"), []byte("secret"), nil)
+	assert.Error(t, err)
+}
+
+func TestDeriveKey(t *testing.T) {
+	params, err := keys.NewKDFParams()
+	assert.NoError(t, err)
+	params.N = 1 << 10 // fast
+
+	k1, err := params.DeriveKey([]byte("passphrase"))
+	assert.NoError(t, err)
+	assert.Len(t, k1, keys.KeySize)
+	k2, err := params.DeriveKey([]byte("passphrase"))
+	assert.NoError(t, err)
+	assert.Equal(t, k1, k2)
+	k3, err := params.DeriveKey([]byte("other passphrase"))
+	assert.NoError(t, err)
+	assert.NotEqual(t, k1, k3)
+
+	// a new salt derives a different key
+	params2, err := keys.NewKDFParams()
+	assert.NoError(t, err)
+	params2.N = params.N
+	k4, err := params2.DeriveKey([]byte("passphrase"))
+	assert.NoError(t, err)
+	assert.NotEqual(t, k1, k4)
+
+	params.KDF = "rot13"
+	_, err = params.DeriveKey([]byte("passphrase"))
+	assert.Error(t, err)
+}
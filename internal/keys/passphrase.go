@@ -0,0 +1,88 @@
+package keys
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Prompter reads passphrases. When In is a terminal the passphrase is read
+// without echoing it, otherwise a line is read from In, eg: for scripts.
+type Prompter struct {
+	In  *os.File
+	Out io.Writer // prompts are written here, usually stderr
+
+	r *bufio.Reader
+}
+
+// NewPrompter returns a Prompter that reads from 'in' and prompts on 'out'.
+func NewPrompter(in *os.File, out io.Writer) *Prompter {
+	return &Prompter{In: in, Out: out}
+}
+
+// Passphrase prompts for a passphrase with 'prompt'.
+func (p *Prompter) Passphrase(prompt string) ([]byte, error) {
+	fmt.Fprint(p.Out, prompt)
+
+	// end the prompt's line, the passphrase is not echoed
+	defer fmt.Fprintln(p.Out)
+
+	fd := int(p.In.Fd())
+	termios, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	if err != nil {
+		// not a terminal
+		return p.readLine()
+	}
+
+	noEcho := *termios
+	noEcho.Lflag &^= unix.ECHO
+	noEcho.Lflag |= unix.ICANON | unix.ISIG
+	if err := unix.IoctlSetTermios(fd, ioctlSetTermios, &noEcho); err != nil {
+		return nil, err
+	}
+	defer unix.IoctlSetTermios(fd, ioctlSetTermios, termios)
+	return p.readLine()
+}
+
+// NewPassphrase prompts for a new passphrase with 'prompt'. On a terminal it is
+// entered twice to catch typos.
+func (p *Prompter) NewPassphrase(prompt string) ([]byte, error) {
+	passphrase, err := p.Passphrase(prompt)
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("the passphrase must not be empty")
+	}
+	if _, err := unix.IoctlGetTermios(int(p.In.Fd()), ioctlGetTermios); err != nil {
+		return passphrase, nil
+	}
+
+	confirm, err := p.Passphrase("Enter the same passphrase again: ")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(passphrase, confirm) {
+		return nil, errors.New("the passphrases do not match")
+	}
+	return passphrase, nil
+}
+
+func (p *Prompter) readLine() ([]byte, error) {
+	if p.r == nil {
+		p.r = bufio.NewReader(p.In)
+	}
+	line, err := p.r.ReadBytes('\n')
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		if err == io.EOF {
+			return nil, errors.New("no passphrase entered")
+		}
+		return nil, err
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
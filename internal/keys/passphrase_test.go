@@ -0,0 +1,35 @@
+package keys_test
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/joemiller/gmachine/internal/keys"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrompter_not_a_terminal(t *testing.T) {
+	r, w, err := os.Pipe()
+	assert.NoError(t, err)
+	defer r.Close()
+	_, err = w.WriteString("first passphrase\nsecond passphrase\r\n")
+	assert.NoError(t, err)
+	w.Close()
+
+	var out bytes.Buffer
+	p := keys.NewPrompter(r, &out)
+
+	passphrase, err := p.Passphrase("Passphrase: ")
+	assert.NoError(t, err)
+	assert.Equal(t, "first passphrase", string(passphrase))
+	assert.Equal(t, "Passphrase: \n", out.String())
+
+	// a new passphrase is not confirmed when it is not typed
+	passphrase, err = p.NewPassphrase("New passphrase: ")
+	assert.NoError(t, err)
+	assert.Equal(t, "second passphrase", string(passphrase))
+
+	_, err = p.Passphrase("Passphrase: ")
+	assert.ErrorContains(t, err, "no passphrase entered")
+}
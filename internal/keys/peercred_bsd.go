@@ -0,0 +1,15 @@
+//go:build darwin || freebsd
+
+package keys
+
+import "golang.org/x/sys/unix"
+
+// getPeerUID returns the user ID of the process on the other end of the unix
+// socket 'fd'.
+func getPeerUID(fd int) (int, error) {
+	cred, err := unix.GetsockoptXucred(fd, unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+	if err != nil {
+		return -1, err
+	}
+	return int(cred.Uid), nil
+}
@@ -0,0 +1,10 @@
+//go:build dragonfly || netbsd || openbsd
+
+package keys
+
+// getPeerUID returns errPeerCredUnsupported, x/sys/unix has no way to get the
+// credentials of a unix socket's peer on these platforms. Only the socket's
+// directory is checked, see checkSocketDir.
+func getPeerUID(int) (int, error) {
+	return -1, errPeerCredUnsupported
+}
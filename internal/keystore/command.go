@@ -0,0 +1,53 @@
+package keystore
+
+import (
+	"context"
+	"strings"
+)
+
+// Command stores keys with an external command, eg: a wrapper around a company
+// secrets manager. The command is run with these arguments appended:
+//
+//	get REF      print the key for REF to stdout, or exit with status 2 if there
+//	             is no key for REF
+//	set REF      store the key read from stdin for REF
+//	delete REF   delete the key for REF, if there is one
+//
+// Any other non-zero exit status is an error.
+type Command struct {
+	Argv []string
+}
+
+// NewCommand returns a Store that runs 'argv'.
+func NewCommand(argv []string) *Command {
+	return &Command{Argv: argv}
+}
+
+// exitNotFound is the exit status of 'get' when there is no key.
+const exitNotFound = 2
+
+func (c *Command) run(ctx context.Context, stdin string, args ...string) ([]byte, error) {
+	argv := append(append([]string{}, c.Argv[1:]...), args...)
+	return run(ctx, stdin, c.Argv[0], argv...)
+}
+
+func (c *Command) Get(ctx context.Context, ref string) (string, error) {
+	out, err := c.run(ctx, "", "get", ref)
+	if exitCode(err) == exitNotFound {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (c *Command) Set(ctx context.Context, ref, key string) error {
+	_, err := c.run(ctx, key, "set", ref)
+	return err
+}
+
+func (c *Command) Delete(ctx context.Context, ref string) error {
+	_, err := c.run(ctx, "", "delete", ref)
+	return err
+}
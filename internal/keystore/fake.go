@@ -0,0 +1,82 @@
+package keystore
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// Fake is a Store for testing that keeps keys in memory, and in the JSON file
+// Path if it is set so that they are shared between gmachine commands.
+type Fake struct {
+	Path string
+
+	mu   sync.Mutex
+	keys map[string]string
+}
+
+// NewFake returns a fake Store. 'path' may be empty to only keep keys in memory.
+func NewFake(path string) *Fake {
+	return &Fake{Path: path, keys: map[string]string{}}
+}
+
+// load reads the keys from Path.
+func (f *Fake) load() error {
+	if f.Path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &f.keys)
+}
+
+// save writes the keys to Path.
+func (f *Fake) save() error {
+	if f.Path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(f.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(f.Path, data, 0o600)
+}
+
+func (f *Fake) Get(_ context.Context, ref string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.load(); err != nil {
+		return "", err
+	}
+	key, ok := f.keys[ref]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return key, nil
+}
+
+func (f *Fake) Set(_ context.Context, ref, key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.load(); err != nil {
+		return err
+	}
+	f.keys[ref] = key
+	return f.save()
+}
+
+func (f *Fake) Delete(_ context.Context, ref string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.load(); err != nil {
+		return err
+	}
+	delete(f.keys, ref)
+	return f.save()
+}
@@ -0,0 +1,83 @@
+package keystore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/joemiller/gmachine/internal/fileutil"
+)
+
+// File stores keys in a JSON vault file that only the current user can read,
+// eg: on an encrypted or removable volume, so that the config file can be shared
+// or synced without the keys.
+type File struct {
+	Path string
+}
+
+// NewFile returns a Store that uses the vault file 'path'.
+func NewFile(path string) *File {
+	return &File{Path: path}
+}
+
+// read returns the keys in the vault, or no keys if it does not exist yet. The
+// file is replaced atomically so it can be read without the lock.
+func (f *File) read() (map[string]string, error) {
+	keys := map[string]string{}
+	data, err := os.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return keys, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("error parsing key vault %s: %w", f.Path, err)
+	}
+	return keys, nil
+}
+
+// update applies 'fn' to the keys in the vault with the vault locked.
+func (f *File) update(fn func(map[string]string)) error {
+	if err := os.MkdirAll(filepath.Dir(f.Path), 0o700); err != nil {
+		return err
+	}
+	unlock, err := fileutil.Lock(f.Path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	keys, err := f.read()
+	if err != nil {
+		return err
+	}
+	fn(keys)
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteFileAtomic(f.Path, data, 0o600)
+}
+
+func (f *File) Get(_ context.Context, ref string) (string, error) {
+	keys, err := f.read()
+	if err != nil {
+		return "", err
+	}
+	key, ok := keys[ref]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return key, nil
+}
+
+func (f *File) Set(_ context.Context, ref, key string) error {
+	return f.update(func(keys map[string]string) { keys[ref] = key })
+}
+
+func (f *File) Delete(_ context.Context, ref string) error {
+	return f.update(func(keys map[string]string) { delete(keys, ref) })
+}
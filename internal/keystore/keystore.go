@@ -0,0 +1,180 @@
+// Package keystore stores CSEK keys in a secret store outside of the config
+// file, eg: the Linux Secret Service or pass(1). The config file only holds a
+// reference to each key.
+package keystore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+// ErrNotFound is returned by Store.Get when the store does not have the key.
+var ErrNotFound = errors.New("key not found in key store")
+
+// Store is a secret store for CSEK keys. Keys are identified by a reference, see
+// Ref.
+type Store interface {
+	// Get returns the key for 'ref', or ErrNotFound.
+	Get(ctx context.Context, ref string) (string, error)
+	// Set stores 'key' for 'ref', replacing any existing key.
+	Set(ctx context.Context, ref, key string) error
+	// Delete removes the key for 'ref'. Deleting a key that does not exist is not
+	// an error.
+	Delete(ctx context.Context, ref string) error
+}
+
+// Types of Store, see Settings.Type.
+const (
+	TypeKeyring = "keyring"
+	TypePass    = "pass"
+	TypeFile    = "file"
+	TypeCommand = "command"
+	TypeFake    = "fake"
+)
+
+// Types lists the supported types of Store.
+var Types = []string{TypeKeyring, TypePass, TypeFile, TypeCommand, TypeFake}
+
+// Settings select and configure a Store, they are stored in the config file's
+// 'key_store' section.
+type Settings struct {
+	Type string `yaml:"type"`
+	// Path is the vault file for the 'file' and 'fake' stores, and the folder in
+	// the password store for 'pass'.
+	Path string `yaml:"path,omitempty"`
+	// Command is the command for the 'command' store, see NewCommand.
+	Command []string `yaml:"command,omitempty"`
+}
+
+// resolve returns the settings with defaults applied. Relative paths, and the
+// default paths of the file based stores, are relative to 'dir'.
+func (s Settings) resolve(dir string) (Settings, error) {
+	var err error
+	if s.Path, err = homedir.Expand(s.Path); err != nil {
+		return s, err
+	}
+	switch s.Type {
+	case TypeFile, TypeFake:
+		if s.Path == "" {
+			s.Path = map[string]string{TypeFile: "gmachine-keys.json", TypeFake: "fake-keystore.json"}[s.Type]
+		}
+		if !filepath.IsAbs(s.Path) {
+			s.Path = filepath.Join(dir, s.Path)
+		}
+	case TypePass:
+		if s.Path == "" {
+			s.Path = "gmachine"
+		}
+	}
+	return s, nil
+}
+
+// Same returns true if 'a' and 'b' refer to the same store. Nil settings, the
+// config file, are only the same as nil.
+func Same(a, b *Settings, dir string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	ra, errA := a.resolve(dir)
+	rb, errB := b.resolve(dir)
+	return errA == nil && errB == nil && reflect.DeepEqual(ra, rb)
+}
+
+// New returns the Store for 'settings'. Relative paths, and the default paths of
+// the file based stores, are relative to 'dir', usually the config file's
+// directory.
+func New(settings Settings, dir string) (Store, error) {
+	settings, err := settings.resolve(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	switch settings.Type {
+	case TypeKeyring:
+		return NewSecretService(), nil
+	case TypePass:
+		return NewPass(settings.Path), nil
+	case TypeFile:
+		return NewFile(settings.Path), nil
+	case TypeCommand:
+		if len(settings.Command) == 0 {
+			return nil, errors.New("the 'command' key store requires a command")
+		}
+		return NewCommand(settings.Command), nil
+	case TypeFake:
+		return NewFake(settings.Path), nil
+	}
+	return nil, fmt.Errorf("unknown key store '%s', must be one of: %s", settings.Type, strings.Join(Types, ", "))
+}
+
+// Ref returns the reference for the key of the resource 'uri', eg:
+// "projects/my-proj/zones/us-west1-a/disks/foo" for a disk.
+func Ref(uri string) string {
+	if i := strings.Index(uri, "/projects/"); i >= 0 {
+		return uri[i+1:]
+	}
+	return uri
+}
+
+// commandError is returned by run when a store's command fails.
+type commandError struct {
+	name   string
+	stderr string
+	err    *exec.ExitError
+}
+
+func (e *commandError) Error() string {
+	if e.stderr == "" {
+		return fmt.Sprintf("%s: %s", e.name, e.err)
+	}
+	return fmt.Sprintf("%s: %s (%s)", e.name, e.stderr, e.err)
+}
+
+func (e *commandError) Unwrap() error {
+	return e.err
+}
+
+// run runs a store's command with 'stdin' and returns its stdout. If the command
+// exits with an error, the error is a *commandError that includes its stderr.
+func run(ctx context.Context, stdin string, name string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	start := time.Now()
+	err := cmd.Run()
+	// the args are references, never keys
+	slog.DebugContext(ctx, "exec", "args", append([]string{name}, args...), "duration", time.Since(start), "error", err)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, context.Cause(ctx)
+		}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, &commandError{name: name, stderr: strings.TrimSpace(stderr.String()), err: exitErr}
+		}
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// exitCode returns the exit code of a command that failed, or -1.
+func exitCode(err error) int {
+	var cmdErr *commandError
+	if errors.As(err, &cmdErr) {
+		return cmdErr.err.ExitCode()
+	}
+	return -1
+}
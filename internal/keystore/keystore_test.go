@@ -0,0 +1,150 @@
+package keystore_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/joemiller/gmachine/internal/keystore"
+	"github.com/stretchr/testify/assert"
+)
+
+const testRef = "projects/my-proj/zones/us-west1-a/disks/foo"
+
+// script writes an executable shell script to a temp dir and returns its path.
+// The scripts store each key in a file named after the last argument in $DIR.
+func script(t *testing.T, body string) string {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "store")
+	err := os.WriteFile(path, []byte("#!/bin/sh\nDIR="+dir+"\nf=\"$DIR/$(eval echo \\${$#} | tr / _)\"\n"+body), 0o700)
+	assert.NoError(t, err)
+	return path
+}
+
+// testStore checks the Store contract: Get of a missing key is ErrNotFound, Set
+// replaces keys, and Delete is idempotent.
+func testStore(t *testing.T, store keystore.Store) {
+	ctx := context.Background()
+
+	_, err := store.Get(ctx, testRef)
+	assert.ErrorIs(t, err, keystore.ErrNotFound)
+
+	assert.NoError(t, store.Set(ctx, testRef, "a2V5MQ=="))
+	assert.NoError(t, store.Set(ctx, testRef, "a2V5Mg=="))
+	key, err := store.Get(ctx, testRef)
+	assert.NoError(t, err)
+	assert.Equal(t, "a2V5Mg==", key)
+
+	assert.NoError(t, store.Delete(ctx, testRef))
+	_, err = store.Get(ctx, testRef)
+	assert.ErrorIs(t, err, keystore.ErrNotFound)
+	assert.NoError(t, store.Delete(ctx, testRef))
+}
+
+func TestFake(t *testing.T) {
+	testStore(t, keystore.NewFake(""))
+
+	// keys are shared through the file
+	path := filepath.Join(t.TempDir(), "fake.json")
+	assert.NoError(t, keystore.NewFake(path).Set(context.Background(), testRef, "a2V5"))
+	key, err := keystore.NewFake(path).Get(context.Background(), testRef)
+	assert.NoError(t, err)
+	assert.Equal(t, "a2V5", key)
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault", "keys.json")
+	testStore(t, keystore.NewFile(path))
+
+	info, err := os.Stat(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	}
+}
+
+func TestCommand(t *testing.T) {
+	cmd := script(t, `
+case "$2" in
+get) [ -f "$f" ] || exit 2; cat "$f" ;;
+set) cat > "$f" ;;
+delete) rm -f "$f" ;;
+*) echo "unexpected: $*" >&2; exit 1 ;;
+esac
+`)
+	testStore(t, keystore.NewCommand([]string{cmd, "--profile"}))
+
+	// other failures are errors that include stderr
+	err := keystore.NewCommand([]string{cmd, "--profile", "bogus"}).Set(context.Background(), testRef, "a2V5")
+	assert.ErrorContains(t, err, "unexpected: --profile bogus set "+testRef)
+}
+
+func TestPass(t *testing.T) {
+	pass := keystore.NewPass("")
+	pass.Command = script(t, `
+case "$1" in
+show) [ -f "$f" ] || { echo "Error: $3 is not in the password store." >&2; exit 1; }; cat "$f"; echo "notes" ;;
+insert) [ "$4" = gmachine/`+testRef+` ] || exit 1; cat > "$f" ;;
+rm) [ -f "$f" ] || { echo "Error: $3 is not in the password store." >&2; exit 1; }; rm "$f" ;;
+esac
+`)
+	testStore(t, pass)
+}
+
+func TestSecretService(t *testing.T) {
+	ss := keystore.NewSecretService()
+	ss.Command = script(t, `
+case "$1" in
+lookup) [ -f "$f" ] || exit 1; cat "$f" ;;
+store) [ "$2 $3" = "--label gmachine CSEK key `+testRef+`" ] || exit 3; cat > "$f" ;;
+clear) [ -f "$f" ] || exit 1; rm "$f" ;;
+esac
+`)
+	testStore(t, ss)
+
+	// a failure with an error message is not a missing secret
+	ss.Command = script(t, `echo "Cannot autolaunch D-Bus without X11 \$DISPLAY" >&2; exit 1`)
+	_, err := ss.Get(context.Background(), testRef)
+	assert.ErrorContains(t, err, "Cannot autolaunch D-Bus")
+	assert.NotErrorIs(t, err, keystore.ErrNotFound)
+	assert.ErrorContains(t, ss.Delete(context.Background(), testRef), "Cannot autolaunch D-Bus")
+
+	ss.Command = "gmachine-test-no-such-secret-tool"
+	assert.ErrorContains(t, ss.Delete(context.Background(), testRef), "needs secret-tool(1) from libsecret")
+}
+
+func TestNew(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := keystore.New(keystore.Settings{Type: keystore.TypeFile}, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "gmachine-keys.json"), store.(*keystore.File).Path)
+
+	store, err = keystore.New(keystore.Settings{Type: keystore.TypeFake, Path: "keys/fake.json"}, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "keys/fake.json"), store.(*keystore.Fake).Path)
+
+	store, err = keystore.New(keystore.Settings{Type: keystore.TypePass}, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, "gmachine", store.(*keystore.Pass).Prefix)
+
+	_, err = keystore.New(keystore.Settings{Type: keystore.TypeCommand}, dir)
+	assert.ErrorContains(t, err, "requires a command")
+
+	_, err = keystore.New(keystore.Settings{Type: "vault"}, dir)
+	assert.ErrorContains(t, err, "unknown key store 'vault'")
+}
+
+func TestSame(t *testing.T) {
+	dir := t.TempDir()
+	assert.True(t, keystore.Same(nil, nil, dir))
+	assert.False(t, keystore.Same(nil, &keystore.Settings{Type: keystore.TypeKeyring}, dir))
+	assert.True(t, keystore.Same(&keystore.Settings{Type: keystore.TypePass}, &keystore.Settings{Type: keystore.TypePass, Path: "gmachine"}, dir))
+	assert.True(t, keystore.Same(&keystore.Settings{Type: keystore.TypeFile}, &keystore.Settings{Type: keystore.TypeFile, Path: filepath.Join(dir, "gmachine-keys.json")}, dir))
+	assert.False(t, keystore.Same(&keystore.Settings{Type: keystore.TypeFile}, &keystore.Settings{Type: keystore.TypeFake}, dir))
+}
+
+func TestRef(t *testing.T) {
+	assert.Equal(t, testRef, keystore.Ref("https://www.googleapis.com/compute/v1/"+testRef))
+	assert.Equal(t, "foo", keystore.Ref("foo"))
+}
@@ -0,0 +1,61 @@
+package keystore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path"
+	"strings"
+)
+
+// Pass stores keys in pass(1), the standard unix password manager, in the folder
+// Prefix of the password store.
+type Pass struct {
+	Prefix string
+	// Command is the pass command, for tests.
+	Command string
+}
+
+// NewPass returns a Store that uses pass. 'prefix' defaults to "gmachine".
+func NewPass(prefix string) *Pass {
+	if prefix == "" {
+		prefix = "gmachine"
+	}
+	return &Pass{Prefix: prefix, Command: "pass"}
+}
+
+func (p *Pass) name(ref string) string {
+	return path.Join(p.Prefix, ref)
+}
+
+// isNotInStore returns true if pass failed because the entry does not exist.
+func isNotInStore(err error) bool {
+	var cmdErr *commandError
+	return errors.As(err, &cmdErr) && strings.Contains(cmdErr.stderr, "is not in the password store")
+}
+
+func (p *Pass) Get(ctx context.Context, ref string) (string, error) {
+	out, err := run(ctx, "", p.Command, "show", p.name(ref))
+	if isNotInStore(err) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	// the password is the first line, the rest is notes
+	line, _, _ := bytes.Cut(out, []byte("\n"))
+	return string(line), nil
+}
+
+func (p *Pass) Set(ctx context.Context, ref, key string) error {
+	_, err := run(ctx, key+"\n", p.Command, "insert", "--multiline", "--force", p.name(ref))
+	return err
+}
+
+func (p *Pass) Delete(ctx context.Context, ref string) error {
+	_, err := run(ctx, "", p.Command, "rm", "--force", p.name(ref))
+	if isNotInStore(err) {
+		return nil
+	}
+	return err
+}
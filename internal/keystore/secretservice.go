@@ -0,0 +1,68 @@
+package keystore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// SecretService stores keys in the Linux Secret Service (eg: GNOME Keyring or
+// KWallet) over D-Bus using the secret-tool(1) command from libsecret.
+type SecretService struct {
+	// Command is the secret-tool command, for tests.
+	Command string
+}
+
+// NewSecretService returns a Store that uses the Secret Service.
+func NewSecretService() *SecretService {
+	return &SecretService{Command: "secret-tool"}
+}
+
+func (s *SecretService) run(ctx context.Context, stdin string, args ...string) ([]byte, error) {
+	out, err := run(ctx, stdin, s.Command, args...)
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil, fmt.Errorf("the keyring key store needs secret-tool(1) from libsecret, eg: the libsecret-tools package: %w", err)
+	}
+	return out, err
+}
+
+// isNoSecret returns true if secret-tool failed because there is no matching
+// secret: it exits with 1 and prints nothing. Other failures, eg: D-Bus not
+// being available, print an error.
+func isNoSecret(err error) bool {
+	var cmdErr *commandError
+	return errors.As(err, &cmdErr) && cmdErr.err.ExitCode() == 1 && cmdErr.stderr == ""
+}
+
+// attributes identify a key in the Secret Service.
+func (s *SecretService) attributes(ref string) []string {
+	return []string{"application", "gmachine", "ref", ref}
+}
+
+func (s *SecretService) Get(ctx context.Context, ref string) (string, error) {
+	out, err := s.run(ctx, "", append([]string{"lookup"}, s.attributes(ref)...)...)
+	if isNoSecret(err) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(out), "\n"), nil
+}
+
+func (s *SecretService) Set(ctx context.Context, ref, key string) error {
+	args := append([]string{"store", "--label", "gmachine CSEK key " + ref}, s.attributes(ref)...)
+	_, err := s.run(ctx, key, args...)
+	return err
+}
+
+func (s *SecretService) Delete(ctx context.Context, ref string) error {
+	_, err := s.run(ctx, "", append([]string{"clear"}, s.attributes(ref)...)...)
+	if isNoSecret(err) {
+		// nothing to clear
+		return nil
+	}
+	return err
+}
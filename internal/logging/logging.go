@@ -0,0 +1,54 @@
+// Package logging configures the log/slog logger used by gmachine. Packages log
+// with the default slog logger, eg: slog.DebugContext(ctx, ...), and cmd installs
+// the logger returned by New as the default.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Redacted replaces the values of secret attributes.
+const Redacted = "REDACTED"
+
+// secretKeys are attribute keys whose values are always redacted, regardless of
+// the value's type. Types that contain secrets, eg: gcp.CSEKBundle, should also
+// implement slog.LogValuer to redact themselves.
+var secretKeys = map[string]bool{
+	"key":               true,
+	"csek":              true,
+	"raw_key":           true,
+	"rawkey":            true,
+	"rsa_encrypted_key": true,
+	"rsaencryptedkey":   true,
+	"passphrase":        true,
+	"password":          true,
+	"token":             true,
+}
+
+// New returns a logger that writes to 'w' in 'format', either "text" or "json",
+// at 'level' and above. Secret attributes are redacted.
+func New(w io.Writer, format string, level slog.Leveler) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: redact,
+	}
+
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format '%s', must be one of: text, json", format)
+	}
+}
+
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if secretKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, Redacted)
+	}
+	return a
+}
@@ -0,0 +1,46 @@
+package logging_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/joemiller/gmachine/internal/gcp"
+	"github.com/joemiller/gmachine/internal/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew_json_redacted(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := logging.New(&buf, "json", slog.LevelDebug)
+	assert.NoError(t, err)
+
+	csek := gcp.CSEKBundle{{URI: "disk-uri", Key: "c2VjcmV0", KeyType: "raw"}}
+	logger.Debug("starting", "bundle", csek, "passphrase", "hunter2", "machine", "foo")
+
+	assert.NotContains(t, buf.String(), "c2VjcmV0")
+	assert.NotContains(t, buf.String(), "hunter2")
+
+	var entry map[string]any
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "starting", entry["msg"])
+	assert.Equal(t, "foo", entry["machine"])
+	assert.Equal(t, logging.Redacted, entry["passphrase"])
+}
+
+func TestNew_level(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := logging.New(&buf, "text", slog.LevelWarn)
+	assert.NoError(t, err)
+
+	logger.Debug("hidden")
+	logger.Warn("shown", "n", 1)
+	assert.NotContains(t, buf.String(), "hidden")
+	assert.Contains(t, buf.String(), "level=WARN msg=shown n=1")
+}
+
+func TestNew_invalid_format(t *testing.T) {
+	_, err := logging.New(nil, "xml", slog.LevelDebug)
+	assert.Error(t, err)
+}
@@ -0,0 +1,306 @@
+// Package rotate replaces the CSEK key of a machine's boot disk. A disk's CSEK
+// key cannot be changed, so the disk is copied to a new disk encrypted with a new
+// key through a snapshot, and the new disk replaces it as the boot disk.
+//
+// Each step is recorded in a journal in the config file before it runs so that a
+// rotation that is interrupted, eg: by a crash or Ctrl-C, is resumed from where
+// it stopped by running it again. The machine's CSEK keys in the config file are
+// only replaced once the new disk is attached, so they always include the key of
+// the disk that is attached.
+package rotate
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/joemiller/gmachine/internal/config"
+	"github.com/joemiller/gmachine/internal/gcp"
+)
+
+// Steps of a rotation, in the order they run. The journal records the next step.
+const (
+	StepStop       = "stop"
+	StepSnapshot   = "snapshot"
+	StepCreateDisk = "create-disk"
+	StepSwap       = "swap"
+	StepCleanup    = "cleanup"
+)
+
+// Journal saves the state of rotations, it is implemented by the config file.
+type Journal interface {
+	CSEK(ctx context.Context, name string) (gcp.CSEKBundle, error)
+	StartCSEK(ctx context.Context, name string) (gcp.CSEKBundle, error)
+	Rotation(name string) (*config.Rotation, error)
+	BeginRotation(ctx context.Context, name string, r config.Rotation) error
+	SetRotationStep(name, step string) error
+	RotationCSEK(ctx context.Context, name string) (gcp.CSEKBundle, error)
+	CommitRotation(name, step string) error
+	FinishRotation(ctx context.Context, name string) error
+}
+
+// Rotator rotates CSEK keys.
+type Rotator struct {
+	Backend gcp.Backend
+	Journal Journal
+	// Wait waits for an operation to complete, 'msg' describes it, eg: to show
+	// progress.
+	Wait func(ctx context.Context, op *gcp.Operation, msg string) error
+	// Now returns the current time, it is used to name the new disk and snapshot.
+	Now func() time.Time
+}
+
+// Options of a new rotation, they are ignored when a rotation is resumed.
+type Options struct {
+	// KeepOldDisk keeps the old boot disk instead of deleting it.
+	KeepOldDisk bool
+	// RSACert wraps the new keys, they are 'rsa-encrypted' if it is set and
+	// 'raw' otherwise. It is required if the old key is 'rsa-encrypted'.
+	RSACert *rsa.PublicKey
+}
+
+// maxNameLength is the longest name of a Compute Engine resource.
+const maxNameLength = 63
+
+// Rotate rotates the CSEK key of the boot disk of the machine 'ref', or resumes
+// its unfinished rotation.
+func (r *Rotator) Rotate(ctx context.Context, ref gcp.InstanceRef, opts Options) error {
+	rot, err := r.Journal.Rotation(ref.Name)
+	if err != nil {
+		return err
+	}
+	if rot == nil {
+		if err := r.begin(ctx, ref, opts); err != nil {
+			return err
+		}
+	}
+
+	for {
+		rot, err := r.Journal.Rotation(ref.Name)
+		if err != nil || rot == nil {
+			return err
+		}
+		if err := r.step(ctx, ref, rot); err != nil {
+			return fmt.Errorf("key rotation of %s failed at step '%s', run the command again to resume it: %w", ref.Name, rot.Step, err)
+		}
+	}
+}
+
+// begin starts a new rotation: it generates the new keys and saves the journal.
+func (r *Rotator) begin(ctx context.Context, ref gcp.InstanceRef, opts Options) error {
+	instance, err := r.Backend.DescribeInstance(ctx, ref)
+	if err != nil {
+		return err
+	}
+	oldDisk, deviceName := gcp.BootDisk(instance)
+	if oldDisk == "" {
+		return fmt.Errorf("machine %s has no boot disk", ref.Name)
+	}
+	csek, err := r.Journal.CSEK(ctx, ref.Name)
+	if err != nil {
+		return err
+	}
+	if !hasKey(csek, ref.Disk(oldDisk).URI()) {
+		return fmt.Errorf("machine %s has no CSEK key for its boot disk %s, only CSEK encrypted disks can be rotated", ref.Name, oldDisk)
+	}
+	if csek.KeyType(ref.Disk(oldDisk).URI()) == gcp.KeyTypeRSAEncrypted && opts.RSACert == nil {
+		return fmt.Errorf("the CSEK key of %s is %s, the RSA certificate to wrap the new key with is required", ref.Name, gcp.KeyTypeRSAEncrypted)
+	}
+
+	suffix := r.Now().UTC().Format("20060102-150405")
+	rot := config.Rotation{
+		Step:        StepStop,
+		OldDisk:     oldDisk,
+		NewDisk:     name(ref.Name, suffix),
+		Snapshot:    name(ref.Name, "rotate-"+suffix),
+		DeviceName:  deviceName,
+		Restart:     instance.Status == "RUNNING",
+		KeepOldDisk: opts.KeepOldDisk,
+	}
+	diskKey, err := gcp.CreateWrappedCSEK(ref.Disk(rot.NewDisk).URI(), opts.RSACert)
+	if err != nil {
+		return err
+	}
+	snapshotKey, err := gcp.CreateWrappedCSEK(gcp.SnapshotURI(ref.Project, rot.Snapshot), opts.RSACert)
+	if err != nil {
+		return err
+	}
+	rot.CSEK = append(diskKey, snapshotKey...)
+	return r.Journal.BeginRotation(ctx, ref.Name, rot)
+}
+
+// step runs the rotation's next step and records the step after it.
+func (r *Rotator) step(ctx context.Context, ref gcp.InstanceRef, rot *config.Rotation) error {
+	oldDisk, newDisk := ref.Disk(rot.OldDisk), ref.Disk(rot.NewDisk)
+
+	switch rot.Step {
+	case StepStop:
+		op, err := r.Backend.StopInstance(ctx, ref)
+		if err == nil {
+			err = r.Wait(ctx, op, fmt.Sprintf("Stopping %s", ref.Name))
+		}
+		if err != nil {
+			return err
+		}
+		return r.Journal.SetRotationStep(ref.Name, StepSnapshot)
+
+	case StepSnapshot:
+		csek, err := r.keys(ctx, ref.Name)
+		if err != nil {
+			return err
+		}
+		op, err := r.Backend.CreateSnapshot(ctx, oldDisk, rot.Snapshot, csek)
+		if err == nil {
+			err = r.Wait(ctx, op, fmt.Sprintf("Snapshotting %s to %s", oldDisk.Name, rot.Snapshot))
+		}
+		// the snapshot was created before the rotation was interrupted
+		if err != nil && !errors.Is(err, gcp.ErrAlreadyExists) {
+			return err
+		}
+		return r.Journal.SetRotationStep(ref.Name, StepCreateDisk)
+
+	case StepCreateDisk:
+		csek, err := r.Journal.RotationCSEK(ctx, ref.Name)
+		if err != nil {
+			return err
+		}
+		disk, err := r.Backend.DescribeDisk(ctx, oldDisk)
+		if err != nil {
+			return err
+		}
+		op, err := r.Backend.CreateDisk(ctx, gcp.DiskRequest{
+			Ref:            newDisk,
+			Size:           fmt.Sprintf("%dGB", disk.SizeGb),
+			Type:           path.Base(disk.Type),
+			SourceSnapshot: rot.Snapshot,
+			CSEK:           csek,
+		})
+		if err == nil {
+			err = r.Wait(ctx, op, fmt.Sprintf("Creating disk %s", newDisk.Name))
+		}
+		if err != nil && !errors.Is(err, gcp.ErrAlreadyExists) {
+			return err
+		}
+		return r.Journal.SetRotationStep(ref.Name, StepSwap)
+
+	case StepSwap:
+		if err := r.swap(ctx, ref, rot); err != nil {
+			return err
+		}
+		// the new disk is attached, its key replaces the old one
+		return r.Journal.CommitRotation(ref.Name, StepCleanup)
+
+	case StepCleanup:
+		// like the boot disk created with the machine, delete it with the machine
+		op, err := r.Backend.SetDiskAutoDelete(ctx, ref, rot.DeviceName, true)
+		if err == nil {
+			err = r.Wait(ctx, op, fmt.Sprintf("Setting auto-delete on disk %s", newDisk.Name))
+		}
+		if err != nil {
+			return err
+		}
+		err = r.Backend.DeleteSnapshot(ctx, oldDisk, rot.Snapshot)
+		if err != nil && !errors.Is(err, gcp.ErrNotFound) {
+			return err
+		}
+		if !rot.KeepOldDisk {
+			op, err := r.Backend.DeleteDisk(ctx, oldDisk)
+			if err == nil {
+				err = r.Wait(ctx, op, fmt.Sprintf("Deleting disk %s", oldDisk.Name))
+			}
+			if err != nil && !errors.Is(err, gcp.ErrNotFound) {
+				return err
+			}
+		}
+		if rot.Restart {
+			csek, err := r.Journal.StartCSEK(ctx, ref.Name)
+			if err != nil {
+				return err
+			}
+			op, err := r.Backend.StartInstance(ctx, ref, csek)
+			if err == nil {
+				err = r.Wait(ctx, op, fmt.Sprintf("Starting %s", ref.Name))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return r.Journal.FinishRotation(ctx, ref.Name)
+	}
+	return fmt.Errorf("unknown key rotation step '%s'", rot.Step)
+}
+
+// swap replaces the old boot disk with the new disk. It checks which disk is
+// attached first so that it can be resumed after either disk operation.
+func (r *Rotator) swap(ctx context.Context, ref gcp.InstanceRef, rot *config.Rotation) error {
+	instance, err := r.Backend.DescribeInstance(ctx, ref)
+	if err != nil {
+		return err
+	}
+	boot, _ := gcp.BootDisk(instance)
+
+	if boot == rot.OldDisk {
+		op, err := r.Backend.DetachDisk(ctx, ref, rot.DeviceName)
+		if err == nil {
+			err = r.Wait(ctx, op, fmt.Sprintf("Detaching disk %s", rot.OldDisk))
+		}
+		if err != nil {
+			return err
+		}
+		boot = ""
+	}
+	if boot == "" {
+		csek, err := r.Journal.RotationCSEK(ctx, ref.Name)
+		if err != nil {
+			return err
+		}
+		op, err := r.Backend.AttachDisk(ctx, ref, gcp.AttachDiskRequest{Disk: rot.NewDisk, DeviceName: rot.DeviceName, Boot: true, CSEK: csek})
+		if err == nil {
+			err = r.Wait(ctx, op, fmt.Sprintf("Attaching disk %s", rot.NewDisk))
+		}
+		if err != nil {
+			return err
+		}
+		boot = rot.NewDisk
+	}
+	if boot != rot.NewDisk {
+		return fmt.Errorf("the boot disk of %s is %s, expected %s or %s", ref.Name, boot, rot.OldDisk, rot.NewDisk)
+	}
+	return nil
+}
+
+// keys returns the machine's current keys and the rotation's keys, to read the
+// old disk and encrypt the snapshot.
+func (r *Rotator) keys(ctx context.Context, name string) (gcp.CSEKBundle, error) {
+	current, err := r.Journal.CSEK(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	rotation, err := r.Journal.RotationCSEK(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return append(current, rotation...), nil
+}
+
+func hasKey(csek gcp.CSEKBundle, uri string) bool {
+	for _, k := range csek {
+		if k.URI == uri && k.Key != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// name returns "PREFIX-SUFFIX", shortening 'prefix' so that it is a valid
+// resource name.
+func name(prefix, suffix string) string {
+	if max := maxNameLength - len(suffix) - 1; len(prefix) > max {
+		prefix = strings.TrimRight(prefix[:max], "-")
+	}
+	return prefix + "-" + suffix
+}
@@ -0,0 +1,355 @@
+package rotate_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/joemiller/gmachine/internal/config"
+	"github.com/joemiller/gmachine/internal/gcp"
+	"github.com/joemiller/gmachine/internal/keystore"
+	"github.com/joemiller/gmachine/internal/rotate"
+	"github.com/stretchr/testify/assert"
+)
+
+var testRef = gcp.InstanceRef{Name: "foo", Account: "me@example.com", Project: "my-proj", Zone: "us-west1-a"}
+
+// setup creates a running machine with a CSEK encrypted boot disk in a fake
+// backend and a config file with 'contents' in a temp dir.
+func setup(t *testing.T, contents string) (*gcp.Fake, string) {
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "gmachine.yaml")
+	assert.NoError(t, os.WriteFile(file, []byte(contents), 0o600))
+	cfg, err := config.LoadFile(file)
+	assert.NoError(t, err)
+
+	fake := gcp.NewFake("", 0, nil)
+	csek, err := gcp.CreateCSEK(gcp.DiskURI(testRef.Project, testRef.Zone, testRef.Name))
+	assert.NoError(t, err)
+	stored, err := cfg.StoreKeys(ctx, csek)
+	assert.NoError(t, err)
+	_, err = fake.CreateInstance(ctx, gcp.CreateRequest{
+		Name: testRef.Name, Account: testRef.Account, Project: testRef.Project, Zone: testRef.Zone,
+		MachineType: "e2-small", BootDiskSize: "20GB", BootDiskType: "pd-ssd", CSEK: csek,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, cfg.Add(testRef.Name, testRef.Account, testRef.Project, testRef.Zone, stored))
+	return fake, file
+}
+
+func newRotator(b gcp.Backend, cfg rotate.Journal) *rotate.Rotator {
+	return &rotate.Rotator{
+		Backend: b,
+		Journal: cfg,
+		Wait: func(ctx context.Context, op *gcp.Operation, _ string) error {
+			_, err := gcp.WaitOperation(ctx, b, op, nil)
+			return err
+		},
+		Now: func() time.Time { return time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC) },
+	}
+}
+
+// checkRotated checks that the machine's boot disk was replaced with a disk
+// encrypted with the key in the config file, unlocked with 'passphrase' if the
+// keys are encrypted.
+func checkRotated(t *testing.T, fake *gcp.Fake, file, passphrase string) {
+	ctx := context.Background()
+	cfg, err := config.LoadFile(file)
+	assert.NoError(t, err)
+	if passphrase != "" {
+		key, err := cfg.PassphraseKey([]byte(passphrase))
+		assert.NoError(t, err)
+		assert.NoError(t, cfg.Unlock(key))
+	}
+
+	rot, err := cfg.Rotation(testRef.Name)
+	assert.NoError(t, err)
+	assert.Nil(t, rot)
+
+	instance, err := fake.DescribeInstance(ctx, testRef)
+	assert.NoError(t, err)
+	assert.Equal(t, "RUNNING", instance.Status, "the machine is restarted")
+	boot, deviceName := gcp.BootDisk(instance)
+	assert.Equal(t, "foo-20260102-030405", boot)
+	assert.Equal(t, "foo", deviceName, "the device name is kept")
+	assert.True(t, instance.Disks[0].AutoDelete)
+
+	disk, err := fake.DescribeDisk(ctx, testRef.Disk(boot))
+	assert.NoError(t, err)
+	assert.EqualValues(t, 20, disk.SizeGb)
+	assert.Contains(t, disk.Type, "/diskTypes/pd-ssd")
+
+	// the old disk and the snapshot are deleted
+	_, err = fake.DescribeDisk(ctx, testRef.Disk("foo"))
+	assert.ErrorIs(t, err, gcp.ErrNotFound)
+	assert.ErrorIs(t, fake.DeleteSnapshot(ctx, testRef.Disk("foo"), "foo-rotate-20260102-030405"), gcp.ErrNotFound)
+
+	// the machine starts with the new key from the config file
+	csek, err := cfg.CSEK(ctx, testRef.Name)
+	assert.NoError(t, err)
+	if assert.Len(t, csek, 1) {
+		assert.Equal(t, gcp.DiskURI(testRef.Project, testRef.Zone, boot), csek[0].URI)
+	}
+	wait := func(op *gcp.Operation, err error) error {
+		if err != nil {
+			return err
+		}
+		_, err = gcp.WaitOperation(ctx, fake, op, nil)
+		return err
+	}
+	assert.NoError(t, wait(fake.StopInstance(ctx, testRef)))
+	assert.NoError(t, wait(fake.StartInstance(ctx, testRef, csek)))
+}
+
+func TestRotate(t *testing.T) {
+	fake, file := setup(t, "")
+	cfg, err := config.LoadFile(file)
+	assert.NoError(t, err)
+	oldKey, _ := cfg.CSEK(context.Background(), testRef.Name)
+
+	assert.NoError(t, newRotator(fake, cfg).Rotate(context.Background(), testRef, rotate.Options{}))
+	checkRotated(t, fake, file, "")
+
+	newKey, _ := cfg.CSEK(context.Background(), testRef.Name)
+	assert.NotEqual(t, oldKey[0].Key, newKey[0].Key)
+}
+
+func TestRotate_keep_old_disk(t *testing.T) {
+	ctx := context.Background()
+	fake, file := setup(t, "version: 4\nkey_store:\n  type: fake\n")
+	cfg, err := config.LoadFile(file)
+	assert.NoError(t, err)
+	oldKey, _ := cfg.CSEK(ctx, testRef.Name)
+
+	assert.NoError(t, newRotator(fake, cfg).Rotate(ctx, testRef, rotate.Options{KeepOldDisk: true}))
+	disk, err := fake.DescribeDisk(ctx, testRef.Disk("foo"))
+	assert.NoError(t, err)
+	assert.Empty(t, disk.Users)
+
+	// the old disk is kept detached, with its key
+	cfg, err = config.LoadFile(file)
+	assert.NoError(t, err)
+	machine, err := cfg.Get(testRef.Name)
+	assert.NoError(t, err)
+	assert.Equal(t, []config.Disk{{Name: "foo"}}, machine.Disks)
+	csek, err := cfg.CSEK(ctx, testRef.Name)
+	assert.NoError(t, err)
+	assert.Contains(t, csek, oldKey[0])
+	start, err := cfg.StartCSEK(ctx, testRef.Name)
+	assert.NoError(t, err)
+	assert.NotContains(t, start, oldKey[0])
+	_, err = keystore.NewFake(filepath.Join(filepath.Dir(file), "fake-keystore.json")).Get(ctx, keystore.Ref(testRef.Disk("foo").URI()))
+	assert.NoError(t, err)
+}
+
+func TestRotate_data_disk(t *testing.T) {
+	ctx := context.Background()
+	fake, file := setup(t, "")
+	cfg, err := config.LoadFile(file)
+	assert.NoError(t, err)
+
+	home := testRef.Disk("home")
+	dataKey, err := gcp.CreateCSEK(home.URI())
+	assert.NoError(t, err)
+	assert.NoError(t, cfg.AddDisk(ctx, testRef.Name, config.Disk{Name: "home", DeviceName: "home", Attached: true}, dataKey))
+	_, err = fake.CreateDisk(ctx, gcp.DiskRequest{Ref: home, CSEK: dataKey})
+	assert.NoError(t, err)
+	_, err = fake.AttachDisk(ctx, testRef, gcp.AttachDiskRequest{Disk: "home", CSEK: dataKey})
+	assert.NoError(t, err)
+
+	// the machine is started again with the key of its data disk
+	assert.NoError(t, newRotator(fake, cfg).Rotate(ctx, testRef, rotate.Options{}))
+	instance, _ := fake.DescribeInstance(ctx, testRef)
+	assert.Equal(t, "RUNNING", instance.Status)
+
+	// only the key of the boot disk is replaced
+	csek, err := cfg.CSEK(ctx, testRef.Name)
+	assert.NoError(t, err)
+	if assert.Len(t, csek, 2) {
+		assert.Equal(t, testRef.Disk("foo-20260102-030405").URI(), csek[0].URI)
+		assert.Equal(t, dataKey[0], csek[1])
+	}
+}
+
+func TestRotate_unencrypted(t *testing.T) {
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "gmachine.yaml")
+	cfg, _ := config.LoadFile(file)
+	fake := gcp.NewFake("", 0, nil)
+	_, err := fake.CreateInstance(ctx, gcp.CreateRequest{Name: testRef.Name, Project: testRef.Project, Zone: testRef.Zone})
+	assert.NoError(t, err)
+	assert.NoError(t, cfg.Add(testRef.Name, testRef.Account, testRef.Project, testRef.Zone, nil))
+
+	err = newRotator(fake, cfg).Rotate(ctx, testRef, rotate.Options{})
+	assert.ErrorContains(t, err, "has no CSEK key for its boot disk foo")
+	rot, _ := cfg.Rotation(testRef.Name)
+	assert.Nil(t, rot)
+}
+
+// failing is a Backend that fails the first call to one of its methods.
+type failing struct {
+	gcp.Backend
+	method string
+	failed bool
+}
+
+var errInjected = errors.New("injected failure")
+
+func (f *failing) fail(method string) error {
+	if f.method == method && !f.failed {
+		f.failed = true
+		return errInjected
+	}
+	return nil
+}
+
+func (f *failing) CreateSnapshot(ctx context.Context, ref gcp.DiskRef, name string, csek gcp.CSEKBundle) (*gcp.Operation, error) {
+	// the snapshot is created but the operation is lost, eg: the process was killed
+	op, err := f.Backend.CreateSnapshot(ctx, ref, name, csek)
+	if err == nil {
+		err = f.fail("CreateSnapshot")
+	}
+	return op, err
+}
+
+func (f *failing) AttachDisk(ctx context.Context, ref gcp.InstanceRef, req gcp.AttachDiskRequest) (*gcp.Operation, error) {
+	if err := f.fail("AttachDisk"); err != nil {
+		return nil, err
+	}
+	return f.Backend.AttachDisk(ctx, ref, req)
+}
+
+func (f *failing) SetDiskAutoDelete(ctx context.Context, ref gcp.InstanceRef, deviceName string, autoDelete bool) (*gcp.Operation, error) {
+	if err := f.fail("SetDiskAutoDelete"); err != nil {
+		return nil, err
+	}
+	return f.Backend.SetDiskAutoDelete(ctx, ref, deviceName, autoDelete)
+}
+
+func (f *failing) StartInstance(ctx context.Context, ref gcp.InstanceRef, csek gcp.CSEKBundle) (*gcp.Operation, error) {
+	if err := f.fail("StartInstance"); err != nil {
+		return nil, err
+	}
+	return f.Backend.StartInstance(ctx, ref, csek)
+}
+
+func TestRotate_resume(t *testing.T) {
+	tests := []struct {
+		method string
+		step   string
+		// the disk the machine boots from after the failure, and whether the
+		// config file's key is for the new disk
+		boot      string
+		committed bool
+	}{
+		{method: "CreateSnapshot", step: rotate.StepSnapshot, boot: "foo"},
+		{method: "AttachDisk", step: rotate.StepSwap, boot: ""},
+		{method: "SetDiskAutoDelete", step: rotate.StepCleanup, boot: "foo-20260102-030405", committed: true},
+		{method: "StartInstance", step: rotate.StepCleanup, boot: "foo-20260102-030405", committed: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.method, func(t *testing.T) {
+			ctx := context.Background()
+			fake, file := setup(t, "")
+			cfg, err := config.LoadFile(file)
+			assert.NoError(t, err)
+			oldKey, _ := cfg.CSEK(ctx, testRef.Name)
+
+			err = newRotator(&failing{Backend: fake, method: tc.method}, cfg).Rotate(ctx, testRef, rotate.Options{})
+			assert.ErrorIs(t, err, errInjected)
+			assert.ErrorContains(t, err, "run the command again to resume it")
+
+			// a new process resumes from the journal in the config file
+			cfg, err = config.LoadFile(file)
+			assert.NoError(t, err)
+			rot, err := cfg.Rotation(testRef.Name)
+			if !assert.NoError(t, err) || !assert.NotNil(t, rot) {
+				return
+			}
+			assert.Equal(t, tc.step, rot.Step)
+
+			instance, _ := fake.DescribeInstance(ctx, testRef)
+			boot, _ := gcp.BootDisk(instance)
+			assert.Equal(t, tc.boot, boot)
+			csek, err := cfg.CSEK(ctx, testRef.Name)
+			assert.NoError(t, err)
+			if tc.committed {
+				assert.Equal(t, gcp.DiskURI(testRef.Project, testRef.Zone, tc.boot), csek[0].URI)
+			} else {
+				assert.Equal(t, oldKey, csek)
+			}
+
+			assert.NoError(t, newRotator(fake, cfg).Rotate(ctx, testRef, rotate.Options{}))
+			checkRotated(t, fake, file, "")
+		})
+	}
+}
+
+func TestRotate_key_store(t *testing.T) {
+	ctx := context.Background()
+	fake, file := setup(t, "version: 4\nkey_store:\n  type: fake\n")
+	cfg, err := config.LoadFile(file)
+	assert.NoError(t, err)
+
+	assert.NoError(t, newRotator(fake, cfg).Rotate(ctx, testRef, rotate.Options{}))
+	checkRotated(t, fake, file, "")
+
+	// only the new disk's key is left in the store, the config file has a reference
+	data, _ := os.ReadFile(file)
+	assert.Contains(t, string(data), "key-ref: projects/my-proj/zones/us-west1-a/disks/foo-20260102-030405")
+	store := keystore.NewFake(filepath.Join(filepath.Dir(file), "fake-keystore.json"))
+	for _, ref := range []string{"projects/my-proj/zones/us-west1-a/disks/foo", "projects/my-proj/global/snapshots/foo-rotate-20260102-030405"} {
+		_, err = store.Get(ctx, ref)
+		assert.ErrorIs(t, err, keystore.ErrNotFound, ref)
+	}
+}
+
+func TestRotate_encrypted(t *testing.T) {
+	ctx := context.Background()
+	fake, file := setup(t, "")
+	cfg, err := config.LoadFile(file)
+	assert.NoError(t, err)
+	assert.NoError(t, cfg.EncryptKeys([]byte("correct horse battery staple")))
+
+	// a new process must unlock the keys
+	cfg, err = config.LoadFile(file)
+	assert.NoError(t, err)
+	err = newRotator(fake, cfg).Rotate(ctx, testRef, rotate.Options{})
+	assert.ErrorIs(t, err, config.ErrLocked)
+
+	key, _ := cfg.PassphraseKey([]byte("correct horse battery staple"))
+	assert.NoError(t, cfg.Unlock(key))
+	assert.NoError(t, newRotator(fake, cfg).Rotate(ctx, testRef, rotate.Options{}))
+
+	// the new key is encrypted too
+	data, _ := os.ReadFile(file)
+	assert.NotContains(t, string(data), " key: ")
+	assert.Contains(t, string(data), "encrypted-key:")
+	checkRotated(t, fake, file, "correct horse battery staple")
+}
+
+func TestRotate_rsa_encrypted(t *testing.T) {
+	ctx := context.Background()
+	fake, file := setup(t, "")
+	cfg, err := config.LoadFile(file)
+	assert.NoError(t, err)
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	// a raw key is rotated to an rsa-encrypted key
+	assert.NoError(t, newRotator(fake, cfg).Rotate(ctx, testRef, rotate.Options{RSACert: &priv.PublicKey}))
+	checkRotated(t, fake, file, "")
+	csek, _ := cfg.CSEK(ctx, testRef.Name)
+	assert.Equal(t, gcp.KeyTypeRSAEncrypted, csek[0].KeyType)
+
+	// which cannot be rotated to a raw key
+	err = newRotator(fake, cfg).Rotate(ctx, testRef, rotate.Options{})
+	assert.ErrorContains(t, err, "the RSA certificate to wrap the new key with is required")
+	rot, _ := cfg.Rotation(testRef.Name)
+	assert.Nil(t, rot)
+}
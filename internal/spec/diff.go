@@ -0,0 +1,266 @@
+package spec
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/joemiller/gmachine/internal/gcp"
+	"google.golang.org/api/compute/v1"
+)
+
+// Current is the current state of a machine that a spec is compared with.
+type Current struct {
+	Instance compute.Instance
+	BootDisk compute.Disk
+	// KMSKey and Network are the machine's settings from the config file
+	KMSKey  string
+	Network gcp.Network
+	// Disks are the spec's data disks by name, nil if the disk does not exist
+	Disks map[string]*compute.Disk
+}
+
+// Action is how a change is applied to an existing machine.
+type Action int
+
+const (
+	// Update changes the machine in place
+	Update Action = iota
+	// Recreate deletes and recreates the machine, its boot disk is recreated
+	// from the image
+	Recreate
+	// Unsupported changes cannot be applied, eg: shrinking a disk
+	Unsupported
+)
+
+// Change is a difference between a spec and the current machine.
+type Change struct {
+	// Field is the spec field, eg: machine_type, labels.env or disks.data.size
+	Field string
+	// Key is the label or metadata key, or the data disk name, of the change
+	Key string
+	// From is the current value, "" if it is added
+	From   string
+	To     string
+	Action Action
+}
+
+// String describes the change, eg: "~ machine_type: e2-small -> e2-medium".
+func (c Change) String() string {
+	s := fmt.Sprintf("+ %s: %s", c.Field, summary(c.To))
+	if c.From != "" {
+		s = fmt.Sprintf("~ %s: %s -> %s", c.Field, summary(c.From), summary(c.To))
+	}
+	switch c.Action {
+	case Recreate:
+		s += " (requires recreate)"
+	case Unsupported:
+		s += " (not supported)"
+	}
+	return s
+}
+
+// summary returns 'v', or its length if it is too long to show in a change, eg:
+// a startup script.
+func summary(v string) string {
+	if len(v) > 60 || strings.Contains(v, "\n") {
+		return fmt.Sprintf("(%d bytes)", len(v))
+	}
+	return v
+}
+
+// Diff returns the changes needed to make the current machine match the spec.
+// Labels and metadata that are not in the spec are ignored, they may be set by
+// other tools. The boot image and the max run duration only apply when the
+// machine is created.
+func (s Spec) Diff(cur Current) []Change {
+	var changes []Change
+	add := func(field, key, from, to string, action Action) {
+		if from != to {
+			changes = append(changes, Change{Field: field, Key: key, From: from, To: to, Action: action})
+		}
+	}
+
+	add("machine_type", "", path.Base(cur.Instance.MachineType), s.MachineType, Update)
+
+	size, _ := gcp.ParseDiskSizeGB(s.BootDisk.Size)
+	action := Update
+	if size < cur.BootDisk.SizeGb {
+		action = Unsupported
+	}
+	add("boot_disk.size", "", fmt.Sprintf("%dGB", cur.BootDisk.SizeGb), fmt.Sprintf("%dGB", size), action)
+	add("boot_disk.type", "", path.Base(cur.BootDisk.Type), s.BootDisk.Type, Recreate)
+	add("encryption", "", encryption(gcp.DiskEncryption(cur.Instance), cur.KMSKey), s.encryption(), Recreate)
+
+	n := s.Network
+	add("network.network", "", defaultNetwork(cur.Network.Network), defaultNetwork(n.Network), Recreate)
+	add("network.subnet", "", cur.Network.Subnet, n.Subnet, Recreate)
+	add("network.no_address", "", fmt.Sprint(cur.Network.NoAddress), fmt.Sprint(n.NoAddress), Recreate)
+	add("network.internal_ip", "", cur.Network.InternalIP, n.InternalIP, Recreate)
+	add("network.tags", "", strings.Join(cur.Network.Tags, ","), strings.Join(n.Tags, ","), Recreate)
+	add("network.stack_type", "", defaultStackType(cur.Network.StackType), defaultStackType(n.StackType), Recreate)
+
+	model, termination := scheduling(cur.Instance)
+	add("scheduling.provisioning_model", "", model, s.provisioningModel(), Recreate)
+	add("scheduling.termination_action", "", termination, s.terminationAction(), Recreate)
+
+	// the default service account's email is not known, only a change to or from
+	// a specific account or none is detected
+	if s.ServiceAccount != "" || s.NoServiceAccount {
+		current := "none"
+		if len(cur.Instance.ServiceAccounts) > 0 {
+			current = cur.Instance.ServiceAccounts[0].Email
+		}
+		want := s.ServiceAccount
+		if s.NoServiceAccount {
+			want = "none"
+		}
+		add("service_account", "", current, want, Recreate)
+	}
+
+	for _, k := range sortedKeys(s.Labels) {
+		add("labels."+k, k, cur.Instance.Labels[k], s.Labels[k], Update)
+	}
+	metadata := instanceMetadata(cur.Instance)
+	want := s.metadata()
+	for _, k := range sortedKeys(want) {
+		add("metadata."+k, k, metadata[k], want[k], Update)
+	}
+
+	for _, d := range s.Disks {
+		changes = append(changes, d.diff(cur)...)
+	}
+	return changes
+}
+
+// diff returns the changes needed to make the disk and its attachment match the
+// spec.
+func (d Disk) diff(cur Current) []Change {
+	size, _ := gcp.ParseDiskSizeGB(d.Size)
+	disk := cur.Disks[d.Name]
+	if disk == nil {
+		to := fmt.Sprintf("%dGB %s", size, d.Type)
+		if d.CSEK {
+			to += " CSEK"
+		}
+		return []Change{{Field: "disks." + d.Name, Key: d.Name, To: to, Action: Update}}
+	}
+
+	var changes []Change
+	add := func(field, from, to string, action Action) {
+		if from != to {
+			changes = append(changes, Change{Field: "disks." + d.Name + "." + field, Key: d.Name, From: from, To: to, Action: action})
+		}
+	}
+	action := Update
+	if size < disk.SizeGb {
+		action = Unsupported
+	}
+	add("size", fmt.Sprintf("%dGB", disk.SizeGb), fmt.Sprintf("%dGB", size), action)
+	add("type", path.Base(disk.Type), d.Type, Unsupported)
+	encryption := gcp.EncryptionGoogleManaged
+	if d.CSEK {
+		encryption = gcp.EncryptionCSEK
+	}
+	add("encryption", gcp.KeyEncryption(disk.DiskEncryptionKey), encryption, Unsupported)
+
+	for _, a := range cur.Instance.Disks {
+		if path.Base(a.Source) == d.Name {
+			// the device name can only be changed by detaching the disk
+			add("device_name", a.DeviceName, d.DeviceName, Unsupported)
+			return changes
+		}
+	}
+	add("attached", "false", "true", Update)
+	return changes
+}
+
+// encryption returns the boot disk encryption that the spec declares.
+func (s Spec) encryption() string {
+	switch {
+	case s.CSEK:
+		return encryption(gcp.EncryptionCSEK, "")
+	case s.KMSKey != "":
+		return encryption(gcp.EncryptionCMEK, s.KMSKey)
+	}
+	return encryption(gcp.EncryptionGoogleManaged, "")
+}
+
+// encryption describes the encryption type 'typ' of a disk, with its Cloud KMS
+// key if it is CMEK encrypted.
+func encryption(typ, kmsKey string) string {
+	if typ == gcp.EncryptionCMEK {
+		return fmt.Sprintf("%s %s", typ, kmsKey)
+	}
+	return typ
+}
+
+func (s Spec) provisioningModel() string {
+	if s.Scheduling.ProvisioningModel == "" {
+		return gcp.ProvisioningModelStandard
+	}
+	return s.Scheduling.ProvisioningModel
+}
+
+// terminationAction returns the spec's termination action, which defaults to
+// stop for machines that can be terminated, or "".
+func (s Spec) terminationAction() string {
+	if s.Scheduling.TerminationAction == "" && (s.provisioningModel() == gcp.ProvisioningModelSpot || s.Scheduling.MaxRunDuration != 0) {
+		return gcp.TerminationActionStop
+	}
+	return s.Scheduling.TerminationAction
+}
+
+// scheduling returns the provisioning model and termination action of the
+// instance, legacy preemptible instances are Spot instances.
+func scheduling(instance compute.Instance) (model, termination string) {
+	model = gcp.ProvisioningModelStandard
+	if gcp.IsSpot(instance) {
+		model = gcp.ProvisioningModelSpot
+	}
+	if instance.Scheduling != nil {
+		termination = instance.Scheduling.InstanceTerminationAction
+	}
+	if termination == "" && model == gcp.ProvisioningModelSpot {
+		termination = gcp.TerminationActionStop
+	}
+	return model, termination
+}
+
+func defaultNetwork(network string) string {
+	if network == "" {
+		return "default"
+	}
+	return network
+}
+
+func defaultStackType(stackType string) string {
+	if stackType == "" {
+		return gcp.StackTypeIPv4
+	}
+	return stackType
+}
+
+// instanceMetadata returns the instance's metadata as a map.
+func instanceMetadata(instance compute.Instance) map[string]string {
+	m := map[string]string{}
+	if instance.Metadata == nil {
+		return m
+	}
+	for _, item := range instance.Metadata.Items {
+		if item.Value != nil {
+			m[item.Key] = *item.Value
+		}
+	}
+	return m
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,217 @@
+// Package spec reads machine spec files, which declare a machine like the flags of
+// 'gmachine create' plus its labels, metadata and data disks, and compares them
+// with existing machines for 'gmachine apply'.
+package spec
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/joemiller/gmachine/internal/gcp"
+	"gopkg.in/yaml.v2"
+)
+
+// Defaults of a spec, the same as the defaults of 'gmachine create'.
+const (
+	DefaultMachineType  = "f1-micro"
+	DefaultDiskSize     = "10GB"
+	DefaultDiskType     = "pd-standard"
+	DefaultImageProject = "ubuntu-os-cloud"
+	DefaultImageFamily  = "ubuntu-2204-lts"
+
+	DefaultDataDiskSize = "100GB"
+	DefaultDataDiskType = "pd-balanced"
+)
+
+// Spec declares a machine.
+type Spec struct {
+	Name        string `yaml:"name"`
+	Account     string `yaml:"account,omitempty"`
+	Project     string `yaml:"project"`
+	Zone        string `yaml:"zone"`
+	MachineType string `yaml:"machine_type,omitempty"`
+	BootDisk    struct {
+		Size         string `yaml:"size,omitempty"`
+		Type         string `yaml:"type,omitempty"`
+		ImageProject string `yaml:"image_project,omitempty"`
+		ImageFamily  string `yaml:"image_family,omitempty"`
+	} `yaml:"boot_disk,omitempty"`
+	// CSEK encrypts the boot disk with a new CSEK key, KMSKey with a Cloud KMS key
+	CSEK                  bool              `yaml:"csek,omitempty"`
+	KMSKey                string            `yaml:"kms_key,omitempty"`
+	Network               gcp.Network       `yaml:"network,omitempty"`
+	Scheduling            gcp.Scheduling    `yaml:"scheduling,omitempty"`
+	ServiceAccount        string            `yaml:"service_account,omitempty"`
+	NoServiceAccount      bool              `yaml:"no_service_account,omitempty"`
+	DisableSSHProjectKeys bool              `yaml:"disable_ssh_project_keys,omitempty"`
+	StartupScript         string            `yaml:"startup_script,omitempty"`
+	StartupScriptURL      string            `yaml:"startup_script_url,omitempty"`
+	Metadata              map[string]string `yaml:"metadata,omitempty"`
+	Labels                map[string]string `yaml:"labels,omitempty"`
+	Disks                 []Disk            `yaml:"disks,omitempty"`
+
+	// startupScript is the content of StartupScript
+	startupScript string
+}
+
+// Disk declares a data disk of a machine.
+type Disk struct {
+	Name       string `yaml:"name"`
+	Size       string `yaml:"size,omitempty"`
+	Type       string `yaml:"type,omitempty"`
+	CSEK       bool   `yaml:"csek,omitempty"`
+	DeviceName string `yaml:"device_name,omitempty"`
+}
+
+// Load reads and validates the spec file 'file' and sets the defaults of unset
+// fields. The startup script's path is relative to the spec file.
+func Load(file string) (Spec, error) {
+	var s Spec
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return s, err
+	}
+	if err := yaml.UnmarshalStrict(data, &s); err != nil {
+		return s, fmt.Errorf("error parsing %s: %w", file, err)
+	}
+	if s.StartupScript != "" {
+		if !filepath.IsAbs(s.StartupScript) {
+			s.StartupScript = filepath.Join(filepath.Dir(file), s.StartupScript)
+		}
+		script, err := os.ReadFile(s.StartupScript)
+		if err != nil {
+			return s, fmt.Errorf("error reading startup script: %w", err)
+		}
+		s.startupScript = string(script)
+	}
+	s.setDefaults()
+	if err := s.Validate(); err != nil {
+		return s, fmt.Errorf("invalid spec %s: %w", file, err)
+	}
+	return s, nil
+}
+
+func (s *Spec) setDefaults() {
+	// like the flags of 'gmachine create', these are case insensitive
+	s.Network.StackType = strings.ToUpper(s.Network.StackType)
+	s.Scheduling.ProvisioningModel = strings.ToUpper(s.Scheduling.ProvisioningModel)
+	s.Scheduling.TerminationAction = strings.ToUpper(s.Scheduling.TerminationAction)
+	setDefault(&s.MachineType, DefaultMachineType)
+	setDefault(&s.BootDisk.Size, DefaultDiskSize)
+	setDefault(&s.BootDisk.Type, DefaultDiskType)
+	setDefault(&s.BootDisk.ImageProject, DefaultImageProject)
+	setDefault(&s.BootDisk.ImageFamily, DefaultImageFamily)
+	for i := range s.Disks {
+		setDefault(&s.Disks[i].Size, DefaultDataDiskSize)
+		setDefault(&s.Disks[i].Type, DefaultDataDiskType)
+		setDefault(&s.Disks[i].DeviceName, s.Disks[i].Name)
+	}
+}
+
+func setDefault(field *string, value string) {
+	if *field == "" {
+		*field = value
+	}
+}
+
+// Validate returns an error if the spec is invalid.
+func (s Spec) Validate() error {
+	if s.Name == "" || s.Project == "" || s.Zone == "" {
+		return errors.New("missing required fields: name, project, zone")
+	}
+	if s.CSEK && s.KMSKey != "" {
+		return errors.New("cannot specify both kms_key and csek")
+	}
+	if s.KMSKey != "" {
+		if err := gcp.ValidateKMSKey(s.KMSKey); err != nil {
+			return err
+		}
+	}
+	if s.NoServiceAccount && s.ServiceAccount != "" {
+		return errors.New("cannot specify both no_service_account and service_account")
+	}
+	if err := s.Network.Validate(); err != nil {
+		return err
+	}
+	if err := s.Scheduling.Validate(); err != nil {
+		return err
+	}
+	if err := gcp.ValidateLabels(s.Labels); err != nil {
+		return err
+	}
+	if _, err := gcp.ParseDiskSizeGB(s.BootDisk.Size); err != nil {
+		return err
+	}
+	names := map[string]bool{s.Name: true}
+	for _, d := range s.Disks {
+		if d.Name == "" {
+			return errors.New("missing name of data disk")
+		}
+		if names[d.Name] {
+			return fmt.Errorf("duplicate disk name '%s'", d.Name)
+		}
+		names[d.Name] = true
+		if _, err := gcp.ParseDiskSizeGB(d.Size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Ref returns the InstanceRef of the machine.
+func (s Spec) Ref() gcp.InstanceRef {
+	return gcp.InstanceRef{Name: s.Name, Account: s.Account, Project: s.Project, Zone: s.Zone}
+}
+
+// CreateRequest returns the request to create the machine, without its data
+// disks. The CSEK key is not set, it is generated when the machine is created.
+func (s Spec) CreateRequest() gcp.CreateRequest {
+	req := gcp.CreateRequest{
+		Name:             s.Name,
+		Account:          s.Account,
+		Project:          s.Project,
+		Zone:             s.Zone,
+		MachineType:      s.MachineType,
+		BootDiskSize:     s.BootDisk.Size,
+		BootDiskType:     s.BootDisk.Type,
+		ImageProject:     s.BootDisk.ImageProject,
+		ImageFamily:      s.BootDisk.ImageFamily,
+		KMSKey:           s.KMSKey,
+		Network:          s.Network,
+		Scheduling:       s.Scheduling,
+		ServiceAccount:   s.ServiceAccount,
+		NoServiceAccount: s.NoServiceAccount,
+		StartupScript:    s.StartupScript,
+		StartupScriptURL: s.StartupScriptURL,
+		Labels:           s.Labels,
+	}
+	for k, v := range s.Metadata {
+		req.AddMetadata(k, v)
+	}
+	if s.DisableSSHProjectKeys {
+		req.AddMetadata("block-project-ssh-keys", "true")
+	}
+	return req
+}
+
+// metadata returns the instance metadata that the spec sets, including the
+// startup script and the block-project-ssh-keys setting.
+func (s Spec) metadata() map[string]string {
+	m := map[string]string{}
+	for k, v := range s.Metadata {
+		m[k] = v
+	}
+	if s.DisableSSHProjectKeys {
+		m["block-project-ssh-keys"] = "true"
+	}
+	if s.StartupScript != "" {
+		m["startup-script"] = s.startupScript
+	}
+	if s.StartupScriptURL != "" {
+		m["startup-script-url"] = s.StartupScriptURL
+	}
+	return m
+}
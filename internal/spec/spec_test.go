@@ -0,0 +1,129 @@
+package spec_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/joemiller/gmachine/internal/gcp"
+	"github.com/joemiller/gmachine/internal/spec"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/compute/v1"
+)
+
+func writeSpec(t *testing.T, data string) string {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "machine.yaml")
+	assert.NoError(t, os.WriteFile(file, []byte(data), 0o600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "startup.sh"), []byte("#!/bin/sh\necho hi\n"), 0o600))
+	return file
+}
+
+func TestLoad(t *testing.T) {
+	s, err := spec.Load(writeSpec(t, `
+name: foo
+project: my-proj
+zone: us-west1-a
+network:
+  stack_type: ipv4_ipv6
+scheduling:
+  provisioning_model: spot
+startup_script: startup.sh
+disks:
+  - name: foo-data
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, spec.DefaultMachineType, s.MachineType)
+	assert.Equal(t, spec.DefaultDiskSize, s.BootDisk.Size)
+	assert.Equal(t, gcp.StackTypeIPv4IPv6, s.Network.StackType)
+	assert.Equal(t, gcp.ProvisioningModelSpot, s.Scheduling.ProvisioningModel)
+	assert.Equal(t, []spec.Disk{{Name: "foo-data", Size: spec.DefaultDataDiskSize, Type: spec.DefaultDataDiskType, DeviceName: "foo-data"}}, s.Disks)
+
+	// the startup script is relative to the spec file
+	req := s.CreateRequest()
+	assert.True(t, filepath.IsAbs(req.StartupScript))
+	assert.Equal(t, "foo", req.Ref().Name)
+
+	tests := []struct {
+		spec string
+		err  string
+	}{
+		{"name: foo\nzone: us-west1-a\n", "missing required fields"},
+		{"name: foo\nproject: p\nzone: z\nmachine: e2-small\n", "field machine not found"},
+		{"name: foo\nproject: p\nzone: z\ncsek: true\nkms_key: projects/p/locations/l/keyRings/r/cryptoKeys/k\n", "cannot specify both"},
+		{"name: foo\nproject: p\nzone: z\nlabels: {Team: infra}\n", "invalid label key"},
+		{"name: foo\nproject: p\nzone: z\ndisks: [{name: foo}]\n", "duplicate disk name"},
+		{"name: foo\nproject: p\nzone: z\ndisks: [{name: data, size: big}]\n", "invalid disk size"},
+		{"name: foo\nproject: p\nzone: z\nstartup_script: missing.sh\n", "error reading startup script"},
+	}
+	for _, tt := range tests {
+		_, err := spec.Load(writeSpec(t, tt.spec))
+		assert.ErrorContains(t, err, tt.err, tt.spec)
+	}
+}
+
+func TestSpec_Diff(t *testing.T) {
+	s, err := spec.Load(writeSpec(t, `
+name: foo
+project: my-proj
+zone: us-west1-a
+machine_type: e2-small
+boot_disk:
+  size: 20GB
+labels: {team: infra}
+metadata: {foo: bar}
+disks:
+  - name: foo-data
+    size: 200GB
+  - name: foo-logs
+  - name: foo-new
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	bar := "bar"
+	cur := spec.Current{
+		Instance: compute.Instance{
+			MachineType: "zones/us-west1-a/machineTypes/e2-small",
+			Disks: []*compute.AttachedDisk{
+				{Boot: true, Source: gcp.DiskURI("my-proj", "us-west1-a", "foo"), DeviceName: "foo"},
+				{Source: gcp.DiskURI("my-proj", "us-west1-a", "foo-data"), DeviceName: "foo-data"},
+			},
+			Labels:   map[string]string{"team": "infra", "other": "kept"},
+			Metadata: &compute.Metadata{Items: []*compute.MetadataItems{{Key: "foo", Value: &bar}}},
+		},
+		BootDisk: compute.Disk{SizeGb: 20, Type: "zones/us-west1-a/diskTypes/pd-standard"},
+		Disks: map[string]*compute.Disk{
+			"foo-data": {SizeGb: 200, Type: "zones/us-west1-a/diskTypes/pd-balanced"},
+			"foo-logs": {SizeGb: 100, Type: "zones/us-west1-a/diskTypes/pd-balanced"},
+			"foo-new":  nil,
+		},
+	}
+	changes := s.Diff(cur)
+	assert.Equal(t, []spec.Change{
+		{Field: "disks.foo-logs.attached", Key: "foo-logs", From: "false", To: "true", Action: spec.Update},
+		{Field: "disks.foo-new", Key: "foo-new", To: "100GB pd-balanced", Action: spec.Update},
+	}, changes)
+
+	s.MachineType = "e2-medium"
+	s.BootDisk.Size = "10GB"
+	s.CSEK = true
+	s.Labels["team"] = "web"
+	s.Network.NoAddress = true
+	s.Disks = s.Disks[:1]
+	s.Disks[0].Type = "pd-ssd"
+	got := []string{}
+	for _, c := range s.Diff(cur) {
+		got = append(got, c.String())
+	}
+	assert.Equal(t, []string{
+		"~ machine_type: e2-small -> e2-medium",
+		"~ boot_disk.size: 20GB -> 10GB (not supported)",
+		"~ encryption: Google-managed -> CSEK (requires recreate)",
+		"~ network.no_address: false -> true (requires recreate)",
+		"~ labels.team: infra -> web",
+		"~ disks.foo-data.type: pd-balanced -> pd-ssd (not supported)",
+	}, got)
+}
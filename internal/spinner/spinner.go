@@ -0,0 +1,108 @@
+package spinner
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+var frames = []string{"-", "\\", "|", "/"}
+
+// Spinner renders a progress indicator with the elapsed time, eg:
+//
+//	/ Stopping machine1 [RUNNING] 12s
+//
+// If the output is not a terminal the animation is not rendered, only a line
+// when the spinner is started and another when it is stopped.
+type Spinner struct {
+	w      io.Writer
+	msg    string
+	status string
+	start  time.Time
+	tty    bool
+
+	mu   sync.Mutex
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// New returns a Spinner that writes to w.
+func New(w io.Writer, msg string) *Spinner {
+	return &Spinner{
+		w:    w,
+		msg:  msg,
+		tty:  isTerminal(w),
+		done: make(chan struct{}),
+	}
+}
+
+// Start starts rendering the spinner.
+func (s *Spinner) Start() {
+	s.start = time.Now()
+	if !s.tty {
+		fmt.Fprintf(s.w, "%s...\n", s.msg)
+		return
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for i := 0; ; i++ {
+			s.render(frames[i%len(frames)])
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// SetStatus sets a short status displayed after the message, eg: "RUNNING".
+func (s *Spinner) SetStatus(status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+// Stop stops the spinner and prints the message with a final status, eg: "done".
+func (s *Spinner) Stop(final string) {
+	if s.tty {
+		close(s.done)
+		s.wg.Wait()
+		fmt.Fprint(s.w, "\r\033[K")
+	}
+	fmt.Fprintf(s.w, "%s... %s (%s)\n", s.msg, final, s.elapsed())
+}
+
+func (s *Spinner) render(frame string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := ""
+	if s.status != "" {
+		status = " [" + s.status + "]"
+	}
+	fmt.Fprintf(s.w, "\r\033[K%s %s%s %s", frame, s.msg, status, s.elapsed())
+}
+
+func (s *Spinner) elapsed() time.Duration {
+	return time.Since(s.start).Round(time.Second)
+}
+
+// isTerminal returns true if w is a terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,33 @@
+package sshclient
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ConfigHost returns the ssh_config Host block that connects to the target as
+// 'alias', eg: 'ssh alias', for an Include file.
+func (t Target) ConfigHost(alias string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Host %s\n", alias)
+	fmt.Fprintf(&b, "  HostName %s\n", configQuote(t.Host))
+	for _, o := range t.Options() {
+		value := o.Value
+		if o.Name != "ProxyCommand" {
+			// the rest of the line is the ProxyCommand, which is run with a shell
+			value = configQuote(value)
+		}
+		fmt.Fprintf(&b, "  %s %s\n", o.Name, value)
+	}
+	return b.String()
+}
+
+// configQuote quotes an ssh_config value with double quotes if it contains
+// whitespace, eg: paths in "Application Support" on macOS. ssh_config cannot
+// escape double quotes so they are removed.
+func configQuote(s string) string {
+	if !strings.ContainsAny(s, " \t\"") {
+		return s
+	}
+	return `"` + strings.ReplaceAll(s, `"`, ``) + `"`
+}
@@ -0,0 +1,80 @@
+package sshclient
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/joemiller/gmachine/internal/fileutil"
+	"golang.org/x/crypto/ssh"
+)
+
+// Key is an ssh key pair managed by gmachine.
+type Key struct {
+	// File is the path of the private key, the public key is File + ".pub"
+	File string
+	// PublicKey is the public key in authorized_keys format, without a trailing
+	// newline
+	PublicKey string
+}
+
+// LoadOrCreateKey returns the ed25519 key pair 'name' in 'dir', generating it if
+// it does not exist yet. 'comment' is added to a new public key, eg: to identify
+// it in instance metadata.
+func LoadOrCreateKey(dir, name, comment string) (Key, error) {
+	key := Key{File: filepath.Join(dir, name)}
+	b, err := os.ReadFile(key.File)
+	switch {
+	case err == nil:
+		signer, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			return key, fmt.Errorf("error parsing ssh key %s: %w", key.File, err)
+		}
+		key.PublicKey = publicKey(signer.PublicKey(), comment)
+		return key, nil
+	case !errors.Is(err, fs.ErrNotExist):
+		return key, fmt.Errorf("error reading ssh key: %w", err)
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return key, fmt.Errorf("error generating ssh key: %w", err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, comment)
+	if err != nil {
+		return key, fmt.Errorf("error encoding ssh key: %w", err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return key, fmt.Errorf("error encoding ssh key: %w", err)
+	}
+	key.PublicKey = publicKey(sshPub, comment)
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return key, err
+	}
+	// the public key is written first so that it exists whenever the private key
+	// does
+	if err := fileutil.WriteFileAtomic(key.File+".pub", []byte(key.PublicKey+"\n"), 0o644); err != nil {
+		return key, err
+	}
+	if err := fileutil.WriteFileAtomic(key.File, pem.EncodeToMemory(block), 0o600); err != nil {
+		return key, err
+	}
+	return key, nil
+}
+
+// publicKey returns the key in authorized_keys format with a comment.
+func publicKey(key ssh.PublicKey, comment string) string {
+	s := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	if comment != "" {
+		s += " " + comment
+	}
+	return s
+}
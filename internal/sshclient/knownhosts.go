@@ -0,0 +1,57 @@
+package sshclient
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/joemiller/gmachine/internal/fileutil"
+)
+
+// WriteKnownHosts rewrites the known_hosts file with the host keys 'pinned' by
+// alias, as "TYPE BASE64" lines. Other entries already in the file are kept if
+// 'keep' returns true for their host, eg: keys that ssh added the first time it
+// connected to a host whose keys are not pinned.
+func WriteKnownHosts(file string, pinned map[string][]string, keep func(host string) bool) error {
+	var b bytes.Buffer
+	existing, err := os.ReadFile(file)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(existing))
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if _, ok := pinned[fields[0]]; ok || !keep(fields[0]) {
+			continue
+		}
+		b.WriteString(line + "\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	aliases := []string{}
+	for alias := range pinned {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		for _, key := range pinned[alias] {
+			b.WriteString(alias + " " + key + "\n")
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+		return err
+	}
+	return fileutil.WriteFileAtomic(file, b.Bytes(), 0o600)
+}
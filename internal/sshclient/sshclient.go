@@ -0,0 +1,180 @@
+// Package sshclient connects to machines with the system ssh client instead of
+// 'gcloud compute ssh'. gmachine manages a dedicated key pair per machine and a
+// known_hosts file of its own, so connecting does not depend on, or change, the
+// user's ~/.ssh.
+package sshclient
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Target is how to connect to a host with the system ssh client.
+type Target struct {
+	// User and Host to connect to, Host is an IP address or hostname. User is
+	// optional, ssh defaults to the local user
+	User string
+	Host string
+	// Port to connect to, 0 for ssh's default
+	Port int
+	// IdentityFile is the private key to authenticate with, no other keys are
+	// offered
+	IdentityFile string
+	// KnownHostsFile is the file the host's key is checked against, under
+	// HostKeyAlias, and added to the first time it is seen unless Pinned is set
+	KnownHostsFile string
+	HostKeyAlias   string
+	// Pinned is set if the host's keys are already in KnownHostsFile, other keys
+	// are then rejected rather than trusted on first use
+	Pinned bool
+	// ProxyCommand connects to the host instead of a TCP connection. Optional
+	ProxyCommand string
+}
+
+// Option is an ssh_config option, see ssh_config(5).
+type Option struct {
+	Name  string
+	Value string
+}
+
+// Options returns the ssh_config options that connect to the target, other than
+// its host.
+func (t Target) Options() []Option {
+	var opts []Option
+	if t.User != "" {
+		opts = append(opts, Option{"User", t.User})
+	}
+	if t.Port != 0 {
+		opts = append(opts, Option{"Port", strconv.Itoa(t.Port)})
+	}
+	strict := "accept-new"
+	if t.Pinned {
+		strict = "yes"
+	}
+	opts = append(opts,
+		Option{"IdentityFile", t.IdentityFile},
+		Option{"IdentitiesOnly", "yes"},
+		Option{"UserKnownHostsFile", t.KnownHostsFile},
+		Option{"HostKeyAlias", t.HostKeyAlias},
+		Option{"StrictHostKeyChecking", strict},
+		// keys ssh adds are kept under the alias, see WriteKnownHosts
+		Option{"HashKnownHosts", "no"},
+	)
+	if t.ProxyCommand != "" {
+		opts = append(opts, Option{"ProxyCommand", t.ProxyCommand})
+	}
+	return opts
+}
+
+// Args returns the ssh command that connects to the target. 'extra' ssh flags,
+// eg: -A, are added before the destination.
+func (t Target) Args(extra ...string) []string {
+	args := []string{"ssh"}
+	for _, o := range t.Options() {
+		args = append(args, "-o", o.Name+"="+o.Value)
+	}
+	args = append(args, extra...)
+	return append(args, t.Host)
+}
+
+// ShellJoin returns the command 'args' as a POSIX shell command line, eg: for a
+// ProxyCommand, which ssh runs with the user's shell. Arguments are quoted if they
+// contain special characters, ssh's %h and %p tokens are not quoted.
+func ShellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = shellQuote(a)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// shellQuote quotes 's' for a POSIX shell if it contains any special characters.
+func shellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_=.,/:@%+", r))
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Proxy connects 'stdin' and 'stdout' to 'addr' over TCP, like 'nc' in a
+// ProxyCommand, until the connection is closed.
+func Proxy(ctx context.Context, addr string, stdin io.Reader, stdout io.Writer) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	go func() {
+		_, _ = io.Copy(conn, stdin)
+		// let the server know that the client is done
+		_ = conn.(*net.TCPConn).CloseWrite()
+	}()
+	_, err = io.Copy(stdout, conn)
+	return err
+}
+
+// WaitReachable waits until an ssh server answers at 'addr' with its version
+// banner, trying every 'interval', or until ctx is done. A booting machine may
+// accept connections before sshd is ready to answer them.
+func WaitReachable(ctx context.Context, addr string, interval time.Duration) error {
+	for {
+		err := checkBanner(ctx, addr, interval)
+		if err == nil {
+			return nil
+		}
+		slog.DebugContext(ctx, "ssh not reachable yet", "addr", addr, "error", err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w, last error: %s", context.Cause(ctx), err)
+		case <-time.After(interval):
+		}
+	}
+}
+
+// checkBanner connects to 'addr' and reads the ssh server's version banner.
+func checkBanner(ctx context.Context, addr string, timeout time.Duration) error {
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "SSH-") {
+		return fmt.Errorf("unexpected banner %q", strings.TrimSpace(line))
+	}
+	return nil
+}
+
+// Exec replaces the current process with the ssh command 'args'.
+func Exec(ctx context.Context, args []string) error {
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		return err
+	}
+	slog.DebugContext(ctx, "exec", "args", args)
+	return unix.Exec(path, args, os.Environ())
+}
@@ -0,0 +1,332 @@
+package sshclient_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joemiller/gmachine/internal/sshclient"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestLoadOrCreateKey(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "ssh")
+	key, err := sshclient.LoadOrCreateKey(dir, "id_ed25519_foo", "gmachine-foo")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, filepath.Join(dir, "id_ed25519_foo"), key.File)
+	assert.Regexp(t, `^ssh-ed25519 \S+ gmachine-foo$`, key.PublicKey)
+	info, err := os.Stat(key.File)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	}
+	pub, err := os.ReadFile(key.File + ".pub")
+	assert.NoError(t, err)
+	assert.Equal(t, key.PublicKey+"\n", string(pub))
+
+	// the existing key is loaded
+	key2, err := sshclient.LoadOrCreateKey(dir, "id_ed25519_foo", "gmachine-foo")
+	assert.NoError(t, err)
+	assert.Equal(t, key, key2)
+
+	assert.NoError(t, os.WriteFile(key.File, []byte("garbage"), 0o600))
+	_, err = sshclient.LoadOrCreateKey(dir, "id_ed25519_foo", "gmachine-foo")
+	assert.ErrorContains(t, err, "error parsing ssh key")
+}
+
+func TestTarget_Args(t *testing.T) {
+	target := sshclient.Target{
+		User:           "me",
+		Host:           "10.0.0.2",
+		IdentityFile:   "/home/me/gmachine/ssh/id_ed25519_foo",
+		KnownHostsFile: "/home/me/gmachine/ssh/known_hosts",
+		HostKeyAlias:   "gmachine-foo",
+		ProxyCommand:   sshclient.ShellJoin([]string{"ssh", "-o", "ProxyCommand=gcloud x", "-W", "%h:%p", "1.2.3.4"}),
+	}
+	assert.Equal(t, []string{
+		"ssh",
+		"-o", "User=me",
+		"-o", "IdentityFile=/home/me/gmachine/ssh/id_ed25519_foo",
+		"-o", "IdentitiesOnly=yes",
+		"-o", "UserKnownHostsFile=/home/me/gmachine/ssh/known_hosts",
+		"-o", "HostKeyAlias=gmachine-foo",
+		"-o", "StrictHostKeyChecking=accept-new",
+		"-o", "HashKnownHosts=no",
+		"-o", "ProxyCommand=ssh -o 'ProxyCommand=gcloud x' -W %h:%p 1.2.3.4",
+		"-A",
+		"10.0.0.2",
+	}, target.Args("-A"))
+}
+
+// sshd is a minimal local stand-in for an instance's sshd. It accepts the public
+// key 'authorized' and runs no commands, exec requests are answered with the
+// command and the user.
+type sshd struct {
+	addr *net.TCPAddr
+	// hostKey is the public host key as a "TYPE BASE64" line
+	hostKey string
+}
+
+func newSSHD(t *testing.T, authorized string) *sshd {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorized))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	_, hostKey, _ := ed25519.GenerateKey(rand.Reader)
+	signer, _ := ssh.NewSignerFromKey(hostKey)
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), pub.Marshal()) {
+				return nil, fmt.Errorf("unknown key for %s", conn.User())
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveConn(conn, config)
+		}
+	}()
+	hostKeyLine := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+	return &sshd{addr: l.Addr().(*net.TCPAddr), hostKey: hostKeyLine}
+}
+
+func serveConn(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			_ = newChan.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		ch, requests, err := newChan.Accept()
+		if err != nil {
+			return
+		}
+		for req := range requests {
+			if req.Type != "exec" {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			var payload struct{ Command string }
+			_ = ssh.Unmarshal(req.Payload, &payload)
+			_ = req.Reply(true, nil)
+			fmt.Fprintf(ch, "%s ran %s\n", sconn.User(), payload.Command)
+			_, _ = ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+			ch.Close()
+			break
+		}
+	}
+}
+
+func TestTarget_sshd(t *testing.T) {
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("ssh not found")
+	}
+	dir := t.TempDir()
+	key, err := sshclient.LoadOrCreateKey(dir, "id_ed25519_foo", "gmachine-foo")
+	if !assert.NoError(t, err) {
+		return
+	}
+	target := sshclient.Target{
+		User:           "me",
+		Host:           "127.0.0.1",
+		IdentityFile:   key.File,
+		KnownHostsFile: filepath.Join(dir, "known_hosts"),
+		HostKeyAlias:   "gmachine-foo",
+	}
+	run := func(srv *sshd) (string, error) {
+		target.Port = srv.addr.Port
+		args := append(target.Args("-o", "BatchMode=yes", "-F", "/dev/null"), "uptime")
+		out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+		return string(out), err
+	}
+
+	srv := newSSHD(t, key.PublicKey)
+	out, err := run(srv)
+	assert.NoError(t, err, out)
+	assert.Contains(t, out, "me ran uptime")
+	known, _ := os.ReadFile(target.KnownHostsFile)
+	assert.True(t, strings.HasPrefix(string(known), "gmachine-foo ssh-ed25519 "), string(known))
+
+	// the host key is pinned under the alias, another host key is rejected even
+	// at the same address
+	out, err = run(newSSHD(t, key.PublicKey))
+	assert.Error(t, err)
+	assert.Contains(t, out, "HOST IDENTIFICATION HAS CHANGED")
+
+	// only the managed key is offered
+	other, _ := sshclient.LoadOrCreateKey(dir, "id_ed25519_other", "")
+	target.HostKeyAlias = "gmachine-other"
+	out, err = run(newSSHD(t, other.PublicKey))
+	assert.Error(t, err)
+	assert.Contains(t, out, "Permission denied")
+}
+
+func TestTarget_ConfigHost(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "Application Support")
+	target := sshclient.Target{
+		User:           "me",
+		Host:           "foo",
+		IdentityFile:   filepath.Join(dir, "id_ed25519_foo"),
+		KnownHostsFile: filepath.Join(dir, "known_hosts"),
+		HostKeyAlias:   "gmachine-foo",
+		ProxyCommand:   sshclient.ShellJoin([]string{filepath.Join(dir, "gmachine"), "ssh-proxy", "foo"}),
+	}
+	host := target.ConfigHost("foo")
+	assert.Contains(t, host, "Host foo\n  HostName foo\n  User me\n")
+	assert.Contains(t, host, fmt.Sprintf("  IdentityFile %q\n", target.IdentityFile))
+
+	// ssh parses the block as intended
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("ssh not found")
+	}
+	file := filepath.Join(t.TempDir(), "config")
+	assert.NoError(t, os.WriteFile(file, []byte(host), 0o600))
+	out, err := exec.Command("ssh", "-G", "-F", file, "foo").CombinedOutput()
+	if !assert.NoError(t, err, string(out)) {
+		return
+	}
+	for _, want := range []string{
+		"user me",
+		"identityfile " + target.IdentityFile,
+		"userknownhostsfile " + target.KnownHostsFile,
+		"hostkeyalias gmachine-foo",
+		"proxycommand " + target.ProxyCommand,
+	} {
+		assert.Contains(t, strings.Split(string(out), "\n"), want)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		// echo until the client is done
+		_, _ = io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	var out bytes.Buffer
+	assert.NoError(t, sshclient.Proxy(context.Background(), l.Addr().String(), strings.NewReader("SSH-2.0-test\r\n"), &out))
+	assert.Equal(t, "SSH-2.0-test\r\n", out.String())
+}
+
+func TestWriteKnownHosts(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "ssh", "known_hosts")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(file), 0o700))
+	assert.NoError(t, os.WriteFile(file, []byte("gmachine-foo ssh-ed25519 OLD\ngmachine-bar ssh-ed25519 TOFU\ngmachine-gone ssh-ed25519 GONE\n# comment\n"), 0o600))
+
+	pinned := map[string][]string{"gmachine-foo": {"ssh-ed25519 NEW", "ssh-rsa NEW"}}
+	keep := func(host string) bool { return host != "gmachine-gone" }
+	assert.NoError(t, sshclient.WriteKnownHosts(file, pinned, keep))
+	b, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "gmachine-bar ssh-ed25519 TOFU\ngmachine-foo ssh-ed25519 NEW\ngmachine-foo ssh-rsa NEW\n", string(b))
+}
+
+func TestTarget_sshdPinned(t *testing.T) {
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("ssh not found")
+	}
+	dir := t.TempDir()
+	key, err := sshclient.LoadOrCreateKey(dir, "id_ed25519_foo", "gmachine-foo")
+	if !assert.NoError(t, err) {
+		return
+	}
+	srv := newSSHD(t, key.PublicKey)
+	target := sshclient.Target{
+		User:           "me",
+		Host:           "127.0.0.1",
+		Port:           srv.addr.Port,
+		IdentityFile:   key.File,
+		KnownHostsFile: filepath.Join(dir, "known_hosts"),
+		HostKeyAlias:   "gmachine-foo",
+		Pinned:         true,
+	}
+	run := func() (string, error) {
+		args := append(target.Args("-o", "BatchMode=yes", "-F", "/dev/null"), "uptime")
+		out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+		return string(out), err
+	}
+
+	// a pinned host key that is not known yet is not trusted on first use
+	out, err := run()
+	assert.Error(t, err)
+	assert.Contains(t, out, "Host key verification failed")
+
+	assert.NoError(t, sshclient.WriteKnownHosts(target.KnownHostsFile, map[string][]string{"gmachine-foo": {srv.hostKey}}, func(string) bool { return true }))
+	out, err = run()
+	assert.NoError(t, err, out)
+	assert.Contains(t, out, "me ran uptime")
+}
+
+func TestWaitReachable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	banners := make(chan string, 2)
+	banners <- "HTTP/1.1 400 Bad Request\r\n"
+	banners <- "SSH-2.0-OpenSSH_9.6\r\n"
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			select {
+			case banner := <-banners:
+				_, _ = conn.Write([]byte(banner))
+			default:
+			}
+			conn.Close()
+		}
+	}()
+
+	// the first connection gets the wrong banner
+	ctx := context.Background()
+	assert.NoError(t, sshclient.WaitReachable(ctx, l.Addr().String(), 10*time.Millisecond))
+	assert.Empty(t, banners)
+
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	err = sshclient.WaitReachable(ctx, l.Addr().String(), 10*time.Millisecond)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, "last error: EOF")
+}